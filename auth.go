@@ -0,0 +1,353 @@
+package engine
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/config"
+	"m7s.live/engine/v4/util"
+)
+
+const (
+	AUTH_ACTION_PUBLISH   = "publish"
+	AUTH_ACTION_SUBSCRIBE = "subscribe"
+)
+
+var (
+	ErrAuthType    = errors.New("unsupported auth type")
+	ErrAuthToken   = errors.New("invalid auth token")
+	ErrAuthExpired = errors.New("auth expired")
+	ErrAuthNoExp   = errors.New("auth token without exp")
+	ErrAuthDenied  = errors.New("auth denied")
+)
+
+// AuthRequest 鉴权请求
+type AuthRequest struct {
+	Action     string // publish 或者 subscribe
+	StreamPath string
+	AppName    string
+	Plugin     string
+	Type       string
+	ID         string
+	RemoteAddr string
+	Args       url.Values
+}
+
+// Permission 鉴权通过后的权限，零值表示不限制
+type Permission struct {
+	Tracks      []string      // 允许订阅的轨道
+	MaxDuration time.Duration // 最长发布或者订阅时长，到时后停止
+	MaxBPS      int           // 订阅的音视频码率上限（字节每秒），按订阅的轨道的发布码率判断，超过时只发送视频关键帧（不转码）
+}
+
+// AllowTrack 是否允许订阅该轨道
+func (p *Permission) AllowTrack(name string) bool {
+	if p == nil || len(p.Tracks) == 0 {
+		return true
+	}
+	for _, t := range p.Tracks {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// permissionClaims JWT 和回调返回的权限字段，时长单位为秒
+type permissionClaims struct {
+	Tracks      []string `json:"tracks,omitempty"`
+	MaxDuration float64  `json:"maxDuration,omitempty"`
+	MaxBPS      int      `json:"maxBPS,omitempty"`
+}
+
+func (c *permissionClaims) Permission() *Permission {
+	if len(c.Tracks) == 0 && c.MaxDuration <= 0 && c.MaxBPS <= 0 {
+		return nil
+	}
+	return &Permission{Tracks: c.Tracks, MaxDuration: time.Duration(c.MaxDuration * float64(time.Second)), MaxBPS: c.MaxBPS}
+}
+
+// AuthProvider 鉴权服务，返回错误表示鉴权失败
+type AuthProvider interface {
+	Auth(*AuthRequest) (*Permission, error)
+}
+
+var authProviders util.Map[string, AuthProvider]
+
+// RegisterAuthProvider 为应用注册鉴权服务，app 为空则作为默认的鉴权服务
+func RegisterAuthProvider(app string, provider AuthProvider) {
+	if provider == nil {
+		authProviders.Delete(app)
+	} else {
+		authProviders.Set(app, provider)
+	}
+}
+
+// SetAuthProvider 为插件设置鉴权服务，优先于应用和默认的鉴权服务
+func (opt *Plugin) SetAuthProvider(provider AuthProvider) {
+	opt.authProvider = provider
+}
+
+// authProvider 依次查找插件、应用、默认的鉴权服务
+func (io *IO) authProvider() AuthProvider {
+	if plugin, ok := Plugins[io.plugin]; ok && plugin.authProvider != nil {
+		return plugin.authProvider
+	}
+	if provider := authProviders.Get(io.Stream.AppName); provider != nil {
+		return provider
+	}
+	return authProviders.Get("")
+}
+
+func (io *IO) authRequest(action string) *AuthRequest {
+	return &AuthRequest{
+		Action:     action,
+		StreamPath: io.Stream.Path,
+		AppName:    io.Stream.AppName,
+		Plugin:     io.plugin,
+		Type:       io.Type,
+		ID:         io.ID,
+		RemoteAddr: io.RemoteAddr,
+		Args:       io.Args,
+	}
+}
+
+// limitDuration 权限中限制了时长时，到时后停止发布或者订阅
+func (io *IO) limitDuration() {
+	if io.Permission == nil || io.Permission.MaxDuration <= 0 {
+		return
+	}
+	timer := time.AfterFunc(io.Permission.MaxDuration, func() {
+		io.Stop(zap.String("reason", "max duration"))
+	})
+	ctx := io.Context
+	go func() {
+		<-ctx.Done()
+		timer.Stop()
+	}()
+}
+
+// NewAuthProvider 根据配置创建内置的鉴权服务，未配置时返回 nil
+func NewAuthProvider(conf *config.Auth) (AuthProvider, error) {
+	switch conf.Type {
+	case "":
+		return nil, nil
+	case "jwt":
+		auth := &JWTAuth{ArgName: conf.TokenArgName, AllowNoExp: conf.AllowNoExp}
+		if conf.Secret != "" {
+			auth.Secret = []byte(conf.Secret)
+		}
+		if conf.PublicKey != "" {
+			data, err := os.ReadFile(conf.PublicKey)
+			if err != nil {
+				return nil, err
+			}
+			if auth.PublicKey, err = ParseRSAPublicKey(data); err != nil {
+				return nil, err
+			}
+		}
+		return auth, nil
+	case "hmac":
+		return &HMACAuth{Key: []byte(conf.Secret), SignArgName: conf.SignArgName, ExpireArgName: conf.ExpireArgName}, nil
+	case "webhook":
+		return &WebhookAuth{URL: conf.WebhookURL, Client: &http.Client{Timeout: conf.WebhookTimeout}}, nil
+	}
+	return nil, ErrAuthType
+}
+
+// matchStreamPath 流路径匹配，支持以 * 结尾的前缀匹配
+func matchStreamPath(pattern, streamPath string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(streamPath, prefix)
+	}
+	return pattern == streamPath
+}
+
+// JWTClaims JWT 中的声明，Stream 为空则不限制流，Action 为空或者 * 则不限制动作
+type JWTClaims struct {
+	Exp    int64  `json:"exp,omitempty"`
+	Nbf    int64  `json:"nbf,omitempty"`
+	Stream string `json:"stream,omitempty"`
+	Action string `json:"action,omitempty"` // publish、subscribe，多个用逗号分隔
+	permissionClaims
+}
+
+// JWTAuth 校验 URL 参数中的 JWT，支持 HS256 和 RS256
+type JWTAuth struct {
+	Secret     []byte
+	PublicKey  *rsa.PublicKey
+	ArgName    string
+	AllowNoExp bool // 允许没有 exp 的令牌，这样的令牌永不过期
+}
+
+func (j *JWTAuth) Auth(req *AuthRequest) (*Permission, error) {
+	claims, err := j.Parse(req.Args.Get(j.ArgName))
+	if err != nil {
+		return nil, err
+	}
+	if claims.Exp <= 0 && !j.AllowNoExp {
+		return nil, ErrAuthNoExp
+	}
+	now := time.Now().Unix()
+	if claims.Exp > 0 && now > claims.Exp || claims.Nbf > 0 && now < claims.Nbf {
+		return nil, ErrAuthExpired
+	}
+	if claims.Stream != "" && !matchStreamPath(claims.Stream, req.StreamPath) {
+		return nil, ErrAuthDenied
+	}
+	if claims.Action != "" && claims.Action != "*" && !strings.Contains(","+claims.Action+",", ","+req.Action+",") {
+		return nil, ErrAuthDenied
+	}
+	return claims.Permission(), nil
+}
+
+// Parse 校验签名并解析声明
+func (j *JWTAuth) Parse(token string) (claims JWTClaims, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, ErrAuthToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err = decodeJWTPart(parts[0], &header); err != nil {
+		return
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrAuthToken
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch header.Alg {
+	case "HS256":
+		if j.Secret == nil {
+			return claims, ErrAuthToken
+		}
+		mac := hmac.New(sha256.New, j.Secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return claims, ErrAuthToken
+		}
+	case "RS256":
+		if j.PublicKey == nil {
+			return claims, ErrAuthToken
+		}
+		digest := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(j.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+			return claims, ErrAuthToken
+		}
+	default:
+		return claims, ErrAuthToken
+	}
+	err = decodeJWTPart(parts[1], &claims)
+	return
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return ErrAuthToken
+	}
+	if json.Unmarshal(data, v) != nil {
+		return ErrAuthToken
+	}
+	return nil
+}
+
+// ParseRSAPublicKey 解析 PEM 格式的 RSA 公钥，支持 PKIX 和 PKCS1
+func ParseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid pem")
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if rsaKey, ok := key.(*rsa.PublicKey); ok {
+		return rsaKey, nil
+	}
+	return nil, errors.New("not rsa public key")
+}
+
+// HMACAuth 校验 HMAC-SHA256 签名的 URL，签名内容为 action\nstreamPath\nexpire
+type HMACAuth struct {
+	Key           []byte
+	SignArgName   string
+	ExpireArgName string
+}
+
+// Sign 生成签名，expire 为 unix 时间戳（秒）
+func (h *HMACAuth) Sign(action, streamPath string, expire int64) string {
+	mac := hmac.New(sha256.New, h.Key)
+	fmt.Fprintf(mac, "%s\n%s\n%d", action, streamPath, expire)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (h *HMACAuth) Auth(req *AuthRequest) (*Permission, error) {
+	expire, err := strconv.ParseInt(req.Args.Get(h.ExpireArgName), 10, 64)
+	if err != nil {
+		return nil, ErrAuthToken
+	}
+	if time.Now().Unix() > expire {
+		return nil, ErrAuthExpired
+	}
+	sign, err := hex.DecodeString(req.Args.Get(h.SignArgName))
+	if err != nil {
+		return nil, ErrAuthToken
+	}
+	expected, _ := hex.DecodeString(h.Sign(req.Action, req.StreamPath, expire))
+	if !hmac.Equal(sign, expected) {
+		return nil, ErrAuthToken
+	}
+	return nil, nil
+}
+
+// WebhookAuth 将鉴权请求以 JSON 发送到回调地址，返回 200 表示通过，响应体中可以带有权限
+type WebhookAuth struct {
+	URL    string
+	Client *http.Client
+}
+
+func (w *WebhookAuth) Auth(req *AuthRequest) (*Permission, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := w.Client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrAuthDenied, res.Status)
+	}
+	var claims permissionClaims
+	if err = json.NewDecoder(res.Body).Decode(&claims); err == io.EOF {
+		return nil, nil // 没有响应体则不限制权限
+	} else if err != nil {
+		return nil, err
+	}
+	return claims.Permission(), nil
+}
@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signTestJWT(secret []byte, claims string) string {
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuthExp(t *testing.T) {
+	secret := []byte("jwt-test")
+	auth := &JWTAuth{Secret: secret, ArgName: "token"}
+	request := func(claims string) *AuthRequest {
+		return &AuthRequest{Action: AUTH_ACTION_SUBSCRIBE, StreamPath: "live/test", Args: url.Values{"token": {signTestJWT(secret, claims)}}}
+	}
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Hour).Unix()
+	cases := []struct {
+		claims     string
+		allowNoExp bool
+		err        error
+	}{
+		{`{"stream":"live/test"}`, false, ErrAuthNoExp},
+		{`{"stream":"live/test"}`, true, nil},
+		{`{"stream":"live/test","exp":` + strconv.FormatInt(future, 10) + `}`, false, nil},
+		{`{"stream":"live/test","exp":` + strconv.FormatInt(past, 10) + `}`, false, ErrAuthExpired},
+		{`{"stream":"live/other","exp":` + strconv.FormatInt(future, 10) + `}`, false, ErrAuthDenied},
+	}
+	for _, c := range cases {
+		auth.AllowNoExp = c.allowNoExp
+		if _, err := auth.Auth(request(c.claims)); err != c.err {
+			t.Errorf("%s allowNoExp=%v: got %v, want %v", c.claims, c.allowNoExp, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/config"
+	"m7s.live/engine/v4/util"
+)
+
+const CLUSTER_SECRET_HEADER = "X-M7S-Cluster-Secret"
+
+var (
+	ErrClusterSecret   = errors.New("cluster secret mismatch")
+	ErrClusterNoSecret = errors.New("cluster secret is required")
+	ErrClusterNotFound = errors.New("stream not found in cluster")
+)
+
+// ClusterNode 集群中的节点以及该节点发布的流（不包括从其他节点拉来的流）
+type ClusterNode struct {
+	Address  string
+	Streams  []string
+	LastSeen time.Time
+}
+
+func (n *ClusterNode) online(heartbeat time.Duration) bool {
+	return time.Since(n.LastSeen) < heartbeat*3
+}
+
+func (n *ClusterNode) has(streamPath string) bool {
+	i := sort.SearchStrings(n.Streams, streamPath)
+	return i < len(n.Streams) && n.Streams[i] == streamPath
+}
+
+// ClusterNodes 源站上注册的节点，key 为节点地址
+var ClusterNodes util.Map[string, *ClusterNode]
+
+// cluster 未配置节点地址时为 nil
+var cluster *clusterManager
+
+type clusterManager struct {
+	*config.Cluster
+	notify     chan struct{}
+	client     http.Client // 注册、查找流，整个请求超时
+	pullClient http.Client // 拉流，只限制连接和等待响应头的时间
+	pullConf   config.Pull // 拉流不重连，由 ClusterPuller.Reconnect 决定
+}
+
+// startCluster 配置了 Origin 时作为边缘节点定时向源站注册本地发布的流
+func startCluster(ctx context.Context, conf *config.Cluster) {
+	if conf.Address == "" {
+		return
+	}
+	if conf.Secret == "" {
+		Engine.Error("cluster", zap.Error(ErrClusterNoSecret))
+		return
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: conf.Timeout}).DialContext,
+		TLSHandshakeTimeout:   conf.Timeout,
+		ResponseHeaderTimeout: conf.Timeout,
+	}
+	cluster = &clusterManager{Cluster: conf, notify: make(chan struct{}, 1)}
+	cluster.client = http.Client{Transport: transport, Timeout: conf.Timeout}
+	cluster.pullClient = http.Client{Transport: transport}
+	cluster.Address = strings.TrimSuffix(conf.Address, "/")
+	cluster.Origin = strings.TrimSuffix(conf.Origin, "/")
+	if cluster.Origin != "" {
+		go cluster.run(ctx)
+	}
+}
+
+func (c *clusterManager) isOrigin() bool {
+	return c.Origin == ""
+}
+
+// localStreams 本节点发布者发布的流，从其他节点拉来的流不注册，避免相互拉流
+func localStreams() (streams []string) {
+	Streams.Range(func(streamPath string, s *Stream) {
+		publisher := s.snapshot().Publisher
+		if publisher == nil {
+			return
+		}
+		if _, ok := publisher.(*ClusterPuller); !ok {
+			streams = append(streams, streamPath)
+		}
+	})
+	sort.Strings(streams)
+	return
+}
+
+func (c *clusterManager) OnEvent(event any) {
+	switch v := event.(type) {
+	case SEpublish, SErepublish, SEclose:
+		if !c.isOrigin() {
+			select {
+			case c.notify <- struct{}{}:
+			default:
+			}
+		}
+	case InvitePublish:
+		go c.pull(v.Target)
+	}
+}
+
+func (c *clusterManager) run(ctx context.Context) {
+	ticker := time.NewTicker(c.Heartbeat)
+	defer ticker.Stop()
+	for {
+		node := ClusterNode{Address: c.Address, Streams: localStreams()}
+		if err := c.request(ctx, http.MethodPost, "/api/cluster/register", &node, nil); err != nil {
+			Engine.Warn("cluster register", zap.String("origin", c.Origin), zap.Error(err))
+		}
+		select {
+		case <-ticker.C:
+		case <-c.notify:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// request 请求源站的接口，result 不为空时读取响应体
+func (c *clusterManager) request(ctx context.Context, method, path string, body any, result *string) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.Origin+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(CLUSTER_SECRET_HEADER, c.Secret)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return ErrClusterNotFound
+	} else if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("cluster %s %s", path, res.Status)
+	}
+	if result != nil {
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		*result = strings.TrimSpace(string(data))
+	}
+	return nil
+}
+
+// locate 查找发布该流的节点地址，源站先查找本地再查找注册的节点，边缘节点询问源站
+func (c *clusterManager) locate(streamPath string) (address string, err error) {
+	if !c.isOrigin() {
+		err = c.request(Engine, http.MethodGet, "/api/cluster/locate?streamPath="+url.QueryEscape(streamPath), nil, &address)
+		return
+	}
+	for _, path := range localStreams() {
+		if path == streamPath {
+			return c.Address, nil
+		}
+	}
+	err = ErrClusterNotFound
+	ClusterNodes.Range(func(_ string, node *ClusterNode) {
+		if err != nil && node.online(c.Heartbeat) && node.has(streamPath) {
+			address, err = node.Address, nil
+		}
+	})
+	return
+}
+
+// pull 订阅了本地不存在的流时，从发布该流的节点拉流，源流关闭后本地的流随之关闭
+func (c *clusterManager) pull(streamPath string) {
+	address, err := c.locate(streamPath)
+	if err != nil {
+		if err != ErrClusterNotFound {
+			Engine.Warn("cluster locate", zap.String("stream", streamPath), zap.Error(err))
+		}
+		return
+	}
+	if address == c.Address {
+		return
+	}
+	remoteURL := address + "/api/cluster/pull?streamPath=" + url.QueryEscape(streamPath)
+	puller := &ClusterPuller{}
+	puller.init(streamPath, remoteURL, &c.pullConf)
+	Engine.AssignPubConfig(puller.GetPublisher())
+	puller.SetLogger(Engine.Logger.With(zap.String("stream", streamPath), zap.String("url", remoteURL)))
+	Engine.Info("cluster pull", zap.String("stream", streamPath), zap.String("node", address))
+	puller.startPull(puller)
+}
+
+// checkSecret 校验其他节点请求中的密钥，未配置密钥时不会启用集群
+func (c *clusterManager) checkSecret(r *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(CLUSTER_SECRET_HEADER)), []byte(c.Secret)) == 1
+}
+
+// ClusterPuller 通过 HTTP 以 TS 格式从其他节点拉流
+type ClusterPuller struct {
+	TSPublisher
+	Puller
+	body io.ReadCloser
+}
+
+// OnConnected 不重置重连次数
+func (p *ClusterPuller) OnConnected() {
+}
+
+// Reconnect 源流关闭后不重连，本地的流随之关闭
+func (p *ClusterPuller) Reconnect() (ok bool) {
+	ok = p.ReConnectCount == 0
+	p.ReConnectCount++
+	return
+}
+
+func (p *ClusterPuller) Connect() error {
+	req, err := http.NewRequestWithContext(Engine, http.MethodGet, p.RemoteURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(CLUSTER_SECRET_HEADER, cluster.Secret)
+	res, err := cluster.pullClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		if res.StatusCode == http.StatusNotFound {
+			return io.EOF // 源流已经不存在
+		}
+		return fmt.Errorf("cluster pull %s", res.Status)
+	}
+	p.body = res.Body
+	p.SetIO(res.Body)
+	return nil
+}
+
+func (p *ClusterPuller) Pull() error {
+	reader := NewTSReader(&p.TSPublisher)
+	defer reader.Close()
+	return reader.Feed(p.body)
+}
+
+func (p *ClusterPuller) Disconnect() {
+	if p.body != nil {
+		p.body.Close()
+	}
+}
+
+// clusterSubscriber 将流以 TS 格式输出给拉流的节点
+type clusterSubscriber struct {
+	Subscriber
+	w http.ResponseWriter
+}
+
+// OnAuth 拉流的节点已经通过密钥校验，不再使用订阅鉴权。仍作为普通订阅者计数，避免源站的流因为无人订阅而关闭
+func (s *clusterSubscriber) OnAuth(promise *util.Promise[ISubscriber]) error {
+	promise.Resolve()
+	return nil
+}
+
+func (s *clusterSubscriber) OnEvent(event any) {
+	switch v := event.(type) {
+	case TSPackets:
+		if _, err := s.w.Write(v); err != nil {
+			s.Stop(zap.Error(err))
+			return
+		}
+		s.w.(http.Flusher).Flush()
+	default:
+		s.Subscriber.OnEvent(event)
+	}
+}
+
+// API_cluster_register 边缘节点注册本地发布的流
+func (conf *GlobalConfig) API_cluster_register(w http.ResponseWriter, r *http.Request) {
+	if cluster == nil || !cluster.checkSecret(r) {
+		http.Error(w, ErrClusterSecret.Error(), http.StatusForbidden)
+		return
+	}
+	var node ClusterNode
+	if err := json.NewDecoder(r.Body).Decode(&node); err != nil || node.Address == "" {
+		util.ReturnError(util.APIErrorDecode, "invalid node", w, r)
+		return
+	}
+	sort.Strings(node.Streams)
+	node.LastSeen = time.Now()
+	ClusterNodes.Set(node.Address, &node)
+	util.ReturnOK(w, r)
+}
+
+// API_cluster_locate 返回发布该流的节点地址
+func (conf *GlobalConfig) API_cluster_locate(w http.ResponseWriter, r *http.Request) {
+	if cluster == nil || !cluster.checkSecret(r) {
+		http.Error(w, ErrClusterSecret.Error(), http.StatusForbidden)
+		return
+	}
+	if address, err := cluster.locate(r.URL.Query().Get("streamPath")); err != nil {
+		util.ReturnError(util.APIErrorNoStream, err.Error(), w, r)
+	} else {
+		util.ReturnValue(address, w, r)
+	}
+}
+
+// API_cluster_nodes 源站上注册的节点
+func (conf *GlobalConfig) API_cluster_nodes(w http.ResponseWriter, r *http.Request) {
+	if cluster == nil || !cluster.checkSecret(r) {
+		http.Error(w, ErrClusterSecret.Error(), http.StatusForbidden)
+		return
+	}
+	util.ReturnFetchList(ClusterNodes.ToList, w, r)
+}
+
+// API_cluster_pull 其他节点拉流，以 TS 格式持续输出直到流关闭
+func (conf *GlobalConfig) API_cluster_pull(w http.ResponseWriter, r *http.Request) {
+	if cluster == nil || !cluster.checkSecret(r) {
+		http.Error(w, ErrClusterSecret.Error(), http.StatusForbidden)
+		return
+	}
+	streamPath := r.URL.Query().Get("streamPath")
+	if s := Streams.Get(streamPath); s == nil || s.snapshot().Publisher == nil {
+		util.ReturnError(util.APIErrorNoStream, NO_SUCH_STREAM, w, r)
+		return
+	}
+	sub := &clusterSubscriber{w: w}
+	sub.ID = r.RemoteAddr
+	sub.RemoteAddr = r.RemoteAddr
+	sub.SetParentCtx(r.Context())
+	// 先返回响应头，等待轨道的时间不计入拉流节点的超时
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	if err := Engine.Subscribe(streamPath, sub); err != nil {
+		sub.Error("cluster pull", zap.Error(err))
+		return
+	}
+	sub.PlayTS()
+}
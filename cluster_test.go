@@ -0,0 +1,254 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"m7s.live/engine/v4/util"
+)
+
+const (
+	clusterTestConfig = "M7S_CLUSTER_TEST_CONFIG"
+	clusterTestRole   = "M7S_CLUSTER_TEST_ROLE"
+	clusterTestStream = "live/cluster"
+	clusterTestSecret = "cluster-test"
+)
+
+// TestClusterNode 由 TestCluster 在子进程中运行的节点，源站发布一路音频，边缘节点订阅该流触发拉流
+func TestClusterNode(t *testing.T) {
+	conf := os.Getenv(clusterTestConfig)
+	if conf == "" {
+		t.Skip("run by TestCluster")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if !startTestEngine(ctx, conf) {
+		t.Fatal("engine not ready")
+	}
+	switch os.Getenv(clusterTestRole) {
+	case "origin":
+		publishClusterTestStream(t)
+	case "edge":
+		// 订阅成功一次后不再订阅，源流关闭后边缘节点上不会再创建该流
+		for {
+			sub := &Subscriber{}
+			if err := Engine.Subscribe(clusterTestStream, sub); err == nil {
+				sub.PlayRaw()
+				break
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+	}
+	select {} // 节点一直运行，由 TestCluster 结束子进程
+}
+
+func publishClusterTestStream(t *testing.T) {
+	pub := &Publisher{}
+	if err := Engine.Publish(clusterTestStream, pub); err != nil {
+		t.Fatal(err)
+	}
+	pool := make(util.BytesPool, 17)
+	write := func(ts uint32, b ...byte) {
+		var frame util.BLL
+		frame.Push(pool.GetShell(b))
+		pub.WriteAVCCAudio(ts, &frame, pool)
+	}
+	write(0, 0xaf, 0, 0x12, 0x10) // AAC LC 44100Hz 双声道
+	// 流被 TestCluster 关闭后停止写入
+	for ts := uint32(0); !pub.IsClosed(); ts += 23 {
+		write(ts, 0xaf, 1, 0x21, 0x10, 0x04, 0x60, 0x8c, 0x1c)
+		time.Sleep(time.Millisecond * 23)
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startClusterNode 以子进程启动一个节点，返回节点地址
+func startClusterNode(t *testing.T, role, origin string) string {
+	dir := t.TempDir()
+	addr := freeAddr(t)
+	auth := "" // 源站开启订阅鉴权，拉流的节点只使用集群密钥
+	if origin == "" {
+		auth = "  subscribe:\n    key: subscribe-key\n"
+	}
+	conf := fmt.Sprintf(`global:
+  loglevel: error
+  http:
+    listenaddr: %s
+  publish:
+    pubvideo: false # 只发布音频，不等待视频轨道
+%s  cluster:
+    origin: "%s"
+    address: http://%s
+    secret: %s
+    heartbeat: 1s
+    timeout: 3s
+`, addr, auth, origin, addr, clusterTestSecret)
+	confPath := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(confPath, []byte(conf), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestClusterNode$", "-test.timeout=0")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), clusterTestConfig+"="+confPath, clusterTestRole+"="+role)
+	if testing.Verbose() {
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return "http://" + addr
+}
+
+func clusterGet(ctx context.Context, url, secret string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if secret != "" {
+		req.Header.Set(CLUSTER_SECRET_HEADER, secret)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// waitCluster 重试直到 check 返回 nil 或超时
+func waitCluster(t *testing.T, timeout time.Duration, check func() error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 200)
+	}
+}
+
+// TestCluster 启动源站和边缘节点，检查节点注册，边缘节点从源站拉流后可以再供其他节点拉流，以及源流关闭后边缘节点的流随之关闭
+func TestCluster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts several engine processes")
+	}
+	origin := startClusterNode(t, "origin", "")
+	edge := startClusterNode(t, "edge", origin)
+	t.Run("nodes", func(t *testing.T) {
+		waitCluster(t, time.Second*10, func() error {
+			res, err := clusterGet(context.Background(), origin+"/api/cluster/nodes", "")
+			if err != nil {
+				return err
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusForbidden {
+				return fmt.Errorf("nodes without secret: %s", res.Status)
+			}
+			if res, err = clusterGet(context.Background(), origin+"/api/cluster/nodes", clusterTestSecret); err != nil {
+				return err
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			if !strings.Contains(string(body), edge) {
+				return fmt.Errorf("edge not registered: %s", body)
+			}
+			return nil
+		})
+	})
+	t.Run("relay", func(t *testing.T) {
+		waitCluster(t, time.Second*10, func() error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+			defer cancel()
+			res, err := clusterGet(ctx, edge+"/api/cluster/pull?streamPath="+clusterTestStream, clusterTestSecret)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				return fmt.Errorf("pull from edge: %s", res.Status)
+			}
+			packet := make([]byte, 188)
+			if _, err = io.ReadFull(res.Body, packet); err != nil {
+				return err
+			}
+			if packet[0] != 0x47 {
+				return fmt.Errorf("not a TS packet: % x", packet[:4])
+			}
+			return nil
+		})
+	})
+	t.Run("close", func(t *testing.T) {
+		res, err := clusterGet(context.Background(), edge+"/api/stream?streamPath="+clusterTestStream, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("edge stream before close: %s", res.Status)
+		}
+		closed := time.Now()
+		res, err = clusterGet(context.Background(), origin+"/api/closestream?streamPath="+clusterTestStream, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("close origin stream: %s", res.Status)
+		}
+		waitCluster(t, time.Second*10, func() error {
+			res, err := clusterGet(context.Background(), origin+"/api/cluster/locate?streamPath="+clusterTestStream, clusterTestSecret)
+			if err != nil {
+				return err
+			}
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusNotFound {
+				body, _ := io.ReadAll(res.Body)
+				return fmt.Errorf("origin still locates the stream: %s %s", res.Status, body)
+			}
+			return nil
+		})
+		// 流关闭（STATE_CLOSED）时才会从 Streams 中删除并记录 close 事件
+		waitCluster(t, time.Second*10, func() error {
+			res, err := clusterGet(context.Background(), edge+"/api/stream?streamPath="+clusterTestStream, "")
+			if err != nil {
+				return err
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusNotFound {
+				return fmt.Errorf("edge stream not closed: %s", res.Status)
+			}
+			if res, err = clusterGet(context.Background(), fmt.Sprintf("%s/api/stream/history?type=%s&streamPath=%s&since=%s", edge, EVENT_CLOSE, clusterTestStream, closed.UTC().Format(time.RFC3339Nano)), ""); err != nil {
+				return err
+			}
+			defer res.Body.Close()
+			var records []EventRecord
+			if err = json.NewDecoder(res.Body).Decode(&records); err != nil {
+				return err
+			}
+			if len(records) == 0 {
+				return fmt.Errorf("no close event on edge")
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,300 @@
+package codec
+
+import (
+	"net"
+
+	"m7s.live/engine/v4/util"
+)
+
+// sample_flags，参见 ISO/IEC 14496-12 8.8.3.1
+const (
+	FMP4_FLAG_KEYFRAME    = 0x02000000 // sample_depends_on=2
+	FMP4_FLAG_NONKEYFRAME = 0x01010000 // sample_depends_on=1, sample_is_non_sync_sample=1
+)
+
+var fourCC = func(s string) (v uint32) {
+	return util.BigEndian.Uint32([]byte(s))
+}
+
+// FMP4Track 描述 init segment 中的一个轨道
+type FMP4Track struct {
+	TrackID     uint32
+	TimeScale   uint32
+	IsVideo     bool
+	SampleEntry []byte // 完整的 sample entry box，例如 avc1、mp4a
+	Width       uint32
+	Height      uint32
+}
+
+// FMP4Sample 一个待写入分片的样本
+type FMP4Sample struct {
+	DTS      uint64 // 以轨道 TimeScale 为单位
+	CTS      int32  // PTS-DTS
+	Duration uint32
+	KeyFrame bool
+	Data     []byte
+}
+
+// FMP4TrackFragment 分片中一个轨道的样本集合
+type FMP4TrackFragment struct {
+	TrackID uint32
+	Samples []FMP4Sample
+}
+
+// MarshalFMP4Init 生成 init segment (ftyp+moov)
+func MarshalFMP4Init(tracks ...*FMP4Track) []byte {
+	var w MP4Writer
+	ftyp := NewFileTypeBox()
+	ftyp.MajorBrand = fourCC("isom")
+	ftyp.MinorVersion = 0x200
+	ftyp.CompatibleBrands = []uint32{fourCC("isom"), fourCC("iso6"), fourCC("mp41"), fourCC("cmfc")}
+	ftyp.Marshal(&w)
+	w.Box("moov", func() {
+		mvhd := MovieHeaderBox{
+			TimeScale:   1000,
+			Rate:        0x00010000,
+			Volume:      0x0100,
+			Matrix:      defaultMatrix,
+			NextTrackID: uint32(len(tracks) + 1),
+		}
+		mvhd.Marshal(&w)
+		for _, track := range tracks {
+			track.marshalTrak(&w)
+		}
+		w.Box("mvex", func() {
+			for _, track := range tracks {
+				trex := TrackExtendsBox{
+					TrackID:                       track.TrackID,
+					DefaultSampleDescriptionIndex: 1,
+				}
+				trex.Marshal(&w)
+			}
+		})
+	})
+	return w.Buffer
+}
+
+func (track *FMP4Track) marshalTrak(w *MP4Writer) {
+	w.Box("trak", func() {
+		tkhd := TrackHeaderBox{
+			TrackID: track.TrackID,
+			Matrix:  defaultMatrix,
+		}
+		tkhd.SetFlags(0x000003) // track_enabled | track_in_movie
+		if track.IsVideo {
+			tkhd.Width = track.Width << 16
+			tkhd.Height = track.Height << 16
+		} else {
+			tkhd.Volume = 0x0100
+			tkhd.AlternateGroup = 1
+		}
+		tkhd.Marshal(w)
+		w.Box("mdia", func() {
+			mdhd := MediaHeaderBox{
+				TimeScale: track.TimeScale,
+				Language:  [2]byte{0x55, 0xc4}, // und
+			}
+			mdhd.Marshal(w)
+			hdlr := HandlerBox{}
+			if track.IsVideo {
+				hdlr.HandlerType = fourCC("vide")
+				hdlr.Name = "VideoHandler"
+			} else {
+				hdlr.HandlerType = fourCC("soun")
+				hdlr.Name = "SoundHandler"
+			}
+			hdlr.Marshal(w)
+			w.Box("minf", func() {
+				if track.IsVideo {
+					vmhd := VideoMediaHeaderBox{}
+					vmhd.SetFlags(1)
+					vmhd.Marshal(w)
+				} else {
+					smhd := SoundMediaHeaderBox{}
+					smhd.Marshal(w)
+				}
+				w.Box("dinf", func() {
+					dref := w.StartFullBox("dref", 0, 0)
+					w.WriteUint32(1)
+					url := w.StartFullBox("url ", 0, 1) // 媒体数据在本文件中
+					w.EndBox(url)
+					w.EndBox(dref)
+				})
+				w.Box("stbl", func() {
+					stsd := w.StartFullBox("stsd", 0, 0)
+					w.WriteUint32(1)
+					w.Write(track.SampleEntry)
+					w.EndBox(stsd)
+					for _, empty := range []string{"stts", "stsc", "stco"} {
+						offset := w.StartFullBox(empty, 0, 0)
+						w.WriteUint32(0)
+						w.EndBox(offset)
+					}
+					stsz := w.StartFullBox("stsz", 0, 0)
+					w.WriteUint32(0)
+					w.WriteUint32(0)
+					w.EndBox(stsz)
+				})
+			})
+		})
+	})
+}
+
+// MarshalFMP4Fragment 生成 moof+mdat，返回值的最后部分直接引用样本数据
+func MarshalFMP4Fragment(sequence uint32, trafs ...FMP4TrackFragment) (result net.Buffers) {
+	var w MP4Writer
+	var dataOffsetPos []int
+	moof := w.StartBox("moof")
+	mfhd := MovieFragmentHeaderBox{SequenceNumber: sequence}
+	mfhd.Marshal(&w)
+	mdatSize := 8
+	for _, traf := range trafs {
+		w.Box("traf", func() {
+			tfhd := TrackFragmentHeaderBox{TrackID: traf.TrackID}
+			tfhd.SetFlags(TFHD_DEFAULT_BASE_IS_MOOF)
+			tfhd.Marshal(&w)
+			tfdt := TrackFragmentBaseMediaDecodeTimeBox{BaseMediaDecodeTime: traf.Samples[0].DTS}
+			tfdt.Version = 1
+			tfdt.Marshal(&w)
+			trun := TrackFragmentRunBox{DataOffset: int32(mdatSize)}
+			trun.Version = 1
+			trun.SetFlags(TRUN_DATA_OFFSET | TRUN_SAMPLE_DURATION | TRUN_SAMPLE_SIZE | TRUN_SAMPLE_FLAGS | TRUN_SAMPLE_COMPOSITION_TIME_OFFSETS)
+			for _, sample := range traf.Samples {
+				entry := TrackFragmentRunTable{
+					SampleDuration:              sample.Duration,
+					SampleSize:                  uint32(len(sample.Data)),
+					SampleFlags:                 FMP4_FLAG_NONKEYFRAME,
+					SampleCompositionTimeOffset: sample.CTS,
+				}
+				if sample.KeyFrame {
+					entry.SampleFlags = FMP4_FLAG_KEYFRAME
+				}
+				trun.Table = append(trun.Table, entry)
+				mdatSize += len(sample.Data)
+			}
+			dataOffsetPos = append(dataOffsetPos, trun.Marshal(&w))
+		})
+	}
+	w.EndBox(moof)
+	// data_offset 是相对 moof 起始位置的偏移，此时才知道 moof 的长度
+	for _, pos := range dataOffsetPos {
+		util.PutBE(w.Buffer[pos:pos+4], util.ReadBE[uint32](w.Buffer[pos:pos+4])+uint32(w.Len()))
+	}
+	w.WriteUint32(uint32(mdatSize))
+	w.WriteString("mdat")
+	result = append(result, w.Buffer)
+	for _, traf := range trafs {
+		for _, sample := range traf.Samples {
+			result = append(result, sample.Data)
+		}
+	}
+	return
+}
+
+func marshalVisualSampleEntry(w *MP4Writer, boxType string, width, height uint16, children func()) {
+	w.Box(boxType, func() {
+		w.WriteZero(6)
+		w.WriteUint16(1) // data_reference_index
+		entry := VisualSampleEntry{
+			Width:           width,
+			Height:          height,
+			HorizreSolution: 0x00480000,
+			VertreSolution:  0x00480000,
+			FrameCount:      1,
+			Depth:           0x0018,
+			PreDefined3:     -1,
+		}
+		w.WriteZero(16)
+		w.WriteUint16(entry.Width)
+		w.WriteUint16(entry.Height)
+		w.WriteUint32(entry.HorizreSolution)
+		w.WriteUint32(entry.VertreSolution)
+		w.WriteUint32(0)
+		w.WriteUint16(entry.FrameCount)
+		w.WriteZero(32) // compressorname
+		w.WriteUint16(entry.Depth)
+		w.WriteUint16(uint16(entry.PreDefined3))
+		children()
+	})
+}
+
+func marshalAudioSampleEntry(w *MP4Writer, boxType string, channels uint16, sampleRate uint32, children func()) {
+	w.Box(boxType, func() {
+		w.WriteZero(6)
+		w.WriteUint16(1) // data_reference_index
+		entry := AudioSampleEntry{
+			ChannelCount: channels,
+			SampleSize:   16,
+			SampleRate:   sampleRate << 16,
+		}
+		w.WriteZero(8)
+		w.WriteUint16(entry.ChannelCount)
+		w.WriteUint16(entry.SampleSize)
+		w.WriteZero(4)
+		w.WriteUint32(entry.SampleRate)
+		children()
+	})
+}
+
+// AVCSampleEntry 生成 avc1，avcC 为 AVCDecoderConfigurationRecord
+func AVCSampleEntry(width, height uint16, avcC []byte) []byte {
+	var w MP4Writer
+	marshalVisualSampleEntry(&w, "avc1", width, height, func() {
+		w.Box("avcC", func() { w.Write(avcC) })
+	})
+	return w.Buffer
+}
+
+// HEVCSampleEntry 生成 hvc1，hvcC 为 HEVCDecoderConfigurationRecord
+func HEVCSampleEntry(width, height uint16, hvcC []byte) []byte {
+	var w MP4Writer
+	marshalVisualSampleEntry(&w, "hvc1", width, height, func() {
+		w.Box("hvcC", func() { w.Write(hvcC) })
+	})
+	return w.Buffer
+}
+
+// AV1SampleEntry 生成 av01，av1C 为 AV1CodecConfigurationRecord
+func AV1SampleEntry(width, height uint16, av1C []byte) []byte {
+	var w MP4Writer
+	marshalVisualSampleEntry(&w, "av01", width, height, func() {
+		w.Box("av1C", func() { w.Write(av1C) })
+	})
+	return w.Buffer
+}
+
+// AACSampleEntry 生成 mp4a，asc 为 AudioSpecificConfig
+func AACSampleEntry(channels uint16, sampleRate uint32, asc []byte) []byte {
+	var w MP4Writer
+	marshalAudioSampleEntry(&w, "mp4a", channels, sampleRate, func() {
+		esds := w.StartFullBox("esds", 0, 0)
+		// ES_Descriptor
+		decSpecificInfo := append([]byte{0x05, byte(len(asc))}, asc...)
+		decConfig := append([]byte{0x04, byte(13 + len(decSpecificInfo)), 0x40, 0x15, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, decSpecificInfo...)
+		esDescriptor := append([]byte{0x03, byte(3 + len(decConfig) + 3), 0, 1, 0}, decConfig...)
+		w.Write(append(esDescriptor, 0x06, 0x01, 0x02))
+		w.EndBox(esds)
+	})
+	return w.Buffer
+}
+
+// OpusSampleEntry 生成 Opus 及 dOps，参见 https://opus-codec.org/docs/opus_in_isobmff.html
+func OpusSampleEntry(channels uint16, preSkip uint16, inputSampleRate uint32) []byte {
+	var w MP4Writer
+	marshalAudioSampleEntry(&w, "Opus", channels, 48000, func() {
+		w.Box("dOps", func() {
+			w.WriteByte(0)
+			w.WriteByte(byte(channels))
+			w.WriteUint16(preSkip)
+			w.WriteUint32(inputSampleRate)
+			w.WriteUint16(0) // OutputGain
+			w.WriteByte(0)   // ChannelMappingFamily
+		})
+	})
+	return w.Buffer
+}
+
+// BuildAV1CodecConfigurationRecord 根据 sequence header OBU 生成 av1C
+func BuildAV1CodecConfigurationRecord(seqProfile, seqLevelIdx0, seqTier0 byte, configOBUs []byte) []byte {
+	return append([]byte{0x81, seqProfile<<5 | seqLevelIdx0&0x1f, seqTier0 << 7, 0}, configOBUs...)
+}
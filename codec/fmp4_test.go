@@ -0,0 +1,144 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+
+	"m7s.live/engine/v4/util"
+)
+
+func TestMarshalFMP4Init(t *testing.T) {
+	video := &FMP4Track{TrackID: 1, TimeScale: 90000, IsVideo: true, Width: 1280, Height: 720, SampleEntry: AVCSampleEntry(1280, 720, []byte{1, 0x64, 0, 0x1f, 0xff})}
+	audio := &FMP4Track{TrackID: 2, TimeScale: 44100, SampleEntry: AACSampleEntry(2, 44100, []byte{0x12, 0x10})}
+	var boxes []string
+	var tracks []*MP4Track
+	var trex []uint32
+	err := readBoxes(MarshalFMP4Init(video, audio), func(boxType string, body util.Buffer) error {
+		boxes = append(boxes, boxType)
+		if boxType != "moov" {
+			return nil
+		}
+		return readBoxes(body, func(boxType string, body util.Buffer) error {
+			switch boxType {
+			case "trak":
+				track := &MP4Track{}
+				tracks = append(tracks, track)
+				return readBoxes(body, track.parseTrak)
+			case "mvex":
+				return readBoxes(body, func(boxType string, body util.Buffer) error {
+					if boxType == "trex" {
+						body.ReadN(4) // version & flags
+						trex = append(trex, body.ReadUint32())
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(boxes) != 2 || boxes[0] != "ftyp" || boxes[1] != "moov" {
+		t.Fatalf("top level boxes %v", boxes)
+	}
+	if len(tracks) != 2 || len(trex) != 2 {
+		t.Fatalf("%d traks, %d trex", len(tracks), len(trex))
+	}
+	if v := tracks[0]; v.TrackID != 1 || v.TimeScale != 90000 || v.SampleEntry != "avc1" || v.Width != 1280 || v.Height != 720 || v.VideoCodec != CodecID_H264 {
+		t.Errorf("video track %+v", v)
+	}
+	if a := tracks[1]; a.TrackID != 2 || a.TimeScale != 44100 || a.SampleEntry != "mp4a" || a.AudioCodec != CodecID_AAC || !bytes.Equal(a.ExtraData, []byte{0x12, 0x10}) {
+		t.Errorf("audio track %+v", a)
+	}
+	if trex[0] != 1 || trex[1] != 2 {
+		t.Errorf("trex track ids %v", trex)
+	}
+}
+
+// TestMarshalFMP4Fragment 每个 trun 的 data_offset 相对 moof 起始位置，应当指向该轨道的样本在 mdat 中的数据
+func TestMarshalFMP4Fragment(t *testing.T) {
+	trafs := []FMP4TrackFragment{
+		{TrackID: 1, Samples: []FMP4Sample{
+			{DTS: 9000, CTS: 3000, Duration: 3000, KeyFrame: true, Data: []byte{0, 0, 0, 2, 0x65, 1}},
+			{DTS: 12000, Duration: 3000, Data: []byte{0, 0, 0, 1, 0x41}},
+		}},
+		{TrackID: 2, Samples: []FMP4Sample{
+			{DTS: 1024, Duration: 1024, KeyFrame: true, Data: []byte{0x21, 0x10, 0x04}},
+		}},
+	}
+	buffers := MarshalFMP4Fragment(7, trafs...)
+	var file []byte
+	for _, b := range buffers {
+		file = append(file, b...)
+	}
+	var moof, mdat util.Buffer
+	err := readBoxes(file, func(boxType string, body util.Buffer) error {
+		switch boxType {
+		case "moof":
+			moof = body
+		case "mdat":
+			mdat = body
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mdat) != 6+5+3 {
+		t.Fatalf("mdat size %d", len(mdat))
+	}
+	var sequence uint32
+	var traf int
+	err = readBoxes(moof, func(boxType string, body util.Buffer) error {
+		switch boxType {
+		case "mfhd":
+			body.ReadN(4)
+			sequence = body.ReadUint32()
+		case "traf":
+			want := trafs[traf]
+			traf++
+			return readBoxes(body, func(boxType string, body util.Buffer) error {
+				switch boxType {
+				case "tfhd":
+					body.ReadN(4)
+					if id := body.ReadUint32(); id != want.TrackID {
+						t.Errorf("tfhd track id %d, want %d", id, want.TrackID)
+					}
+				case "tfdt":
+					body.ReadN(4)
+					if dts := body.ReadUint64(); dts != want.Samples[0].DTS {
+						t.Errorf("track %d tfdt %d", want.TrackID, dts)
+					}
+				case "trun":
+					body.ReadN(4)
+					if count := body.ReadUint32(); count != uint32(len(want.Samples)) {
+						t.Fatalf("track %d sample count %d", want.TrackID, count)
+					}
+					offset := int(int32(body.ReadUint32()))
+					for i, sample := range want.Samples {
+						duration, size, flags, cts := body.ReadUint32(), int(body.ReadUint32()), body.ReadUint32(), int32(body.ReadUint32())
+						if duration != sample.Duration || cts != sample.CTS || size != len(sample.Data) {
+							t.Errorf("track %d sample %d: duration %d size %d cts %d", want.TrackID, i, duration, size, cts)
+						}
+						if keyFrame := flags == FMP4_FLAG_KEYFRAME; keyFrame != sample.KeyFrame {
+							t.Errorf("track %d sample %d flags %x", want.TrackID, i, flags)
+						}
+						if offset < 0 || offset+size > len(file) || !bytes.Equal(file[offset:offset+size], sample.Data) {
+							t.Fatalf("track %d sample %d: data_offset %d does not point to the sample", want.TrackID, i, offset)
+						}
+						offset += size
+					}
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequence != 7 || traf != 2 {
+		t.Errorf("sequence %d, %d trafs", sequence, traf)
+	}
+}
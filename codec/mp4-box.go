@@ -0,0 +1,265 @@
+package codec
+
+import (
+	"m7s.live/engine/v4/util"
+)
+
+// MP4Writer 用于拼装 ISO-BMFF box，box 的长度在 EndBox 时回填
+type MP4Writer struct {
+	util.Buffer
+}
+
+// StartBox 写入 box 头，返回 box 的起始位置，长度先占位
+func (w *MP4Writer) StartBox(boxType string) (offset int) {
+	offset = w.Len()
+	w.WriteUint32(0)
+	w.WriteString(boxType)
+	return
+}
+
+// StartFullBox 写入 full box 头
+func (w *MP4Writer) StartFullBox(boxType string, version byte, flags uint32) (offset int) {
+	offset = w.StartBox(boxType)
+	w.WriteByte(version)
+	w.WriteUint24(flags)
+	return
+}
+
+// EndBox 回填 box 长度
+func (w *MP4Writer) EndBox(offset int) {
+	util.PutBE(w.Buffer[offset:offset+4], uint32(w.Len()-offset))
+}
+
+// Box 写入一个容器 box，子 box 在 body 中写入
+func (w *MP4Writer) Box(boxType string, body func()) {
+	offset := w.StartBox(boxType)
+	if body != nil {
+		body()
+	}
+	w.EndBox(offset)
+}
+
+func (w *MP4Writer) WriteUint64(v uint64) {
+	util.PutBE(w.Malloc(8), v)
+}
+
+func (w *MP4Writer) WriteZero(n int) {
+	b := w.Malloc(n)
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func boxUint(v any) uint64 {
+	switch v := v.(type) {
+	case uint64:
+		return v
+	case uint32:
+		return uint64(v)
+	case int64:
+		return uint64(v)
+	case int32:
+		return uint64(v)
+	case int:
+		return uint64(v)
+	}
+	return 0
+}
+
+func (w *MP4Writer) writeVersioned(version byte, v any) {
+	if version == 1 {
+		w.WriteUint64(boxUint(v))
+	} else {
+		w.WriteUint32(uint32(boxUint(v)))
+	}
+}
+
+func (box *MP4FullBoxHeader) flags() uint32 {
+	return util.ReadBE[uint32](box.Flags[:])
+}
+
+func (box *MP4FullBoxHeader) SetFlags(flags uint32) {
+	util.PutBE(box.Flags[:], flags)
+}
+
+var defaultMatrix = [9]int32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+func (box *FileTypeBox) Marshal(w *MP4Writer) {
+	offset := w.StartBox("ftyp")
+	w.WriteUint32(box.MajorBrand)
+	w.WriteUint32(box.MinorVersion)
+	for _, brand := range box.CompatibleBrands {
+		w.WriteUint32(brand)
+	}
+	w.EndBox(offset)
+}
+
+func (box *MovieHeaderBox) Marshal(w *MP4Writer) {
+	offset := w.StartFullBox("mvhd", box.Version, box.flags())
+	w.writeVersioned(box.Version, box.CreationTime)
+	w.writeVersioned(box.Version, box.ModificationTime)
+	w.WriteUint32(box.TimeScale)
+	w.writeVersioned(box.Version, box.Duration)
+	w.WriteUint32(uint32(box.Rate))
+	w.WriteUint16(uint16(box.Volume))
+	w.WriteZero(10)
+	for _, m := range box.Matrix {
+		w.WriteUint32(uint32(m))
+	}
+	w.WriteZero(24)
+	w.WriteUint32(box.NextTrackID)
+	w.EndBox(offset)
+}
+
+func (box *TrackHeaderBox) Marshal(w *MP4Writer) {
+	offset := w.StartFullBox("tkhd", box.Version, box.flags())
+	w.writeVersioned(box.Version, box.CreationTime)
+	w.writeVersioned(box.Version, box.ModificationTime)
+	w.WriteUint32(box.TrackID)
+	w.WriteUint32(0)
+	w.writeVersioned(box.Version, box.Duration)
+	w.WriteZero(8)
+	w.WriteUint16(uint16(box.Layer))
+	w.WriteUint16(uint16(box.AlternateGroup))
+	w.WriteUint16(uint16(box.Volume))
+	w.WriteUint16(0)
+	for _, m := range box.Matrix {
+		w.WriteUint32(uint32(m))
+	}
+	w.WriteUint32(box.Width)
+	w.WriteUint32(box.Height)
+	w.EndBox(offset)
+}
+
+func (box *MediaHeaderBox) Marshal(w *MP4Writer) {
+	offset := w.StartFullBox("mdhd", box.Version, box.flags())
+	w.writeVersioned(box.Version, box.CreationTime)
+	w.writeVersioned(box.Version, box.ModificationTime)
+	w.WriteUint32(box.TimeScale)
+	w.writeVersioned(box.Version, box.Duration)
+	w.WriteByte(box.Language[0]&0x7f | box.Pad<<7)
+	w.WriteByte(box.Language[1])
+	w.WriteUint16(box.PreDefined)
+	w.EndBox(offset)
+}
+
+func (box *HandlerBox) Marshal(w *MP4Writer) {
+	offset := w.StartFullBox("hdlr", box.Version, box.flags())
+	w.WriteUint32(box.PreDefined)
+	w.WriteUint32(box.HandlerType)
+	w.WriteZero(12)
+	w.WriteString(box.Name)
+	w.WriteByte(0)
+	w.EndBox(offset)
+}
+
+func (box *VideoMediaHeaderBox) Marshal(w *MP4Writer) {
+	offset := w.StartFullBox("vmhd", box.Version, box.flags())
+	w.WriteUint16(box.GraphicsMode)
+	for _, c := range box.Opcolor {
+		w.WriteUint16(c)
+	}
+	w.EndBox(offset)
+}
+
+func (box *SoundMediaHeaderBox) Marshal(w *MP4Writer) {
+	offset := w.StartFullBox("smhd", box.Version, box.flags())
+	w.WriteUint16(uint16(box.Balance))
+	w.WriteUint16(0)
+	w.EndBox(offset)
+}
+
+func (box *TrackExtendsBox) Marshal(w *MP4Writer) {
+	offset := w.StartFullBox("trex", box.Version, box.flags())
+	w.WriteUint32(box.TrackID)
+	w.WriteUint32(box.DefaultSampleDescriptionIndex)
+	w.WriteUint32(box.DefaultSampleDuration)
+	w.WriteUint32(box.DefaultSampleSize)
+	w.WriteUint32(box.DefaultSampleFlags)
+	w.EndBox(offset)
+}
+
+func (box *MovieFragmentHeaderBox) Marshal(w *MP4Writer) {
+	offset := w.StartFullBox("mfhd", box.Version, box.flags())
+	w.WriteUint32(box.SequenceNumber)
+	w.EndBox(offset)
+}
+
+// tfhd 的可选字段标志
+const (
+	TFHD_BASE_DATA_OFFSET         = 0x000001
+	TFHD_SAMPLE_DESCRIPTION_INDEX = 0x000002
+	TFHD_DEFAULT_SAMPLE_DURATION  = 0x000008
+	TFHD_DEFAULT_SAMPLE_SIZE      = 0x000010
+	TFHD_DEFAULT_SAMPLE_FLAGS     = 0x000020
+	TFHD_DEFAULT_BASE_IS_MOOF     = 0x020000
+)
+
+func (box *TrackFragmentHeaderBox) Marshal(w *MP4Writer) {
+	flags := box.flags()
+	offset := w.StartFullBox("tfhd", box.Version, flags)
+	w.WriteUint32(box.TrackID)
+	if flags&TFHD_BASE_DATA_OFFSET != 0 {
+		w.WriteUint64(box.BaseDataOffset)
+	}
+	if flags&TFHD_SAMPLE_DESCRIPTION_INDEX != 0 {
+		w.WriteUint32(box.SampleDescriptionIndex)
+	}
+	if flags&TFHD_DEFAULT_SAMPLE_DURATION != 0 {
+		w.WriteUint32(box.DefaultSampleDuration)
+	}
+	if flags&TFHD_DEFAULT_SAMPLE_SIZE != 0 {
+		w.WriteUint32(box.DefaultSampleSize)
+	}
+	if flags&TFHD_DEFAULT_SAMPLE_FLAGS != 0 {
+		w.WriteUint32(box.DefaultSampleFlags)
+	}
+	w.EndBox(offset)
+}
+
+func (box *TrackFragmentBaseMediaDecodeTimeBox) Marshal(w *MP4Writer) {
+	offset := w.StartFullBox("tfdt", box.Version, box.flags())
+	w.writeVersioned(box.Version, box.BaseMediaDecodeTime)
+	w.EndBox(offset)
+}
+
+// trun 的可选字段标志
+const (
+	TRUN_DATA_OFFSET                     = 0x000001
+	TRUN_FIRST_SAMPLE_FLAGS              = 0x000004
+	TRUN_SAMPLE_DURATION                 = 0x000100
+	TRUN_SAMPLE_SIZE                     = 0x000200
+	TRUN_SAMPLE_FLAGS                    = 0x000400
+	TRUN_SAMPLE_COMPOSITION_TIME_OFFSETS = 0x000800
+)
+
+// Marshal 写入 trun，返回 data_offset 字段在 w 中的位置，便于 moof 写完后回填
+func (box *TrackFragmentRunBox) Marshal(w *MP4Writer) (dataOffsetPos int) {
+	flags := box.flags()
+	offset := w.StartFullBox("trun", box.Version, flags)
+	w.WriteUint32(uint32(len(box.Table)))
+	dataOffsetPos = -1
+	if flags&TRUN_DATA_OFFSET != 0 {
+		dataOffsetPos = w.Len()
+		w.WriteUint32(uint32(box.DataOffset))
+	}
+	if flags&TRUN_FIRST_SAMPLE_FLAGS != 0 {
+		w.WriteUint32(box.FirstSampleFlags)
+	}
+	for _, entry := range box.Table {
+		if flags&TRUN_SAMPLE_DURATION != 0 {
+			w.WriteUint32(entry.SampleDuration)
+		}
+		if flags&TRUN_SAMPLE_SIZE != 0 {
+			w.WriteUint32(entry.SampleSize)
+		}
+		if flags&TRUN_SAMPLE_FLAGS != 0 {
+			w.WriteUint32(entry.SampleFlags)
+		}
+		if flags&TRUN_SAMPLE_COMPOSITION_TIME_OFFSETS != 0 {
+			w.WriteUint32(uint32(boxUint(entry.SampleCompositionTimeOffset)))
+		}
+	}
+	w.EndBox(offset)
+	return
+}
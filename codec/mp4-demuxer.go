@@ -0,0 +1,734 @@
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"m7s.live/engine/v4/util"
+)
+
+var (
+	ErrMP4NoMoov       = errors.New("mp4: moov box not found")
+	ErrMP4BoxTruncated = errors.New("mp4: box truncated")
+)
+
+// MP4Sample 一个样本在文件中的位置及时间戳，时间戳以轨道的 TimeScale 为单位，已应用 edit list
+type MP4Sample struct {
+	Offset   int64
+	Size     uint32
+	DTS      int64
+	PTS      int64
+	Duration uint32
+	KeyFrame bool
+}
+
+// MP4Track 解析 moov 得到的轨道信息
+type MP4Track struct {
+	TrackID      uint32
+	TimeScale    uint32
+	Duration     uint64
+	HandlerType  uint32
+	SampleEntry  string // sample entry 的 box 类型，例如 avc1、mp4a、Opus
+	VideoCodec   VideoCodecID
+	AudioCodec   AudioCodecID
+	Width        uint16
+	Height       uint16
+	ChannelCount uint16
+	SampleRate   uint32
+	ExtraData    []byte // avcC、hvcC、av1C 的内容，AAC 为 AudioSpecificConfig，Opus 为 dOps 的内容
+	Samples      []MP4Sample
+	sampleIndex  int
+
+	stts TimeToSampleBox
+	ctts CompositionOffsetBox
+	stsc SampleToChunkBox
+	stsz SampleSizeBox
+	stco ChunkLargeOffsetBox
+	stss *SyncSampleBox
+	elst *EditListBox
+}
+
+func (t *MP4Track) IsVideo() bool {
+	return t.VideoCodec != 0
+}
+
+func (t *MP4Track) IsAudio() bool {
+	return t.AudioCodec != 0
+}
+
+// Time 将以 TimeScale 为单位的时间戳转换为 time.Duration
+func (t *MP4Track) Time(ts int64) time.Duration {
+	return time.Duration(ts) * time.Second / time.Duration(t.TimeScale)
+}
+
+// MP4Demuxer 基于 mp4.go 中定义的 box 结构解析 mp4 文件
+type MP4Demuxer struct {
+	reader    io.ReadSeeker
+	TimeScale uint32
+	Duration  uint64
+	Tracks    []*MP4Track
+}
+
+func NewMP4Demuxer(r io.ReadSeeker) *MP4Demuxer {
+	return &MP4Demuxer{reader: r}
+}
+
+type mp4BoxVisitor func(boxType string, body util.Buffer) error
+
+// readBoxes 遍历 b 中相邻的 box
+func readBoxes(b util.Buffer, visit mp4BoxVisitor) error {
+	for b.CanReadN(8) {
+		size := uint64(b.ReadUint32())
+		boxType := string(b.ReadN(4))
+		headerSize := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(b.Len()) + headerSize
+		case 1:
+			if !b.CanReadN(8) {
+				return ErrMP4BoxTruncated
+			}
+			size = b.ReadUint64()
+			headerSize += 8
+		}
+		if size < headerSize || !b.CanReadN(int(size-headerSize)) {
+			return fmt.Errorf("%w: %s", ErrMP4BoxTruncated, boxType)
+		}
+		if err := visit(boxType, b.ReadN(int(size-headerSize))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Demux 读取文件的顶层 box，解析 moov 并生成所有样本的索引
+func (d *MP4Demuxer) Demux() (err error) {
+	defer func() {
+		// util.Buffer 读取越界时会 panic
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrMP4BoxTruncated, r)
+		}
+	}()
+	if _, err = d.reader.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	var header [16]byte
+	for {
+		if _, err = io.ReadFull(d.reader, header[:8]); err != nil {
+			if err == io.EOF {
+				return ErrMP4NoMoov
+			}
+			return
+		}
+		size := int64(util.ReadBE[uint32](header[:4]))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+		switch size {
+		case 0:
+			if boxType == "moov" {
+				var moov []byte
+				if moov, err = io.ReadAll(d.reader); err != nil {
+					return
+				}
+				return d.parseMoov(moov)
+			}
+			return ErrMP4NoMoov
+		case 1:
+			if _, err = io.ReadFull(d.reader, header[8:16]); err != nil {
+				return
+			}
+			size = int64(util.ReadBE[uint64](header[8:16]))
+			headerSize = 16
+		}
+		if size < headerSize {
+			return fmt.Errorf("%w: %s", ErrMP4BoxTruncated, boxType)
+		}
+		if boxType == "moov" {
+			moov := make([]byte, size-headerSize)
+			if _, err = io.ReadFull(d.reader, moov); err != nil {
+				return
+			}
+			return d.parseMoov(moov)
+		}
+		if _, err = d.reader.Seek(size-headerSize, io.SeekCurrent); err != nil {
+			return
+		}
+	}
+}
+
+func (d *MP4Demuxer) parseMoov(moov util.Buffer) error {
+	return readBoxes(moov, func(boxType string, body util.Buffer) error {
+		switch boxType {
+		case "mvhd":
+			var mvhd MovieHeaderBox
+			mvhd.Unmarshal(body)
+			d.TimeScale = mvhd.TimeScale
+			d.Duration = boxUint(mvhd.Duration)
+		case "trak":
+			track := &MP4Track{}
+			if err := readBoxes(body, track.parseTrak); err != nil {
+				return err
+			}
+			if track.IsVideo() || track.IsAudio() {
+				track.buildSamples(d.TimeScale)
+				d.Tracks = append(d.Tracks, track)
+			}
+		}
+		return nil
+	})
+}
+
+func (track *MP4Track) parseTrak(boxType string, body util.Buffer) error {
+	switch boxType {
+	case "tkhd":
+		var tkhd TrackHeaderBox
+		tkhd.Unmarshal(body)
+		track.TrackID = tkhd.TrackID
+	case "edts":
+		return readBoxes(body, func(boxType string, body util.Buffer) error {
+			if boxType == "elst" {
+				track.elst = &EditListBox{}
+				track.elst.Unmarshal(body)
+			}
+			return nil
+		})
+	case "mdia", "minf", "stbl":
+		return readBoxes(body, track.parseTrak)
+	case "mdhd":
+		var mdhd MediaHeaderBox
+		mdhd.Unmarshal(body)
+		track.TimeScale = mdhd.TimeScale
+		track.Duration = boxUint(mdhd.Duration)
+	case "hdlr":
+		var hdlr HandlerBox
+		hdlr.Unmarshal(body)
+		track.HandlerType = hdlr.HandlerType
+	case "stsd":
+		body.ReadN(4) // version & flags
+		if count := body.ReadUint32(); count > 0 {
+			// 只使用第一个 sample entry
+			return readBoxes(body, func(boxType string, entry util.Buffer) error {
+				if track.SampleEntry == "" {
+					track.SampleEntry = boxType
+					track.parseSampleEntry(boxType, entry)
+				}
+				return nil
+			})
+		}
+	case "stts":
+		track.stts.Unmarshal(body)
+	case "ctts":
+		track.ctts.Unmarshal(body)
+	case "stsc":
+		track.stsc.Unmarshal(body)
+	case "stsz":
+		track.stsz.Unmarshal(body)
+	case "stz2":
+		var stz2 CompactSampleSizeBox
+		stz2.Unmarshal(body)
+		track.stsz.SampleCount = stz2.SampleCount
+		track.stsz.EntrySize = stz2.EntrySize
+	case "stco":
+		var stco ChunkOffsetBox
+		stco.Unmarshal(body)
+		track.stco.EntryCount = stco.EntryCount
+		track.stco.ChunkOffset = make([]uint64, len(stco.ChunkOffset))
+		for i, offset := range stco.ChunkOffset {
+			track.stco.ChunkOffset[i] = uint64(offset)
+		}
+	case "co64":
+		track.stco.Unmarshal(body)
+	case "stss":
+		track.stss = &SyncSampleBox{}
+		track.stss.Unmarshal(body)
+	}
+	return nil
+}
+
+func (track *MP4Track) parseSampleEntry(boxType string, entry util.Buffer) {
+	switch boxType {
+	case "avc1", "avc3", "hvc1", "hev1", "av01":
+		var visual VisualSampleEntry
+		entry.ReadN(8) // reserved & data_reference_index
+		visual.Unmarshal(&entry)
+		track.Width, track.Height = visual.Width, visual.Height
+		readBoxes(entry, func(child string, body util.Buffer) error {
+			switch child {
+			case "avcC":
+				track.VideoCodec, track.ExtraData = CodecID_H264, body
+			case "hvcC":
+				track.VideoCodec, track.ExtraData = CodecID_H265, body
+			case "av1C":
+				track.VideoCodec, track.ExtraData = CodecID_AV1, body
+			}
+			return nil
+		})
+	case "mp4a", "Opus", "alaw", "ulaw":
+		var audio AudioSampleEntry
+		entry.ReadN(8)
+		version := audio.Unmarshal(&entry)
+		track.ChannelCount = audio.ChannelCount
+		track.SampleRate = audio.SampleRate >> 16
+		// QuickTime 的 SoundDescription V1/V2 有额外的字段
+		switch version {
+		case 1:
+			entry.ReadN(16)
+		case 2:
+			entry.ReadN(36)
+		}
+		switch boxType {
+		case "alaw":
+			track.AudioCodec = CodecID_PCMA
+		case "ulaw":
+			track.AudioCodec = CodecID_PCMU
+		}
+		readBoxes(entry, func(child string, body util.Buffer) error {
+			switch child {
+			case "esds":
+				body.ReadN(4)
+				if asc := parseESDescriptor(body); asc != nil {
+					track.AudioCodec, track.ExtraData = CodecID_AAC, asc
+				}
+			case "dOps":
+				track.AudioCodec, track.ExtraData = CodecID_OPUS, body
+				if len(body) >= 2 {
+					track.ChannelCount = uint16(body[1])
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// parseESDescriptor 从 esds 中取出 AudioSpecificConfig，参见 ISO/IEC 14496-1 7.2.6
+func parseESDescriptor(b util.Buffer) (asc []byte) {
+	for b.CanReadN(2) {
+		tag := b.ReadByte()
+		var size int
+		for i := 0; i < 4 && b.CanRead(); i++ {
+			c := b.ReadByte()
+			size = size<<7 | int(c&0x7f)
+			if c&0x80 == 0 {
+				break
+			}
+		}
+		if !b.CanReadN(size) {
+			return
+		}
+		body := b.ReadN(size)
+		switch tag {
+		case 0x03: // ES_Descriptor
+			body.ReadN(2) // ES_ID
+			flags := body.ReadByte()
+			if flags&0x80 != 0 {
+				body.ReadN(2)
+			}
+			if flags&0x40 != 0 {
+				body.ReadN(int(body.ReadByte()))
+			}
+			if flags&0x20 != 0 {
+				body.ReadN(2)
+			}
+			return parseESDescriptor(body)
+		case 0x04: // DecoderConfigDescriptor
+			if objectType := body.ReadByte(); objectType != 0x40 && objectType != 0x66 && objectType != 0x67 && objectType != 0x68 {
+				return
+			}
+			body.ReadN(12)
+			return parseESDescriptor(body)
+		case 0x05: // DecoderSpecificInfo
+			return body
+		}
+	}
+	return
+}
+
+// buildSamples 根据 stbl 中的各个表展开每个样本的偏移、大小、时间戳
+func (track *MP4Track) buildSamples(movieTimeScale uint32) {
+	count := int(track.stsz.SampleCount)
+	// 以 stts 中的样本总数为上限，避免 stsz 中的异常值导致分配过大的内存
+	var sttsCount int
+	for _, entry := range track.stts.Table {
+		sttsCount += int(entry.SampleCount)
+	}
+	if count > sttsCount {
+		count = sttsCount
+	}
+	track.Samples = make([]MP4Sample, count)
+	// stsz/stz2
+	sizes, _ := track.stsz.EntrySize.([]uint32)
+	for i := range track.Samples {
+		if track.stsz.SampleSize != 0 {
+			track.Samples[i].Size = track.stsz.SampleSize
+		} else if i < len(sizes) {
+			track.Samples[i].Size = sizes[i]
+		}
+	}
+	// stts
+	var dts int64
+	i := 0
+	for _, entry := range track.stts.Table {
+		for j := uint32(0); j < entry.SampleCount && i < count; j++ {
+			track.Samples[i].DTS = dts
+			track.Samples[i].Duration = entry.SampleDelta
+			dts += int64(entry.SampleDelta)
+			i++
+		}
+	}
+	// ctts
+	i = 0
+	for _, entry := range track.ctts.Table {
+		offset := int64(boxInt(entry.SampleOffset))
+		for j := uint32(0); j < entry.SampleCount && i < count; j++ {
+			track.Samples[i].PTS = offset
+			i++
+		}
+	}
+	for i := range track.Samples {
+		track.Samples[i].PTS += track.Samples[i].DTS
+	}
+	// stss，没有 stss 时所有样本都是同步样本
+	if track.stss == nil {
+		for i := range track.Samples {
+			track.Samples[i].KeyFrame = true
+		}
+	} else {
+		for _, n := range track.stss.SampleNumber {
+			if n > 0 && int(n) <= count {
+				track.Samples[n-1].KeyFrame = true
+			}
+		}
+	}
+	// stsc + stco/co64
+	i = 0
+	chunkCount := len(track.stco.ChunkOffset)
+	for e, entry := range track.stsc.Table {
+		lastChunk := chunkCount
+		if e+1 < len(track.stsc.Table) {
+			lastChunk = int(track.stsc.Table[e+1].FirstChunk) - 1
+		}
+		for chunk := int(entry.FirstChunk); chunk <= lastChunk && chunk <= chunkCount; chunk++ {
+			offset := int64(track.stco.ChunkOffset[chunk-1])
+			for j := uint32(0); j < entry.SamplesPerChunk && i < count; j++ {
+				track.Samples[i].Offset = offset
+				offset += int64(track.Samples[i].Size)
+				i++
+			}
+		}
+	}
+	track.applyEditList(movieTimeScale)
+}
+
+// applyEditList 处理 edit list：空 edit 表示延迟播放，第一个非空 edit 的 media_time 表示起始位置
+func (track *MP4Track) applyEditList(movieTimeScale uint32) {
+	if track.elst == nil || movieTimeScale == 0 {
+		return
+	}
+	var shift int64
+	for _, entry := range track.elst.Tables {
+		mediaTime := boxInt(entry.MediaTime)
+		if mediaTime == -1 {
+			shift += int64(boxUint(entry.SegmentDuration)) * int64(track.TimeScale) / int64(movieTimeScale)
+			continue
+		}
+		shift -= mediaTime
+		break
+	}
+	if shift == 0 {
+		return
+	}
+	for i := range track.Samples {
+		track.Samples[i].DTS += shift
+		track.Samples[i].PTS += shift
+	}
+}
+
+// ReadSample 按照解码时间交错读取各个轨道的下一个样本，所有样本读取完毕返回 io.EOF
+func (d *MP4Demuxer) ReadSample() (track *MP4Track, sample *MP4Sample, data []byte, err error) {
+	for _, t := range d.Tracks {
+		if t.sampleIndex >= len(t.Samples) {
+			continue
+		}
+		if track == nil || compareTime(t.Samples[t.sampleIndex].DTS, t.TimeScale, track.Samples[track.sampleIndex].DTS, track.TimeScale) < 0 {
+			track = t
+		}
+	}
+	if track == nil {
+		return nil, nil, nil, io.EOF
+	}
+	sample = &track.Samples[track.sampleIndex]
+	track.sampleIndex++
+	if _, err = d.reader.Seek(sample.Offset, io.SeekStart); err != nil {
+		return
+	}
+	data = make([]byte, sample.Size)
+	_, err = io.ReadFull(d.reader, data)
+	return
+}
+
+// SeekTime 定位到 pos 之前最近的视频关键帧，其他轨道从该关键帧之后的第一个样本开始读取，返回实际定位到的时间
+func (d *MP4Demuxer) SeekTime(pos time.Duration) time.Duration {
+	for _, t := range d.Tracks {
+		if !t.IsVideo() || len(t.Samples) == 0 {
+			continue
+		}
+		key := 0
+		for i, sample := range t.Samples {
+			if t.Time(sample.DTS) > pos {
+				break
+			}
+			if sample.KeyFrame {
+				key = i
+			}
+		}
+		pos = t.Time(t.Samples[key].DTS)
+		break
+	}
+	for _, t := range d.Tracks {
+		t.sampleIndex = sort.Search(len(t.Samples), func(i int) bool {
+			return t.Time(t.Samples[i].DTS) >= pos
+		})
+	}
+	return pos
+}
+
+func compareTime(a int64, aScale uint32, b int64, bScale uint32) int {
+	l, r := a*int64(bScale), b*int64(aScale)
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+func boxInt(v any) int64 {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	}
+	return 0
+}
+
+func readVersioned(b *util.Buffer, version uint8) any {
+	if version == 1 {
+		return b.ReadUint64()
+	}
+	return b.ReadUint32()
+}
+
+// readEntryCount 读取表的条目数，条目数超出 box 剩余长度时视为 box 被截断
+func readEntryCount(b *util.Buffer, entrySize int) uint32 {
+	count := b.ReadUint32()
+	if uint64(count)*uint64(entrySize) > uint64(b.Len()) {
+		panic(fmt.Sprintf("entry count %d too large", count))
+	}
+	return count
+}
+
+func (box *MP4FullBoxHeader) unmarshal(b *util.Buffer) {
+	box.Version = b.ReadByte()
+	copy(box.Flags[:], b.ReadN(3))
+}
+
+func (box *MovieHeaderBox) Unmarshal(b util.Buffer) {
+	box.MP4FullBoxHeader.unmarshal(&b)
+	box.CreationTime = readVersioned(&b, box.Version)
+	box.ModificationTime = readVersioned(&b, box.Version)
+	box.TimeScale = b.ReadUint32()
+	box.Duration = readVersioned(&b, box.Version)
+}
+
+func (box *TrackHeaderBox) Unmarshal(b util.Buffer) {
+	box.MP4FullBoxHeader.unmarshal(&b)
+	box.CreationTime = readVersioned(&b, box.Version)
+	box.ModificationTime = readVersioned(&b, box.Version)
+	box.TrackID = b.ReadUint32()
+	b.ReadN(4)
+	box.Duration = readVersioned(&b, box.Version)
+	b.ReadN(8)
+	box.Layer = int16(b.ReadUint16())
+	box.AlternateGroup = int16(b.ReadUint16())
+	box.Volume = int16(b.ReadUint16())
+	b.ReadN(2)
+	for i := range box.Matrix {
+		box.Matrix[i] = int32(b.ReadUint32())
+	}
+	box.Width = b.ReadUint32()
+	box.Height = b.ReadUint32()
+}
+
+func (box *MediaHeaderBox) Unmarshal(b util.Buffer) {
+	box.MP4FullBoxHeader.unmarshal(&b)
+	box.CreationTime = readVersioned(&b, box.Version)
+	box.ModificationTime = readVersioned(&b, box.Version)
+	box.TimeScale = b.ReadUint32()
+	box.Duration = readVersioned(&b, box.Version)
+	copy(box.Language[:], b.ReadN(2))
+	box.Pad = box.Language[0] >> 7
+	box.Language[0] &= 0x7f
+}
+
+func (box *HandlerBox) Unmarshal(b util.Buffer) {
+	box.MP4FullBoxHeader.unmarshal(&b)
+	box.PreDefined = b.ReadUint32()
+	box.HandlerType = b.ReadUint32()
+}
+
+func (box *EditListBox) Unmarshal(b util.Buffer) {
+	box.MP4FullBoxHeader.unmarshal(&b)
+	box.EntryCount = readEntryCount(&b, 12)
+	box.Tables = make([]EditListTable, 0, box.EntryCount)
+	for i := uint32(0); i < box.EntryCount; i++ {
+		var entry EditListTable
+		if box.Version == 1 {
+			entry.SegmentDuration = b.ReadUint64()
+			entry.MediaTime = int64(b.ReadUint64())
+		} else {
+			entry.SegmentDuration = b.ReadUint32()
+			entry.MediaTime = int32(b.ReadUint32())
+		}
+		entry.MediaRateInteger = int16(b.ReadUint16())
+		entry.MediaRateFraction = int16(b.ReadUint16())
+		box.Tables = append(box.Tables, entry)
+	}
+}
+
+func (entry *VisualSampleEntry) Unmarshal(b *util.Buffer) {
+	entry.PreDefined1 = b.ReadUint16()
+	entry.Reserved1 = b.ReadUint16()
+	for i := range entry.PreDefined2 {
+		entry.PreDefined2[i] = b.ReadUint32()
+	}
+	entry.Width = b.ReadUint16()
+	entry.Height = b.ReadUint16()
+	entry.HorizreSolution = b.ReadUint32()
+	entry.VertreSolution = b.ReadUint32()
+	entry.Reserved3 = b.ReadUint32()
+	entry.FrameCount = b.ReadUint16()
+	b.ReadN(32) // compressorname
+	entry.Depth = b.ReadUint16()
+	entry.PreDefined3 = int16(b.ReadUint16())
+}
+
+// Unmarshal 返回 QuickTime SoundDescription 的版本号，ISO 文件中为 0
+func (entry *AudioSampleEntry) Unmarshal(b *util.Buffer) (version uint16) {
+	version = b.ReadUint16()
+	b.ReadN(6)
+	entry.ChannelCount = b.ReadUint16()
+	entry.SampleSize = b.ReadUint16()
+	entry.PreDefined = b.ReadUint16()
+	entry.Reserved2 = b.ReadUint16()
+	entry.SampleRate = b.ReadUint32()
+	return
+}
+
+func (box *TimeToSampleBox) Unmarshal(b util.Buffer) {
+	box.MP4FullBoxHeader.unmarshal(&b)
+	box.EntryCount = readEntryCount(&b, 8)
+	box.Table = make([]TimeToSampleTable, box.EntryCount)
+	for i := range box.Table {
+		box.Table[i].SampleCount = b.ReadUint32()
+		box.Table[i].SampleDelta = b.ReadUint32()
+	}
+}
+
+func (box *CompositionOffsetBox) Unmarshal(b util.Buffer) {
+	box.MP4FullBoxHeader.unmarshal(&b)
+	box.EntryCount = readEntryCount(&b, 8)
+	box.Table = make([]CompositionOffsetTable, box.EntryCount)
+	for i := range box.Table {
+		box.Table[i].SampleCount = b.ReadUint32()
+		// version 0 按规范是无符号数，但是很多文件写入的是负数，这里统一按有符号处理
+		box.Table[i].SampleOffset = int32(b.ReadUint32())
+	}
+}
+
+func (box *SampleToChunkBox) Unmarshal(b util.Buffer) {
+	box.MP4FullBoxHeader.unmarshal(&b)
+	box.EntryCount = readEntryCount(&b, 12)
+	box.Table = make([]SampleToChunkTable, box.EntryCount)
+	for i := range box.Table {
+		box.Table[i].FirstChunk = b.ReadUint32()
+		box.Table[i].SamplesPerChunk = b.ReadUint32()
+		box.Table[i].SampleDescriptionIndex = b.ReadUint32()
+	}
+}
+
+func (box *SampleSizeBox) Unmarshal(b util.Buffer) {
+	box.MP4FullBoxHeader.unmarshal(&b)
+	box.SampleSize = b.ReadUint32()
+	if box.SampleSize != 0 {
+		box.SampleCount = b.ReadUint32()
+	} else {
+		box.SampleCount = readEntryCount(&b, 4)
+		sizes := make([]uint32, box.SampleCount)
+		for i := range sizes {
+			sizes[i] = b.ReadUint32()
+		}
+		box.EntrySize = sizes
+	}
+}
+
+func (box *CompactSampleSizeBox) Unmarshal(b util.Buffer) {
+	box.MP4FullBoxHeader.unmarshal(&b)
+	copy(box.Reserved[:], b.ReadN(3))
+	box.FieldSize = b.ReadByte()
+	box.SampleCount = b.ReadUint32()
+	if uint64(box.SampleCount)*uint64(box.FieldSize) > uint64(b.Len())*8 {
+		panic(fmt.Sprintf("entry count %d too large", box.SampleCount))
+	}
+	sizes := make([]uint32, box.SampleCount)
+	for i := range sizes {
+		switch box.FieldSize {
+		case 4:
+			if i%2 == 0 {
+				sizes[i] = uint32(b[0] >> 4)
+			} else {
+				sizes[i] = uint32(b.ReadByte() & 0x0f)
+			}
+		case 8:
+			sizes[i] = uint32(b.ReadByte())
+		case 16:
+			sizes[i] = uint32(b.ReadUint16())
+		}
+	}
+	box.EntrySize = sizes
+}
+
+func (box *ChunkOffsetBox) Unmarshal(b util.Buffer) {
+	box.MP4FullBoxHeader.unmarshal(&b)
+	box.EntryCount = readEntryCount(&b, 4)
+	box.ChunkOffset = make([]uint32, box.EntryCount)
+	for i := range box.ChunkOffset {
+		box.ChunkOffset[i] = b.ReadUint32()
+	}
+}
+
+func (box *ChunkLargeOffsetBox) Unmarshal(b util.Buffer) {
+	box.MP4FullBoxHeader.unmarshal(&b)
+	box.EntryCount = readEntryCount(&b, 8)
+	box.ChunkOffset = make([]uint64, box.EntryCount)
+	for i := range box.ChunkOffset {
+		box.ChunkOffset[i] = b.ReadUint64()
+	}
+}
+
+func (box *SyncSampleBox) Unmarshal(b util.Buffer) {
+	box.MP4FullBoxHeader.unmarshal(&b)
+	box.EntryCount = readEntryCount(&b, 4)
+	box.SampleNumber = make([]uint32, box.EntryCount)
+	for i := range box.SampleNumber {
+		box.SampleNumber[i] = b.ReadUint32()
+	}
+}
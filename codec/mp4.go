@@ -702,8 +702,8 @@ type TimeToSampleBox struct {
 }
 
 type TimeToSampleTable struct {
-	SampleCount []uint32 // 32 bits, is an integer that counts the number of consecutive samples that have the given duration
-	SampleDelta []uint32 // 32 bits, is an integer that gives the delta of these samples in the time-scale of the media.
+	SampleCount uint32 // 32 bits, is an integer that counts the number of consecutive samples that have the given duration
+	SampleDelta uint32 // 32 bits, is an integer that gives the delta of these samples in the time-scale of the media.
 }
 
 // “stts”存储了sample的duration,描述了sample时序的映射方法,我们通过它可以找到任何时间的sample.
@@ -771,9 +771,9 @@ type SampleToChunkBox struct {
 }
 
 type SampleToChunkTable struct {
-	FirstChunk             []uint32 // 32 bits, is an integer that gives the index of the first chunk in this run of chunks that share the same samples-per-chunk and sample-description-index; the index of the first chunk in a track has the value 1 (the first_chunk field in the first record of this box has the value 1, identifying that the first sample maps to the first chunk).
-	SamplesPerChunk        []uint32 // 32 bits, is an integer that gives the number of samples in each of these chunks
-	SampleDescriptionIndex []uint32 // 32 bits, is an integer that gives the index of the sample entry that describes the samples in this chunk. The index ranges from 1 to the number of sample entries in the Sample Description Box
+	FirstChunk             uint32 // 32 bits, is an integer that gives the index of the first chunk in this run of chunks that share the same samples-per-chunk and sample-description-index; the index of the first chunk in a track has the value 1 (the first_chunk field in the first record of this box has the value 1, identifying that the first sample maps to the first chunk).
+	SamplesPerChunk        uint32 // 32 bits, is an integer that gives the number of samples in each of these chunks
+	SampleDescriptionIndex uint32 // 32 bits, is an integer that gives the index of the sample entry that describes the samples in this chunk. The index ranges from 1 to the number of sample entries in the Sample Description Box
 }
 
 // 用chunk组织sample可以方便优化数据获取,一个thunk包含一个或多个sample.
@@ -0,0 +1,184 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+// buildTestMP4 构造一个包含 H264 和 Opus 两个轨道的 mp4 文件，moov 在 mdat 之后
+func buildTestMP4() (file []byte, videoData, audioData [][]byte) {
+	videoData = [][]byte{{0, 0, 0, 1, 0x65}, {0, 0, 0, 2, 0x41, 1}, {0, 0, 0, 1, 0x41}}
+	audioData = [][]byte{{0xa1}, {0xa2, 0xa2}}
+	var w MP4Writer
+	ftyp := NewFileTypeBox()
+	ftyp.MajorBrand = fourCC("isom")
+	ftyp.Marshal(&w)
+	mdat := w.StartBox("mdat")
+	var videoOffsets []uint32
+	for i, data := range videoData {
+		if i != 1 {
+			videoOffsets = append(videoOffsets, uint32(w.Len()))
+		}
+		w.Write(data)
+	}
+	audioOffset := uint64(w.Len())
+	for _, data := range audioData {
+		w.Write(data)
+	}
+	w.EndBox(mdat)
+	fullBox := func(boxType string, version byte, body func()) {
+		offset := w.StartFullBox(boxType, version, 0)
+		body()
+		w.EndBox(offset)
+	}
+	w.Box("moov", func() {
+		mvhd := MovieHeaderBox{TimeScale: 1000, Matrix: defaultMatrix, NextTrackID: 3}
+		mvhd.Marshal(&w)
+		w.Box("trak", func() {
+			tkhd := TrackHeaderBox{TrackID: 1, Matrix: defaultMatrix}
+			tkhd.Marshal(&w)
+			w.Box("edts", func() {
+				fullBox("elst", 0, func() {
+					w.WriteUint32(1)
+					w.WriteUint32(100)
+					w.WriteUint32(3000) // media_time，跳过第一帧的 cts
+					w.WriteUint32(0x00010000)
+				})
+			})
+			w.Box("mdia", func() {
+				mdhd := MediaHeaderBox{TimeScale: 90000}
+				mdhd.Marshal(&w)
+				hdlr := HandlerBox{HandlerType: fourCC("vide")}
+				hdlr.Marshal(&w)
+				w.Box("minf", func() {
+					w.Box("stbl", func() {
+						fullBox("stsd", 0, func() {
+							w.WriteUint32(1)
+							w.Write(AVCSampleEntry(640, 480, []byte{1, 0x64, 0, 0x1f, 0xff}))
+						})
+						fullBox("stts", 0, func() {
+							w.WriteUint32(1)
+							w.WriteUint32(3)
+							w.WriteUint32(3000)
+						})
+						fullBox("ctts", 0, func() {
+							w.WriteUint32(2)
+							w.WriteUint32(1)
+							w.WriteUint32(3000)
+							w.WriteUint32(2)
+							w.WriteUint32(0)
+						})
+						fullBox("stsc", 0, func() {
+							w.WriteUint32(2)
+							w.Write([]byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 1})
+							w.Write([]byte{0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 1})
+						})
+						fullBox("stsz", 0, func() {
+							w.WriteUint32(0)
+							w.WriteUint32(uint32(len(videoData)))
+							for _, data := range videoData {
+								w.WriteUint32(uint32(len(data)))
+							}
+						})
+						fullBox("stco", 0, func() {
+							w.WriteUint32(uint32(len(videoOffsets)))
+							for _, offset := range videoOffsets {
+								w.WriteUint32(offset)
+							}
+						})
+						fullBox("stss", 0, func() {
+							w.WriteUint32(1)
+							w.WriteUint32(1)
+						})
+					})
+				})
+			})
+		})
+		w.Box("trak", func() {
+			tkhd := TrackHeaderBox{TrackID: 2, Matrix: defaultMatrix}
+			tkhd.Marshal(&w)
+			w.Box("mdia", func() {
+				mdhd := MediaHeaderBox{TimeScale: 48000}
+				mdhd.Marshal(&w)
+				hdlr := HandlerBox{HandlerType: fourCC("soun")}
+				hdlr.Marshal(&w)
+				w.Box("minf", func() {
+					w.Box("stbl", func() {
+						fullBox("stsd", 0, func() {
+							w.WriteUint32(1)
+							w.Write(OpusSampleEntry(1, 312, 48000))
+						})
+						fullBox("stts", 0, func() {
+							w.WriteUint32(1)
+							w.WriteUint32(2)
+							w.WriteUint32(960)
+						})
+						fullBox("stsc", 0, func() {
+							w.WriteUint32(1)
+							w.Write([]byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 1})
+						})
+						fullBox("stz2", 0, func() {
+							w.WriteUint32(8)
+							w.WriteUint32(2)
+							w.Write([]byte{1, 2})
+						})
+						fullBox("co64", 0, func() {
+							w.WriteUint32(1)
+							w.WriteUint64(audioOffset)
+						})
+					})
+				})
+			})
+		})
+	})
+	return w.Buffer, videoData, audioData
+}
+
+func TestMP4Demuxer(t *testing.T) {
+	file, videoData, audioData := buildTestMP4()
+	t.Run(t.Name(), func(t *testing.T) {
+		demuxer := NewMP4Demuxer(bytes.NewReader(file))
+		if err := demuxer.Demux(); err != nil {
+			t.Fatal(err)
+		}
+		if len(demuxer.Tracks) != 2 {
+			t.Fatalf("expect 2 tracks, got %d", len(demuxer.Tracks))
+		}
+		video, audio := demuxer.Tracks[0], demuxer.Tracks[1]
+		if video.VideoCodec != CodecID_H264 || video.Width != 640 || video.Height != 480 {
+			t.Fatalf("video track mismatch: %+v", video)
+		}
+		if audio.AudioCodec != CodecID_OPUS || audio.ChannelCount != 1 || audio.SampleRate != 48000 {
+			t.Fatalf("audio track mismatch: %+v", audio)
+		}
+		// edit list 使第一帧的 PTS 为 0
+		if s := video.Samples[0]; s.PTS != 0 || s.DTS != -3000 || !s.KeyFrame {
+			t.Fatalf("video sample 0 mismatch: %+v", s)
+		}
+		if s := video.Samples[2]; s.PTS != 3000 || s.KeyFrame {
+			t.Fatalf("video sample 2 mismatch: %+v", s)
+		}
+		var gotVideo, gotAudio [][]byte
+		for {
+			track, _, data, err := demuxer.ReadSample()
+			if err != nil {
+				break
+			}
+			if track == video {
+				gotVideo = append(gotVideo, data)
+			} else {
+				gotAudio = append(gotAudio, data)
+			}
+		}
+		for i := range videoData {
+			if i >= len(gotVideo) || !bytes.Equal(gotVideo[i], videoData[i]) {
+				t.Fatalf("video sample %d data mismatch", i)
+			}
+		}
+		for i := range audioData {
+			if i >= len(gotAudio) || !bytes.Equal(gotAudio[i], audioData[i]) {
+				t.Fatalf("audio sample %d data mismatch", i)
+			}
+		}
+	})
+}
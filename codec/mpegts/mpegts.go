@@ -5,9 +5,9 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"sync"
 
 	"m7s.live/engine/v4/util"
-	//"sync"
 )
 
 // NALU AUD 00 00 00 01 09 F0
@@ -106,6 +106,76 @@ type MpegTsStream struct {
 	PMT       MpegTsPMT // PMT表信息
 	PESBuffer map[uint16]*MpegTsPESPacket
 	PESChan   chan *MpegTsPESPacket
+	// 以 PSI 段承载的 PID（例如 SCTE-35），这些 PID 上送出的包只有 Payload
+	sectionPID map[uint16]bool
+	pmtLock    sync.RWMutex // PMT 版本变化时在 Feed 中替换，读取 PES 的协程通过 GetPmtStream、PmtStreams 读取
+}
+
+// GetPmtStream 根据 PID 查找 PMT 中的流信息
+func (s *MpegTsStream) GetPmtStream(pid uint16) *MpegTsPmtStream {
+	s.pmtLock.RLock()
+	defer s.pmtLock.RUnlock()
+	for i := range s.PMT.Stream {
+		if s.PMT.Stream[i].ElementaryPID == pid {
+			return &s.PMT.Stream[i]
+		}
+	}
+	return nil
+}
+
+// PmtStreams 当前 PMT 中的所有流
+func (s *MpegTsStream) PmtStreams() []MpegTsPmtStream {
+	s.pmtLock.RLock()
+	defer s.pmtLock.RUnlock()
+	return s.PMT.Stream
+}
+
+// setPMT 第一次收到 PMT 或者 PMT 版本变化时更新 PID，移除的 PID 上未完成的包被丢弃
+func (s *MpegTsStream) setPMT(pmt MpegTsPMT) {
+	s.pmtLock.Lock()
+	s.PMT = pmt
+	s.pmtLock.Unlock()
+	pids := make(map[uint16]bool)
+	s.sectionPID = make(map[uint16]bool)
+	for _, v := range pmt.Stream {
+		pids[v.ElementaryPID] = true
+		if _, ok := s.PESBuffer[v.ElementaryPID]; !ok {
+			s.PESBuffer[v.ElementaryPID] = nil
+		}
+		if v.IsSection() {
+			s.sectionPID[v.ElementaryPID] = true
+		}
+	}
+	for pid := range s.PESBuffer {
+		if !pids[pid] {
+			delete(s.PESBuffer, pid)
+		}
+	}
+}
+
+// flushSection 段的数据达到 section_length 后立即送出，不等待该 PID 上的下一个段
+func (s *MpegTsStream) flushSection(pid uint16) {
+	for {
+		pesPkt := s.PESBuffer[pid]
+		if pesPkt == nil || len(pesPkt.Payload) < 3 {
+			return
+		}
+		if pesPkt.Payload[0] == 0xff { // 段之后的填充字节
+			s.PESBuffer[pid] = nil
+			return
+		}
+		n := int(util.ReadBE[uint16](pesPkt.Payload[1:3])&0xfff) + 3
+		if len(pesPkt.Payload) < n {
+			return
+		}
+		rest := pesPkt.Payload[n:]
+		pesPkt.Payload = pesPkt.Payload[:n:n]
+		s.PESChan <- pesPkt
+		s.PESBuffer[pid] = nil
+		if len(rest) > 0 { // 同一个包中的下一个段
+			s.PESBuffer[pid] = &MpegTsPESPacket{Pid: pid, Payload: append(util.Buffer(nil), rest...)}
+		}
+	}
 }
 
 // ios13818-1-CN.pdf 33/165
@@ -549,30 +619,45 @@ func (s *MpegTsStream) Feed(ts io.Reader) (err error) {
 			}
 			continue
 		}
-		if len(s.PMT.Stream) == 0 {
-			for _, v := range s.PAT.Program {
-				if v.ProgramMapPID == tsHeader.Pid {
-					if s.PMT, err = ReadPMT(&lr); err != nil {
-						return
-					}
-					for _, v := range s.PMT.Stream {
-						s.PESBuffer[v.ElementaryPID] = nil
-					}
+		isPMT := false
+		for _, v := range s.PAT.Program {
+			isPMT = isPMT || v.ProgramMapPID == tsHeader.Pid
+		}
+		if isPMT {
+			pmt, err := ReadPMT(&lr)
+			if err != nil {
+				if len(s.PMT.Stream) == 0 {
+					return err
 				}
 				continue
 			}
+			if len(s.PMT.Stream) == 0 || pmt.VersionNumber != s.PMT.VersionNumber {
+				s.setPMT(pmt)
+			}
 		} else if pesPkt, ok := s.PESBuffer[tsHeader.Pid]; ok {
 			if tsHeader.PayloadUnitStartIndicator == 1 {
 				if pesPkt != nil {
 					s.PESChan <- pesPkt
 				}
-				pesPkt = &MpegTsPESPacket{}
+				pesPkt = &MpegTsPESPacket{Pid: tsHeader.Pid}
 				s.PESBuffer[tsHeader.Pid] = pesPkt
-				if pesPkt.Header, err = ReadPESHeader(&lr); err != nil {
+				if s.sectionPID[tsHeader.Pid] {
+					// PSI 段以 pointer_field 开头，负载为完整的段
+					var pointerField uint8
+					if pointerField, err = util.ReadByteToUint8(&lr); err != nil {
+						return
+					}
+					io.CopyN(io.Discard, &lr, int64(pointerField))
+				} else if pesPkt.Header, err = ReadPESHeader(&lr); err != nil {
 					return
 				}
+			} else if pesPkt == nil {
+				continue
 			}
 			io.Copy(&pesPkt.Payload, &lr)
+			if s.sectionPID[tsHeader.Pid] {
+				s.flushSection(tsHeader.Pid)
+			}
 		}
 	}
 }
@@ -23,6 +23,7 @@ type MpegTsPesStream struct {
 // 1110 xxxx 为视频流(0xE0)
 // 110x xxxx 为音频流(0xC0)
 type MpegTsPESPacket struct {
+	Pid     uint16 // 所属的 PID
 	Header  MpegTsPESHeader
 	Payload util.Buffer //从TS包中读取的数据
 	Buffers net.Buffers //用于写TS包
@@ -0,0 +1,101 @@
+package mpegts
+
+import (
+	"errors"
+)
+
+// 私有数据、元数据及 SCTE-35 相关定义
+
+const (
+	STREAM_TYPE_METADATA = 0x15                     // PES 承载的元数据，例如 KLV
+	STREAM_TYPE_SCTE35   = 0x86                     // SCTE-35 splice_info_section
+	STREAM_TYPE_OPUS     = STREAM_TYPE_PRIVATE_DATA // Opus 使用私有数据流，通过 registration descriptor 标识
+
+	STREAM_ID_PRIVATE_1 = 0xBD
+	STREAM_ID_METADATA  = 0xFC
+
+	DESCRIPTOR_TAG_REGISTRATION = 0x05
+	DESCRIPTOR_TAG_SUBTITLING   = 0x59 // DVB 字幕
+	DESCRIPTOR_TAG_EXTENSION    = 0x7F
+)
+
+var ErrOpusControlHeader = errors.New("opus control header error")
+
+// Registration 返回 registration descriptor 中的 format_identifier，例如 Opus、KLVA、CUEI
+func (s *MpegTsPmtStream) Registration() string {
+	for _, desc := range s.Descriptor {
+		if desc.Tag == DESCRIPTOR_TAG_REGISTRATION && len(desc.Data) >= 4 {
+			return string(desc.Data[:4])
+		}
+	}
+	return ""
+}
+
+// HasDescriptor 是否含有指定 tag 的描述符
+func (s *MpegTsPmtStream) HasDescriptor(tag byte) bool {
+	for _, desc := range s.Descriptor {
+		if desc.Tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSection 该流是否以 PSI 段的形式承载，而不是 PES
+func (s *MpegTsPmtStream) IsSection() bool {
+	return s.StreamType == STREAM_TYPE_SCTE35 || s.StreamType == STREAM_TYPE_PRIVATE_SECTIONS
+}
+
+// OpusDescriptors PMT 中 Opus 流的描述符（registration + extension descriptor）
+func OpusDescriptors(channels byte) []MpegTsDescriptor {
+	return []MpegTsDescriptor{
+		{Tag: DESCRIPTOR_TAG_REGISTRATION, Data: []byte("Opus")},
+		{Tag: DESCRIPTOR_TAG_EXTENSION, Data: []byte{0x80, channels}},
+	}
+}
+
+// OpusControlHeader 每个 Opus 访问单元前的控制头
+func OpusControlHeader(size int) []byte {
+	header := []byte{0x7f, 0xe0}
+	for ; size >= 0xff; size -= 0xff {
+		header = append(header, 0xff)
+	}
+	return append(header, byte(size))
+}
+
+// SplitOpusAccessUnits 按控制头拆分 PES 负载中的 Opus 访问单元
+func SplitOpusAccessUnits(payload []byte) (aus [][]byte, err error) {
+	for len(payload) > 0 {
+		if len(payload) < 3 || payload[0] != 0x7f || payload[1]&0xe0 != 0xe0 {
+			return aus, ErrOpusControlHeader
+		}
+		flags := payload[1]
+		payload = payload[2:]
+		size := 0
+		for len(payload) > 0 {
+			b := payload[0]
+			payload = payload[1:]
+			size += int(b)
+			if b != 0xff {
+				break
+			}
+		}
+		skip := 0
+		// start_trim、end_trim 各 2 字节
+		if flags&0x10 != 0 {
+			skip += 2
+		}
+		if flags&0x08 != 0 {
+			skip += 2
+		}
+		if flags&0x04 != 0 && len(payload) > skip {
+			skip += 1 + int(payload[skip])
+		}
+		if skip+size > len(payload) {
+			return aus, ErrOpusControlHeader
+		}
+		aus = append(aus, payload[skip:skip+size])
+		payload = payload[skip+size:]
+	}
+	return
+}
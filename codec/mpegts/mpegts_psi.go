@@ -1,6 +1,7 @@
 package mpegts
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -155,7 +156,7 @@ func WritePSI(w io.Writer, pt uint32, psi MpegTsPSI, data []byte) (err error) {
 			tableId = psi.Pat.TableID
 			sectionSyntaxIndicatorAndSectionLength = uint16(psi.Pat.SectionSyntaxIndicator)<<15 | 3<<12 | psi.Pat.SectionLength
 			transportStreamIdOrProgramNumber = psi.Pat.TransportStreamID
-			versionNumberAndCurrentNextIndicator = psi.Pat.VersionNumber<<1 | psi.Pat.CurrentNextIndicator
+			versionNumberAndCurrentNextIndicator = 3<<6 | psi.Pat.VersionNumber<<1 | psi.Pat.CurrentNextIndicator
 			sectionNumber = psi.Pat.SectionNumber
 			lastSectionNumber = psi.Pat.LastSectionNumber
 		}
@@ -169,7 +170,7 @@ func WritePSI(w io.Writer, pt uint32, psi MpegTsPSI, data []byte) (err error) {
 			tableId = psi.Pmt.TableID
 			sectionSyntaxIndicatorAndSectionLength = uint16(psi.Pmt.SectionSyntaxIndicator)<<15 | 3<<12 | psi.Pmt.SectionLength
 			transportStreamIdOrProgramNumber = psi.Pmt.ProgramNumber
-			versionNumberAndCurrentNextIndicator = psi.Pmt.VersionNumber<<1 | psi.Pmt.CurrentNextIndicator
+			versionNumberAndCurrentNextIndicator = 3<<6 | psi.Pmt.VersionNumber<<1 | psi.Pmt.CurrentNextIndicator
 			sectionNumber = psi.Pmt.SectionNumber
 			lastSectionNumber = psi.Pmt.LastSectionNumber
 		}
@@ -180,7 +181,8 @@ func WritePSI(w io.Writer, pt uint32, psi MpegTsPSI, data []byte) (err error) {
 		return
 	}
 
-	cw := &util.Crc32Writer{W: w, Crc32: 0xffffffff}
+	// util.Crc32Writer 是 zlib 的 CRC32，PSI 需要使用 MPEG-2 的 CRC32，先写入缓冲再计算
+	cw := &bytes.Buffer{}
 
 	// table id(8)
 	if err = util.WriteUint8ToByte(cw, tableId); err != nil {
@@ -222,10 +224,11 @@ func WritePSI(w io.Writer, pt uint32, psi MpegTsPSI, data []byte) (err error) {
 	}
 
 	// crc32
-	crc32 := util.BigLittleSwap(uint(cw.Crc32))
-	if err = util.WriteUint32ToByte(cw, uint32(crc32), true); err != nil {
+	if err = util.WriteUint32ToByte(cw, GetCRC32(cw.Bytes()), true); err != nil {
 		return
 	}
 
+	_, err = cw.WriteTo(w)
+
 	return
 }
@@ -0,0 +1,71 @@
+package mpegts
+
+import (
+	"bytes"
+	"testing"
+
+	"m7s.live/engine/v4/codec"
+)
+
+// TestWritePSI 写出的 PAT、PMT 应与预先计算好的包一致：保留位为 1，CRC 为 MPEG-2 的 CRC32
+func TestWritePSI(t *testing.T) {
+	t.Run("PAT", func(t *testing.T) {
+		var out bytes.Buffer
+		pat := MpegTsPAT{
+			TableID:                TABLE_PAS,
+			SectionSyntaxIndicator: 1,
+			TransportStreamID:      1,
+			CurrentNextIndicator:   1,
+			Program:                []MpegTsPATProgram{{ProgramNumber: 1, ProgramMapPID: PID_PMT}},
+		}
+		if err := WritePAT(&out, pat); err != nil {
+			t.Fatal(err)
+		}
+		if want := DefaultPATPacket[4 : 4+out.Len()]; !bytes.Equal(out.Bytes(), want) {
+			t.Fatalf("pat mismatch:\n% x\n% x", out.Bytes(), want)
+		}
+	})
+	t.Run("PMT", func(t *testing.T) {
+		var out, want bytes.Buffer
+		pmt := MpegTsPMT{
+			TableID:                TABLE_TSPMS,
+			SectionSyntaxIndicator: 1,
+			ProgramNumber:          1,
+			CurrentNextIndicator:   1,
+			PcrPID:                 PID_VIDEO,
+			Stream: []MpegTsPmtStream{
+				{StreamType: STREAM_TYPE_H264, ElementaryPID: PID_VIDEO},
+				{StreamType: STREAM_TYPE_AAC, ElementaryPID: PID_AUDIO},
+			},
+		}
+		if err := WritePMT(&out, pmt); err != nil {
+			t.Fatal(err)
+		}
+		WritePMTPacket(&want, codec.CodecID_H264, codec.CodecID_AAC)
+		if w := want.Bytes()[4 : 4+out.Len()]; !bytes.Equal(out.Bytes(), w) {
+			t.Fatalf("pmt mismatch:\n% x\n% x", out.Bytes(), w)
+		}
+	})
+	t.Run("Version", func(t *testing.T) {
+		var out bytes.Buffer
+		pmt := MpegTsPMT{
+			TableID:                TABLE_TSPMS,
+			SectionSyntaxIndicator: 1,
+			ProgramNumber:          1,
+			VersionNumber:          5,
+			CurrentNextIndicator:   1,
+			PcrPID:                 PID_VIDEO,
+		}
+		if err := WritePMT(&out, pmt); err != nil {
+			t.Fatal(err)
+		}
+		section := out.Bytes()[1:] // 跳过 pointer field
+		if section[5] != 0xc0|5<<1|1 {
+			t.Fatalf("version byte %08b", section[5])
+		}
+		// 包含 CRC 在内的整个段的 CRC32 为 0
+		if crc := GetCRC32(section); crc != 0 {
+			t.Fatalf("crc %08x", crc)
+		}
+	})
+}
@@ -0,0 +1,347 @@
+package mpegts
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+
+	"m7s.live/engine/v4/util"
+)
+
+const (
+	PID_NULL = 0x1FFF // 空包
+
+	PCR_CLOCK = 27000000 // PCR 时钟频率
+	PCR_DELAY = 63000    // PCR 比 DTS 早 700ms(90kHz)，给解码器留出缓冲时间
+)
+
+var (
+	ErrTsTooManyStreams  = errors.New("too many streams in program")
+	ErrTsSectionTooLarge = errors.New("psi section larger than one ts packet")
+)
+
+// TsStream 节目中的一个基本流
+type TsStream struct {
+	Pid        uint16
+	StreamType byte
+	StreamID   byte
+	Descriptor []MpegTsDescriptor
+	cc         byte
+	program    *TsProgram
+}
+
+// TsProgram 一个节目，对应 PAT 中的一项及一个 PMT
+type TsProgram struct {
+	Number  uint16
+	PmtPid  uint16
+	Streams []*TsStream
+	pcr     *TsStream // 携带 PCR 的流，优先选择视频
+	muxer   *TsMuxer
+	version byte // PMT 版本，输出之后添加流时加一
+	cc      byte
+	lastPCR uint64 // 90kHz
+	hasPCR  bool
+}
+
+// AddStream 添加基本流，PID 从 PmtPid+1 开始依次分配
+func (p *TsProgram) AddStream(streamType byte, streamID byte, descriptor ...MpegTsDescriptor) (*TsStream, error) {
+	return p.addStream(streamType, streamID, true, descriptor)
+}
+
+// AddDataStream 添加不携带 PCR 的数据流，节目中只有数据流时 PCR_PID 为 0x1FFF
+func (p *TsProgram) AddDataStream(streamType byte, streamID byte, descriptor ...MpegTsDescriptor) (*TsStream, error) {
+	return p.addStream(streamType, streamID, false, descriptor)
+}
+
+func (p *TsProgram) addStream(streamType byte, streamID byte, pcr bool, descriptor []MpegTsDescriptor) (*TsStream, error) {
+	if len(p.Streams) >= 0x0f {
+		return nil, ErrTsTooManyStreams
+	}
+	s := &TsStream{
+		Pid:        p.PmtPid + 1 + uint16(len(p.Streams)),
+		StreamType: streamType,
+		StreamID:   streamID,
+		Descriptor: descriptor,
+		program:    p,
+	}
+	p.Streams = append(p.Streams, s)
+	if pcr && (p.pcr == nil || (streamID == STREAM_ID_VIDEO && p.pcr.StreamID != STREAM_ID_VIDEO)) {
+		p.pcr = s
+	}
+	if m := p.muxer; m != nil && m.psiSent {
+		p.version = (p.version + 1) & 0x1f
+		m.psiSent = false // 下一个包之前输出新的 PMT
+	}
+	return s, nil
+}
+
+func (p *TsProgram) PcrPid() uint16 {
+	if p.pcr == nil {
+		return PID_NULL
+	}
+	return p.pcr.Pid
+}
+
+// TsMuxer 多节目 TS 复用器，输出 188 字节的 TS 包
+type TsMuxer struct {
+	PCRInterval       uint64 // PCR 最大间隔，90kHz
+	PSIInterval       uint64 // PAT/PMT 重复间隔，90kHz
+	BitRate           uint64 // 恒定码率(bps)，大于 0 时用空包填充
+	TransportStreamID uint16
+	Programs          []*TsProgram
+	version           byte // PAT 版本，输出之后添加节目时加一
+	patCC             byte
+	nullCC            byte
+	lastPSI           uint64
+	psiSent           bool
+	started           bool
+	startClock        uint64 // 第一帧的 DTS，90kHz
+	packets           uint64 // 已输出的包数，用于恒定码率时计算 PCR
+}
+
+// AddProgram 添加节目，节目号从 1 开始，PMT 的 PID 为 0x100、0x110……
+func (m *TsMuxer) AddProgram() *TsProgram {
+	n := uint16(len(m.Programs))
+	p := &TsProgram{Number: n + 1, PmtPid: PID_PMT + n<<4, muxer: m}
+	m.Programs = append(m.Programs, p)
+	if m.psiSent {
+		m.version = (m.version + 1) & 0x1f
+		m.psiSent = false // 下一个包之前输出新的 PAT
+	}
+	return p
+}
+
+// clock 当前的系统时钟（27MHz），恒定码率时由已输出的包数推算，保证 PCR 连续
+func (m *TsMuxer) clock(dts uint64) uint64 {
+	if m.BitRate == 0 {
+		return dts * 300
+	}
+	return m.startClock*300 + m.packets*TS_PACKET_SIZE*8*PCR_CLOCK/m.BitRate
+}
+
+// WritePSI 写入 PAT 以及所有节目的 PMT
+func (m *TsMuxer) WritePSI(w io.Writer) (err error) {
+	pat := MpegTsPAT{
+		TableID:                TABLE_PAS,
+		SectionSyntaxIndicator: 1,
+		TransportStreamID:      m.TransportStreamID,
+		VersionNumber:          m.version,
+		CurrentNextIndicator:   1,
+	}
+	for _, p := range m.Programs {
+		pat.Program = append(pat.Program, MpegTsPATProgram{ProgramNumber: p.Number, ProgramMapPID: p.PmtPid})
+	}
+	var section bytes.Buffer
+	if err = WritePAT(&section, pat); err != nil {
+		return
+	}
+	if err = m.writeSection(w, PID_PAT, &m.patCC, section.Bytes()); err != nil {
+		return
+	}
+	for _, p := range m.Programs {
+		pmt := MpegTsPMT{
+			TableID:                TABLE_TSPMS,
+			SectionSyntaxIndicator: 1,
+			ProgramNumber:          p.Number,
+			VersionNumber:          p.version,
+			CurrentNextIndicator:   1,
+			PcrPID:                 p.PcrPid(),
+		}
+		for _, s := range p.Streams {
+			pmt.Stream = append(pmt.Stream, MpegTsPmtStream{StreamType: s.StreamType, ElementaryPID: s.Pid, Descriptor: s.Descriptor})
+		}
+		section.Reset()
+		if err = WritePMT(&section, pmt); err != nil {
+			return
+		}
+		if err = m.writeSection(w, p.PmtPid, &p.cc, section.Bytes()); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// writeSection 将 PSI 段（含 pointer field）写入一个 TS 包，剩余部分填充 0xff
+func (m *TsMuxer) writeSection(w io.Writer, pid uint16, cc *byte, section []byte) (err error) {
+	if len(section) > TS_PACKET_SIZE-4 {
+		return ErrTsSectionTooLarge
+	}
+	var pkt [TS_PACKET_SIZE]byte
+	pkt[0] = 0x47
+	pkt[1] = 0x40 | byte(pid>>8)&0x1f
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 | *cc
+	*cc = (*cc + 1) & 0x0f
+	copy(pkt[4+copy(pkt[4:], section):], Stuffing)
+	return m.write(w, pkt[:])
+}
+
+// WriteSection 将 SCTE-35 等以 PSI 段承载的数据写入 s 的 PID，section 不含 pointer field
+func (m *TsMuxer) WriteSection(w io.Writer, s *TsStream, section []byte) (err error) {
+	// 新添加的节目的 PMT 需要先于数据输出
+	if !m.psiSent {
+		if err = m.WritePSI(w); err != nil {
+			return
+		}
+		m.psiSent = true
+	}
+	return m.writeSection(w, s.Pid, &s.cc, append([]byte{0}, section...))
+}
+
+func (m *TsMuxer) write(w io.Writer, pkt []byte) (err error) {
+	_, err = w.Write(pkt)
+	m.packets++
+	return
+}
+
+// pad 恒定码率时在写入 dts 对应的数据之前用空包补齐码率，空包期间按需插入只含 PCR 的包
+func (m *TsMuxer) pad(w io.Writer, dts uint64) (err error) {
+	if m.BitRate == 0 || dts <= m.startClock {
+		return
+	}
+	target := (dts - m.startClock) * m.BitRate / 90000 / (TS_PACKET_SIZE * 8)
+	for m.packets < target {
+		clock := m.clock(dts)
+		pcrWritten := false
+		for _, p := range m.Programs {
+			if p.pcr != nil && p.hasPCR && clock/300 >= p.lastPCR+m.PCRInterval {
+				if err = m.writePCR(w, p, clock); err != nil {
+					return
+				}
+				pcrWritten = true
+				break
+			}
+		}
+		if !pcrWritten {
+			var pkt [TS_PACKET_SIZE]byte
+			pkt[0] = 0x47
+			pkt[1] = byte(PID_NULL >> 8)
+			pkt[2] = byte(PID_NULL & 0xff)
+			pkt[3] = 0x10 | m.nullCC
+			m.nullCC = (m.nullCC + 1) & 0x0f
+			copy(pkt[4:], Stuffing)
+			if err = m.write(w, pkt[:]); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// writePCR 写入只有调整字段的包，用于在没有数据时保持 PCR 连续，这种包不增加连续计数器
+func (m *TsMuxer) writePCR(w io.Writer, p *TsProgram, clock uint64) error {
+	var pkt [TS_PACKET_SIZE]byte
+	pkt[0] = 0x47
+	pkt[1] = byte(p.pcr.Pid>>8) & 0x1f
+	pkt[2] = byte(p.pcr.Pid)
+	pkt[3] = 0x20 | (p.pcr.cc-1)&0x0f
+	pkt[4] = TS_PACKET_SIZE - 5
+	pkt[5] = 0x10
+	putPCR(pkt[6:12], clock)
+	copy(pkt[12:], Stuffing)
+	p.lastPCR, p.hasPCR = clock/300, true
+	return m.write(w, pkt[:])
+}
+
+func putPCR(b []byte, clock uint64) {
+	base, ext := (clock/300)&0x1ffffffff, clock%300
+	b[0] = byte(base >> 25)
+	b[1] = byte(base >> 17)
+	b[2] = byte(base >> 9)
+	b[3] = byte(base >> 1)
+	b[4] = byte(base<<7) | 0x7e | byte(ext>>8)
+	b[5] = byte(ext)
+}
+
+// WritePES 将一帧数据封装为 PES 并切分为 TS 包写入 w，pts、dts 为 90kHz，写入时加上 PCR_DELAY
+func (m *TsMuxer) WritePES(w io.Writer, s *TsStream, pts, dts uint64, keyFrame bool, payload net.Buffers) (err error) {
+	if !m.started {
+		m.started = true
+		m.startClock = dts
+	}
+	if err = m.pad(w, dts); err != nil {
+		return
+	}
+	// 关键帧前总是重复 PSI，从关键帧处切分的文件可以独立播放
+	if !m.psiSent || keyFrame || dts < m.lastPSI || dts-m.lastPSI >= m.PSIInterval {
+		if err = m.WritePSI(w); err != nil {
+			return
+		}
+		m.psiSent, m.lastPSI = true, dts
+	}
+	p := s.program
+	withPCR := false
+	if s == p.pcr {
+		clock := m.clock(dts)
+		if !p.hasPCR || keyFrame || clock/300 < p.lastPCR || clock/300-p.lastPCR >= m.PCRInterval {
+			withPCR = true
+			p.lastPCR, p.hasPCR = clock/300, true
+		}
+	}
+	var header MpegTsPESHeader
+	header.PacketStartCodePrefix = 0x000001
+	header.ConstTen = 0x80
+	header.StreamID = s.StreamID
+	// PCR 由帧的 dts 得出，时间戳整体后移 PCR_DELAY，保证数据在解码时间之前到达
+	header.Pts, header.Dts = pts+PCR_DELAY, dts+PCR_DELAY
+	if pts != dts {
+		header.PtsDtsFlags, header.PesHeaderDataLength = 0xC0, 10
+	} else {
+		header.PtsDtsFlags, header.PesHeaderDataLength = 0x80, 5
+	}
+	if pesLength := 3 + int(header.PesHeaderDataLength) + util.SizeOfBuffers(payload); pesLength <= 0xffff {
+		header.PesPacketLength = uint16(pesLength)
+	}
+	var pesHeader util.Buffer
+	if _, err = WritePESHeader(&pesHeader, header); err != nil {
+		return
+	}
+	buffers := append(net.Buffers{pesHeader}, payload...)
+	for remain, start := util.SizeOfBuffers(buffers), true; remain > 0; start = false {
+		var pkt [TS_PACKET_SIZE]byte
+		afMin := 0
+		if start && (withPCR || keyFrame) {
+			afMin = 2
+			if withPCR {
+				afMin += 6
+			}
+		}
+		payloadLen := TS_PACKET_SIZE - 4 - afMin
+		if remain < payloadLen {
+			payloadLen = remain
+		}
+		afTotal := TS_PACKET_SIZE - 4 - payloadLen // 包含 adaptation_field_length 本身
+		pkt[0] = 0x47
+		pkt[1] = byte(s.Pid>>8) & 0x1f
+		if start {
+			pkt[1] |= 0x40
+		}
+		pkt[2] = byte(s.Pid)
+		pkt[3] = 0x10 | s.cc
+		s.cc = (s.cc + 1) & 0x0f
+		if afTotal > 0 {
+			pkt[3] |= 0x20
+			pkt[4] = byte(afTotal - 1)
+			if afTotal > 1 {
+				n := 6
+				if start && keyFrame {
+					pkt[5] |= 0x40 // random_access_indicator
+				}
+				if start && withPCR {
+					pkt[5] |= 0x10
+					// 恒定码率时 PCR 按包的位置计算
+					putPCR(pkt[6:12], m.clock(dts))
+					n = 12
+				}
+				copy(pkt[n:4+afTotal], Stuffing)
+			}
+		}
+		buffers.Read(pkt[4+afTotal:])
+		remain -= payloadLen
+		if err = m.write(w, pkt[:]); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,215 @@
+package mpegts
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTsMuxer(t *testing.T) {
+	t.Run(t.Name(), func(t *testing.T) {
+		var m TsMuxer
+		m.PCRInterval = 3600
+		m.PSIInterval = 9000
+		m.TransportStreamID = 1
+		video, _ := m.AddProgram().AddStream(STREAM_TYPE_H264, STREAM_ID_VIDEO)
+		audio, _ := m.AddProgram().AddStream(STREAM_TYPE_AAC, STREAM_ID_AUDIO)
+		var out bytes.Buffer
+		if err := m.WritePSI(&out); err != nil {
+			t.Fatal(err)
+		}
+		// 单节目时 PAT 应与默认的 PAT 一致
+		var single TsMuxer
+		single.TransportStreamID = 1
+		single.AddProgram()
+		var pat bytes.Buffer
+		single.WritePSI(&pat)
+		if !bytes.Equal(pat.Bytes()[:TS_PACKET_SIZE], DefaultPATPacket) {
+			t.Fatalf("pat mismatch: % x", pat.Bytes()[:24])
+		}
+		out.Reset()
+		frame := bytes.Repeat([]byte{1}, 1000)
+		for i := uint64(0); i < 10; i++ {
+			if err := m.WritePES(&out, video, i*3000+3000, i*3000, i == 0, net.Buffers{frame}); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.WritePES(&out, audio, i*3000, i*3000, false, net.Buffers{frame[:100]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if out.Len()%TS_PACKET_SIZE != 0 {
+			t.Fatalf("output length %d", out.Len())
+		}
+		cc := map[uint16]byte{}
+		pcrs := map[uint16]int{}
+		for b := out.Bytes(); len(b) > 0; b = b[TS_PACKET_SIZE:] {
+			if b[0] != 0x47 {
+				t.Fatal("sync byte error")
+			}
+			pid := uint16(b[1]&0x1f)<<8 | uint16(b[2])
+			if b[3]&0x10 != 0 {
+				if last, ok := cc[pid]; ok && b[3]&0x0f != (last+1)&0x0f {
+					t.Fatalf("pid %x continuity counter %d after %d", pid, b[3]&0x0f, last)
+				}
+				cc[pid] = b[3] & 0x0f
+			}
+			if b[3]&0x20 != 0 && b[4] > 0 && b[5]&0x10 != 0 {
+				pcrs[pid]++
+				// PCR 与同一个包中 PES 的 DTS 相差 PCR_DELAY
+				pcr := uint64(b[6])<<25 | uint64(b[7])<<17 | uint64(b[8])<<9 | uint64(b[9])<<1 | uint64(b[10])>>7
+				if pes := b[5+b[4]:]; b[1]&0x40 != 0 {
+					ts := pes[9:14]
+					if pes[7]&0x40 != 0 {
+						ts = pes[14:19]
+					}
+					dts := uint64(ts[0]>>1&7)<<30 | uint64(ts[1])<<22 | uint64(ts[2]>>1)<<15 | uint64(ts[3])<<7 | uint64(ts[4]>>1)
+					if dts != pcr+PCR_DELAY {
+						t.Fatalf("pid %x pcr %d dts %d", pid, pcr, dts)
+					}
+				}
+			}
+		}
+		// 每个节目都有自己的 PCR，间隔 40ms 时 10 帧 100ms 的视频至少有 3 个 PCR
+		if pcrs[video.Pid] < 3 || pcrs[audio.Pid] < 3 {
+			t.Fatalf("pcr count %v", pcrs)
+		}
+		if _, ok := cc[0x110]; !ok {
+			t.Fatal("second pmt not found")
+		}
+	})
+	t.Run("CBR", func(t *testing.T) {
+		var m TsMuxer
+		m.PCRInterval = 3600
+		m.PSIInterval = 9000
+		m.BitRate = 1000000
+		video, _ := m.AddProgram().AddStream(STREAM_TYPE_H264, STREAM_ID_VIDEO)
+		var out bytes.Buffer
+		m.WritePES(&out, video, 0, 0, true, net.Buffers{[]byte{1}})
+		m.WritePES(&out, video, 90000, 90000, false, net.Buffers{[]byte{1}})
+		// 1 秒 1Mbps 约 664 个包
+		if n := out.Len() / TS_PACKET_SIZE; n < 664 || n > 668 {
+			t.Fatalf("packet count %d", n)
+		}
+	})
+	t.Run("Demux", func(t *testing.T) {
+		var m TsMuxer
+		m.PCRInterval = 3600
+		m.PSIInterval = 9000
+		program := m.AddProgram()
+		video, _ := program.AddStream(STREAM_TYPE_H265, STREAM_ID_VIDEO)
+		opus, _ := program.AddStream(STREAM_TYPE_OPUS, STREAM_ID_PRIVATE_1, OpusDescriptors(2)...)
+		var out bytes.Buffer
+		au := []byte{0xfc, 1, 2, 3}
+		m.WritePES(&out, video, 3000, 0, true, net.Buffers{bytes.Repeat([]byte{1}, 500)})
+		m.WritePES(&out, opus, 0, 0, false, net.Buffers{OpusControlHeader(len(au)), au, OpusControlHeader(len(au)), au})
+		var s MpegTsStream
+		s.PESChan = make(chan *MpegTsPESPacket, 10)
+		s.PESBuffer = make(map[uint16]*MpegTsPESPacket)
+		if err := s.Feed(&out); err != nil {
+			t.Fatal(err)
+		}
+		close(s.PESChan)
+		got := map[uint16]*MpegTsPESPacket{}
+		for pes := range s.PESChan {
+			got[pes.Pid] = pes
+		}
+		if pes := got[video.Pid]; pes == nil || pes.Header.Pts != 3000+PCR_DELAY || len(pes.Payload) != 500 {
+			t.Fatalf("video pes mismatch: %+v", pes)
+		}
+		if s := s.GetPmtStream(opus.Pid); s == nil || s.Registration() != "Opus" {
+			t.Fatal("opus registration descriptor not found")
+		}
+		if aus, err := SplitOpusAccessUnits(got[opus.Pid].Payload); err != nil || len(aus) != 2 || !bytes.Equal(aus[1], au) {
+			t.Fatalf("opus access units mismatch: %v %v", aus, err)
+		}
+	})
+	t.Run("Section", func(t *testing.T) {
+		var m TsMuxer
+		program := m.AddProgram()
+		video, _ := program.AddStream(STREAM_TYPE_H264, STREAM_ID_VIDEO)
+		scte35, _ := program.AddStream(STREAM_TYPE_SCTE35, 0)
+		writePMT := func(w io.Writer, version byte, streams ...*TsStream) {
+			pmt := MpegTsPMT{TableID: TABLE_TSPMS, SectionSyntaxIndicator: 1, ProgramNumber: program.Number, VersionNumber: version, CurrentNextIndicator: 1, PcrPID: video.Pid}
+			for _, s := range streams {
+				pmt.Stream = append(pmt.Stream, MpegTsPmtStream{StreamType: s.StreamType, ElementaryPID: s.Pid})
+			}
+			var section bytes.Buffer
+			WritePMT(&section, pmt)
+			m.writeSection(w, program.PmtPid, &program.cc, section.Bytes())
+		}
+		section := []byte{0xFC, 0x30, 0x05, 1, 2, 3, 4, 5}
+		writeSCTE35 := func(w io.Writer) {
+			// pointer_field + 段，段之后的同一个包中还有一个段
+			m.writeSection(w, scte35.Pid, &scte35.cc, append(append([]byte{0}, section...), section...))
+		}
+		r, w := io.Pipe()
+		var s MpegTsStream
+		s.PESChan = make(chan *MpegTsPESPacket, 10)
+		s.PESBuffer = make(map[uint16]*MpegTsPESPacket)
+		go s.Feed(r)
+		receive := func() *MpegTsPESPacket {
+			select {
+			case pes := <-s.PESChan:
+				return pes
+			case <-time.After(time.Second):
+				return nil
+			}
+		}
+		m.WritePSI(w)
+		writePMT(w, 1, video)
+		writeSCTE35(w)
+		// PMT 版本变化后新增 SCTE-35，段完整后立即送出，不等待下一个段
+		writePMT(w, 2, video, scte35)
+		writeSCTE35(w)
+		for i := 0; i < 2; i++ {
+			if pes := receive(); pes == nil || pes.Pid != scte35.Pid || !bytes.Equal(pes.Payload, section) {
+				t.Fatalf("section %d not received: %+v", i, pes)
+			}
+		}
+		// PMT 版本变化后移除 SCTE-35
+		writePMT(w, 3, video)
+		writeSCTE35(w)
+		w.Close()
+		if pes := receive(); pes != nil {
+			t.Fatalf("removed pid received: %+v", pes)
+		}
+		if s.GetPmtStream(scte35.Pid) != nil {
+			t.Fatal("pmt not updated")
+		}
+	})
+	t.Run("AddProgram", func(t *testing.T) {
+		var m TsMuxer
+		video, _ := m.AddProgram().AddStream(STREAM_TYPE_H264, STREAM_ID_VIDEO)
+		var out bytes.Buffer
+		m.WritePES(&out, video, 0, 0, true, net.Buffers{[]byte{1}})
+		// 输出之后添加只有数据流的节目，PAT 的版本加一，数据之前先输出新的 PAT 和 PMT
+		data, _ := m.AddProgram().AddDataStream(STREAM_TYPE_SCTE35, 0)
+		out.Reset()
+		if err := m.WriteSection(&out, data, []byte{0xFC, 0x30, 0x05, 1, 2, 3, 4, 5}); err != nil {
+			t.Fatal(err)
+		}
+		pkt := append([]byte(nil), out.Bytes()...)
+		if len(pkt) != TS_PACKET_SIZE*4 {
+			t.Fatalf("%d bytes written", len(pkt))
+		}
+		var s MpegTsStream
+		s.PESChan = make(chan *MpegTsPESPacket, 10)
+		s.PESBuffer = make(map[uint16]*MpegTsPESPacket)
+		if err := s.Feed(&out); err != nil {
+			t.Fatal(err)
+		}
+		if len(s.PAT.Program) != 2 || s.PAT.VersionNumber>>1 != 1 {
+			t.Fatalf("pat %+v", s.PAT)
+		}
+		// 第二个 PMT 是新增的节目，没有 PCR
+		pmt, err := ReadPMT(bytes.NewReader(pkt[TS_PACKET_SIZE*2+4 : TS_PACKET_SIZE*3]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pmt.Stream) != 1 || pmt.Stream[0].ElementaryPID != data.Pid || pmt.PcrPID != PID_NULL {
+			t.Fatalf("data program pmt %+v", pmt)
+		}
+	})
+}
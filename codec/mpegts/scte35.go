@@ -0,0 +1,121 @@
+package mpegts
+
+import (
+	"errors"
+
+	"m7s.live/engine/v4/util"
+)
+
+// SCTE-35 splice_command_type
+const (
+	SCTE35_SPLICE_NULL     = 0x00
+	SCTE35_SPLICE_SCHEDULE = 0x04
+	SCTE35_SPLICE_INSERT   = 0x05
+	SCTE35_TIME_SIGNAL     = 0x06
+	SCTE35_BANDWIDTH       = 0x07
+	SCTE35_PRIVATE_COMMAND = 0xFF
+
+	SCTE35_TABLE_ID = 0xFC
+)
+
+var ErrSCTE35 = errors.New("invalid scte35 splice_info_section")
+
+// SpliceInfo splice_info_section 中常用的字段，时间均为 90kHz
+type SpliceInfo struct {
+	CommandType  byte
+	EventID      uint32
+	Cancel       bool
+	OutOfNetwork bool
+	Immediate    bool
+	HasPTS       bool
+	PTS          uint64 // 已加上 pts_adjustment
+	Duration     uint64 // break_duration，0 表示未指定
+	AutoReturn   bool
+}
+
+// ParseSpliceInfo 解析 SCTE-35 splice_info_section，只解析 splice_insert 和 time_signal 的时间信息
+func ParseSpliceInfo(data []byte) (info SpliceInfo, err error) {
+	if len(data) < 14 || data[0] != SCTE35_TABLE_ID {
+		return info, ErrSCTE35
+	}
+	if data[4]&0x80 != 0 {
+		// 加密的命令无法解析
+		return info, ErrSCTE35
+	}
+	ptsAdjustment := uint64(data[4]&1)<<32 | uint64(util.ReadBE[uint32](data[5:9]))
+	commandLength := int(util.ReadBE[uint16](data[11:13]) & 0xfff)
+	info.CommandType = data[13]
+	command := data[14:]
+	if commandLength != 0xfff && commandLength <= len(command) {
+		command = command[:commandLength]
+	}
+	readSpliceTime := func() bool {
+		if len(command) < 1 {
+			return false
+		}
+		if command[0]&0x80 == 0 {
+			command = command[1:]
+			return true
+		}
+		if len(command) < 5 {
+			return false
+		}
+		info.HasPTS = true
+		info.PTS = (uint64(command[0]&1)<<32 | uint64(util.ReadBE[uint32](command[1:5])) + ptsAdjustment) & 0x1ffffffff
+		command = command[5:]
+		return true
+	}
+	switch info.CommandType {
+	case SCTE35_SPLICE_INSERT:
+		if len(command) < 5 {
+			return info, ErrSCTE35
+		}
+		info.EventID = util.ReadBE[uint32](command[:4])
+		info.Cancel = command[4]&0x80 != 0
+		command = command[5:]
+		if info.Cancel {
+			return
+		}
+		if len(command) < 1 {
+			return info, ErrSCTE35
+		}
+		flags := command[0]
+		command = command[1:]
+		info.OutOfNetwork = flags&0x80 != 0
+		programSplice, hasDuration := flags&0x40 != 0, flags&0x20 != 0
+		info.Immediate = flags&0x10 != 0
+		if programSplice && !info.Immediate {
+			if !readSpliceTime() {
+				return info, ErrSCTE35
+			}
+		} else if !programSplice {
+			// 按组件切换，只取第一个组件的时间
+			if len(command) < 1 {
+				return info, ErrSCTE35
+			}
+			count := int(command[0])
+			command = command[1:]
+			for i := 0; i < count; i++ {
+				if len(command) < 1 {
+					return info, ErrSCTE35
+				}
+				command = command[1:]
+				if !info.Immediate && !readSpliceTime() {
+					return info, ErrSCTE35
+				}
+			}
+		}
+		if hasDuration {
+			if len(command) < 5 {
+				return info, ErrSCTE35
+			}
+			info.AutoReturn = command[0]&0x80 != 0
+			info.Duration = uint64(command[0]&1)<<32 | uint64(util.ReadBE[uint32](command[1:5]))
+		}
+	case SCTE35_TIME_SIGNAL:
+		if !readSpliceTime() {
+			return info, ErrSCTE35
+		}
+	}
+	return
+}
@@ -0,0 +1,22 @@
+package mpegts
+
+import "testing"
+
+func TestParseSpliceInfo(t *testing.T) {
+	t.Run(t.Name(), func(t *testing.T) {
+		section := []byte{0xFC, 0x30, 0x25, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xFF, 0xF0, 0x14, SCTE35_SPLICE_INSERT,
+			0x00, 0x00, 0x00, 0x01, 0x7F, 0xEF,
+			0xFE, 0x00, 0x0D, 0xBB, 0xA0, // splice_time 900000
+			0xFE, 0x00, 0x29, 0x32, 0xE0, // break_duration 30s
+			0x00, 0x01, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // CRC 不校验
+		}
+		info, err := ParseSpliceInfo(section)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.EventID != 1 || !info.OutOfNetwork || info.Immediate || !info.HasPTS || info.PTS != 900000 || info.Duration != 2700000 || !info.AutoReturn {
+			t.Fatalf("splice info mismatch: %+v", info)
+		}
+	})
+}
@@ -0,0 +1,32 @@
+package codec
+
+import "time"
+
+// OpusPacketDuration 根据 TOC 计算 Opus 包的时长，参见 RFC 6716 3.1
+func OpusPacketDuration(packet []byte) time.Duration {
+	if len(packet) == 0 {
+		return 0
+	}
+	toc := packet[0]
+	config := toc >> 3
+	var frame time.Duration
+	switch {
+	case config < 12: // SILK
+		frame = [4]time.Duration{10, 20, 40, 60}[config&3] * time.Millisecond
+	case config < 16: // Hybrid
+		frame = [2]time.Duration{10, 20}[config&1] * time.Millisecond
+	default: // CELT
+		frame = [4]time.Duration{2500, 5000, 10000, 20000}[config&3] * time.Microsecond
+	}
+	switch toc & 3 {
+	case 0:
+		return frame
+	case 1, 2:
+		return frame * 2
+	default:
+		if len(packet) < 2 {
+			return 0
+		}
+		return frame * time.Duration(packet[1]&0x3f)
+	}
+}
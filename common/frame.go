@@ -50,8 +50,9 @@ type DataFrame[T any] struct {
 	WriteTime   time.Time    // 写入时间,可用于比较两个帧的先后
 	Sequence    uint32       // 在一个Track中的序号
 	BytesIn     int          // 输入字节数用于计算BPS
-	CanRead     bool         `json:"-" yaml:"-"` // 是否可读取
-	readerCount atomic.Int32 `json:"-" yaml:"-"` // 读取者数量
+	canRead     atomic.Bool  // 是否可读取，写入者置位后读取者才能看到帧内容
+	discarded   atomic.Bool  // 是否已废弃
+	readerCount atomic.Int32 // 读取者数量
 	Data        T            `json:"-" yaml:"-"`
 	sync.Cond   `json:"-" yaml:"-"`
 }
@@ -60,15 +61,15 @@ func NewDataFrame[T any]() *DataFrame[T] {
 	return &DataFrame[T]{}
 }
 func (df *DataFrame[T]) IsWriting() bool {
-	return !df.CanRead
+	return !df.canRead.Load()
 }
 
 func (df *DataFrame[T]) IsDiscarded() bool {
-	return df.L == nil
+	return df.discarded.Load()
 }
 
 func (df *DataFrame[T]) Discard() int32 {
-	df.L = nil //标记为废弃
+	df.discarded.Store(true) //标记为废弃
 	return df.readerCount.Load()
 }
 
@@ -97,19 +98,25 @@ func (df *DataFrame[T]) StartWrite() bool {
 		df.Discard() //标记为废弃
 		return false
 	} else {
-		df.CanRead = false //标记为正在写入
+		df.canRead.Store(false) //标记为正在写入
 		return true
 	}
 }
 
 func (df *DataFrame[T]) Ready() {
 	df.WriteTime = time.Now()
-	df.CanRead = true //标记为可读取
+	df.MarkReadable()
 	df.Broadcast()
 }
 
+// MarkReadable 标记为可读取但不改写入时间，用于从磁盘还原的帧
+func (df *DataFrame[T]) MarkReadable() {
+	df.canRead.Store(true)
+}
+
 func (df *DataFrame[T]) Init() {
 	df.L = util.EmptyLocker
+	df.discarded.Store(false)
 }
 
 func (df *DataFrame[T]) Reset() {
@@ -69,6 +69,7 @@ type AVTrack interface {
 	WriteSequenceHead(sh []byte) error
 	Flush()
 	SetSpeedLimit(time.Duration)
+	ResetSpeedLimit()
 	GetRTPFromPool() *util.ListItem[RTPFrame]
 	GetFromPool(util.IBytes) *util.ListItem[util.Buffer]
 }
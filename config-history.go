@@ -0,0 +1,254 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"m7s.live/engine/v4/config"
+	"m7s.live/engine/v4/util"
+)
+
+// 配置修改的来源
+const (
+	CONFIG_SOURCE_INITIAL  = "initial" // 第一次保存前已有的配置
+	CONFIG_SOURCE_PLUGIN   = "plugin"
+	CONFIG_SOURCE_API      = "api"
+	CONFIG_SOURCE_PULL     = "pull" // 拉流时保存
+	CONFIG_SOURCE_PUSH     = "push" // 推流时保存
+	CONFIG_SOURCE_ROLLBACK = "rollback"
+)
+
+var ErrConfigVersionNotFound = errors.New("config version not found")
+
+// ConfigVersion 插件保存过的一个配置版本，Modify 为保存的动态修改的配置
+type ConfigVersion struct {
+	Version int
+	Time    time.Time
+	Source  string
+	Modify  map[string]any `json:",omitempty" yaml:",omitempty"`
+}
+
+// ConfigChange 两个版本之间变化的配置项，Key 形如 publish.kickexist，没有修改的一方为 nil
+type ConfigChange struct {
+	Key  string
+	From any
+	To   any
+}
+
+func (opt *Plugin) historyDir() string {
+	return filepath.Join(SettingDir, "history", strings.ToLower(opt.Name))
+}
+
+// History 插件的配置历史，按版本号从小到大排列
+func (opt *Plugin) History() (list []ConfigVersion) {
+	opt.historyLock.Lock()
+	defer opt.historyLock.Unlock()
+	return opt.history()
+}
+
+func (opt *Plugin) history() (list []ConfigVersion) {
+	entries, _ := os.ReadDir(opt.historyDir())
+	for _, entry := range entries {
+		if v, err := opt.readVersion(entry.Name()); err == nil {
+			list = append(list, v)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Version < list[j].Version
+	})
+	return
+}
+
+func (opt *Plugin) readVersion(name string) (v ConfigVersion, err error) {
+	if !strings.HasSuffix(name, ".yaml") {
+		return v, ErrConfigVersionNotFound
+	}
+	b, err := os.ReadFile(filepath.Join(opt.historyDir(), name))
+	if err == nil {
+		err = yaml.Unmarshal(b, &v)
+	}
+	return
+}
+
+// GetVersion 获取指定的配置版本
+func (opt *Plugin) GetVersion(version int) (ConfigVersion, error) {
+	opt.historyLock.Lock()
+	defer opt.historyLock.Unlock()
+	return opt.readVersion(fmt.Sprintf("%d.yaml", version))
+}
+
+// saveVersion 保存后记录一个版本，第一次保存时先记录原有的配置，超过 ConfigHistory 的旧版本被删除
+func (opt *Plugin) saveVersion(source string, modify map[string]any, initial *ConfigVersion) {
+	if EngineConfig.ConfigHistory <= 0 {
+		return
+	}
+	opt.historyLock.Lock()
+	defer opt.historyLock.Unlock()
+	if err := os.MkdirAll(opt.historyDir(), 0766); err != nil {
+		opt.Error("config history", zap.Error(err))
+		return
+	}
+	list := opt.history()
+	next := ConfigVersion{Version: 1, Time: time.Now(), Source: source, Modify: modify}
+	if l := len(list); l > 0 {
+		next.Version = list[l-1].Version + 1
+	} else if initial != nil {
+		initial.Version = 1
+		next.Version = 2
+		list = append(list, *initial)
+		opt.writeVersion(initial)
+	}
+	list = append(list, next)
+	opt.writeVersion(&next)
+	for len(list) > EngineConfig.ConfigHistory {
+		os.Remove(filepath.Join(opt.historyDir(), fmt.Sprintf("%d.yaml", list[0].Version)))
+		list = list[1:]
+	}
+}
+
+func (opt *Plugin) writeVersion(v *ConfigVersion) {
+	b, err := yaml.Marshal(v)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(opt.historyDir(), fmt.Sprintf("%d.yaml", v.Version)), b, 0666)
+	}
+	if err != nil {
+		opt.Error("config history", zap.Int("version", v.Version), zap.Error(err))
+	}
+}
+
+// readSetting 读取保存在 SettingDir 中的配置，作为第一次保存前的版本
+func (opt *Plugin) readSetting() *ConfigVersion {
+	initial := &ConfigVersion{Time: time.Now(), Source: CONFIG_SOURCE_INITIAL}
+	if info, err := os.Stat(opt.settingPath()); err == nil {
+		initial.Time = info.ModTime()
+		if b, err := os.ReadFile(opt.settingPath()); err == nil {
+			yaml.Unmarshal(b, &initial.Modify)
+		}
+	}
+	return initial
+}
+
+// Rollback 回滚到指定的配置版本，通过 Update 热更新，回滚本身也会保存为一个新的版本
+func (opt *Plugin) Rollback(version int) error {
+	v, err := opt.GetVersion(version)
+	if err != nil {
+		return ErrConfigVersionNotFound
+	}
+	changed := opt.RawConfig.ReloadModifyFile(v.Modify)
+	opt.Info("config rollback", zap.Int("version", version), zap.Strings("keys", changed))
+	if err = opt.Save(CONFIG_SOURCE_ROLLBACK); err != nil {
+		return err
+	}
+	opt.Update(&opt.RawConfig)
+	return nil
+}
+
+// DiffConfig 比较两个版本的动态修改配置
+func (opt *Plugin) DiffConfig(from, to map[string]any) (changes []ConfigChange) {
+	f, t := make(map[string]any), make(map[string]any)
+	flattenConfig(&opt.RawConfig, "", from, f)
+	flattenConfig(&opt.RawConfig, "", to, t)
+	for k, v := range f {
+		if tv, ok := t[k]; !ok || !reflect.DeepEqual(v, tv) {
+			changes = append(changes, ConfigChange{k, v, tv})
+		}
+	}
+	for k, v := range t {
+		if _, ok := f[k]; !ok {
+			changes = append(changes, ConfigChange{k, nil, v})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	return
+}
+
+// flattenConfig 展开配置结构体对应的 map，值本身是 map 的配置项（例如 pull.pullonstart）不展开
+func flattenConfig(c *config.Config, prefix string, m map[string]any, result map[string]any) {
+	for k, v := range m {
+		if sub, ok := v.(map[string]any); ok && c.Has(k) && c.Get(k).Ptr.Kind() == reflect.Struct {
+			flattenConfig(c.Get(k), prefix+k+".", sub, result)
+		} else {
+			result[prefix+k] = v
+		}
+	}
+}
+
+func (conf *GlobalConfig) configPlugin(w http.ResponseWriter, r *http.Request) *Plugin {
+	if configName := r.URL.Query().Get("name"); configName != "" {
+		if p, ok := Plugins[configName]; ok {
+			return p
+		}
+		util.ReturnError(util.APIErrorNoConfig, NO_SUCH_CONIFG, w, r)
+		return nil
+	}
+	return Engine
+}
+
+// API_config_history 配置的历史版本 ?name=插件名，为空时为全局配置
+func (conf *GlobalConfig) API_config_history(w http.ResponseWriter, r *http.Request) {
+	if p := conf.configPlugin(w, r); p != nil {
+		util.ReturnFetchList(p.History, w, r)
+	}
+}
+
+// API_config_diff 比较两个版本 ?name=插件名&from=版本号&to=版本号，to 为空时和当前的配置比较
+func (conf *GlobalConfig) API_config_diff(w http.ResponseWriter, r *http.Request) {
+	p := conf.configPlugin(w, r)
+	if p == nil {
+		return
+	}
+	q := r.URL.Query()
+	var modify [2]map[string]any
+	for i, arg := range []string{"from", "to"} {
+		if q.Get(arg) == "" && arg == "to" {
+			modify[i], _ = p.RawConfig.Modify.(map[string]any)
+			continue
+		}
+		version, err := strconv.Atoi(q.Get(arg))
+		if err != nil {
+			util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+			return
+		}
+		v, err := p.GetVersion(version)
+		if err != nil {
+			util.ReturnError(util.APIErrorNotFound, ErrConfigVersionNotFound.Error(), w, r)
+			return
+		}
+		modify[i] = v.Modify
+	}
+	util.ReturnFetchList(func() []ConfigChange {
+		return p.DiffConfig(modify[0], modify[1])
+	}, w, r)
+}
+
+// API_config_rollback 回滚到指定的版本 ?name=插件名&version=版本号，回滚后立即热更新
+func (conf *GlobalConfig) API_config_rollback(w http.ResponseWriter, r *http.Request) {
+	p := conf.configPlugin(w, r)
+	if p == nil {
+		return
+	}
+	version, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	if err = p.Rollback(version); err == ErrConfigVersionNotFound {
+		util.ReturnError(util.APIErrorNotFound, err.Error(), w, r)
+	} else if err != nil {
+		util.ReturnError(util.APIErrorSave, err.Error(), w, r)
+	} else {
+		util.ReturnOK(w, r)
+	}
+}
@@ -27,10 +27,11 @@ type Config struct {
 		Label string `json:"label"`
 		Value any    `json:"value"`
 	}
-	name     string // 小写
-	propsMap map[string]*Config
-	props    []*Config
-	tag      reflect.StructTag
+	name        string // 小写
+	propsMap    map[string]*Config
+	props       []*Config
+	tag         reflect.StructTag
+	yamlDefault bool // Default 来自插件的 defaultYaml，优先于全局配置
 }
 
 var durationType = reflect.TypeOf(time.Duration(0))
@@ -104,7 +105,7 @@ func (config *Config) GetValue() any{
 	return config.Ptr.Interface()
 }
 
-// Parse 第一步读取配置结构体的默认值
+// Parse 第一步读取配置结构体的默认值，prefix 为环境变量名的前缀，例如 GLOBAL
 func (config *Config) Parse(s any, prefix ...string) {
 	var t reflect.Type
 	var v reflect.Value
@@ -118,14 +119,6 @@ func (config *Config) Parse(s any, prefix ...string) {
 	}
 	config.Ptr = v
 	config.Default = v.Interface()
-	if len(prefix) > 0 { // 读取环境变量
-		envKey := strings.Join(prefix, "_")
-		if envValue := os.Getenv(envKey); envValue != "" {
-			envv := config.assign(strings.ToLower(prefix[0]), envValue)
-			config.Env = envv.Interface()
-			config.Ptr.Set(envv)
-		}
-	}
 	if t.Kind() == reflect.Struct && t != regexpType {
 		for i, j := 0, t.NumField(); i < j; i++ {
 			ft, fv := t.Field(i), v.Field(i)
@@ -140,8 +133,12 @@ func (config *Config) Parse(s any, prefix ...string) {
 				name, _, _ = strings.Cut(tag, ",")
 			}
 			prop := config.Get(name)
-			prop.Parse(fv, append(prefix, strings.ToUpper(ft.Name))...)
 			prop.tag = ft.Tag
+			if len(prefix) > 0 {
+				prop.Parse(fv, append(prefix, strings.ToUpper(ft.Name))...)
+			} else {
+				prop.Parse(fv) // 没有前缀时不读取环境变量，例如按路径覆盖的配置副本
+			}
 			for _, kv := range strings.Split(ft.Tag.Get("enum"), ",") {
 				kvs := strings.Split(kv, ":")
 				if len(kvs) != 2 {
@@ -160,6 +157,8 @@ func (config *Config) Parse(s any, prefix ...string) {
 				})
 			}
 		}
+	} else if len(prefix) > 0 { // 读取环境变量
+		config.parseEnv(strings.Join(prefix, "_"))
 	}
 }
 
@@ -170,7 +169,7 @@ func (config *Config) ParseGlobal(g *Config) {
 		for k, v := range config.propsMap {
 			v.ParseGlobal(g.Get(k))
 		}
-	} else {
+	} else if config.Env == nil {
 		config.Ptr.Set(g.Ptr)
 	}
 }
@@ -189,6 +188,7 @@ func (config *Config) ParseDefaultYaml(defaultYaml map[string]any) {
 			} else {
 				dv := prop.assign(k, v)
 				prop.Default = dv.Interface()
+				prop.yamlDefault = true
 				if prop.Env == nil {
 					prop.Ptr.Set(dv)
 				}
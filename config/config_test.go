@@ -1,7 +1,10 @@
 package config
 
 import (
+	"errors"
+	"os"
 	"testing"
+	"time"
 )
 // TestModify 测试动态修改配置文件，比较值是否修改，修改后是否有Modify属性
 func TestModify(t *testing.T) {
@@ -51,3 +54,183 @@ func TestGlobal(t *testing.T) {
 		}
 	})
 }
+
+// TestOverrides 测试按流路径覆盖配置，越具体的通配符越优先
+func TestOverrides(t *testing.T) {
+	var engine Engine
+	var conf Config
+	conf.Parse(&engine)
+	conf.ParseUserFile(map[string]any{
+		"publish": map[string]any{"idletimeout": "5s"},
+		"overrides": map[string]any{
+			"live/*":    map[string]any{"publish": map[string]any{"buffertime": "10s", "kickexist": true, "idletimeout": 0}},
+			"live/vip*": map[string]any{"publish": map[string]any{"buffertime": "20s"}},
+			"cctv/*":    map[string]any{"subscribe": map[string]any{"iframeonly": true, "unknown": 1}},
+		},
+	})
+	if !MatchPath("live/*", "live/a/b") || MatchPath("live/*", "live") || MatchPath("live/*", "cctv/a") {
+		t.Error("match path")
+	}
+	if p := engine.OverridePublish("live/a/b", &engine.Publish); p == nil || p.BufferTime != 10*time.Second || !p.KickExist || p.IdleTimeout != 0 {
+		t.Error("override publish", p)
+	}
+	if p := engine.OverridePublish("live/vip1", &engine.Publish); p == nil || p.BufferTime != 20*time.Second {
+		t.Error("override more specific", p)
+	}
+	if engine.Publish.IdleTimeout != 5*time.Second || engine.Publish.KickExist {
+		t.Error("global config changed")
+	}
+	if engine.OverridePublish("cctv/a", &engine.Publish) != nil {
+		t.Error("no publish override")
+	}
+	if s := engine.OverrideSubscribe("cctv/a", &engine.Subscribe); s == nil || !s.IFrameOnly {
+		t.Error("override subscribe", s)
+	}
+	if errs := engine.CheckOverrides(); len(errs) != 1 {
+		t.Error("check overrides", errs)
+	}
+}
+
+// TestOverridesEnv 覆盖配置不读取没有前缀的环境变量
+func TestOverridesEnv(t *testing.T) {
+	t.Setenv("BUFFERTIME", "1s")
+	t.Setenv("KICKEXIST", "false")
+	var publish Publish
+	if unknown := Override(&publish, map[string]any{"buffertime": "10s", "kickexist": true}); len(unknown) > 0 {
+		t.Error("unknown", unknown)
+	}
+	if publish.BufferTime != 10*time.Second || !publish.KickExist {
+		t.Error("override with env", publish)
+	}
+}
+
+// TestReloadUserFile 测试重新读取配置文件，删除的配置项恢复为全局配置或默认值，无效的值保留原值
+func TestReloadUserFile(t *testing.T) {
+	var globalValue, pluginValue struct {
+		Publish
+	}
+	var globalConf, conf Config
+	globalConf.Parse(&globalValue)
+	conf.Parse(&pluginValue)
+	conf.Get("publish").ParseGlobal(globalConf.Get("publish"))
+	conf.ParseUserFile(map[string]any{"publish": map[string]any{"kickexist": true, "buffertime": "3s"}})
+	globalConf.ReloadUserFile(map[string]any{"publish": map[string]any{"pubaudio": true}})
+	changed := conf.ReloadUserFile(map[string]any{"publish": map[string]any{"buffertime": "3x"}})
+	if pluginValue.KickExist || !pluginValue.PubAudio || pluginValue.BufferTime != 3*time.Second {
+		t.Error("reload", pluginValue.Publish)
+	}
+	if len(changed) != 2 || changed[0] != "publish.pubaudio" || changed[1] != "publish.kickexist" {
+		t.Error("changed", changed)
+	}
+}
+
+// TestReloadModifyFile 测试用整个动态修改配置替换，没有的配置项取消修改
+func TestReloadModifyFile(t *testing.T) {
+	var value struct {
+		Publish
+	}
+	var conf Config
+	conf.Parse(&value)
+	conf.ParseModifyFile(map[string]any{"publish": map[string]any{"kickexist": true, "buffertime": "3s"}})
+	changed := conf.ReloadModifyFile(map[string]any{"publish": map[string]any{"buffertime": "5s"}})
+	if value.KickExist || value.BufferTime != 5*time.Second || len(changed) != 2 {
+		t.Error("reload modify", value.Publish, changed)
+	}
+	if conf.ReloadModifyFile(nil); conf.Modify != nil || value.BufferTime != 0 {
+		t.Error("clear modify", conf.Modify)
+	}
+}
+
+// TestValidate 测试按配置结构体校验配置
+func TestValidate(t *testing.T) {
+	var value struct {
+		Publish
+		Subscribe
+	}
+	var conf Config
+	conf.Parse(&value)
+	conf.ParseDefaultYaml(map[string]any{"publish": map[string]any{"buffertime": "1s"}})
+	userConfig := map[string]any{
+		"publish": map[string]any{
+			"buffertime":  "10x",
+			"ringsize":    "abc",
+			"kickexit":    true,
+			"pausetimeout": "5s",
+		},
+		"subscribe": map[string]any{"submode": 3, "syncmode": 1, "waittimeout": 10},
+	}
+	errs := conf.Validate(userConfig)
+	expect := map[string]error{
+		"publish.buffertime":    ErrInvalidDuration,
+		"publish.kickexit":      ErrUnknownConfig,
+		"publish.ringsize":      ErrInvalidRingSize,
+		"subscribe.submode":     ErrInvalidEnum,
+		"subscribe.waittimeout": ErrInvalidDuration,
+	}
+	if len(errs) != len(expect) {
+		t.Fatal(errs)
+	}
+	for _, err := range errs {
+		if !errors.Is(err, expect[err.Key]) {
+			t.Error(err)
+		}
+	}
+	errs.Prune(userConfig)
+	conf.ParseUserFile(userConfig)
+	if value.Publish.BufferTime != time.Second || value.PauseTimeout != 5*time.Second || value.SyncMode != 1 {
+		t.Error("prune", userConfig)
+	}
+}
+
+// TestEnv 测试环境变量覆盖配置，包括 map、数组和从文件读取的密钥
+func TestEnv(t *testing.T) {
+	var value struct {
+		Publish
+		Subscribe
+		Webhook
+		HTTP
+	}
+	keyFile := t.TempDir() + "/key"
+	os.WriteFile(keyFile, []byte("secret\n"), 0600)
+	t.Setenv("TEST_PUBLISH_BUFFERTIME", "3s")
+	t.Setenv("TEST_PUBLISH_KICKEXIST", "true")
+	t.Setenv("TEST_PUBLISH_KEY_FILE", keyFile)
+	t.Setenv("TEST_PUBLISH_PAUSETIMEOUT", "10x")
+	t.Setenv("TEST_SUBSCRIBE_SUBAUDIOTRACKS", "aac, opus")
+	t.Setenv("TEST_WEBHOOK_HEADERS", "{token: abc}")
+	t.Setenv("TEST_HTTP_LISTENADDR", ":8081")
+	t.Setenv("TEST_HTTP_USERNAME_FILE", keyFile)
+	var conf Config
+	conf.Parse(&value, "TEST")
+	conf.ParseUserFile(map[string]any{"publish": map[string]any{"buffertime": "5s"}})
+	if value.BufferTime != 3*time.Second || !value.KickExist || value.Publish.Key != "secret" || value.PauseTimeout != 0 {
+		t.Error("publish", value.Publish)
+	}
+	if len(value.SubAudioTracks) != 2 || value.SubAudioTracks[1] != "opus" || value.Headers["token"] != "abc" {
+		t.Error("slice and map", value.SubAudioTracks, value.Headers)
+	}
+	if value.ListenAddr != ":8081" || value.UserName != "" {
+		t.Error("http", value.HTTP)
+	}
+}
+
+// TestRecordPath 测试录制路径只能在录制根目录下
+func TestRecordPath(t *testing.T) {
+	for _, root := range []string{"", ".", "/", "./"} {
+		if (&Record{Root: root, Path: "{app}/{stream}"}).Check() != ErrRecordRoot {
+			t.Error("root", root)
+		}
+	}
+	r := Record{Root: "record", Path: "{app}/{stream}"}
+	if err := r.Check(); err != nil {
+		t.Error(err)
+	}
+	for _, rel := range []string{"/etc/passwd", "../x", "live/../../x", "a/..", ""} {
+		if _, err := r.Resolve(rel); err != ErrRecordPath {
+			t.Error("path", rel)
+		}
+	}
+	if p, err := r.Resolve("live/test/1.flv"); err != nil || p != "record/live/test/1.flv" {
+		t.Error(p, err)
+	}
+}
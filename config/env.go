@@ -0,0 +1,59 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"m7s.live/engine/v4/log"
+)
+
+// parseEnv 读取环境变量中的配置，例如 GLOBAL_PUBLISH_KEY、RTMP_TCP_LISTENADDR。
+// 带有 secret 标签的配置项还可以从 <环境变量>_FILE 指定的文件中读取，例如 GLOBAL_PUBLISH_KEY_FILE=/run/secrets/key
+func (config *Config) parseEnv(envKey string) {
+	envValue := os.Getenv(envKey)
+	if file := os.Getenv(envKey + "_FILE"); envValue == "" && file != "" && config.tag.Get("secret") == "true" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			log.Errorf("%s_FILE: %v", envKey, err)
+			return
+		}
+		envValue = strings.TrimRight(string(b), "\r\n")
+	}
+	if envValue == "" {
+		return
+	}
+	v := config.envValue(envValue)
+	if err := config.check(v); err != nil {
+		log.Errorf("%s %v: %s", envKey, err, envValue)
+		return
+	}
+	envv := config.assign(config.name, v)
+	config.Env = envv.Interface()
+	config.Ptr.Set(envv)
+}
+
+// envValue 环境变量的值按 yaml 解析，map 和数组可以写成 {a: 1} 和 [a, b]，数组也可以用逗号分隔，例如 a,b
+func (config *Config) envValue(s string) any {
+	ft := config.Ptr.Type()
+	if ft == durationType || ft == regexpType || ft.Kind() == reflect.String {
+		return s
+	}
+	var v any
+	if yaml.Unmarshal([]byte(s), &v) != nil {
+		return s
+	}
+	if str, ok := v.(string); ok && ft.Kind() == reflect.Slice {
+		var items []any
+		for _, item := range strings.Split(str, ",") {
+			var iv any
+			if yaml.Unmarshal([]byte(strings.TrimSpace(item)), &iv) != nil {
+				iv = strings.TrimSpace(item)
+			}
+			items = append(items, iv)
+		}
+		return items
+	}
+	return v
+}
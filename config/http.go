@@ -22,7 +22,7 @@ type HTTP struct {
 	KeyFile       string        `desc:"HTTPS密钥文件"`
 	CORS          bool          `default:"true" desc:"是否自动添加CORS头"` //是否自动添加CORS头
 	UserName      string        `desc:"基本身份认证用户名"`
-	Password      string        `desc:"基本身份认证密码"`
+	Password      string        `desc:"基本身份认证密码" secret:"true"`
 	ReadTimeout   time.Duration `desc:"读取超时"`
 	WriteTimeout  time.Duration `desc:"写入超时"`
 	IdleTimeout   time.Duration `desc:"空闲超时"`
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// PathOverride 按流路径覆盖的发布、订阅配置，只需要填写要覆盖的配置项，写法与 publish、subscribe 相同
+type PathOverride struct {
+	Publish   map[string]any `json:"publish,omitempty" yaml:"publish,omitempty"`
+	Subscribe map[string]any `json:"subscribe,omitempty" yaml:"subscribe,omitempty"`
+}
+
+// MatchPath 流路径是否匹配通配符，规则同 path.Match，以 /* 结尾时还匹配更深的路径，例如 live/* 匹配 live/a/b
+func MatchPath(pattern, streamPath string) bool {
+	if ok, _ := path.Match(pattern, streamPath); ok {
+		return true
+	}
+	if parent, ok := strings.CutSuffix(pattern, "/*"); ok {
+		for i := range streamPath {
+			if streamPath[i] == '/' {
+				if ok, _ := path.Match(parent, streamPath[:i]); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// MatchOverrides 匹配流路径的覆盖配置的通配符，越长的越具体，排在后面，覆盖前面的配置
+func (cfg *Engine) MatchOverrides(streamPath string) (patterns []string) {
+	for pattern := range cfg.Overrides {
+		if MatchPath(pattern, streamPath) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) < len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+	return
+}
+
+// OverridePublish 返回应用了覆盖配置的发布配置副本，没有需要覆盖的配置时返回 nil
+func (cfg *Engine) OverridePublish(streamPath string, conf *Publish) (result *Publish) {
+	if conf == nil {
+		return
+	}
+	for _, pattern := range cfg.MatchOverrides(streamPath) {
+		if values := cfg.Overrides[pattern].Publish; len(values) > 0 {
+			if result == nil {
+				copyConfig := *conf
+				result = &copyConfig
+			}
+			Override(result, values)
+		}
+	}
+	return
+}
+
+// OverrideSubscribe 返回应用了覆盖配置的订阅配置副本，没有需要覆盖的配置时返回 nil
+func (cfg *Engine) OverrideSubscribe(streamPath string, conf *Subscribe) (result *Subscribe) {
+	if conf == nil {
+		return
+	}
+	for _, pattern := range cfg.MatchOverrides(streamPath) {
+		if values := cfg.Overrides[pattern].Subscribe; len(values) > 0 {
+			if result == nil {
+				copyConfig := *conf
+				result = &copyConfig
+			}
+			Override(result, values)
+		}
+	}
+	return
+}
+
+// Override 把 values 中的配置项写入 target 指向的配置结构体，返回不存在的配置项
+func Override(target any, values map[string]any) (unknown []string) {
+	var conf Config
+	conf.Parse(target)
+	lower := make(map[string]any, len(values))
+	for k, v := range values {
+		k = strings.ToLower(k)
+		if !conf.Has(k) {
+			unknown = append(unknown, k)
+			continue
+		}
+		lower[k] = v
+	}
+	conf.ParseUserFile(lower)
+	sort.Strings(unknown)
+	return
+}
+
+// CheckOverrides 检查覆盖配置的通配符和配置项，配置值按照正常配置的方式解析
+func (cfg *Engine) CheckOverrides() (errs []error) {
+	for pattern, override := range cfg.Overrides {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("overrides %s: %w", pattern, err))
+			continue
+		}
+		publish := cfg.Publish
+		for _, k := range Override(&publish, override.Publish) {
+			errs = append(errs, fmt.Errorf("overrides %s: unknown publish config %s", pattern, k))
+		}
+		subscribe := cfg.Subscribe
+		for _, k := range Override(&subscribe, override.Subscribe) {
+			errs = append(errs, fmt.Errorf("overrides %s: unknown subscribe config %s", pattern, k))
+		}
+	}
+	return
+}
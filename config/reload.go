@@ -0,0 +1,100 @@
+package config
+
+import (
+	"reflect"
+
+	"m7s.live/engine/v4/log"
+)
+
+// value 按优先级得到配置项的值：动态修改值>环境变量>配置文件>defaultYaml>全局配置>默认值
+func (config *Config) value() any {
+	if config.Modify != nil {
+		return config.Modify
+	}
+	if config.Env != nil {
+		return config.Env
+	}
+	if config.File != nil {
+		return config.File
+	}
+	if config.Global != nil && !config.yamlDefault {
+		return config.Global.GetValue()
+	}
+	return config.Default
+}
+
+// ReloadUserFile 重新读取用户配置文件，配置文件中删除的配置项恢复为默认值，返回值发生变化的配置项，例如 http.listenaddr
+func (config *Config) ReloadUserFile(conf map[string]any) (changed []string) {
+	config.File = nil
+	if conf != nil {
+		config.File = conf
+	}
+	for _, prop := range config.props {
+		v := conf[prop.name]
+		if prop.props != nil {
+			m, _ := v.(map[string]any)
+			for _, key := range prop.ReloadUserFile(m) {
+				changed = append(changed, prop.name+"."+key)
+			}
+			continue
+		}
+		if err := prop.check(v); err != nil {
+			log.Errorf("%s %v: %v, keep the old value", prop.name, err, v)
+			continue
+		}
+		old := prop.GetValue()
+		if v != nil {
+			prop.File = prop.assign(prop.name, v).Interface()
+		} else {
+			prop.File = nil
+		}
+		if v := prop.value(); v != nil {
+			prop.Ptr.Set(reflect.ValueOf(v))
+		}
+		if !equal(old, prop.GetValue()) {
+			changed = append(changed, prop.name)
+		}
+	}
+	return
+}
+
+// ReloadModifyFile 用 conf 替换全部动态修改的配置，conf 中没有的配置项取消修改，返回值发生变化的配置项
+func (config *Config) ReloadModifyFile(conf map[string]any) (changed []string) {
+	modify := make(map[string]any)
+	for _, prop := range config.props {
+		v := conf[prop.name]
+		if prop.props != nil {
+			m, _ := v.(map[string]any)
+			for _, key := range prop.ReloadModifyFile(m) {
+				changed = append(changed, prop.name+"."+key)
+			}
+			if prop.Modify != nil {
+				modify[prop.name] = prop.Modify
+			}
+			continue
+		}
+		if err := prop.check(v); err != nil {
+			log.Errorf("%s %v: %v, ignored", prop.name, err, v)
+			v = nil
+		}
+		old := prop.GetValue()
+		prop.Modify = nil
+		if v != nil {
+			if mv := prop.assign(prop.name, v).Interface(); !equal(prop.value(), mv) {
+				prop.Modify = mv
+				modify[prop.name] = v
+			}
+		}
+		if v := prop.value(); v != nil {
+			prop.Ptr.Set(reflect.ValueOf(v))
+		}
+		if !equal(old, prop.GetValue()) {
+			changed = append(changed, prop.name)
+		}
+	}
+	config.Modify = nil
+	if len(modify) > 0 {
+		config.Modify = modify
+	}
+	return
+}
@@ -2,8 +2,10 @@ package config
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -34,6 +36,7 @@ type Publish struct {
 	PubAudio          bool          `default:"true" desc:"是否发布音频"`
 	PubVideo          bool          `default:"true" desc:"是否发布视频"`
 	KickExist         bool          `desc:"是否踢掉已经存在的发布者"`                     // 是否踢掉已经存在的发布者
+	BackupArgName     string        `default:"backup" desc:"备用发布者参数名"`        // 带有该参数的发布者在流已有发布者时作为备用发布者等待接替
 	PublishTimeout    time.Duration `default:"10s" desc:"发布无数据超时"`            // 发布无数据超时
 	WaitCloseTimeout  time.Duration `desc:"延迟自动关闭（等待重连）"`                     // 延迟自动关闭（等待重连）
 	DelayCloseTimeout time.Duration `desc:"延迟自动关闭（无订阅时）"`                     // 延迟自动关闭（无订阅时）
@@ -41,10 +44,13 @@ type Publish struct {
 	PauseTimeout      time.Duration `default:"30s" desc:"暂停超时时间"`             // 暂停超时
 	BufferTime        time.Duration `desc:"缓冲长度(单位：秒)，0代表取最近关键帧"`             // 缓冲长度(单位：秒)，0代表取最近关键帧
 	SpeedLimit        time.Duration `default:"500ms" desc:"速度限制最大等待时间,0则不等待"` //速度限制最大等待时间
-	Key               string        `desc:"发布鉴权key"`                          // 发布鉴权key
+	Key               string        `desc:"发布鉴权key" secret:"true"`            // 发布鉴权key
 	SecretArgName     string        `default:"secret" desc:"发布鉴权参数名"`         // 发布鉴权参数名
 	ExpireArgName     string        `default:"expire" desc:"发布鉴权失效时间参数名"`     // 发布鉴权失效时间参数名
 	RingSize          string        `default:"256-1024" desc:"缓冲范围"`          // 初始缓冲区大小
+	TimeShift         time.Duration `desc:"时移窗口长度,0则不开启"`                     // 在磁盘上保留最近一段时间的音视频，订阅者可以从过去的时间点开始播放
+	TimeShiftPath     string        `default:"timeshift" desc:"时移数据目录"`       // 时移数据目录，每个流一个子目录
+	TimeShiftFragment time.Duration `default:"1m" desc:"时移分片时长"`              // 时移数据按分片存储，过期的分片整体删除
 }
 
 func (c Publish) GetPublishConfig() Publish {
@@ -54,6 +60,7 @@ func (c Publish) GetPublishConfig() Publish {
 type Subscribe struct {
 	SubAudio        bool          `default:"true" desc:"是否订阅音频"`
 	SubVideo        bool          `default:"true" desc:"是否订阅视频"`
+	SubCue          bool          `default:"true" desc:"是否订阅广告标记"`
 	SubVideoArgName string        `default:"vts" desc:"定订阅的视频轨道参数名"`                     // 指定订阅的视频轨道参数名
 	SubAudioArgName string        `default:"ats" desc:"指定订阅的音频轨道参数名"`                    // 指定订阅的音频轨道参数名
 	SubDataArgName  string        `default:"dts" desc:"指定订阅的数据轨道参数名"`                    // 指定订阅的数据轨道参数名
@@ -64,12 +71,20 @@ type Subscribe struct {
 	SubMode         int           `desc:"订阅模式" enum:"0:实时模式,1:首屏后不进行追赶,2:从缓冲最大的关键帧开始播放"` // 0，实时模式：追赶发布者进度，在播放首屏后等待发布者的下一个关键帧，然后跳到该帧。1、首屏后不进行追赶。2、从缓冲最大的关键帧开始播放，也不追赶，需要发布者配置缓存长度
 	SyncMode        int           `desc:"同步模式" enum:"0:采用时间戳同步,1:采用写入时间同步"`              // 0，采用时间戳同步，1，采用写入时间同步
 	IFrameOnly      bool          `desc:"只要关键帧"`                                         // 只要关键帧
+	FMP4Mode        int           `desc:"fMP4分片模式" enum:"0:按帧分片,1:按GOP分片"`               // fMP4 订阅时每帧一个分片或者每个 GOP 一个分片
+	TSPCRInterval   time.Duration `default:"40ms" desc:"TS的PCR最大间隔"`                     // TS 订阅时 PCR 的最大间隔
+	TSPSIInterval   time.Duration `default:"100ms" desc:"TS的PAT/PMT重复间隔"`                // TS 订阅时 PAT/PMT 的重复间隔
+	TSBitRate       int           `desc:"TS恒定码率(bps),0则不填充空包"`                           // TS 订阅时以空包填充到恒定码率
+	TSMultiProgram  bool          `desc:"TS每个轨道一个节目"`                                    // TS 订阅时流中的每个音视频和数据轨道各自一个节目，包括播放过程中加入的轨道
 	WaitTimeout     time.Duration `default:"10s" desc:"等待流超时时间"`                         // 等待流超时
 	WriteBufferSize int           `desc:"写缓冲大小"`                                         // 写缓冲大小
-	Key             string        `desc:"订阅鉴权key"`                                       // 订阅鉴权key
+	Key             string        `desc:"订阅鉴权key" secret:"true"`                         // 订阅鉴权key
 	SecretArgName   string        `default:"secret" desc:"订阅鉴权参数名"`                      // 订阅鉴权参数名
 	ExpireArgName   string        `default:"expire" desc:"订阅鉴权失效时间参数名"`                  // 订阅鉴权失效时间参数名
 	Internal        bool          `default:"false" desc:"是否内部订阅"`                        // 是否内部订阅
+	StartArgName    string        `default:"starttime" desc:"时移开始时间参数名"`                 // 时移开始时间参数名，值为 unix 时间戳（秒）或 RFC3339 时间
+	OffsetArgName   string        `default:"offset" desc:"时移偏移参数名"`                      // 时移偏移参数名，例如 -300s 表示从 5 分钟前开始播放
+	TimeShiftSpeed  float64       `default:"1" desc:"时移播放速度,大于1时逐渐追上直播"`                 // 从磁盘读取历史数据的速度倍数
 }
 
 func (c *Subscribe) GetSubscribeConfig() *Subscribe {
@@ -192,16 +207,121 @@ func (p *Push) CheckPush(streamPath string) string {
 
 type Console struct {
 	Server        string `default:"console.monibuca.com:44944" desc:"远程控制台地址"` //远程控制台地址
-	Secret        string `desc:"远程控制台密钥"`                                      //远程控制台密钥
+	Secret        string `desc:"远程控制台密钥" secret:"true"`                        //远程控制台密钥
 	PublicAddr    string `desc:"远程控制台公网地址"`                                    //公网地址，提供远程控制台访问的地址，不配置的话使用自动识别的地址
 	PublicAddrTLS string `desc:"远程控制台公网TLS地址"`
 }
 
+// Record 录制策略
+type Record struct {
+	Format      string            `default:"flv" desc:"录制格式" enum:"flv:FLV,mp4:MP4,ts:TS"` // 录制格式
+	Root        string            `default:"record" desc:"录制根目录"`                          // 录像只会写入该目录，保留策略也只删除该目录下的录像
+	Path        string            `default:"{app}/{stream}/{time}" desc:"录制文件路径模板"`        // 相对于 Root，支持 {app} {stream} {streamPath} {date} {time} {unix}，不含扩展名
+	Fragment    time.Duration     `default:"10m" desc:"分片时长,0则不分片"`                        // 分片时长，到达后在下一个关键帧处切分
+	MaxSize     int64             `desc:"单个文件最大字节数,0则不限制"`                                 // 单个文件超过后在下一个关键帧处切分
+	MaxAge      time.Duration     `desc:"录像保留时长,0则不删除"`                                    // 超过保留时长的录像会被删除
+	MaxDiskSize int64             `desc:"录像总大小上限(字节),0则不限制"`                               // 按录像所在目录计算，超出时从该目录最旧的录像开始删除
+	AutoRecord  map[string]string `desc:"自动录制的流(正则)及格式"`                                   // 发布时自动录制，值为录制格式，为空则使用 Format
+}
+
+// Auth 内置鉴权服务，插件或者应用注册的鉴权服务优先
+type Auth struct {
+	Type           string        `desc:"鉴权方式(jwt、hmac、webhook),为空则不启用"`
+	Secret         string        `desc:"JWT(HS256)或者HMAC签名的密钥" secret:"true"`
+	PublicKey      string        `desc:"JWT(RS256)公钥PEM文件路径"`
+	TokenArgName   string        `default:"token" desc:"JWT参数名"`
+	AllowNoExp     bool          `desc:"允许没有exp声明的JWT"` // 这样的令牌永不过期，默认拒绝
+	SignArgName    string        `default:"sign" desc:"HMAC签名参数名"`
+	ExpireArgName  string        `default:"expire" desc:"HMAC签名失效时间参数名"` // unix 时间戳（秒）
+	WebhookURL     string        `desc:"鉴权回调地址"`
+	WebhookTimeout time.Duration `default:"3s" desc:"鉴权回调超时"`
+}
+
+// Webhook 事件回调，以 JSON POST 到所有回调地址
+type Webhook struct {
+	URLs          []string          `desc:"回调地址"`
+	Events        []string          `desc:"回调的事件,为空则回调所有事件"`               // publish、close、subscribe、unsubscribe、reconnect、authfail 等
+	Secret        string            `desc:"HMAC-SHA256签名密钥" secret:"true"` // 签名放在 X-M7S-Signature 请求头中
+	Headers       map[string]string `desc:"附加的请求头"`
+	Timeout       time.Duration     `default:"5s" desc:"请求超时"`
+	Retry         int               `default:"3" desc:"失败重试次数"`
+	RetryInterval time.Duration     `default:"1s" desc:"首次重试间隔,之后逐次翻倍,为0则立即重试"`
+	QueueSize     int               `default:"1000" desc:"每个回调地址的队列长度,满了之后丢弃事件"`
+}
+
+// Cluster 集群，边缘节点向源站注册本地发布的流，订阅本地不存在的流时从发布该流的节点拉流
+type Cluster struct {
+	Origin    string        `desc:"源站地址,为空则本节点作为源站"` // 例如 http://127.0.0.1:8080
+	Address   string        `desc:"本节点供其他节点访问的地址,为空则不启用集群"`
+	Secret    string        `desc:"节点之间通信的密钥" secret:"true"`
+	Heartbeat time.Duration `default:"10s" desc:"向源站注册的间隔"`  // 超过三个间隔没有注册的节点视为离线
+	Timeout   time.Duration `default:"10s" desc:"请求其他节点的超时"` // 拉流时只限制连接和等待响应头的时间
+}
+
+// Trace OpenTelemetry 链路追踪
+type Trace struct {
+	Endpoint    string            `desc:"OTLP HTTP 接收地址,为空则不启用"` // 例如 localhost:4318
+	URLPath     string            `desc:"OTLP 接收路径,默认为 /v1/traces"`
+	Insecure    bool              `default:"true" desc:"不使用 TLS"`
+	Headers     map[string]string `desc:"上报时附加的请求头"`
+	SampleRatio float64           `default:"1" desc:"采样率"`
+	ServiceName string            `default:"m7s" desc:"服务名"`
+}
+
+var (
+	ErrRecordRoot = errors.New("record root must be a dedicated directory")
+	ErrRecordPath = errors.New("record path must be relative to the record root")
+)
+
+// Check 检查录制根目录和路径模板，根目录不能为空、当前目录或者文件系统的根目录
+func (r *Record) Check() error {
+	if root := filepath.Clean(r.Root); r.Root == "" || root == "." || root == filepath.Dir(root) && filepath.IsAbs(root) {
+		return ErrRecordRoot
+	}
+	_, err := r.Resolve(r.Path)
+	return err
+}
+
+// Resolve 得到录制根目录下的文件路径，绝对路径和包含 .. 的路径会被拒绝
+func (r *Record) Resolve(rel string) (string, error) {
+	if rel == "" || filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" || strings.HasPrefix(rel, "/") || strings.HasPrefix(rel, "\\") {
+		return "", ErrRecordPath
+	}
+	for _, elem := range strings.FieldsFunc(rel, func(c rune) bool { return c == '/' || c == '\\' }) {
+		if elem == ".." {
+			return "", ErrRecordPath
+		}
+	}
+	return filepath.Join(r.Root, rel), nil
+}
+
+// CheckAutoRecord 返回需要自动录制时的录制格式
+func (r *Record) CheckAutoRecord(streamPath string) (format string, ok bool) {
+	for k, v := range r.AutoRecord {
+		if k == streamPath {
+			return util.Conditoinal(v == "", r.Format, v), true
+		}
+		if reg, err := regexp.Compile(k); err == nil && reg.MatchString(streamPath) {
+			return util.Conditoinal(v == "", r.Format, v), true
+		}
+	}
+	return
+}
+
 type Engine struct {
 	Publish
 	Subscribe
 	HTTP
 	Console
+	Record              Record
+	Auth                Auth
+	Webhook             Webhook
+	Cluster             Cluster
+	StreamGroups        map[string][]string     `desc:"码率组，主路径对应各清晰度的流路径"` // 例如 live/test: [live/test_1080, live/test_720]
+	StreamAlias         map[string]string       `desc:"流别名，别名对应真实的流路径"`    // 例如 public/front-door: live/cam1
+	StreamRewrite       map[string]string       `desc:"流路径重写规则(正则)及替换模板"`  // 例如 ^public/(.+)$: live/$1，订阅匹配的路径时订阅替换后的流
+	Overrides           map[string]PathOverride `desc:"按流路径覆盖发布、订阅配置"`     // 例如 live/*: {publish: {buffertime: 10s}}，通配符越具体越优先
+	Trace               Trace
 	EnableAVCC          bool          `default:"true" desc:"启用AVCC格式，rtmp、http-flv协议使用"`                 //启用AVCC格式，rtmp、http-flv协议使用
 	EnableRTP           bool          `default:"true" desc:"启用RTP格式，rtsp、webrtc等协议使用"`                   //启用RTP格式，rtsp、webrtc等协议使用
 	EnableSubEvent      bool          `default:"true" desc:"启用订阅事件,禁用可以提高性能"`                            //启用订阅事件,禁用可以提高性能
@@ -209,10 +329,13 @@ type Engine struct {
 	LogLang             string        `default:"zh" desc:"日志语言" enum:"zh:中文,en:英文"`                      //日志语言
 	LogLevel            string        `default:"info" enum:"trace:跟踪,debug:调试,info:信息,warn:警告,error:错误"` //日志级别
 	EventBusSize        int           `default:"10" desc:"事件总线大小"`                                       //事件总线大小
+	EventHistorySize    int           `default:"1000" desc:"保留的流事件历史条数"`                                 //保留的流事件历史条数
 	PulseInterval       time.Duration `default:"5s" desc:"心跳事件间隔"`                                       //心跳事件间隔
 	DisableAll          bool          `default:"false" desc:"禁用所有插件"`                                    //禁用所有插件
 	RTPReorderBufferLen int           `default:"50" desc:"RTP重排序缓冲区长度"`                                  //RTP重排序缓冲区长度
 	PoolSize            int           `desc:"内存池大小"`                                                     //内存池大小
+	WatchConfig         time.Duration `default:"5s" desc:"检查配置文件修改的间隔,0则只在收到SIGHUP时重新加载"`                //检查配置文件修改的间隔,0则只在收到SIGHUP时重新加载
+	ConfigHistory       int           `default:"20" desc:"每个插件保留的配置历史版本数,0则不保留"`                         //每个插件保留的配置历史版本数,0则不保留
 	enableReport        bool          `default:"false"`                                                  //启用报告,用于统计和监控
 	reportStream        quic.Stream   // console server connection
 	instanceId          string        // instance id 来自console
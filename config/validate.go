@@ -0,0 +1,171 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrUnknownConfig   = errors.New("unknown config")
+	ErrInvalidType     = errors.New("invalid type")
+	ErrInvalidEnum     = errors.New("invalid enum value")
+	ErrInvalidDuration = errors.New("invalid duration, please add unit (s,m,h), eg: 100ms, 10s, 4m, 1h")
+	ErrInvalidRegexp   = errors.New("invalid regexp")
+	ErrInvalidRingSize = errors.New("invalid ring size, eg: 256-1024")
+)
+
+// ValidationError 配置项校验错误，Key 为配置项的路径，例如 publish.ringsize
+type ValidationError struct {
+	Key   string
+	Value any
+	Err   error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %v: %v", e.Key, e.Err, e.Value)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ValidationError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.toMap())
+}
+
+func (e *ValidationError) MarshalYAML() (any, error) {
+	return e.toMap(), nil
+}
+
+func (e *ValidationError) toMap() map[string]any {
+	return map[string]any{"key": e.Key, "value": e.Value, "error": e.Err.Error()}
+}
+
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	s := make([]string, len(errs))
+	for i, e := range errs {
+		s[i] = e.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// Prune 删除 conf 中无法解析的配置项，未知的配置项不影响解析，保留
+func (errs ValidationErrors) Prune(conf map[string]any) {
+	for _, e := range errs {
+		if e.Err == ErrUnknownConfig {
+			continue
+		}
+		m, keys := conf, strings.Split(e.Key, ".")
+		for _, k := range keys[:len(keys)-1] {
+			m, _ = m[k].(map[string]any)
+		}
+		delete(m, keys[len(keys)-1])
+	}
+}
+
+// Validate 按配置结构体校验 conf，不修改配置。检查未知的配置项、值的类型、enum 标签的取值范围、时间、正则表达式和缓冲范围
+func (config *Config) Validate(conf map[string]any) (errs ValidationErrors) {
+	config.validate("", conf, &errs)
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Key < errs[j].Key
+	})
+	return
+}
+
+func (config *Config) validate(prefix string, conf map[string]any, errs *ValidationErrors) {
+	for k, v := range conf {
+		key := prefix + k
+		if !config.Has(k) {
+			*errs = append(*errs, &ValidationError{key, v, ErrUnknownConfig})
+			continue
+		}
+		prop := config.Get(strings.ToLower(k))
+		if prop.props == nil {
+			if err := prop.check(v); err != nil {
+				*errs = append(*errs, &ValidationError{key, v, err})
+			}
+		} else if m, ok := v.(map[string]any); ok {
+			prop.validate(key+".", m, errs)
+		} else if v != nil {
+			*errs = append(*errs, &ValidationError{key, v, ErrInvalidType})
+		}
+	}
+}
+
+// check 检查配置项的值是否可以被 assign 正确解析
+func (config *Config) check(v any) error {
+	if v == nil {
+		return nil
+	}
+	str, isString := v.(string)
+	switch config.Ptr.Type() {
+	case durationType:
+		if _, ok := v.(time.Duration); ok {
+			return nil
+		}
+		if !isString {
+			if reflect.ValueOf(v).IsZero() {
+				return nil
+			}
+			return ErrInvalidDuration
+		}
+		if _, err := time.ParseDuration(str); str != "" && (err != nil || regexPureNumber.MatchString(str)) {
+			return ErrInvalidDuration
+		}
+		return nil
+	case regexpType:
+		if _, err := regexp.Compile(str); !isString || err != nil {
+			return ErrInvalidRegexp
+		}
+		return nil
+	}
+	target := reflect.New(reflect.StructOf([]reflect.StructField{{Name: "Value", Type: config.Ptr.Type(), Tag: `yaml:"value"`}}))
+	b, err := yaml.Marshal(map[string]any{"value": v})
+	if err == nil {
+		err = yaml.Unmarshal(b, target.Interface())
+	}
+	if err != nil {
+		return ErrInvalidType
+	}
+	value := target.Elem().Field(0).Interface()
+	if len(config.Enum) > 0 {
+		valid := false
+		for _, e := range config.Enum {
+			valid = valid || fmt.Sprint(e.Value) == fmt.Sprint(value)
+		}
+		if !valid {
+			return ErrInvalidEnum
+		}
+	}
+	if config.name == "ringsize" {
+		if _, _, err := ParseRingSize(fmt.Sprint(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseRingSize 解析缓冲范围，格式为 最小值-最大值，例如 256-1024
+func ParseRingSize(s string) (minSize, maxSize int, err error) {
+	minStr, maxStr, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, ErrInvalidRingSize
+	}
+	minSize, err1 := strconv.Atoi(strings.TrimSpace(minStr))
+	maxSize, err2 := strconv.Atoi(strings.TrimSpace(maxStr))
+	if err1 != nil || err2 != nil || minSize <= 0 || minSize > maxSize {
+		return 0, 0, ErrInvalidRingSize
+	}
+	return
+}
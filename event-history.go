@@ -0,0 +1,177 @@
+package engine
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"m7s.live/engine/v4/config"
+)
+
+// 事件记录的类型
+const (
+	EVENT_CREATE         = "create"
+	EVENT_WAITPUBLISH    = "waitpublish"
+	EVENT_PUBLISH        = "publish"
+	EVENT_TRACKAVALIABLE = "trackavaliable"
+	EVENT_REPUBLISH      = "republish"
+	EVENT_WAITCLOSE      = "waitclose"
+	EVENT_CLOSE          = "close"
+	EVENT_SUBSCRIBE      = "subscribe"
+	EVENT_UNSUBSCRIBE    = "unsubscribe"
+)
+
+// EventRecord 可序列化的流事件记录，用于事件推送和历史查询
+type EventRecord struct {
+	Time           time.Time
+	Type           string
+	StreamPath     string
+	Action         string `json:",omitempty" yaml:",omitempty"`
+	From           string `json:",omitempty" yaml:",omitempty"`
+	To             string `json:",omitempty" yaml:",omitempty"`
+	Subscriber     string `json:",omitempty" yaml:",omitempty"` // 订阅者ID
+	SubscriberType string `json:",omitempty" yaml:",omitempty"`
+}
+
+// EventFilter 事件过滤条件，字段为空时不过滤
+type EventFilter struct {
+	StreamPath string
+	Types      map[string]bool
+	Since      time.Time
+	Until      time.Time
+}
+
+func (f *EventFilter) Match(record *EventRecord) bool {
+	if f.StreamPath != "" && f.StreamPath != record.StreamPath {
+		return false
+	}
+	if len(f.Types) > 0 && !f.Types[record.Type] {
+		return false
+	}
+	if !f.Since.IsZero() && record.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && record.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// parseEventFilter 从查询参数 streamPath、type（逗号分隔）、since、until 中解析过滤条件
+func parseEventFilter(q url.Values) (filter EventFilter, err error) {
+	filter.StreamPath = q.Get("streamPath")
+	if v := q.Get("type"); v != "" {
+		filter.Types = make(map[string]bool)
+		for _, t := range strings.Split(v, ",") {
+			filter.Types[strings.TrimSpace(t)] = true
+		}
+	}
+	if v := q.Get("since"); v != "" {
+		if filter.Since, err = parseTime(v); err != nil {
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		filter.Until, err = parseTime(v)
+	}
+	return
+}
+
+// EventHistory 最近的流事件，容量由 EventHistorySize 决定，流关闭后依然可以查询
+var EventHistory eventHistory
+
+type eventHistory struct {
+	sync.RWMutex
+	records   []EventRecord
+	listeners map[chan EventRecord]struct{}
+}
+
+// Add 记录事件并推送给所有监听者，监听者处理不过来时丢弃事件而不阻塞事件总线
+func (h *eventHistory) Add(record EventRecord) {
+	h.Lock()
+	defer h.Unlock()
+	if size := config.Global.EventHistorySize; size > 0 {
+		if len(h.records) >= size {
+			n := copy(h.records, h.records[len(h.records)-size+1:])
+			h.records = h.records[:n]
+		}
+		h.records = append(h.records, record)
+	}
+	for ch := range h.listeners {
+		select {
+		case ch <- record:
+		default:
+		}
+	}
+}
+
+// Listen 监听新的事件，使用完毕后需要调用 cancel
+func (h *eventHistory) Listen() (ch chan EventRecord, cancel func()) {
+	ch = make(chan EventRecord, 64)
+	h.Lock()
+	if h.listeners == nil {
+		h.listeners = make(map[chan EventRecord]struct{})
+	}
+	h.listeners[ch] = struct{}{}
+	h.Unlock()
+	return ch, func() {
+		h.Lock()
+		delete(h.listeners, ch)
+		h.Unlock()
+	}
+}
+
+// Query 按时间顺序返回符合条件的历史事件
+func (h *eventHistory) Query(filter *EventFilter) (records []EventRecord) {
+	h.RLock()
+	defer h.RUnlock()
+	for i := range h.records {
+		if filter.Match(&h.records[i]) {
+			records = append(records, h.records[i])
+		}
+	}
+	return
+}
+
+// newEventRecord 将流状态事件和订阅者加入、离开事件转换为事件记录
+func newEventRecord(event any) (record EventRecord, ok bool) {
+	switch v := event.(type) {
+	case SEcreate:
+		return EventRecord{Time: v.Time, Type: EVENT_CREATE, StreamPath: v.Target.Path}, true
+	case SEwaitPublish:
+		return newStateRecord(EVENT_WAITPUBLISH, v.StateEvent), true
+	case SEpublish:
+		return newStateRecord(EVENT_PUBLISH, v.StateEvent), true
+	case SEtrackAvaliable:
+		return newStateRecord(EVENT_TRACKAVALIABLE, v.StateEvent), true
+	case SErepublish:
+		return newStateRecord(EVENT_REPUBLISH, v.StateEvent), true
+	case SEwaitClose:
+		return newStateRecord(EVENT_WAITCLOSE, v.StateEvent), true
+	case SEclose:
+		return newStateRecord(EVENT_CLOSE, v.StateEvent), true
+	case UnsubscribeEvent:
+		return newSubscriberRecord(EVENT_UNSUBSCRIBE, v.Time, v.Target), true
+	case ISubscriber:
+		return newSubscriberRecord(EVENT_SUBSCRIBE, time.Now(), v), true
+	}
+	return
+}
+
+func newStateRecord(t string, se StateEvent) EventRecord {
+	record := EventRecord{Time: se.Time, Type: t, StreamPath: se.Target.Path, Action: se.Action.String(), From: se.From.String()}
+	if next, ok := se.Next(); ok {
+		record.To = next.String()
+	}
+	return record
+}
+
+func newSubscriberRecord(t string, at time.Time, suber ISubscriber) EventRecord {
+	io := suber.GetSubscriber()
+	record := EventRecord{Time: at, Type: t, Subscriber: io.ID, SubscriberType: io.Type}
+	if io.Stream != nil {
+		record.StreamPath = io.Stream.Path
+	}
+	return record
+}
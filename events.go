@@ -76,14 +76,48 @@ type SEKick struct {
 	Event[struct{}]
 }
 
+// FailoverEvent 发布者超时后由备用发布者接替的事件
+type FailoverEvent struct {
+	Event[*Stream]
+	From IPublisher // 超时的发布者
+	To   IPublisher // 接替的备用发布者
+}
+
 type UnsubscribeEvent struct {
 	Event[ISubscriber]
 }
 
+// PullerReconnectEvent 远程拉流断开后重连的事件
+type PullerReconnectEvent struct {
+	Event[IPuller]
+	StreamPath string
+	URL        string
+	Count      int   // 第几次重连
+	Error      error // 上次断开的原因
+}
+
+// AuthFailEvent 发布或者订阅鉴权失败的事件
+type AuthFailEvent struct {
+	Event[*AuthRequest]
+	Error error
+}
+
+// TrackSwitchEvent 订阅者切换了轨道，在新轨道的第一帧之前送给订阅者，之后会送出新轨道的 VideoDeConf 或 AudioDeConf
+type TrackSwitchEvent struct {
+	Event[common.Track] // 新的轨道
+	From                common.Track
+}
+
 type AddTrackEvent struct {
 	Event[common.Track]
 }
 
+// MP4EOFEvent mp4 文件播放到结尾的事件，Loop 为 true 时会从头继续播放
+type MP4EOFEvent struct {
+	Event[*MP4Publisher]
+	Loop bool
+}
+
 // InvitePublishEvent 邀请推流事件(按需拉流)
 type InvitePublish struct {
 	Event[string]
@@ -7,11 +7,13 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v3"
 	"m7s.live/engine/v4/codec"
 	"m7s.live/engine/v4/config"
+	"m7s.live/engine/v4/track"
 	"m7s.live/engine/v4/util"
 )
 
@@ -38,6 +40,41 @@ func (conf *GlobalConfig) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (conf *GlobalConfig) OnEvent(event any) {
+	switch v := event.(type) {
+	case UpdateConfig:
+		// 全局配置热更新
+		setLogLevel()
+		util.RTPReorderBufferLen = uint16(conf.RTPReorderBufferLen)
+		loadStreamGroups(conf.StreamGroups)
+		loadStreamAliases(conf.StreamAlias, conf.StreamRewrite)
+		for _, err := range conf.CheckOverrides() {
+			Engine.Error("path overrides", zap.Error(err))
+		}
+	case SEpublish:
+		if format, ok := conf.Record.CheckAutoRecord(v.Target.Path); ok {
+			policy := conf.Record
+			policy.Format = format
+			go func() {
+				if _, err := StartRecord(v.Target.Path, policy); err != nil && err != ErrRecording {
+					Engine.Error("auto record", zap.String("stream", v.Target.Path), zap.Error(err))
+				}
+			}()
+		}
+	}
+	if record, ok := newEventRecord(event); ok {
+		EventHistory.Add(record)
+		countStateTransition(&record)
+	}
+	if webhooks != nil {
+		webhooks.OnEvent(event)
+	}
+	if cluster != nil {
+		cluster.OnEvent(event)
+	}
+	conf.Engine.OnEvent(event)
+}
+
 func (conf *GlobalConfig) API_summary(rw http.ResponseWriter, r *http.Request) {
 	util.ReturnValue(&summary, rw, r)
 }
@@ -48,8 +85,11 @@ func (conf *GlobalConfig) API_plugins(rw http.ResponseWriter, r *http.Request) {
 
 func (conf *GlobalConfig) API_stream(rw http.ResponseWriter, r *http.Request) {
 	if streamPath := r.URL.Query().Get("streamPath"); streamPath != "" {
-		if s := Streams.Get(streamPath); s != nil {
-			util.ReturnValue(s, rw, r)
+		if s := Streams.Get(ResolveStreamPath(streamPath)); s != nil {
+			util.ReturnValue(struct {
+				*Stream
+				Aliases []string `json:",omitempty" yaml:",omitempty"`
+			}{s, AliasesOf(s.Path)}, rw, r)
 		} else {
 			util.ReturnError(util.APIErrorNoStream, NO_SUCH_STREAM, rw, r)
 		}
@@ -58,6 +98,44 @@ func (conf *GlobalConfig) API_stream(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// API_stream_events 以 SSE 实时推送流的状态变化和订阅者的加入、离开，可按 streamPath、type 过滤
+func (conf *GlobalConfig) API_stream_events(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	ch, cancel := EventHistory.Listen()
+	defer cancel()
+	sse := util.NewSSE(w, r.Context())
+	for {
+		select {
+		case <-sse.Done():
+			return
+		case record := <-ch:
+			if !filter.Match(&record) {
+				continue
+			}
+			data, _ := json.Marshal(record)
+			if sse.WriteEvent(record.Type, data) != nil {
+				return
+			}
+		}
+	}
+}
+
+// API_stream_history 查询流事件历史，可按 streamPath、type（逗号分隔）、since、until 过滤，用于追溯流关闭的原因
+func (conf *GlobalConfig) API_stream_history(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	util.ReturnFetchList(func() []EventRecord {
+		return EventHistory.Query(&filter)
+	}, w, r)
+}
+
 func (conf *GlobalConfig) API_sysInfo(rw http.ResponseWriter, r *http.Request) {
 	util.ReturnValue(&SysInfo, rw, r)
 }
@@ -75,6 +153,105 @@ func (conf *GlobalConfig) API_closeStream(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// parseDuration 解析秒数或者 1m30s 这样的时间格式
+func parseDuration(t string) (time.Duration, error) {
+	d, err := time.ParseDuration(t)
+	if err != nil {
+		var seconds float64
+		if seconds, err = strconv.ParseFloat(t, 64); err != nil {
+			return 0, err
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	}
+	return d, nil
+}
+
+// parseTime 解析 unix 时间戳（秒）或者 RFC3339 格式的时间
+func parseTime(t string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(t, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, t)
+}
+
+// API_stream_cue 向流中插入广告标记，type 为 out、in、point，pts 为 90kHz 时间戳，不传则立即生效
+func (conf *GlobalConfig) API_stream_cue(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s := Streams.Get(q.Get("streamPath"))
+	if s == nil {
+		util.ReturnError(util.APIErrorNoStream, NO_SUCH_STREAM, w, r)
+		return
+	}
+	if s.Publisher == nil {
+		util.ReturnError(util.APIErrorNoPublisher, "no publisher", w, r)
+		return
+	}
+	cue := &track.CueMarker{Type: q.Get("type"), Name: q.Get("name")}
+	switch cue.Type {
+	case "":
+		cue.Type = track.CUE_TYPE_POINT
+	case track.CUE_TYPE_OUT, track.CUE_TYPE_IN, track.CUE_TYPE_POINT:
+	default:
+		util.ReturnError(util.APIErrorQueryParse, "invalid type", w, r)
+		return
+	}
+	if v := q.Get("id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			util.ReturnError(util.APIErrorQueryParse, "invalid id", w, r)
+			return
+		}
+		cue.ID = uint32(id)
+	}
+	if v := q.Get("pts"); v != "" {
+		pts, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			util.ReturnError(util.APIErrorQueryParse, "invalid pts", w, r)
+			return
+		}
+		cue.PTS = uint32(pts)
+	}
+	if v := q.Get("duration"); v != "" {
+		var err error
+		if cue.Duration, err = parseDuration(v); err != nil {
+			util.ReturnError(util.APIErrorQueryParse, "invalid duration", w, r)
+			return
+		}
+	}
+	if err := s.Publisher.GetPublisher().WriteCue(cue); err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		return
+	}
+	util.ReturnOK(w, r)
+}
+
+// API_stream_main 设置流的主视频轨道（video）或者主音频轨道（audio），之后加入的订阅者默认订阅主轨道
+func (conf *GlobalConfig) API_stream_main(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s := Streams.Get(q.Get("streamPath"))
+	if s == nil {
+		util.ReturnError(util.APIErrorNoStream, NO_SUCH_STREAM, w, r)
+		return
+	}
+	video, audio := q.Get("video"), q.Get("audio")
+	if video == "" && audio == "" {
+		util.ReturnError(util.APIErrorQueryParse, "video or audio required", w, r)
+		return
+	}
+	var err error
+	if video != "" {
+		err = s.SetMainTrack(video)
+	}
+	if err == nil && audio != "" {
+		err = s.SetMainTrack(audio)
+	}
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	util.ReturnOK(w, r)
+}
+
 // API_getConfig 获取指定的配置信息
 func (conf *GlobalConfig) API_getConfig(w http.ResponseWriter, r *http.Request) {
 	var p *Plugin
@@ -90,7 +267,32 @@ func (conf *GlobalConfig) API_getConfig(w http.ResponseWriter, r *http.Request)
 		p = Engine
 	}
 	var data any
-	if q.Get("yaml") != "" {
+	if streamPath := q.Get("streamPath"); streamPath != "" {
+		// 该插件对指定流路径实际生效的发布、订阅配置
+		var tmp struct {
+			Overrides []string `json:",omitempty" yaml:",omitempty"`
+			Publish   config.Publish
+			Subscribe config.Subscribe
+		}
+		pubConf, ok := p.Config.(config.PublishConfig)
+		if !ok {
+			pubConf = EngineConfig
+		}
+		subConf, ok := p.Config.(config.SubscribeConfig)
+		if !ok {
+			subConf = EngineConfig
+		}
+		tmp.Publish, tmp.Subscribe = pubConf.GetPublishConfig(), *subConf.GetSubscribeConfig()
+		streamPath = strings.Trim(streamPath, "/")
+		tmp.Overrides = EngineConfig.MatchOverrides(streamPath)
+		if conf := EngineConfig.OverridePublish(streamPath, &tmp.Publish); conf != nil {
+			tmp.Publish = *conf
+		}
+		if conf := EngineConfig.OverrideSubscribe(ResolveStreamPath(streamPath), &tmp.Subscribe); conf != nil {
+			tmp.Subscribe = *conf
+		}
+		data = &tmp
+	} else if q.Get("yaml") != "" {
 		var tmp struct {
 			File     string
 			Modified string
@@ -117,33 +319,62 @@ func (conf *GlobalConfig) API_getConfig(w http.ResponseWriter, r *http.Request)
 	util.ReturnValue(data, w, r)
 }
 
-// API_modifyConfig 修改并保存配置
-func (conf *GlobalConfig) API_modifyConfig(w http.ResponseWriter, r *http.Request) {
-	var p *Plugin
-	var q = r.URL.Query()
-	var err error
-	if configName := q.Get("name"); configName != "" {
-		if c, ok := Plugins[configName]; ok {
-			p = c
-		} else {
-			util.ReturnError(util.APIErrorNoConfig, NO_SUCH_CONIFG, w, r)
-			return
+// ValidateConfig 校验配置，插件配置中的 enable 不属于配置结构体
+func (opt *Plugin) ValidateConfig(conf map[string]any) config.ValidationErrors {
+	if _, ok := conf["enable"]; ok && opt != Engine {
+		props := make(map[string]any, len(conf))
+		for k, v := range conf {
+			if k != "enable" {
+				props[k] = v
+			}
 		}
-	} else {
-		p = Engine
+		conf = props
 	}
-	var modified map[string]any
-	if q.Get("yaml") != "" {
+	return opt.RawConfig.Validate(conf)
+}
+
+func decodeConfig(w http.ResponseWriter, r *http.Request) (modified map[string]any, err error) {
+	if r.URL.Query().Get("yaml") != "" {
 		err = yaml.NewDecoder(r.Body).Decode(&modified)
 	} else {
 		err = json.NewDecoder(r.Body).Decode(&modified)
 	}
 	if err != nil {
 		util.ReturnError(util.APIErrorDecode, err.Error(), w, r)
+	}
+	return
+}
+
+// API_validateConfig 只校验要修改的配置而不保存，返回全部错误
+func (conf *GlobalConfig) API_validateConfig(w http.ResponseWriter, r *http.Request) {
+	p := conf.configPlugin(w, r)
+	if p == nil {
+		return
+	}
+	if modified, err := decodeConfig(w, r); err == nil {
+		errs := p.ValidateConfig(modified)
+		util.ReturnFetchList(func() []*config.ValidationError {
+			return append([]*config.ValidationError{}, errs...)
+		}, w, r)
+	}
+}
+
+// API_modifyConfig 修改并保存配置，校验不通过时不保存
+func (conf *GlobalConfig) API_modifyConfig(w http.ResponseWriter, r *http.Request) {
+	p := conf.configPlugin(w, r)
+	if p == nil {
+		return
+	}
+	modified, err := decodeConfig(w, r)
+	if err != nil {
+		return
+	}
+	if errs := p.ValidateConfig(modified); len(errs) > 0 {
+		util.ReturnError(util.APIErrorInvalidConfig, errs.Error(), w, r)
 		return
 	}
 	p.RawConfig.ParseModifyFile(modified)
-	if err = p.Save(); err != nil {
+	if err = p.Save(CONFIG_SOURCE_API); err != nil {
 		util.ReturnError(util.APIErrorSave, err.Error(), w, r)
 		return
 	}
@@ -176,7 +407,7 @@ func (conf *GlobalConfig) API_updateConfig(w http.ResponseWriter, r *http.Reques
 		return
 	}
 	p.RawConfig.ParseModifyFile(modified)
-	if err = p.Save(); err != nil {
+	if err = p.Save(CONFIG_SOURCE_API); err != nil {
 		util.ReturnError(util.APIErrorSave, err.Error(), w, r)
 		return
 	}
@@ -233,6 +464,98 @@ func (conf *GlobalConfig) API_stop_subscribe(w http.ResponseWriter, r *http.Requ
 	util.ReturnOK(w, r)
 }
 
+// API_switch_track 切换订阅者的视频轨道（video）或者音频轨道（audio），视频在下一个关键帧处切换
+func (conf *GlobalConfig) API_switch_track(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s := Streams.Get(q.Get("streamPath"))
+	if s == nil {
+		util.ReturnError(util.APIErrorNoStream, NO_SUCH_STREAM, w, r)
+		return
+	}
+	suber := s.Subscribers.Find(q.Get("id"))
+	if suber == nil {
+		util.ReturnError(util.APIErrorNoSubscriber, "no such subscriber", w, r)
+		return
+	}
+	var err error
+	if video := q.Get("video"); video != "" {
+		err = suber.GetSubscriber().SwitchVideoTrack(video)
+	}
+	if audio := q.Get("audio"); err == nil && audio != "" {
+		err = suber.GetSubscriber().SwitchAudioTrack(audio)
+	}
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	util.ReturnOK(w, r)
+}
+
+// API_record_start 开始录制，format、fragment、maxSize、path 不传则使用全局的录制配置，path 只能是录制根目录下的相对路径
+func (conf *GlobalConfig) API_record_start(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	streamPath := q.Get("streamPath")
+	if streamPath == "" {
+		util.ReturnError(util.APIErrorQueryParse, "streamPath is required", w, r)
+		return
+	}
+	policy := conf.Record
+	if v := q.Get("format"); v != "" {
+		policy.Format = v
+	}
+	if v := q.Get("path"); v != "" {
+		policy.Path = v
+	}
+	if v := q.Get("fragment"); v != "" {
+		var err error
+		if policy.Fragment, err = parseDuration(v); err != nil {
+			util.ReturnError(util.APIErrorQueryParse, "invalid fragment", w, r)
+			return
+		}
+	}
+	if v := q.Get("maxSize"); v != "" {
+		var err error
+		if policy.MaxSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			util.ReturnError(util.APIErrorQueryParse, "invalid maxSize", w, r)
+			return
+		}
+	}
+	if err := policy.Check(); err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	if _, err := StartRecord(streamPath, policy); err != nil {
+		util.ReturnError(util.APIErrorInternal, err.Error(), w, r)
+		return
+	}
+	util.ReturnOK(w, r)
+}
+
+func (conf *GlobalConfig) API_record_stop(w http.ResponseWriter, r *http.Request) {
+	recorder, ok := Recorders.Load(r.URL.Query().Get("streamPath"))
+	if !ok {
+		util.ReturnError(util.APIErrorNotFound, "no such recorder", w, r)
+		return
+	}
+	recorder.(*Recorder).Stop(zap.String("reason", "stop by api"))
+	util.ReturnOK(w, r)
+}
+
+// API_record_list 正在进行的录制以及录制目录下的录像文件
+func (conf *GlobalConfig) API_record_list(w http.ResponseWriter, r *http.Request) {
+	util.ReturnFetchValue(func() (result struct {
+		Recording []any
+		Files     []RecordFile
+	}) {
+		Recorders.Range(func(key, value any) bool {
+			result.Recording = append(result.Recording, value)
+			return true
+		})
+		result.Files = ListRecords(&conf.Record)
+		return
+	}, w, r)
+}
+
 func (conf *GlobalConfig) API_replay_rtpdump(w http.ResponseWriter, r *http.Request) {
 	q := r.URL.Query()
 	streamPath := q.Get("streamPath")
@@ -337,6 +660,14 @@ func (conf *GlobalConfig) API_replay_mp4(w http.ResponseWriter, r *http.Request)
 		dumpFile = streamPath + ".mp4"
 	}
 	var pub MP4Publisher
+	pub.Loop = q.Get("loop") == "true" || q.Get("loop") == "1"
+	if speed := q.Get("speed"); speed != "" {
+		var err error
+		if pub.Replay.Speed, err = strconv.ParseFloat(speed, 64); err != nil || pub.Replay.Speed <= 0 {
+			util.ReturnError(util.APIErrorQueryParse, "invalid speed", w, r)
+			return
+		}
+	}
 	f, err := os.Open(dumpFile)
 	if err != nil {
 		util.ReturnError(util.APIErrorOpen, err.Error(), w, r)
@@ -350,3 +681,56 @@ func (conf *GlobalConfig) API_replay_mp4(w http.ResponseWriter, r *http.Request)
 		go pub.ReadMP4Data(f)
 	}
 }
+
+func getMP4Publisher(w http.ResponseWriter, r *http.Request) *MP4Publisher {
+	s := Streams.Get(r.URL.Query().Get("streamPath"))
+	if s == nil {
+		util.ReturnError(util.APIErrorNoStream, NO_SUCH_STREAM, w, r)
+		return nil
+	}
+	if pub, ok := s.Publisher.(*MP4Publisher); ok {
+		return pub
+	}
+	util.ReturnError(util.APIErrorNoPublisher, "publisher is not mp4 replay", w, r)
+	return nil
+}
+
+// API_replay_mp4_seek 定位到指定时间，time 可以是秒数或者 1m30s 这样的格式
+func (conf *GlobalConfig) API_replay_mp4_seek(w http.ResponseWriter, r *http.Request) {
+	pos, err := parseDuration(r.URL.Query().Get("time"))
+	if err != nil {
+		util.ReturnError(util.APIErrorQueryParse, "invalid time", w, r)
+		return
+	}
+	if pub := getMP4Publisher(w, r); pub != nil {
+		pub.Seek(pos)
+		util.ReturnOK(w, r)
+	}
+}
+
+func (conf *GlobalConfig) API_replay_mp4_pause(w http.ResponseWriter, r *http.Request) {
+	if pub := getMP4Publisher(w, r); pub != nil {
+		pub.Pause()
+		util.ReturnOK(w, r)
+	}
+}
+
+func (conf *GlobalConfig) API_replay_mp4_resume(w http.ResponseWriter, r *http.Request) {
+	if pub := getMP4Publisher(w, r); pub != nil {
+		pub.Resume()
+		util.ReturnOK(w, r)
+	}
+}
+
+// API_replay_mp4_speed 设置播放倍速，例如 speed=0.5、2、4
+func (conf *GlobalConfig) API_replay_mp4_speed(w http.ResponseWriter, r *http.Request) {
+	speed, err := strconv.ParseFloat(r.URL.Query().Get("speed"), 64)
+	if err != nil || speed <= 0 {
+		util.ReturnError(util.APIErrorQueryParse, "invalid speed", w, r)
+		return
+	}
+	if pub := getMP4Publisher(w, r); pub != nil {
+		pub.SetSpeed(speed)
+		util.ReturnOK(w, r)
+	}
+}
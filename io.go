@@ -49,7 +49,11 @@ type IO struct {
 	io.Writer               `json:"-" yaml:"-"`
 	io.Closer               `json:"-" yaml:"-"`
 	Args                    url.Values
-	Spesific                common.IIO `json:"-" yaml:"-"`
+	Spesific                common.IIO      `json:"-" yaml:"-"`
+	Permission              *Permission     // 鉴权服务返回的权限
+	plugin                  string          // 所属插件名称
+	traceCtx                context.Context // 追踪的父级上下文
+	spanCtx                 context.Context // IO.receive 追踪的上下文，流的状态追踪以发布者的该上下文为父级
 }
 
 func (io *IO) GetStream() common.IStream {
@@ -129,6 +133,8 @@ var (
 	ErrBadStreamName    = errors.New("StreamPath Illegal")
 	ErrBadTrackName     = errors.New("Track Already Exist")
 	ErrTrackMute        = errors.New("Track Mute")
+	ErrTrackNotFound    = errors.New("Track Not Found")
+	ErrTrackNotMedia    = errors.New("Track Not Audio Or Video")
 	ErrStreamIsClosed   = errors.New("Stream Is Closed")
 	ErrPublisherLost    = errors.New("Publisher Lost")
 	ErrAuth             = errors.New("Auth Failed")
@@ -151,7 +157,7 @@ func (io *IO) auth(key string, secret string, expire string) bool {
 }
 
 // receive 用于接收发布或者订阅
-func (io *IO) receive(streamPath string, specific common.IIO) error {
+func (io *IO) receive(streamPath string, specific common.IIO) (err error) {
 	streamPath = strings.Trim(streamPath, "/")
 	u, err := url.Parse(streamPath)
 	if err != nil {
@@ -163,14 +169,40 @@ func (io *IO) receive(streamPath string, specific common.IIO) error {
 		return err
 	}
 	io.Args = u.Query()
+	parent := io.traceCtx
+	if parent == nil {
+		parent = io.Context
+	}
+	ctx, span := startSpan(parent, "IO.receive", u.Path, io.plugin)
+	io.spanCtx = ctx
+	defer func() {
+		span.SetAttributes(TRACE_ATTR_TYPE.String(io.Type))
+		endSpan(span, err)
+	}()
 	wt := time.Second * 5
 	var iSub ISubscriber
 	var iPub IPublisher
 	var isSubscribe bool
 	if iSub, isSubscribe = specific.(ISubscriber); isSubscribe {
-		wt = iSub.GetSubscriber().Config.WaitTimeout
+		suber := iSub.GetSubscriber()
+		// 订阅别名时订阅真实的流
+		if realPath := ResolveStreamPath(u.Path); realPath != u.Path {
+			log.Debug("alias", zap.String("alias", u.Path), zap.String("streamPath", realPath))
+			u.Path = realPath
+		}
+		// 内部订阅者的配置由插件自行决定，不受流路径的覆盖配置影响
+		if !suber.Config.Internal {
+			if conf := EngineConfig.OverrideSubscribe(u.Path, suber.Config); conf != nil {
+				suber.Config = conf
+			}
+		}
+		wt = suber.Config.WaitTimeout
 	} else {
 		iPub = specific.(IPublisher)
+		puber := iPub.GetPublisher()
+		if conf := EngineConfig.OverridePublish(u.Path, puber.Config); conf != nil {
+			puber.Config = conf
+		}
 	}
 	s, create := findOrCreateStream(u.Path, wt)
 	if s == nil {
@@ -205,6 +237,7 @@ func (io *IO) receive(streamPath string, specific common.IIO) error {
 	}
 	defer func() {
 		if err == nil {
+			io.limitDuration()
 			specific.OnEvent(specific)
 		}
 	}()
@@ -215,26 +248,17 @@ func (io *IO) receive(streamPath string, specific common.IIO) error {
 		s.pubLocker.Lock()
 		defer s.pubLocker.Unlock()
 		if _, isPuller := specific.(IPuller); config.Global.EnableAuth && !isPuller {
-			onAuthPub := OnAuthPub
-			if auth, ok := specific.(AuthPub); ok {
-				onAuthPub = auth.OnAuth
-			}
-			if onAuthPub != nil {
-				authPromise := util.NewPromise(iPub)
-				if err = onAuthPub(authPromise); err == nil {
-					err = authPromise.Await()
-				}
-				if err != nil {
-					return err
-				}
-			} else if conf.Key != "" {
-				if !io.auth(conf.Key, io.Args.Get(conf.SecretArgName), io.Args.Get(conf.ExpireArgName)) {
-					return ErrAuth
-				}
+			_, authSpan := startSpan(ctx, "IO.auth", s.Path, io.plugin)
+			err = io.authPublish(iPub, conf)
+			if endSpan(authSpan, err); err != nil {
+				EventBus <- AuthFailEvent{CreateEvent(io.authRequest(AUTH_ACTION_PUBLISH)), err}
+				return err
 			}
 		}
 		if promise := util.NewPromise(iPub); s.Receive(promise) {
+			_, waitSpan := startSpan(ctx, "IO.wait", s.Path, io.plugin)
 			err = promise.Await()
+			endSpan(waitSpan, err)
 			return err
 		}
 	} else {
@@ -244,32 +268,67 @@ func (io *IO) receive(streamPath string, specific common.IIO) error {
 			EventBus <- InvitePublish{CreateEvent(s.Path)} // 通知发布者按需拉流
 		}
 		if config.Global.EnableAuth && !conf.Internal {
-			onAuthSub := OnAuthSub
-			if auth, ok := specific.(AuthSub); ok {
-				onAuthSub = auth.OnAuth
-			}
-			if onAuthSub != nil {
-				authPromise := util.NewPromise(iSub)
-				if err = onAuthSub(authPromise); err == nil {
-					err = authPromise.Await()
-				}
-				if err != nil {
-					return err
-				}
-			} else if conf.Key != "" {
-				if !io.auth(conf.Key, io.Args.Get(conf.SecretArgName), io.Args.Get(conf.ExpireArgName)) {
-					return ErrAuth
-				}
+			_, authSpan := startSpan(ctx, "IO.auth", s.Path, io.plugin)
+			err = io.authSubscribe(iSub, conf)
+			if endSpan(authSpan, err); err != nil {
+				EventBus <- AuthFailEvent{CreateEvent(io.authRequest(AUTH_ACTION_SUBSCRIBE)), err}
+				return err
 			}
 		}
 		if promise := util.NewPromise(iSub); s.Receive(promise) {
+			_, waitSpan := startSpan(ctx, "IO.wait", s.Path, io.plugin)
 			err = promise.Await()
+			endSpan(waitSpan, err)
 			return err
 		}
 	}
 	return ErrStreamIsClosed
 }
 
+// authPublish 发布鉴权，依次使用发布者自己的 OnAuth、全局的 OnAuthPub、鉴权服务、Key 签名
+func (io *IO) authPublish(iPub IPublisher, conf *config.Publish) (err error) {
+	onAuthPub := OnAuthPub
+	if auth, ok := iPub.(AuthPub); ok {
+		onAuthPub = auth.OnAuth
+	}
+	if onAuthPub != nil {
+		authPromise := util.NewPromise(iPub)
+		if err = onAuthPub(authPromise); err == nil {
+			err = authPromise.Await()
+		}
+		return
+	} else if provider := io.authProvider(); provider != nil {
+		io.Permission, err = provider.Auth(io.authRequest(AUTH_ACTION_PUBLISH))
+	} else if conf.Key != "" {
+		if !io.auth(conf.Key, io.Args.Get(conf.SecretArgName), io.Args.Get(conf.ExpireArgName)) {
+			return ErrAuth
+		}
+	}
+	return
+}
+
+// authSubscribe 订阅鉴权，依次使用订阅者自己的 OnAuth、全局的 OnAuthSub、鉴权服务、Key 签名
+func (io *IO) authSubscribe(iSub ISubscriber, conf *config.Subscribe) (err error) {
+	onAuthSub := OnAuthSub
+	if auth, ok := iSub.(AuthSub); ok {
+		onAuthSub = auth.OnAuth
+	}
+	if onAuthSub != nil {
+		authPromise := util.NewPromise(iSub)
+		if err = onAuthSub(authPromise); err == nil {
+			err = authPromise.Await()
+		}
+		return
+	} else if provider := io.authProvider(); provider != nil {
+		io.Permission, err = provider.Auth(io.authRequest(AUTH_ACTION_SUBSCRIBE))
+	} else if conf.Key != "" {
+		if !io.auth(conf.Key, io.Args.Get(conf.SecretArgName), io.Args.Get(conf.ExpireArgName)) {
+			return ErrAuth
+		}
+	}
+	return
+}
+
 // ClientIO 作为Client角色(Puller，Pusher)的公共结构体
 type ClientIO[C ClientConfig] struct {
 	Config         *C
@@ -18,7 +18,6 @@ import (
 	"github.com/google/uuid"
 	. "github.com/logrusorgru/aurora/v4"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 	"gopkg.in/yaml.v3"
 	"m7s.live/engine/v4/lang"
 	"m7s.live/engine/v4/log"
@@ -68,6 +67,8 @@ func Run(ctx context.Context, conf any) (err error) {
 		}
 		if ConfigRaw, err = os.ReadFile(v); err != nil {
 			log.Warn("read config file error:", err.Error())
+		} else {
+			configFile = v
 		}
 	case []byte:
 		ConfigRaw = v
@@ -91,27 +92,33 @@ func Run(ctx context.Context, conf any) (err error) {
 	}
 	Engine.RawConfig.Parse(&EngineConfig.Engine, "GLOBAL")
 	if cg != nil {
+		validateConfig(Engine, "global", cg["global"])
 		Engine.RawConfig.ParseUserFile(cg["global"])
 	}
 	var logger log.Logger
 	log.LocaleLogger = logger.Lang(lang.Get(EngineConfig.LogLang))
-	if EngineConfig.LogLevel == "trace" {
-		log.Trace = true
-		log.LogLevel.SetLevel(zap.DebugLevel)
-	} else {
-		loglevel, err := zapcore.ParseLevel(EngineConfig.LogLevel)
-		if err != nil {
-			logger.Error("parse log level error:", zap.Error(err))
-			loglevel = zapcore.InfoLevel
-		}
-		log.LogLevel.SetLevel(loglevel)
-	}
+	setLogLevel()
 
 	Engine.Logger = log.LocaleLogger.Named("engine")
 
 	Engine.assign()
 	Engine.Logger.Debug("", zap.Any("config", EngineConfig))
 	util.PoolSize = EngineConfig.PoolSize
+	if err = initTrace(ctx, &EngineConfig.Trace); err != nil {
+		Engine.Error("init trace", zap.Error(err))
+	}
+	if provider, err := NewAuthProvider(&EngineConfig.Auth); err != nil {
+		Engine.Error("init auth", zap.Error(err))
+	} else if provider != nil {
+		RegisterAuthProvider("", provider)
+	}
+	startWebhooks(ctx, &EngineConfig.Webhook)
+	startCluster(ctx, &EngineConfig.Cluster)
+	loadStreamGroups(EngineConfig.StreamGroups)
+	loadStreamAliases(EngineConfig.StreamAlias, EngineConfig.StreamRewrite)
+	for _, err := range EngineConfig.CheckOverrides() {
+		Engine.Error("path overrides", zap.Error(err))
+	}
 	EventBus = make(chan any, EngineConfig.EventBusSize)
 	go EngineConfig.Listen(Engine)
 	for _, plugin := range plugins {
@@ -138,6 +145,7 @@ func Run(ctx context.Context, conf any) (err error) {
 			}
 		}
 		userConfig = cg[strings.ToLower(plugin.Name)]
+		validateConfig(plugin, strings.ToLower(plugin.Name), userConfig)
 		plugin.RawConfig.ParseUserFile(userConfig)
 		if EngineConfig.DisableAll {
 			plugin.Disabled = true
@@ -147,6 +155,9 @@ func Run(ctx context.Context, conf any) (err error) {
 		} else if userConfig["enable"] == true {
 			plugin.Disabled = false
 		}
+		if os.Getenv(strings.ToUpper(plugin.Name)+"_ENABLE") == "true" {
+			plugin.Disabled = false
+		}
 		if plugin.Disabled {
 			plugin.Warn("plugin disabled")
 		} else {
@@ -218,6 +229,7 @@ func Run(ctx context.Context, conf any) (err error) {
 	json.NewEncoder(contentBuf).Encode(&rp)
 	req.Body = io.NopCloser(contentBuf)
 	EngineConfig.OnEvent(ctx)
+	go watchConfig(ctx)
 	go func() {
 		var c http.Client
 		reportTimer := time.NewTimer(time.Minute)
@@ -254,3 +266,12 @@ func Run(ctx context.Context, conf any) (err error) {
 		}
 	}
 }
+
+// validateConfig 校验配置文件中插件的配置，报告全部错误，并删除无法解析的配置项以免启动时退出
+func validateConfig(p *Plugin, section string, conf map[string]any) {
+	errs := p.ValidateConfig(conf)
+	for _, err := range errs {
+		log.Errorf("config %s %s.%v", configFile, section, err)
+	}
+	errs.Prune(conf)
+}
@@ -0,0 +1,225 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+)
+
+var (
+	// 测试用的 SPS，分别为 640x480 和 1280x720
+	testSPS480 = []byte{0x67, 0x42, 0xc0, 0x1e, 0xd9, 0x00, 0xa0, 0x3d, 0xa1, 0x00, 0x00, 0x03, 0x00, 0x01, 0x00, 0x00, 0x03, 0x00, 0x32, 0x0f, 0x16, 0x2e, 0x48}
+	testSPS720 = []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60}
+	// testDir 测试引擎的数据目录，时移、录像和配置缓存都在这里
+	testDir string
+)
+
+// TestReadyConfig 测试用的插件，引擎初始化完成后通知 TestMain
+type TestReadyConfig struct {
+	ready chan struct{}
+}
+
+func (c *TestReadyConfig) OnEvent(event any) {
+	if _, ok := event.(*GlobalConfig); ok {
+		close(c.ready)
+	}
+}
+
+// startTestEngine 启动引擎并等待初始化完成，每个进程只能调用一次
+func startTestEngine(ctx context.Context, conf any) bool {
+	ready := &TestReadyConfig{ready: make(chan struct{})}
+	InstallPlugin(ready)
+	go Run(ctx, conf)
+	select {
+	case <-ready.ready:
+		return true
+	case <-ctx.Done():
+	case <-time.After(time.Second * 10):
+	}
+	return false
+}
+
+// TestMain 启动一个只发布视频的引擎供所有测试使用，数据目录通过配置指向临时目录
+func TestMain(m *testing.M) {
+	if os.Getenv(clusterTestConfig) != "" {
+		os.Exit(m.Run()) // 集群测试的子进程由 TestClusterNode 自行启动引擎
+	}
+	var err error
+	if testDir, err = os.MkdirTemp("", "m7s-test"); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	SettingDir = filepath.Join(testDir, ".m7s")
+	ctx, cancel := context.WithCancel(context.Background())
+	code := 1
+	if startTestEngine(ctx, []byte(fmt.Sprintf(`global:
+  loglevel: error
+  http:
+    listenaddr: 127.0.0.1:0
+    listenaddrtls: ""
+  publish:
+    pubaudio: false
+    delayclosetimeout: 1m
+    timeshiftpath: %s
+  record:
+    root: %s
+`, filepath.Join(testDir, "timeshift"), filepath.Join(testDir, "record")))) {
+		code = m.Run()
+	} else {
+		fmt.Fprintln(os.Stderr, "engine not ready")
+	}
+	cancel()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
+// testVideoPublisher 以 AVCC 格式发布 H264 视频，可以同时发布具名的视频轨道
+type testVideoPublisher struct {
+	Publisher
+	pool util.BytesPool
+}
+
+// publishTestVideo 发布测试流，setup 可以在发布前修改发布者（例如配置）
+func publishTestVideo(t *testing.T, streamPath string, setup ...func(*Publisher)) *testVideoPublisher {
+	pub := &testVideoPublisher{pool: make(util.BytesPool, 17)}
+	for _, f := range setup {
+		f(&pub.Publisher)
+	}
+	if err := Engine.Publish(streamPath, pub); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pub.Stop()
+	})
+	return pub
+}
+
+func (p *testVideoPublisher) avcc(b ...[]byte) *util.BLL {
+	var frame util.BLL
+	for _, v := range b {
+		frame.Push(p.pool.GetShell(v))
+	}
+	return &frame
+}
+
+// sequenceHead 以 AVCDecoderConfigurationRecord 作为序列帧
+func (p *testVideoPublisher) sequenceHead(sps []byte) *util.BLL {
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	return p.avcc([]byte{0x17, 0, 0, 0, 0, 1, sps[1], sps[2], sps[3], 0xff, 0xe1, 0, byte(len(sps))}, sps, []byte{1, 0, byte(len(pps))}, pps)
+}
+
+func (p *testVideoPublisher) frame(idr bool) *util.BLL {
+	if idr {
+		return p.avcc([]byte{0x17, 1, 0, 0, 0, 0, 0, 0, 4, 0x65, 0x88, 0x84, 0x00})
+	}
+	return p.avcc([]byte{0x27, 1, 0, 0, 0, 0, 0, 0, 3, 0x41, 0x9a, 0x00})
+}
+
+// writeVideo 写入主视频轨道，name 不为空时写入具名轨道
+func (p *testVideoPublisher) writeVideo(name string, ts uint32, frame *util.BLL) {
+	if name == "" {
+		p.WriteAVCCVideo(ts, frame, p.pool)
+	} else {
+		p.WriteNamedAVCCVideo(name, ts, frame, p.pool)
+	}
+}
+
+// testFrame 订阅者收到的视频帧，帧的内存会被复用，只保留需要检查的字段。switched 为 true 时是切换事件，记录新的轨道
+type testFrame struct {
+	stream   *Stream
+	track    *track.Video
+	name     string
+	seq      uint32
+	idr      bool
+	absTime  uint32
+	switched bool
+}
+
+// testSubscriber 以 PlayRaw 读取视频，按顺序记录收到的帧和切换事件
+type testSubscriber struct {
+	Subscriber
+	frames  chan testFrame
+	stopped chan struct{}
+	wake    func()
+}
+
+// subscribeTestVideo 订阅测试流，wake 写入一帧，唤醒等待下一帧的 PlayRaw 使其退出，setup 可以在订阅前修改订阅者（例如配置）
+func subscribeTestVideo(t *testing.T, streamPath string, wake func(), setup ...func(*Subscriber)) *testSubscriber {
+	sub := &testSubscriber{frames: make(chan testFrame, 1024), stopped: make(chan struct{}), wake: wake}
+	for _, f := range setup {
+		f(&sub.Subscriber)
+	}
+	if err := Engine.Subscribe(streamPath, sub); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer close(sub.stopped)
+		sub.PlayRaw()
+	}()
+	t.Cleanup(sub.stop)
+	return sub
+}
+
+// stop 停止订阅并等待 PlayRaw 返回，之后的操作（例如关闭发布者）不会和读取同时进行。
+// 读取者在等待下一帧时不会检查是否停止，需要再写入一帧
+func (s *testSubscriber) stop() {
+	s.Stop()
+	select {
+	case <-s.stopped:
+		return
+	default:
+	}
+	s.wake()
+	<-s.stopped
+}
+
+func (s *testSubscriber) OnEvent(event any) {
+	switch v := event.(type) {
+	case VideoFrame:
+		stream, _ := v.Video.Publisher.GetStream().(*Stream)
+		s.push(testFrame{stream: stream, track: v.Video, name: v.Video.Name, seq: v.Sequence, idr: v.IFrame, absTime: v.AbsTime})
+	case TrackSwitchEvent:
+		video := v.Target.(*track.Video)
+		stream, _ := video.Publisher.GetStream().(*Stream)
+		s.push(testFrame{stream: stream, track: video, name: video.Name, switched: true})
+	default:
+		s.Subscriber.OnEvent(event)
+	}
+}
+
+// push 读取跟不上时丢弃，不阻塞 PlayBlock
+func (s *testSubscriber) push(f testFrame) {
+	select {
+	case s.frames <- f:
+	default:
+	}
+}
+
+// next 等待下一帧
+func (s *testSubscriber) next(t *testing.T) testFrame {
+	select {
+	case f := <-s.frames:
+		return f
+	case <-time.After(time.Second * 5):
+		t.Fatal("no frame received")
+	}
+	return testFrame{}
+}
+
+// sync 等待订阅者读到所读轨道上最新写入的帧，返回期间收到的帧和切换事件。
+// 测试在写入的协程中交替写入和调用 sync，订阅者读取时轨道不会同时被写入，在 -race 下也不会产生竞争
+func (s *testSubscriber) sync(t *testing.T) (frames []testFrame) {
+	for {
+		f := s.next(t)
+		frames = append(frames, f)
+		if !f.switched && f.seq == f.track.LastValue.Sequence {
+			return
+		}
+	}
+}
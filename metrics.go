@@ -0,0 +1,170 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/track"
+)
+
+// stateMetrics 流状态迁移次数，由事件总线更新
+var stateMetrics struct {
+	sync.Mutex
+	total   map[string]uint64            // action -> 次数
+	streams map[string]map[string]uint64 // streamPath -> action -> 次数，流关闭后删除
+}
+
+func countStateTransition(record *EventRecord) {
+	if record.Action == "" {
+		return
+	}
+	stateMetrics.Lock()
+	defer stateMetrics.Unlock()
+	if stateMetrics.total == nil {
+		stateMetrics.total = make(map[string]uint64)
+		stateMetrics.streams = make(map[string]map[string]uint64)
+	}
+	stateMetrics.total[record.Action]++
+	if record.Type == EVENT_CLOSE {
+		delete(stateMetrics.streams, record.StreamPath)
+		return
+	}
+	actions := stateMetrics.streams[record.StreamPath]
+	if actions == nil {
+		actions = make(map[string]uint64)
+		stateMetrics.streams[record.StreamPath] = actions
+	}
+	actions[record.Action]++
+}
+
+type metricSample struct {
+	labels []string // name、value 交替
+	value  float64
+}
+
+type metricFamily struct {
+	name, typ, help string
+	samples         []metricSample
+}
+
+// metricsWriter 按 Prometheus 文本格式输出指标，同名指标聚合在一起
+type metricsWriter struct {
+	families []*metricFamily
+	index    map[string]*metricFamily
+}
+
+func (m *metricsWriter) add(name, typ, help string, value float64, labels ...string) {
+	if m.index == nil {
+		m.index = make(map[string]*metricFamily)
+	}
+	f := m.index[name]
+	if f == nil {
+		f = &metricFamily{name: name, typ: typ, help: help}
+		m.index[name] = f
+		m.families = append(m.families, f)
+	}
+	f.samples = append(f.samples, metricSample{labels, value})
+}
+
+func (m *metricsWriter) gauge(name, help string, value float64, labels ...string) {
+	m.add(name, "gauge", help, value, labels...)
+}
+
+func (m *metricsWriter) counter(name, help string, value float64, labels ...string) {
+	m.add(name, "counter", help, value, labels...)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metricsWriter) WriteTo(w io.Writer) (n int64, err error) {
+	var b strings.Builder
+	for _, f := range m.families {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, s := range f.samples {
+			b.WriteString(f.name)
+			for i := 0; i+1 < len(s.labels); i += 2 {
+				if i == 0 {
+					b.WriteByte('{')
+				} else {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(&b, `%s="%s"`, s.labels[i], labelEscaper.Replace(s.labels[i+1]))
+			}
+			if len(s.labels) > 1 {
+				b.WriteByte('}')
+			}
+			fmt.Fprintf(&b, " %g\n", s.value)
+		}
+	}
+	nn, err := io.WriteString(w, b.String())
+	return int64(nn), err
+}
+
+// Metrics 以 Prometheus 文本格式输出流和轨道的指标，路径为 /metrics
+func (conf *GlobalConfig) Metrics(w http.ResponseWriter, r *http.Request) {
+	var m metricsWriter
+	streams := Streams.ToList()
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].Path < streams[j].Path
+	})
+	m.gauge("m7s_streams", "Number of streams", float64(len(streams)))
+	for _, s := range streams {
+		collectStreamMetrics(&m, s)
+	}
+	stateMetrics.Lock()
+	actions := make([]string, 0, len(stateMetrics.total))
+	for action := range stateMetrics.total {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	for _, action := range actions {
+		m.counter("m7s_state_transitions_total", "Stream state transitions of all streams", float64(stateMetrics.total[action]), "action", action)
+	}
+	stateMetrics.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+func collectStreamMetrics(m *metricsWriter, s *Stream) {
+	app := s.AppName
+	m.gauge("m7s_stream_state", "Current state of the stream", 1, "stream", s.Path, "app", app, "state", s.State.String())
+	for t, count := range s.Subscribers.CountByType() {
+		m.gauge("m7s_stream_subscribers", "Number of subscribers by type", float64(count), "stream", s.Path, "app", app, "type", t)
+	}
+	if s.Publisher != nil {
+		if puber := s.Publisher.GetPublisher(); puber != nil {
+			m.gauge("m7s_stream_publisher_uptime_seconds", "Seconds since the publisher started", time.Since(puber.StartTime).Seconds(), "stream", s.Path, "app", app, "type", puber.Type)
+		}
+	}
+	stateMetrics.Lock()
+	for action, count := range stateMetrics.streams[s.Path] {
+		m.counter("m7s_stream_state_transitions_total", "Stream state transitions", float64(count), "stream", s.Path, "app", app, "action", action)
+	}
+	stateMetrics.Unlock()
+	s.Tracks.Range(func(name string, t common.Track) {
+		var media *track.Media
+		codec := name
+		switch v := t.(type) {
+		case *track.Video:
+			media, codec = &v.Media, v.CodecID.String()
+			m.gauge("m7s_track_gop", "Frames between the last two key frames", float64(v.GOP), "stream", s.Path, "app", app, "track", name, "codec", codec)
+		case *track.Audio:
+			media, codec = &v.Media, v.CodecID.String()
+		}
+		labels := []string{"stream", s.Path, "app", app, "track", name, "codec", codec}
+		m.gauge("m7s_track_bytes_per_second", "Track bitrate in bytes per second", float64(t.GetBPS()), labels...)
+		m.gauge("m7s_track_fps", "Track frames per second", float64(t.GetFPS()), labels...)
+		m.gauge("m7s_track_drops_per_second", "Dropped frames per second", float64(t.GetDrops()), labels...)
+		m.gauge("m7s_track_ring_size", "Ring buffer size of the track", float64(t.GetRBSize()), labels...)
+		m.gauge("m7s_track_readers", "Number of readers of the track", float64(t.GetReaderCount()), labels...)
+		if media != nil {
+			m.counter("m7s_track_slow_reader_jumps_total", "Times a slow reader jumped to the latest key frame", float64(media.SlowJumps.Load()), labels...)
+		}
+	})
+}
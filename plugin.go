@@ -76,6 +76,10 @@ type Plugin struct {
 	*log.Logger        `json:"-" yaml:"-"`
 	saveTimer          *time.Timer //用于保存的时候的延迟，防抖
 	Disabled           bool
+	authProvider       AuthProvider //插件的鉴权服务
+	saveSource         string       //下次保存的修改来源，记录到配置历史中
+	saveLock           sync.Mutex
+	historyLock        sync.Mutex
 }
 
 func (opt *Plugin) logHandler(pattern string, handler http.Handler) http.Handler {
@@ -165,23 +169,39 @@ func (opt *Plugin) settingPath() string {
 	return filepath.Join(SettingDir, strings.ToLower(opt.Name)+".yaml")
 }
 
-func (opt *Plugin) Save() error {
+// Save 延迟保存动态修改的配置，source 为修改的来源，保存后记录到配置历史中
+func (opt *Plugin) Save(source ...string) error {
+	opt.saveLock.Lock()
+	defer opt.saveLock.Unlock()
+	if len(source) > 0 {
+		opt.saveSource = source[0]
+	} else if opt.saveSource == "" {
+		opt.saveSource = CONFIG_SOURCE_PLUGIN
+	}
 	if opt.saveTimer == nil {
 		var lock sync.Mutex
 		opt.saveTimer = time.AfterFunc(time.Second, func() {
 			lock.Lock()
 			defer lock.Unlock()
-			if opt.RawConfig.Modify == nil {
+			opt.saveLock.Lock()
+			source := opt.saveSource
+			opt.saveSource = ""
+			opt.saveLock.Unlock()
+			initial := opt.readSetting()
+			modify, _ := opt.RawConfig.Modify.(map[string]any)
+			if modify == nil {
 				os.Remove(opt.settingPath())
+				opt.saveVersion(source, nil, initial)
 				return
 			}
 			file, err := os.OpenFile(opt.settingPath(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 			if err == nil {
 				defer file.Close()
-				err = yaml.NewEncoder(file).Encode(opt.RawConfig.Modify)
+				err = yaml.NewEncoder(file).Encode(modify)
 			}
 			if err == nil {
-				opt.Info("config saved")
+				opt.Info("config saved", zap.String("source", source))
+				opt.saveVersion(source, modify, initial)
 			}
 		})
 	} else {
@@ -199,6 +219,9 @@ func (opt *Plugin) AssignPubConfig(puber *Publisher) {
 		copyConfig := conf.GetPublishConfig()
 		puber.Config = &copyConfig
 	}
+	if puber.plugin == "" {
+		puber.plugin = opt.Name
+	}
 }
 
 func (opt *Plugin) Publish(streamPath string, pub IPublisher) error {
@@ -220,7 +243,7 @@ var ErrStreamNotExist = errors.New("stream not exist")
 func (opt *Plugin) SubscribeExist(streamPath string, sub ISubscriber) error {
 	opt.Info("subscribe exsit", zap.String("path", streamPath))
 	path, _, _ := strings.Cut(streamPath, "?")
-	if !Streams.Has(path) {
+	if !Streams.Has(ResolveStreamPath(strings.Trim(path, "/"))) {
 		opt.Warn("stream not exist", zap.String("path", streamPath))
 		return ErrStreamNotExist
 	}
@@ -238,6 +261,9 @@ func (opt *Plugin) AssignSubConfig(suber *Subscriber) {
 	if suber.ID == "" {
 		suber.ID = fmt.Sprintf("%d", uintptr(unsafe.Pointer(suber)))
 	}
+	if suber.plugin == "" {
+		suber.plugin = opt.Name
+	}
 }
 
 // Subscribe 订阅一个流，如果流不存在则创建一个等待流
@@ -304,7 +330,7 @@ func (opt *Plugin) Pull(streamPath string, url string, puller IPuller, save int)
 		})
 	}
 	if save > 0 {
-		if err = opt.Save(); err != nil {
+		if err = opt.Save(CONFIG_SOURCE_PULL); err != nil {
 			opt.Error("save faild", zap.Error(err))
 		}
 	}
@@ -334,7 +360,7 @@ func (opt *Plugin) Push(streamPath string, url string, pusher IPusher, save bool
 	if save {
 		pushConfig.AddPush(url, streamPath)
 		opt.RawConfig.Get("push").Get("pushlist").Modify = pushConfig.PushList
-		if err = opt.Save(); err != nil {
+		if err = opt.Save(CONFIG_SOURCE_PUSH); err != nil {
 			opt.Error("save faild", zap.Error(err))
 		}
 	}
@@ -1,62 +1,275 @@
 package engine
 
 import (
+	"encoding/json"
 	"io"
+	"sync"
+	"time"
 
-	"github.com/yapingcat/gomedia/go-mp4"
 	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/common"
 	"m7s.live/engine/v4/track"
 	"m7s.live/engine/v4/util"
 )
 
+// mp4 点播控制指令，由读取协程统一处理
+type (
+	mp4Seek  time.Duration
+	mp4Speed float64
+	mp4Pause bool
+)
+
+// MP4ReplayState mp4 点播的播放状态
+type MP4ReplayState struct {
+	Speed    float64       // 播放倍速
+	Position time.Duration // 当前播放位置
+	Paused   bool
+}
+
+// mp4ReplayState 只由读取协程加锁修改，HTTP 接口和 JSON 序列化等其他协程通过 Snapshot 读取
+type mp4ReplayState struct {
+	MP4ReplayState
+	lock sync.RWMutex
+}
+
+func (s *mp4ReplayState) Snapshot() MP4ReplayState {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.MP4ReplayState
+}
+
+func (s *mp4ReplayState) update(f func(*MP4ReplayState)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	f(&s.MP4ReplayState)
+}
+
+func (s *mp4ReplayState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Snapshot())
+}
+
 type MP4Publisher struct {
 	Publisher
-	*mp4.MovDemuxer `json:"-" yaml:"-"`
+	*codec.MP4Demuxer `json:"-" yaml:"-"`
+	Loop              bool           // 播放结束后从头循环播放
+	Replay            mp4ReplayState `yaml:"-"` // 播放状态，开始播放前可以直接设置 Speed
+	video, audio      *codec.MP4Track
+	controlOnce       sync.Once
+	control           chan any
+	// 输出时间戳 = outBase + (文件中的时间戳 - segBase) / Speed，seek 或者改变倍速后从下一个样本开始新的一段，保证输出的时间戳连续
+	segBase, outBase, nextOut time.Duration
+	rebase                    bool // 下一个样本开始新的一段
+}
+
+func (p *MP4Publisher) controlChan() chan any {
+	p.controlOnce.Do(func() {
+		p.control = make(chan any, 1)
+	})
+	return p.control
+}
+
+func (p *MP4Publisher) sendControl(c any) bool {
+	select {
+	case p.controlChan() <- c:
+		return true
+	case <-p.Done():
+		return false
+	}
+}
+
+// Seek 定位到 pos 之前最近的关键帧
+func (p *MP4Publisher) Seek(pos time.Duration) bool {
+	return p.sendControl(mp4Seek(pos))
+}
+
+func (p *MP4Publisher) Pause() bool {
+	return p.sendControl(mp4Pause(true))
+}
+
+func (p *MP4Publisher) Resume() bool {
+	return p.sendControl(mp4Pause(false))
+}
+
+// SetSpeed 设置播放倍速，例如 0.5、2、4
+func (p *MP4Publisher) SetSpeed(speed float64) bool {
+	return speed > 0 && p.sendControl(mp4Speed(speed))
 }
 
 // Start reading the MP4 file
 func (p *MP4Publisher) ReadMP4Data(source io.ReadSeeker) error {
 	defer p.Stop()
-	p.MovDemuxer = mp4.CreateMp4Demuxer(source)
-	if tracks, err := p.ReadHead(); err != nil {
-		if err == io.EOF {
-			p.Info("Reached end of MP4 file")
-			return nil
-		}
+	control := p.controlChan()
+	p.MP4Demuxer = codec.NewMP4Demuxer(source)
+	if err := p.Demux(); err != nil {
 		p.Error("Error reading MP4 header", zap.Error(err))
 		return err
-	} else {
-		info := p.GetMp4Info()
-		p.Info("MP4 info", zap.Any("info", info))
-		for _, t := range tracks {
-			p.Info("MP4 track", zap.Any("track", t))
-			switch t.Cid {
-			case mp4.MP4_CODEC_H264:
-				p.VideoTrack = track.NewH264(p)
-			case mp4.MP4_CODEC_H265:
-				p.VideoTrack = track.NewH265(p)
-			case mp4.MP4_CODEC_AAC:
-				p.AudioTrack = track.NewAAC(p)
-			case mp4.MP4_CODEC_G711A:
-				p.AudioTrack = track.NewG711(p, true)
-			case mp4.MP4_CODEC_G711U:
-				p.AudioTrack = track.NewG711(p, false)
-			}
+	}
+	p.Info("MP4 info", zap.Uint32("timescale", p.TimeScale), zap.Uint64("duration", p.Duration))
+	for _, t := range p.Tracks {
+		p.Info("MP4 track", zap.Uint32("id", t.TrackID), zap.String("entry", t.SampleEntry), zap.Int("samples", len(t.Samples)))
+		if t.IsVideo() && p.video == nil {
+			p.createVideoTrack(t)
+		} else if t.IsAudio() && p.audio == nil {
+			p.createAudioTrack(t)
+		}
+	}
+	if p.Replay.Speed <= 0 {
+		p.Replay.update(func(s *MP4ReplayState) { s.Speed = 1 })
+	}
+	// edit list 可能使起始时间戳为负数，从最早的样本开始计时
+	p.rebase = true
+	for {
+		select {
+		case c := <-control:
+			p.handleControl(c)
+		default:
+		}
+		if p.IsClosed() {
+			return nil
 		}
-		for {
-			pkg, err := p.ReadPacket()
-			if err != nil {
+		t, sample, data, err := p.ReadSample()
+		if err != nil {
+			if err != io.EOF {
 				p.Error("Error reading MP4 packet", zap.Error(err))
 				return err
 			}
-			switch pkg.Cid {
-			case mp4.MP4_CODEC_H264, mp4.MP4_CODEC_H265:
-				p.VideoTrack.WriteAnnexB(uint32(pkg.Pts*90), uint32(pkg.Dts*90), pkg.Data)
-			case mp4.MP4_CODEC_AAC:
-				p.AudioTrack.WriteADTS(uint32(pkg.Pts*90), util.Buffer(pkg.Data))
-			case mp4.MP4_CODEC_G711A, mp4.MP4_CODEC_G711U:
-				p.AudioTrack.WriteRawBytes(uint32(pkg.Pts*90), util.Buffer(pkg.Data))
+			p.Info("Reached end of MP4 file", zap.Bool("loop", p.Loop))
+			EventBus <- MP4EOFEvent{Event: CreateEvent(p), Loop: p.Loop}
+			if !p.Loop {
+				return nil
+			}
+			p.seek(0)
+			continue
+		}
+		if t != p.video && t != p.audio {
+			continue
+		}
+		dts, pts := p.timestamp(t, sample)
+		switch t {
+		case p.video:
+			p.writeVideoSample(sample, dts, pts, data)
+		case p.audio:
+			p.AudioTrack.WriteRawBytes(pts, util.Buffer(data))
+		}
+	}
+}
+
+// timestamp 计算样本输出的时间戳（90kHz），同时更新播放位置
+func (p *MP4Publisher) timestamp(t *codec.MP4Track, sample *codec.MP4Sample) (dts, pts uint32) {
+	pos, speed := t.Time(sample.DTS), p.Replay.Speed
+	p.Replay.update(func(s *MP4ReplayState) { s.Position = pos })
+	if p.rebase {
+		p.rebase = false
+		p.segBase, p.outBase = pos, p.nextOut
+	}
+	out := p.outBase + time.Duration(float64(pos-p.segBase)/speed)
+	if next := out + time.Duration(float64(t.Time(int64(sample.Duration)))/speed); next > p.nextOut {
+		p.nextOut = next
+	}
+	dts = uint32(out * 90 / time.Millisecond)
+	pts = dts + uint32(time.Duration(float64(t.Time(sample.PTS-sample.DTS))/speed)*90/time.Millisecond)
+	return
+}
+
+func (p *MP4Publisher) handleControl(c any) {
+	switch v := c.(type) {
+	case mp4Seek:
+		p.seek(time.Duration(v))
+	case mp4Speed:
+		p.Info("speed", zap.Float64("from", p.Replay.Speed), zap.Float64("to", float64(v)))
+		p.Replay.update(func(s *MP4ReplayState) { s.Speed = float64(v) })
+		p.rebase = true
+	case mp4Pause:
+		if !v {
+			return
+		}
+		p.Info("pause", zap.Duration("position", p.Replay.Position))
+		p.Replay.update(func(s *MP4ReplayState) { s.Paused = true })
+		p.Stream.Pause()
+		for p.Replay.Paused {
+			select {
+			case c := <-p.control:
+				if pause, ok := c.(mp4Pause); ok {
+					p.Replay.update(func(s *MP4ReplayState) { s.Paused = bool(pause) })
+				} else {
+					p.handleControl(c)
+				}
+			case <-p.Done():
+				return
 			}
 		}
+		p.Stream.Resume()
+		p.Info("resume", zap.Duration("position", p.Replay.Position))
+		for _, t := range []common.AVTrack{p.VideoTrack, p.AudioTrack} {
+			if t != nil {
+				t.ResetSpeedLimit()
+			}
+		}
+	}
+}
+
+func (p *MP4Publisher) seek(pos time.Duration) {
+	actual := p.SeekTime(pos)
+	p.Info("seek", zap.Duration("target", pos), zap.Duration("actual", actual))
+	p.Replay.update(func(s *MP4ReplayState) { s.Position = actual })
+	p.rebase = true
+}
+
+func (p *MP4Publisher) createVideoTrack(t *codec.MP4Track) {
+	if p.CreateVideoTrack(t.VideoCodec) == nil {
+		return
+	}
+	var head []byte
+	switch t.VideoCodec {
+	case codec.CodecID_H264, codec.CodecID_H265:
+		head = []byte{0x10 | byte(t.VideoCodec), 0, 0, 0, 0}
+	case codec.CodecID_AV1:
+		head = []byte{0b1001_0000 | byte(codec.PacketTypeSequenceStart), 0, 0, 0, 0}
+		util.BigEndian.PutUint32(head[1:], codec.FourCC_AV1_32)
+	}
+	if err := p.VideoTrack.WriteSequenceHead(append(head, t.ExtraData...)); err != nil {
+		p.Error("write video sequence head", zap.Error(err))
+		return
+	}
+	p.VideoTrack.SetSpeedLimit(500 * time.Millisecond)
+	p.video = t
+}
+
+func (p *MP4Publisher) createAudioTrack(t *codec.MP4Track) {
+	switch a := p.CreateAudioTrack(t.AudioCodec).(type) {
+	case *track.AAC:
+		a.WriteSequenceHead(append([]byte{0xAF, 0x00}, t.ExtraData...))
+	case *track.Opus:
+		a.Channels = byte(t.ChannelCount)
+	case *track.G711:
+		a.SampleRate = t.SampleRate
+		a.Channels = byte(t.ChannelCount)
+	default:
+		return
+	}
+	p.AudioTrack.SetSpeedLimit(500 * time.Millisecond)
+	p.audio = t
+}
+
+// writeVideoSample 将样本封装为 AVCC 格式写入，mp4 中的视频样本与 AVCC 的负载格式相同
+func (p *MP4Publisher) writeVideoSample(sample *codec.MP4Sample, dts, pts uint32, data []byte) {
+	head := make(util.Buffer, 5)
+	frameType := byte(2)
+	if sample.KeyFrame {
+		frameType = 1
+	}
+	switch p.video.VideoCodec {
+	case codec.CodecID_AV1:
+		head[0] = 0b1000_0000 | frameType<<4 | byte(codec.PacketTypeCodedFrames)
+		util.BigEndian.PutUint32(head[1:], codec.FourCC_AV1_32)
+	default:
+		head[0] = frameType<<4 | byte(p.video.VideoCodec)
+		head[1] = 1
+		util.PutBE(head[2:5], (pts-dts)/90)
 	}
+	var frame util.BLL
+	frame.Push(p.VideoTrack.GetFromPool(head))
+	frame.Push(p.VideoTrack.GetFromPool(util.Buffer(data)))
+	p.VideoTrack.WriteAVCC(dts/90, &frame)
 }
@@ -0,0 +1,172 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+)
+
+// buildTestMP4 构造只有一个 H264 轨道的 mp4 文件，每帧 40ms，每 gop 帧一个关键帧，所有样本在同一个 chunk 中
+func buildTestMP4(frames, gop int) []byte {
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	avcC := append([]byte{1, testSPS720[1], testSPS720[2], testSPS720[3], 0xff, 0xe1, 0, byte(len(testSPS720))}, testSPS720...)
+	avcC = append(append(avcC, 1, 0, byte(len(pps))), pps...)
+	fourCC := func(s string) uint32 { return util.BigEndian.Uint32([]byte(s)) }
+	matrix := [9]int32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+	var w codec.MP4Writer
+	ftyp := codec.NewFileTypeBox()
+	ftyp.MajorBrand = fourCC("isom")
+	ftyp.Marshal(&w)
+	var sizes, keys []uint32
+	mdat := w.StartBox("mdat")
+	offset := uint32(w.Len())
+	for i := 0; i < frames; i++ {
+		data := []byte{0, 0, 0, 3, 0x41, 0x9a, 0x00}
+		if i%gop == 0 {
+			data = []byte{0, 0, 0, 4, 0x65, 0x88, 0x84, 0x00}
+			keys = append(keys, uint32(i+1))
+		}
+		sizes = append(sizes, uint32(len(data)))
+		w.Write(data)
+	}
+	w.EndBox(mdat)
+	fullBox := func(boxType string, body func()) {
+		offset := w.StartFullBox(boxType, 0, 0)
+		body()
+		w.EndBox(offset)
+	}
+	w.Box("moov", func() {
+		mvhd := codec.MovieHeaderBox{TimeScale: 1000, Duration: uint64(frames * 40), Matrix: matrix, NextTrackID: 2}
+		mvhd.Marshal(&w)
+		w.Box("trak", func() {
+			tkhd := codec.TrackHeaderBox{TrackID: 1, Duration: uint64(frames * 40), Matrix: matrix}
+			tkhd.Marshal(&w)
+			w.Box("mdia", func() {
+				mdhd := codec.MediaHeaderBox{TimeScale: 1000, Duration: uint64(frames * 40)}
+				mdhd.Marshal(&w)
+				hdlr := codec.HandlerBox{HandlerType: fourCC("vide")}
+				hdlr.Marshal(&w)
+				w.Box("minf", func() {
+					w.Box("stbl", func() {
+						fullBox("stsd", func() {
+							w.WriteUint32(1)
+							w.Write(codec.AVCSampleEntry(1280, 720, avcC))
+						})
+						fullBox("stts", func() {
+							w.WriteUint32(1)
+							w.WriteUint32(uint32(frames))
+							w.WriteUint32(40)
+						})
+						fullBox("stsc", func() {
+							w.WriteUint32(1)
+							w.WriteUint32(1)
+							w.WriteUint32(uint32(frames))
+							w.WriteUint32(1)
+						})
+						fullBox("stsz", func() {
+							w.WriteUint32(0)
+							w.WriteUint32(uint32(frames))
+							for _, size := range sizes {
+								w.WriteUint32(size)
+							}
+						})
+						fullBox("stco", func() {
+							w.WriteUint32(1)
+							w.WriteUint32(offset)
+						})
+						fullBox("stss", func() {
+							w.WriteUint32(uint32(len(keys)))
+							for _, key := range keys {
+								w.WriteUint32(key)
+							}
+						})
+					})
+				})
+			})
+		})
+	})
+	return w.Buffer
+}
+
+// TestMP4ReplayControl 暂停时可以定位和改变倍速，恢复后从定位到的关键帧继续播放，改变倍速后输出的时间戳从下一帧开始按新的倍速连续增加
+func TestMP4ReplayControl(t *testing.T) {
+	pub := &MP4Publisher{}
+	conf := EngineConfig.GetPublishConfig()
+	conf.BufferTime = time.Minute // 环形缓冲不会在订阅者读取时缩小
+	pub.Config = &conf
+	if err := Engine.Publish("mp4/control", pub); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pub.ReadMP4Data(bytes.NewReader(buildTestMP4(150, 25)))
+	}()
+	t.Cleanup(func() {
+		pub.Stop() // 暂停时等待恢复的读取协程也会退出
+		<-done
+	})
+	waitState := func(desc string, ok func(MP4ReplayState) bool) {
+		for deadline := time.Now().Add(time.Second * 5); ; time.Sleep(time.Millisecond * 10) {
+			if ok(pub.Replay.Snapshot()) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: %+v", desc, pub.Replay.Snapshot())
+			}
+		}
+	}
+	waitState("playing", func(s MP4ReplayState) bool { return s.Speed == 1 && s.Position >= time.Millisecond*200 })
+	// 暂停之后读取协程不再写入，订阅者开始读取时不会和写入同时进行
+	pub.Pause()
+	waitState("paused", func(s MP4ReplayState) bool { return s.Paused })
+	sub := subscribeTestVideo(t, "mp4/control", func() { pub.Resume() }, func(s *Subscriber) {
+		conf := EngineConfig.Subscribe
+		conf.SubMode = track.SUBMODE_NOJUMP
+		s.Config = &conf
+	})
+	frames := sub.sync(t)
+	prev := frames[len(frames)-1]
+	if b, _ := json.Marshal(pub); !bytes.Contains(b, []byte(`"Paused":true`)) {
+		t.Fatalf("replay state not in json: %s", b)
+	}
+	// 定位到 2s 的关键帧，暂停时位置不变
+	pub.Seek(time.Millisecond * 2100)
+	pub.SetSpeed(2)
+	waitState("seek", func(s MP4ReplayState) bool { return s.Position == time.Second*2 && s.Speed == 2 })
+	if s := pub.Replay.Snapshot(); !s.Paused {
+		t.Fatalf("resumed by seek: %+v", s)
+	}
+	pub.Resume()
+	f := sub.next(t)
+	if !f.idr || f.seq != prev.seq+1 || f.absTime != prev.absTime+40 {
+		t.Fatalf("first frame after seek: seq %d idr %v absTime %d, previous seq %d absTime %d", f.seq, f.idr, f.absTime, prev.seq, prev.absTime)
+	}
+	// 倍速为 2 时每帧 20ms
+	for i := 0; i < 5; i++ {
+		next := sub.next(t)
+		if next.seq != f.seq+1 || next.absTime != f.absTime+20 {
+			t.Fatalf("frame seq %d absTime %d after seq %d absTime %d at speed 2", next.seq, next.absTime, f.seq, f.absTime)
+		}
+		f = next
+	}
+	// 播放过程中改为 1 倍速，从下一帧开始每帧 40ms，改变时没有空隙
+	pub.SetSpeed(1)
+	for slow := 0; slow < 5; {
+		next := sub.next(t)
+		switch delta := next.absTime - f.absTime; {
+		case next.seq != f.seq+1:
+			t.Fatalf("frame seq %d after seq %d", next.seq, f.seq)
+		case delta == 40:
+			slow++
+		case delta != 20 || slow > 0:
+			t.Fatalf("frame absTime %d after %d at speed 1", next.absTime, f.absTime)
+		}
+		f = next
+	}
+}
@@ -1,7 +1,11 @@
 package engine
 
 import (
+	"fmt"
+	"time"
+
 	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
 	"m7s.live/engine/v4/codec/mpegts"
 	"m7s.live/engine/v4/track"
 	"m7s.live/engine/v4/util"
@@ -10,6 +14,7 @@ import (
 type TSReader struct {
 	*TSPublisher
 	mpegts.MpegTsStream
+	pmtStreams map[uint16]bool // 已经处理过的 PMT 中的流，PMT 版本变化时新增的流也会被处理
 }
 
 func NewTSReader(pub *TSPublisher) (r *TSReader) {
@@ -18,13 +23,23 @@ func NewTSReader(pub *TSPublisher) (r *TSReader) {
 	}
 	r.PESChan = make(chan *mpegts.MpegTsPESPacket, 50)
 	r.PESBuffer = make(map[uint16]*mpegts.MpegTsPESPacket)
+	r.pmtStreams = make(map[uint16]bool)
 	go r.ReadPES()
 	return
 }
 
+// TSData TS 中的私有数据，例如 KLV 元数据、SCTE-35 splice_info_section、DVB 字幕
+type TSData struct {
+	PID        uint16
+	StreamType byte
+	PTS        uint64 // 90kHz，以 PSI 段承载的数据（SCTE-35）没有 PTS
+	Payload    []byte
+}
+
 type TSPublisher struct {
 	Publisher
-	pool util.BytesPool
+	pool       util.BytesPool
+	DataTracks map[uint16]*track.Data[TSData] `json:"-" yaml:"-"` // 按 PID 索引的数据轨道
 }
 
 func (t *TSPublisher) OnEvent(event any) {
@@ -65,11 +80,46 @@ func (t *TSPublisher) OnPmtStream(s mpegts.MpegTsPmtStream) {
 		if t.AudioTrack == nil {
 			t.AudioTrack = track.NewG711(t, false, t.pool)
 		}
+	case mpegts.STREAM_TYPE_OPUS:
+		if s.Registration() == "Opus" {
+			if t.AudioTrack == nil {
+				t.AudioTrack = track.NewOpus(t, t.pool)
+			}
+			break
+		}
+		t.addDataTrack(s)
+	case mpegts.STREAM_TYPE_METADATA, mpegts.STREAM_TYPE_SCTE35, mpegts.STREAM_TYPE_PRIVATE_SECTIONS:
+		t.addDataTrack(s)
 	default:
 		t.Warn("unsupport stream type:", zap.Uint8("type", s.StreamType))
 	}
 }
 
+// addDataTrack 将私有数据、KLV、SCTE-35 等流作为数据轨道发布
+func (t *TSPublisher) addDataTrack(s mpegts.MpegTsPmtStream) {
+	if _, ok := t.DataTracks[s.ElementaryPID]; ok {
+		return
+	}
+	var name string
+	switch {
+	case s.StreamType == mpegts.STREAM_TYPE_SCTE35 || s.Registration() == "CUEI":
+		name = "scte35"
+	case s.Registration() == "KLVA" || s.StreamType == mpegts.STREAM_TYPE_METADATA:
+		name = "klv"
+	case s.HasDescriptor(mpegts.DESCRIPTOR_TAG_SUBTITLING):
+		name = "subtitle"
+	default:
+		name = "private"
+	}
+	dt := track.NewDataTrack[TSData](fmt.Sprintf("%s_%d", name, s.ElementaryPID))
+	dt.SetStuff(t) // 数据轨道的日志来自发布者，Attach 之前设置
+	if t.DataTracks == nil {
+		t.DataTracks = make(map[uint16]*track.Data[TSData])
+	}
+	t.DataTracks[s.ElementaryPID] = dt
+	dt.Attach(t.Stream)
+}
+
 func (t *TSReader) Close() {
 	close(t.PESChan)
 }
@@ -79,33 +129,93 @@ func (t *TSReader) ReadPES() {
 		if t.Err() != nil {
 			continue
 		}
+		for _, s := range t.PmtStreams() {
+			if !t.pmtStreams[s.ElementaryPID] {
+				t.pmtStreams[s.ElementaryPID] = true
+				t.OnPmtStream(s)
+			}
+		}
 		if pes.Header.Dts == 0 {
 			pes.Header.Dts = pes.Header.Pts
 		}
-		switch pes.Header.StreamID & 0xF0 {
-		case mpegts.STREAM_ID_VIDEO:
-			if t.VideoTrack == nil {
-				for _, s := range t.PMT.Stream {
-					t.OnPmtStream(s)
+		if dt, ok := t.DataTracks[pes.Pid]; ok {
+			s := t.GetPmtStream(pes.Pid)
+			if s == nil { // PMT 中已经移除的流
+				continue
+			}
+			payload := pes.Payload
+			// 去掉段之后的填充字节
+			if s.IsSection() && len(payload) >= 3 {
+				if n := int(util.ReadBE[uint16](payload[1:3])&0xfff) + 3; n < len(payload) {
+					payload = payload[:n]
 				}
 			}
+			dt.Push(TSData{PID: pes.Pid, StreamType: s.StreamType, PTS: pes.Header.Pts, Payload: payload})
+			if s.StreamType == mpegts.STREAM_TYPE_SCTE35 {
+				t.writeSCTE35(payload)
+			}
+			continue
+		}
+		switch pes.Header.StreamID & 0xF0 {
+		case mpegts.STREAM_ID_VIDEO:
 			if t.VideoTrack != nil {
 				t.WriteAnnexB(uint32(pes.Header.Pts), uint32(pes.Header.Dts), pes.Payload)
 			}
 		default:
-			if t.AudioTrack == nil {
-				for _, s := range t.PMT.Stream {
-					t.OnPmtStream(s)
-				}
-			}
 			if t.AudioTrack != nil {
 				switch t.AudioTrack.(type) {
 				case *track.AAC:
 					t.AudioTrack.WriteADTS(uint32(pes.Header.Pts), pes.Payload)
 				case *track.G711:
 					t.AudioTrack.WriteRawBytes(uint32(pes.Header.Pts), pes.Payload)
+				case *track.Opus:
+					t.writeOpus(pes)
 				}
 			}
 		}
 	}
 }
+
+// writeSCTE35 将 splice_insert、time_signal 转换为广告标记
+func (t *TSReader) writeSCTE35(section []byte) {
+	info, err := mpegts.ParseSpliceInfo(section)
+	if err != nil {
+		t.Warn("parse scte35", zap.Error(err))
+		return
+	}
+	cue := &track.CueMarker{
+		ID:       info.EventID,
+		Duration: time.Duration(info.Duration) * time.Millisecond / 90,
+		Data:     section,
+	}
+	if info.HasPTS && !info.Immediate {
+		cue.PTS = uint32(info.PTS)
+	}
+	switch info.CommandType {
+	case mpegts.SCTE35_SPLICE_INSERT:
+		if info.Cancel {
+			return
+		}
+		cue.Type = util.Conditoinal(info.OutOfNetwork, track.CUE_TYPE_OUT, track.CUE_TYPE_IN)
+	case mpegts.SCTE35_TIME_SIGNAL:
+		cue.Type = track.CUE_TYPE_POINT
+	default:
+		return
+	}
+	if err = t.WriteCue(cue); err != nil {
+		t.Warn("write cue", zap.Error(err))
+	}
+}
+
+// writeOpus 一个 PES 中可能含有多个 Opus 访问单元，按各自的时长推算时间戳
+func (t *TSReader) writeOpus(pes *mpegts.MpegTsPESPacket) {
+	aus, err := mpegts.SplitOpusAccessUnits(pes.Payload)
+	if err != nil {
+		t.Warn("split opus access units", zap.Error(err))
+	}
+	pts := pes.Header.Pts
+	for _, au := range aus {
+		t.AudioTrack.WriteRawBytes(uint32(pts), util.Buffer(au))
+		pts += uint64(codec.OpusPacketDuration(au) * 90 / time.Millisecond)
+	}
+}
@@ -0,0 +1,33 @@
+package engine
+
+import (
+	"testing"
+
+	"m7s.live/engine/v4/codec/mpegts"
+	. "m7s.live/engine/v4/common"
+)
+
+// TestTSDataTrack PMT 中的 KLV、SCTE-35 和私有数据流作为数据轨道发布，同一个 PID 只添加一次
+func TestTSDataTrack(t *testing.T) {
+	pub := &TSPublisher{}
+	if err := Engine.Publish("ts/data", pub); err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Stop()
+	for _, s := range []mpegts.MpegTsPmtStream{
+		{StreamType: mpegts.STREAM_TYPE_METADATA, ElementaryPID: 0x101},
+		{StreamType: mpegts.STREAM_TYPE_SCTE35, ElementaryPID: 0x102},
+		{StreamType: mpegts.STREAM_TYPE_PRIVATE_SECTIONS, ElementaryPID: 0x103},
+		{StreamType: mpegts.STREAM_TYPE_METADATA, ElementaryPID: 0x101},
+	} {
+		pub.OnPmtStream(s)
+	}
+	for _, name := range []string{"klv_257", "scte35_258", "private_259"} {
+		if v, ok := pub.Stream.Tracks.Load(name); !ok || v.(Track).GetPublisher() == nil {
+			t.Errorf("data track %s not attached", name)
+		}
+	}
+	if len(pub.DataTracks) != 3 {
+		t.Fatalf("%d data tracks", len(pub.DataTracks))
+	}
+}
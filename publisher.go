@@ -1,6 +1,8 @@
 package engine
 
 import (
+	"sync"
+
 	"go.uber.org/zap"
 	"m7s.live/engine/v4/codec"
 	"m7s.live/engine/v4/common"
@@ -21,6 +23,14 @@ type Publisher struct {
 	Config            *config.Publish
 	common.AudioTrack `json:"-" yaml:"-"`
 	common.VideoTrack `json:"-" yaml:"-"`
+	CueTrack          *track.Cue `json:"-" yaml:"-"`
+	cueLock           sync.Mutex
+	namedVideo        util.Map[string, common.VideoTrack] // 具名视频轨道，用于多机位等同时发布多路视频
+	namedAudio        util.Map[string, common.AudioTrack] // 具名音频轨道，用于多语言等同时发布多路音频
+	namedLock         sync.Mutex
+	Backup            bool `json:",omitempty" yaml:",omitempty"` // 流已有发布者时作为备用发布者，等同于推流地址带有 BackupArgName 参数
+	backup            backupPublisher
+	backupLock        sync.Mutex
 }
 
 func (p *Publisher) Publish(streamPath string, pub common.IPuber) error {
@@ -58,74 +68,223 @@ func (p *Publisher) GetConfig() *config.Publish {
 //	}
 
 func (p *Publisher) CreateAudioTrack(codecID codec.AudioCodecID, stuff ...any) common.AudioTrack {
+	p.AudioTrack = p.newAudioTrack(codecID, stuff...)
+	return p.AudioTrack
+}
+
+func (p *Publisher) CreateVideoTrack(codecID codec.VideoCodecID, stuff ...any) common.VideoTrack {
+	p.VideoTrack = p.newVideoTrack(codecID, stuff...)
+	return p.VideoTrack
+}
+
+func (p *Publisher) newAudioTrack(codecID codec.AudioCodecID, stuff ...any) (t common.AudioTrack) {
 	switch codecID {
 	case codec.CodecID_AAC:
-		p.AudioTrack = track.NewAAC(p, stuff...)
+		t = track.NewAAC(p, stuff...)
 	case codec.CodecID_PCMA:
-		p.AudioTrack = track.NewG711(p, true, stuff...)
+		t = track.NewG711(p, true, stuff...)
 	case codec.CodecID_PCMU:
-		p.AudioTrack = track.NewG711(p, false, stuff...)
+		t = track.NewG711(p, false, stuff...)
 	case codec.CodecID_OPUS:
-		p.AudioTrack = track.NewOpus(p, stuff...)
+		t = track.NewOpus(p, stuff...)
 	}
-	return p.AudioTrack
+	return
 }
 
-func (p *Publisher) CreateVideoTrack(codecID codec.VideoCodecID, stuff ...any) common.VideoTrack {
+func (p *Publisher) newVideoTrack(codecID codec.VideoCodecID, stuff ...any) (t common.VideoTrack) {
 	switch codecID {
 	case codec.CodecID_H264:
-		p.VideoTrack = track.NewH264(p, stuff...)
+		t = track.NewH264(p, stuff...)
 	case codec.CodecID_H265:
-		p.VideoTrack = track.NewH265(p, stuff...)
+		t = track.NewH265(p, stuff...)
 	case codec.CodecID_AV1:
-		p.VideoTrack = track.NewAV1(p, stuff...)
+		t = track.NewAV1(p, stuff...)
 	}
-	return p.VideoTrack
+	return
+}
+
+// CreateNamedVideoTrack 创建具名视频轨道，同一个发布者可以创建多个，第一个创建的同时作为 VideoTrack
+func (p *Publisher) CreateNamedVideoTrack(name string, codecID codec.VideoCodecID, stuff ...any) common.VideoTrack {
+	t := p.newVideoTrack(codecID, stuff, name)
+	if t != nil {
+		p.addNamedVideo(name, t)
+	}
+	return t
+}
+
+// CreateNamedAudioTrack 创建具名音频轨道，同一个发布者可以创建多个，第一个创建的同时作为 AudioTrack
+func (p *Publisher) CreateNamedAudioTrack(name string, codecID codec.AudioCodecID, stuff ...any) common.AudioTrack {
+	t := p.newAudioTrack(codecID, stuff, name)
+	if t != nil {
+		p.addNamedAudio(name, t)
+	}
+	return t
+}
+
+func (p *Publisher) addNamedVideo(name string, t common.VideoTrack) {
+	p.namedLock.Lock()
+	defer p.namedLock.Unlock()
+	p.namedVideo.Set(name, t)
+	if p.VideoTrack == nil {
+		p.VideoTrack = t
+	}
+}
+
+func (p *Publisher) addNamedAudio(name string, t common.AudioTrack) {
+	p.namedLock.Lock()
+	defer p.namedLock.Unlock()
+	p.namedAudio.Set(name, t)
+	if p.AudioTrack == nil {
+		p.AudioTrack = t
+	}
+}
+
+// RemoveNamedTrack 从流中移除具名轨道，移除的是 VideoTrack 或 AudioTrack 时由其他同类具名轨道接替
+func (p *Publisher) RemoveNamedTrack(name string) {
+	p.namedLock.Lock()
+	defer p.namedLock.Unlock()
+	if vt, ok := p.namedVideo.Delete(name); ok {
+		if p.VideoTrack == vt {
+			p.VideoTrack = nil
+			p.namedVideo.Range(func(_ string, t common.VideoTrack) {
+				if p.VideoTrack == nil {
+					p.VideoTrack = t
+				}
+			})
+		}
+		vt.Detach()
+	}
+	if at, ok := p.namedAudio.Delete(name); ok {
+		if p.AudioTrack == at {
+			p.AudioTrack = nil
+			p.namedAudio.Range(func(_ string, t common.AudioTrack) {
+				if p.AudioTrack == nil {
+					p.AudioTrack = t
+				}
+			})
+		}
+		at.Detach()
+	}
+}
+
+func (p *Publisher) GetNamedVideoTrack(name string) common.VideoTrack {
+	return p.namedVideo.Get(name)
+}
+
+func (p *Publisher) GetNamedAudioTrack(name string) common.AudioTrack {
+	return p.namedAudio.Get(name)
+}
+
+// SetMainTrack 将指定名称的音视频轨道设为流的主轨道，之后加入的订阅者默认订阅主轨道
+func (p *Publisher) SetMainTrack(name string) error {
+	if p.Stream == nil {
+		return ErrStreamIsClosed
+	}
+	return p.Stream.SetMainTrack(name)
+}
+
+// WriteCue 插入广告标记，cue.PTS 为发布者时间轴上的时间戳（90kHz），订阅者在播放到该时间点时收到标记
+func (p *Publisher) WriteCue(cue *track.CueMarker) error {
+	p.cueLock.Lock()
+	if p.CueTrack == nil {
+		if p.Stream == nil {
+			p.cueLock.Unlock()
+			return ErrStreamIsClosed
+		}
+		p.CueTrack = track.NewCue(p)
+		if err := p.Stream.AddTrack(p.CueTrack).Await(); err != nil {
+			p.CueTrack = nil
+			p.cueLock.Unlock()
+			return err
+		}
+	}
+	p.cueLock.Unlock()
+	p.Info("cue", zap.String("type", cue.Type), zap.Uint32("id", cue.ID), zap.Uint32("pts", cue.PTS))
+	p.CueTrack.Push(cue)
+	return nil
 }
 
 func (p *Publisher) WriteAVCCVideo(ts uint32, frame *util.BLL, pool util.BytesPool) {
+	if p.standbyVideo(frame) {
+		return
+	}
+	p.writeAVCCVideo(&p.VideoTrack, ts, frame, pool)
+}
+
+func (p *Publisher) WriteAVCCAudio(ts uint32, frame *util.BLL, pool util.BytesPool) {
+	if p.standbyAudio(frame) {
+		return
+	}
+	p.writeAVCCAudio(&p.AudioTrack, ts, frame, pool)
+}
+
+// WriteNamedAVCCVideo 写入具名视频轨道，轨道不存在时根据序列帧创建
+func (p *Publisher) WriteNamedAVCCVideo(name string, ts uint32, frame *util.BLL, pool util.BytesPool) {
+	if vt := p.namedVideo.Get(name); vt != nil {
+		vt.WriteAVCC(ts, frame)
+		return
+	}
+	var vt common.VideoTrack
+	if p.writeAVCCVideo(&vt, ts, frame, pool, name); vt != nil {
+		p.addNamedVideo(name, vt)
+	}
+}
+
+// WriteNamedAVCCAudio 写入具名音频轨道，轨道不存在时根据首帧创建
+func (p *Publisher) WriteNamedAVCCAudio(name string, ts uint32, frame *util.BLL, pool util.BytesPool) {
+	if at := p.namedAudio.Get(name); at != nil {
+		at.WriteAVCC(ts, frame)
+		return
+	}
+	var at common.AudioTrack
+	if p.writeAVCCAudio(&at, ts, frame, pool, name); at != nil {
+		p.addNamedAudio(name, at)
+	}
+}
+
+func (p *Publisher) writeAVCCVideo(vt *common.VideoTrack, ts uint32, frame *util.BLL, pool util.BytesPool, stuff ...any) {
 	if frame.ByteLength < 6 {
 		return
 	}
-	if p.VideoTrack == nil {
+	if *vt == nil {
 		b0 := frame.GetByte(0)
 		// https://github.com/veovera/enhanced-rtmp/blob/main/enhanced-rtmp-v1.pdf
 		if isExtHeader := b0 & 0b1000_0000; isExtHeader != 0 {
 			fourCC := frame.GetUintN(1, 4)
 			switch fourCC {
 			case codec.FourCC_H265_32:
-				p.VideoTrack = track.NewH265(p, pool)
-				p.VideoTrack.WriteAVCC(ts, frame)
+				*vt = track.NewH265(p, pool, stuff)
+				(*vt).WriteAVCC(ts, frame)
 			case codec.FourCC_AV1_32:
-				p.VideoTrack = track.NewAV1(p, pool)
-				p.VideoTrack.WriteAVCC(ts, frame)
+				*vt = track.NewAV1(p, pool, stuff)
+				(*vt).WriteAVCC(ts, frame)
 			}
 		} else {
 			if frame.GetByte(1) == 0 {
 				ts = 0
-				p.CreateVideoTrack(codec.VideoCodecID(b0&0x0F), pool)
-				if p.VideoTrack == nil {
+				*vt = p.newVideoTrack(codec.VideoCodecID(b0&0x0F), pool, stuff)
+				if *vt == nil {
 					p.Stream.Error("video codecID not support", zap.Uint8("codeId", uint8(codec.VideoCodecID(b0&0x0F))))
 					return
 				}
-				p.VideoTrack.WriteAVCC(ts, frame)
+				(*vt).WriteAVCC(ts, frame)
 			} else {
 				p.Stream.Warn("need sequence frame")
 			}
 		}
 	} else {
-		p.VideoTrack.WriteAVCC(ts, frame)
+		(*vt).WriteAVCC(ts, frame)
 	}
 }
 
-func (p *Publisher) WriteAVCCAudio(ts uint32, frame *util.BLL, pool util.BytesPool) {
+func (p *Publisher) writeAVCCAudio(at *common.AudioTrack, ts uint32, frame *util.BLL, pool util.BytesPool, stuff ...any) {
 	if frame.ByteLength < 4 {
 		return
 	}
-	if p.AudioTrack == nil {
+	if *at == nil {
 		b0 := frame.GetByte(0)
-		t := p.CreateAudioTrack(codec.AudioCodecID(b0>>4), pool)
-		switch a := t.(type) {
+		*at = p.newAudioTrack(codec.AudioCodecID(b0>>4), pool, stuff)
+		switch a := (*at).(type) {
 		case *track.AAC:
 			if frame.GetByte(1) != 0 {
 				return
@@ -144,6 +303,6 @@ func (p *Publisher) WriteAVCCAudio(ts uint32, frame *util.BLL, pool util.BytesPo
 			p.Stream.Error("audio codec not support yet", zap.Uint8("codecId", uint8(codec.AudioCodecID(b0>>4))))
 		}
 	} else {
-		p.AudioTrack.WriteAVCC(ts, frame)
+		(*at).WriteAVCC(ts, frame)
 	}
 }
@@ -5,6 +5,8 @@ import (
 	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"m7s.live/engine/v4/config"
 )
@@ -68,13 +70,21 @@ func (pub *Puller) startPull(puller IPuller) {
 		}
 	}()
 	puber := puller.GetPublisher()
+	ctx, span := startSpan(puber.Context, "Puller.startPull", streamPath, puber.plugin, attribute.String("url", pub.RemoteURL))
+	defer func() { endSpan(span, err) }()
 	var startTime time.Time
 	for puller.Info("start pull"); puller.Reconnect(); puller.Warn("restart pull") {
 		if time.Since(startTime) < 5*time.Second {
 			time.Sleep(5 * time.Second)
 		}
+		if !startTime.IsZero() {
+			EventBus <- PullerReconnectEvent{CreateEvent(puller), streamPath, pub.RemoteURL, pub.ReConnectCount, err}
+		}
 		startTime = time.Now()
+		var reconnectSpan trace.Span
+		puber.traceCtx, reconnectSpan = startSpan(ctx, "Puller.Reconnect", streamPath, puber.plugin, attribute.Int("count", pub.ReConnectCount))
 		if err = puller.Connect(); err != nil {
+			endSpan(reconnectSpan, err)
 			if err == io.EOF {
 				puller.Info("pull complete")
 				return
@@ -86,6 +96,7 @@ func (pub *Puller) startPull(puller IPuller) {
 		} else {
 			if err = puller.Publish(pub.StreamPath, puller); err != nil {
 				puller.Error("pull publish", zap.Error(err))
+				endSpan(reconnectSpan, err)
 				return
 			}
 			if stream != puber.Stream {
@@ -98,6 +109,7 @@ func (pub *Puller) startPull(puller IPuller) {
 			if err = puller.Pull(); err != nil && !puller.IsShutdown() {
 				puller.Error("pull interrupt", zap.Error(err))
 			}
+			endSpan(reconnectSpan, err)
 		}
 		if puller.IsShutdown() {
 			puller.Info("stop pull", zshutdown)
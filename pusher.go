@@ -4,6 +4,8 @@ import (
 	"io"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"m7s.live/engine/v4/config"
 )
@@ -42,17 +44,24 @@ func (pub *Pusher) startPush(pusher IPusher) {
 
 	defer Pushers.Delete(key)
 	defer pusher.Disconnect()
+	suber := pusher.GetSubscriber()
+	ctx, span := startSpan(suber.IO.Context, "Pusher.startPush", pub.StreamPath, suber.plugin, attribute.String("url", pub.RemoteURL))
+	defer func() { endSpan(span, err) }()
 	var startTime time.Time
 	for pusher.Info("start push"); pusher.Reconnect(); pusher.Warn("restart push") {
 		if time.Since(startTime) < 5*time.Second {
 			time.Sleep(5 * time.Second)
 		}
 		startTime = time.Now()
+		var reconnectSpan trace.Span
+		suber.traceCtx, reconnectSpan = startSpan(ctx, "Pusher.Reconnect", pub.StreamPath, suber.plugin, attribute.Int("count", pub.ReConnectCount))
 		if err = pusher.Subscribe(pub.StreamPath, pusher); err != nil {
 			pusher.Error("push subscribe", zap.Error(err))
+			endSpan(reconnectSpan, err)
 		} else {
 			stream := pusher.GetSubscriber().Stream
 			if err = pusher.Connect(); err != nil {
+				endSpan(reconnectSpan, err)
 				if err == io.EOF {
 					pusher.Info("push complete")
 					return
@@ -63,9 +72,12 @@ func (pub *Pusher) startPush(pusher IPusher) {
 				if badPusher {
 					return
 				}
-			} else if err = pusher.Push(); err != nil && !stream.IsClosed() {
-				pusher.Error("push", zap.Error(err))
-				pusher.Stop()
+			} else {
+				if err = pusher.Push(); err != nil && !stream.IsClosed() {
+					pusher.Error("push", zap.Error(err))
+					pusher.Stop()
+				}
+				endSpan(reconnectSpan, err)
 			}
 			badPusher = false
 			if stream.IsClosed() {
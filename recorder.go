@@ -0,0 +1,362 @@
+package engine
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/config"
+	"m7s.live/engine/v4/log"
+	"m7s.live/engine/v4/util"
+)
+
+const (
+	RECORD_FORMAT_FLV = "flv"
+	RECORD_FORMAT_MP4 = "mp4"
+	RECORD_FORMAT_TS  = "ts"
+)
+
+var (
+	ErrRecordFormat = errors.New("unsupported record format")
+	ErrRecording    = errors.New("stream is recording")
+)
+
+// Recorders 正在录制的流，key 为 streamPath
+var Recorders sync.Map
+
+// RecordFile 录像文件信息
+type RecordFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Recorder 将流录制为 FLV、MP4（fMP4）或 TS 文件，在关键帧处按时长或大小切分
+type Recorder struct {
+	Subscriber
+	Policy   config.Record `json:"-" yaml:"-"`
+	Format   string
+	FilePath string // 正在写入的文件
+	Files    int    // 已经生成的文件数
+	dir      string // 录像所在的目录，保留策略只清理该目录
+	file     *os.File
+	size     int64
+	segStart uint32    // 当前分片第一帧的绝对时间（毫秒）
+	flvHeads [2][]byte // FLV 的音视频序列头，新分片开始时重新写入
+	fmp4Init FMP4Init
+	reinit   bool // 解码配置变化，需要在下一个关键帧处开始新的文件
+	mu       sync.Mutex
+}
+
+// StartRecord 按照录制策略开始录制一个流，录制在后台进行直到流关闭或者调用 Stop
+func StartRecord(streamPath string, policy config.Record) (*Recorder, error) {
+	switch policy.Format {
+	case RECORD_FORMAT_FLV, RECORD_FORMAT_MP4, RECORD_FORMAT_TS:
+	default:
+		return nil, ErrRecordFormat
+	}
+	if err := policy.Check(); err != nil {
+		return nil, err
+	}
+	r := &Recorder{Policy: policy, Format: policy.Format}
+	if _, loaded := Recorders.LoadOrStore(streamPath, r); loaded {
+		return nil, ErrRecording
+	}
+	subConf := EngineConfig.Subscribe
+	subConf.FMP4Mode = 1 // 按 GOP 分片，保证每个分片都从关键帧开始
+	subConf.SubMode = 1
+	r.Config = &subConf
+	if err := Engine.Subscribe(streamPath, r); err != nil {
+		Recorders.Delete(streamPath)
+		return nil, err
+	}
+	go r.start(streamPath)
+	return r, nil
+}
+
+func (r *Recorder) start(streamPath string) {
+	defer Recorders.Delete(streamPath)
+	r.Info("start record", zap.String("format", r.Format))
+	switch r.Format {
+	case RECORD_FORMAT_FLV:
+		r.PlayFLV()
+	case RECORD_FORMAT_MP4:
+		r.PlayFMP4()
+	case RECORD_FORMAT_TS:
+		r.PlayTS()
+	}
+	r.mu.Lock()
+	r.closeFile()
+	r.mu.Unlock()
+	r.Info("stop record", zap.Int("files", r.Files))
+	if r.dir != "" {
+		CleanRecords(&r.Policy, r.dir)
+	}
+}
+
+// absTime 当前帧的绝对时间（毫秒）
+func (r *Recorder) absTime() uint32 {
+	if r.VideoReader != nil {
+		return r.VideoReader.AbsTime
+	}
+	if r.AudioReader != nil {
+		return r.AudioReader.AbsTime
+	}
+	return 0
+}
+
+func (r *Recorder) OnEvent(event any) {
+	switch v := event.(type) {
+	case FLVFrame:
+		r.writeFLV(v)
+	case FMP4Init:
+		r.fmp4Init = append(r.fmp4Init[:0], v...)
+		r.reinit = r.file != nil
+	case FMP4Fragment:
+		// 按 GOP 分片时每个分片都从关键帧开始
+		r.rotate(true)
+		r.write(v...)
+	case TSPackets:
+		r.rotate(r.Video == nil || tsRandomAccess(v))
+		r.write(v)
+	default:
+		r.Subscriber.OnEvent(event)
+	}
+}
+
+func (r *Recorder) writeFLV(frame FLVFrame) {
+	if len(frame) < 3 || len(frame[1]) < 2 {
+		return
+	}
+	head, body := frame[1][0], frame[1][1]
+	ts := util.ReadBE[uint32](frame[0][4:7]) | uint32(frame[0][7])<<24
+	keyFrame := r.Video == nil
+	switch frame[0][0] {
+	case codec.FLV_TAG_TYPE_VIDEO:
+		var seqHead bool
+		if head&0x80 != 0 { // Enhanced RTMP
+			keyFrame, seqHead = (head>>4)&7 == 1, head&0x0f == codec.PacketTypeSequenceStart
+		} else {
+			keyFrame, seqHead = head>>4 == 1, body == 0
+		}
+		if seqHead {
+			r.flvHeads[0] = util.ConcatBuffers(frame[1 : len(frame)-1])
+			if r.file != nil {
+				r.writeFLVTag(codec.FLV_TAG_TYPE_VIDEO, ts, r.flvHeads[0])
+			}
+			return
+		}
+	case codec.FLV_TAG_TYPE_AUDIO:
+		if head>>4 == 10 && body == 0 {
+			r.flvHeads[1] = util.ConcatBuffers(frame[1 : len(frame)-1])
+			if r.file != nil {
+				r.writeFLVTag(codec.FLV_TAG_TYPE_AUDIO, ts, r.flvHeads[1])
+			}
+			return
+		}
+	}
+	if !r.rotate(keyFrame) {
+		return
+	}
+	r.writeFLVTag(frame[0][0], ts, frame[1:len(frame)-1]...)
+}
+
+// writeFLVTag 写入 FLV tag，时间戳相对于当前分片的开始
+func (r *Recorder) writeFLVTag(t byte, ts uint32, data ...[]byte) {
+	if ts < r.segStart {
+		ts = r.segStart
+	}
+	r.write(codec.AVCC2FLV(t, ts-r.segStart, data...)...)
+}
+
+// rotate 到达分片时长或大小后在关键帧处切换文件，返回当前是否有可写入的文件
+func (r *Recorder) rotate(keyFrame bool) bool {
+	if !keyFrame {
+		return r.file != nil
+	}
+	now := r.absTime()
+	if r.file != nil {
+		p := &r.Policy
+		if !r.reinit && !(p.Fragment > 0 && time.Duration(now-r.segStart)*time.Millisecond >= p.Fragment || p.MaxSize > 0 && r.size >= p.MaxSize) {
+			return true
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file != nil {
+		r.closeFile()
+		go CleanRecords(&r.Policy, r.dir)
+	}
+	base, err := r.Policy.Resolve(r.Stream.recordPath(r.Policy.Path, time.Now()))
+	if err != nil {
+		r.Error("record path", zap.String("stream", r.Stream.Path), zap.Error(err))
+		r.Stop(zap.Error(err))
+		return false
+	}
+	if err := os.MkdirAll(filepath.Dir(base), 0766); err != nil {
+		r.Error("create record dir", zap.Error(err))
+		return false
+	}
+	file, filePath, err := createRecordFile(base, "."+r.Format)
+	if err != nil {
+		r.Error("create record file", zap.Error(err))
+		return false
+	}
+	r.Info("record file", zap.String("path", filePath))
+	r.file, r.FilePath, r.dir, r.size, r.segStart, r.reinit = file, filePath, filepath.Dir(filePath), 0, now, false
+	r.Files++
+	switch r.Format {
+	case RECORD_FORMAT_FLV:
+		r.write(codec.FLVHeader)
+		if r.flvHeads[0] != nil {
+			r.writeFLVTag(codec.FLV_TAG_TYPE_VIDEO, now, r.flvHeads[0])
+		}
+		if r.flvHeads[1] != nil {
+			r.writeFLVTag(codec.FLV_TAG_TYPE_AUDIO, now, r.flvHeads[1])
+		}
+	case RECORD_FORMAT_MP4:
+		r.write(r.fmp4Init)
+	}
+	return true
+}
+
+// createRecordFile 创建新的录像文件，同名文件已存在时（例如同一秒内切分）加上序号，不会覆盖已有的录像
+func createRecordFile(base, ext string) (file *os.File, filePath string, err error) {
+	filePath = base + ext
+	for i := 1; ; i++ {
+		if file, err = os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666); !os.IsExist(err) {
+			return
+		}
+		filePath = base + "_" + strconv.Itoa(i) + ext
+	}
+}
+
+func (r *Recorder) write(data ...[]byte) {
+	if r.file == nil {
+		return
+	}
+	for _, b := range data {
+		n, err := r.file.Write(b)
+		r.size += int64(n)
+		if err != nil {
+			r.Error("write record file", zap.Error(err))
+			r.Stop(zap.Error(err))
+			return
+		}
+	}
+}
+
+func (r *Recorder) closeFile() {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+		r.FilePath = ""
+	}
+}
+
+// tsRandomAccess TS 包中是否有设置了 random_access_indicator 的 PES 起始包
+func tsRandomAccess(packets []byte) bool {
+	for ; len(packets) >= 188; packets = packets[188:] {
+		if packets[1]&0x40 != 0 && packets[3]&0x20 != 0 && packets[4] > 0 && packets[5]&0x40 != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ListRecords 列出录制根目录下的所有录像文件，按修改时间排序
+func ListRecords(policy *config.Record) (files []RecordFile) {
+	if policy.Check() != nil {
+		return
+	}
+	return listRecords(policy.Root, true)
+}
+
+// listRecords 列出 dir 下的录像文件，recursive 为 false 时不查找子目录
+func listRecords(dir string, recursive bool) (files []RecordFile) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if !recursive && path != dir {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		switch strings.TrimPrefix(filepath.Ext(path), ".") {
+		case RECORD_FORMAT_FLV, RECORD_FORMAT_MP4, RECORD_FORMAT_TS:
+			if info, err := d.Info(); err == nil {
+				files = append(files, RecordFile{Path: path, Size: info.Size(), ModTime: info.ModTime()})
+			}
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime.Before(files[j].ModTime)
+	})
+	return
+}
+
+var cleanRecordsLock sync.Mutex
+
+// CleanRecords 删除 dir 下（不含子目录）超过保留时长的录像，总大小超出上限时从最旧的录像开始删除，正在写入的文件不会被删除。
+// dir 是某个录制者的录像目录，只能在录制根目录内
+func CleanRecords(policy *config.Record, dir string) {
+	if policy.MaxAge <= 0 && policy.MaxDiskSize <= 0 || policy.Check() != nil {
+		return
+	}
+	if rel, err := filepath.Rel(policy.Root, dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return
+	}
+	cleanRecordsLock.Lock()
+	defer cleanRecordsLock.Unlock()
+	recording := make(map[string]bool)
+	Recorders.Range(func(key, value any) bool {
+		r := value.(*Recorder)
+		r.mu.Lock()
+		recording[r.FilePath] = true
+		r.mu.Unlock()
+		return true
+	})
+	files := listRecords(dir, false) // 子目录可能是其他流的录像
+	var total int64
+	for _, f := range files {
+		total += f.Size
+	}
+	for _, f := range files {
+		if recording[f.Path] {
+			continue
+		}
+		expired := policy.MaxAge > 0 && time.Since(f.ModTime) > policy.MaxAge
+		if !expired && (policy.MaxDiskSize <= 0 || total <= policy.MaxDiskSize) {
+			continue
+		}
+		if err := os.Remove(f.Path); err != nil {
+			log.Warn("remove record", zap.String("path", f.Path), zap.Error(err))
+			continue
+		}
+		log.Info("remove record", zap.String("path", f.Path), zap.Bool("expired", expired))
+		total -= f.Size
+	}
+}
+
+// recordPath 根据路径模板生成不含扩展名的文件路径
+func (s *Stream) recordPath(tmpl string, t time.Time) string {
+	return strings.NewReplacer(
+		"{app}", s.AppName,
+		"{stream}", s.StreamName,
+		"{streamPath}", s.Path,
+		"{date}", t.Format("20060102"),
+		"{time}", t.Format("20060102150405"),
+		"{unix}", strconv.FormatInt(t.Unix(), 10),
+	).Replace(tmpl)
+}
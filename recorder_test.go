@@ -0,0 +1,64 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"m7s.live/engine/v4/config"
+)
+
+// TestCreateRecordFile 同一秒内切分出的文件名相同时加上序号，已有的录像不会被截断
+func TestCreateRecordFile(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "20240101120000")
+	var paths []string
+	for i := 0; i < 3; i++ {
+		file, filePath, err := createRecordFile(base, ".flv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.WriteString(filePath)
+		file.Close()
+		paths = append(paths, filePath)
+	}
+	for i, want := range []string{base + ".flv", base + "_1.flv", base + "_2.flv"} {
+		if paths[i] != want {
+			t.Fatalf("file %d: %s, want %s", i, paths[i], want)
+		}
+		if data, _ := os.ReadFile(want); string(data) != want {
+			t.Fatalf("%s overwritten: %q", want, data)
+		}
+	}
+}
+
+// TestCleanRecordsDir 保留策略只清理录制者自己的目录，其他目录和子目录中的录像不受影响
+func TestCleanRecordsDir(t *testing.T) {
+	policy := config.Record{Root: t.TempDir(), Path: "{app}/{stream}/{time}", MaxAge: time.Hour}
+	old := time.Now().Add(-time.Hour * 2)
+	dir := filepath.Join(policy.Root, "live", "a")
+	files := map[string]bool{ // 文件是否应该保留
+		filepath.Join(dir, "old.flv"):                      false,
+		filepath.Join(dir, "new.flv"):                      true,
+		filepath.Join(dir, "b", "old.flv"):                 true,
+		filepath.Join(policy.Root, "live", "c", "old.flv"): true,
+	}
+	for path := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0766); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("flv"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Base(path) == "old.flv" {
+			os.Chtimes(path, old, old)
+		}
+	}
+	CleanRecords(&policy, dir)
+	CleanRecords(&policy, filepath.Dir(policy.Root)) // 根目录之外的目录不会被清理
+	for path, keep := range files {
+		if _, err := os.Stat(path); (err == nil) != keep {
+			t.Errorf("%s: keep %v, stat %v", path, keep, err)
+		}
+	}
+}
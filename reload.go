@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+	"m7s.live/engine/v4/log"
+)
+
+var (
+	// RestartConfigs 修改后需要重启才能生效的配置项（最后一级的名称），例如监听地址，插件可以追加
+	RestartConfigs = []string{"listenaddr", "listenaddrtls", "certfile", "keyfile", "listennum", "enable"}
+	// restartGlobalConfigs 全局配置中只在启动时读取的配置项。eventhistorysize 每次记录事件时读取，不需要重启
+	restartGlobalConfigs = []string{"eventbussize", "poolsize", "trace", "auth", "webhook", "cluster", "console", "loglang", "pulseinterval", "watchconfig"}
+	configFile           string // 启动时读取的配置文件路径
+	reloadLock           sync.Mutex
+)
+
+// watchConfig 收到 SIGHUP 信号或者配置文件修改后重新加载配置
+func watchConfig(ctx context.Context) {
+	if configFile == "" {
+		return
+	}
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+	var check <-chan time.Time
+	if EngineConfig.WatchConfig > 0 {
+		ticker := time.NewTicker(EngineConfig.WatchConfig)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+	modTime := configModTime()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			Engine.Info("SIGHUP, reload config", zap.String("file", configFile))
+		case <-check:
+			if t := configModTime(); t.Equal(modTime) {
+				continue
+			} else {
+				modTime = t
+			}
+			Engine.Info("config file changed", zap.String("file", configFile))
+		}
+		if err := ReloadConfig(); err != nil {
+			Engine.Error("reload config", zap.Error(err))
+		}
+	}
+}
+
+func configModTime() (t time.Time) {
+	if info, err := os.Stat(configFile); err == nil {
+		t = info.ModTime()
+	}
+	return
+}
+
+// ReloadConfig 重新读取配置文件，计算每个插件变化的配置项，只热更新受影响的插件，无法热更新的配置项记录日志提示重启
+func ReloadConfig() error {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	raw, err := os.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	var cg map[string]map[string]any
+	if err = yaml.Unmarshal(raw, &cg); err != nil {
+		return err
+	}
+	ConfigRaw = raw
+	Engine.reload(Engine.RawConfig.ReloadUserFile(cg["global"]))
+	for _, plugin := range plugins {
+		userConfig := cg[strings.ToLower(plugin.Name)]
+		var changed []string
+		oldEnable, _ := plugin.RawConfig.File.(map[string]any)
+		if oldEnable["enable"] != userConfig["enable"] {
+			changed = append(changed, "enable")
+		}
+		if plugin.RawConfig.Ptr.IsValid() { // 被环境变量禁用的插件没有解析配置
+			changed = append(changed, plugin.RawConfig.ReloadUserFile(userConfig)...)
+		}
+		plugin.reload(changed)
+	}
+	return nil
+}
+
+// reload 区分可以热更新和需要重启的配置项，有可以热更新的配置项时调用 Update
+func (opt *Plugin) reload(changed []string) {
+	if len(changed) == 0 {
+		return
+	}
+	var hot, restart []string
+	for _, key := range changed {
+		if opt.needRestart(key) {
+			restart = append(restart, key)
+		} else {
+			hot = append(hot, key)
+		}
+	}
+	if len(restart) > 0 {
+		opt.Warn("config changed, restart required", zap.Strings("keys", restart))
+	}
+	if len(hot) > 0 {
+		opt.Info("config reloaded", zap.Strings("keys", hot))
+		if !opt.Disabled {
+			opt.Update(&opt.RawConfig)
+		}
+	}
+}
+
+func (opt *Plugin) needRestart(key string) bool {
+	name := key[strings.LastIndexByte(key, '.')+1:]
+	for _, k := range RestartConfigs {
+		if name == k {
+			return true
+		}
+	}
+	if opt == Engine {
+		section, _, _ := strings.Cut(key, ".")
+		for _, k := range restartGlobalConfigs {
+			if section == k {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setLogLevel 按全局配置设置日志级别
+func setLogLevel() {
+	if EngineConfig.LogLevel == "trace" {
+		log.Trace = true
+		log.LogLevel.SetLevel(zap.DebugLevel)
+	} else {
+		log.Trace = false
+		loglevel, err := zapcore.ParseLevel(EngineConfig.LogLevel)
+		if err != nil {
+			log.Error("parse log level error:", err)
+			loglevel = zapcore.InfoLevel
+		}
+		log.LogLevel.SetLevel(loglevel)
+	}
+}
@@ -0,0 +1,57 @@
+package engine
+
+import "testing"
+
+// TestReloadGlobalKeys 只在启动时读取的全局配置项修改后提示重启
+func TestReloadGlobalKeys(t *testing.T) {
+	for key, restart := range map[string]bool{
+		"loglang":            true,
+		"pulseinterval":      true,
+		"watchconfig":        true,
+		"webhook.urls":       true,
+		"eventhistorysize":   false,
+		"streamgroups":       false,
+		"streamalias":        false,
+		"publish.buffertime": false,
+	} {
+		if Engine.needRestart(key) != restart {
+			t.Errorf("%s: restart %v", key, !restart)
+		}
+	}
+}
+
+// TestReloadStreamAliases 重新加载配置时删除配置中去掉的别名，通过接口添加的别名保留
+func TestReloadStreamAliases(t *testing.T) {
+	defer RemoveStreamAlias("reload/api")
+	defer loadStreamAliases(nil, nil)
+	loadStreamAliases(map[string]string{"reload/a": "live/a", "reload/b": "live/b"}, nil)
+	if err := AddStreamAlias("reload/api", "live/api"); err != nil {
+		t.Fatal(err)
+	}
+	loadStreamAliases(map[string]string{"reload/a": "live/a2"}, nil)
+	for alias, want := range map[string]string{"reload/a": "live/a2", "reload/b": "reload/b", "reload/api": "live/api"} {
+		if got := ResolveStreamPath(alias); got != want {
+			t.Errorf("%s resolves to %s, want %s", alias, got, want)
+		}
+	}
+}
+
+// TestReloadStreamGroups 重新加载配置时更新配置中的码率组，通过接口添加的码率组保留
+func TestReloadStreamGroups(t *testing.T) {
+	defer StreamGroups.Delete("reload/api")
+	defer loadStreamGroups(nil)
+	loadStreamGroups(map[string][]string{"reload/a": {"reload/a_hd"}, "reload/b": {"reload/b_hd"}})
+	if err := AddStreamGroup(&StreamGroup{Master: "reload/api", Renditions: []Rendition{{StreamPath: "reload/api_hd"}}}); err != nil {
+		t.Fatal(err)
+	}
+	loadStreamGroups(map[string][]string{"reload/a": {"reload/a_hd", "reload/a_sd"}})
+	if g := StreamGroups.Get("reload/a"); g == nil || len(g.Renditions) != 2 {
+		t.Fatalf("group reload/a not updated: %+v", g)
+	}
+	if StreamGroups.Get("reload/b") != nil {
+		t.Fatal("group removed from config still exists")
+	}
+	if StreamGroups.Get("reload/api") == nil {
+		t.Fatal("group added by api removed")
+	}
+}
@@ -0,0 +1,163 @@
+package engine
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+var (
+	ErrAliasInvalid  = errors.New("alias needs alias and streamPath")
+	ErrAliasLoop     = errors.New("alias points to itself")
+	ErrAliasNotFound = errors.New("alias not found")
+)
+
+// StreamAliases 流别名，key 为别名，value 为真实的流路径，订阅别名时订阅的是真实的流
+var StreamAliases util.Map[string, string]
+
+// streamRewrite 流路径重写规则，匹配的路径按 Replace 模板（可使用 $1、${name} 引用分组）改写为真实的流路径
+type streamRewrite struct {
+	*regexp.Regexp
+	Replace string
+}
+
+var (
+	streamRewrites     []streamRewrite
+	configAliases      []string // 上次从配置加载的别名，重新加载配置时先删除
+	streamRewritesLock sync.RWMutex
+)
+
+// StreamAlias 别名信息，Regexp 为 true 时 Alias 为重写规则的正则表达式
+type StreamAlias struct {
+	Alias      string
+	StreamPath string
+	Regexp     bool `json:",omitempty" yaml:",omitempty"`
+}
+
+// AddStreamAlias 添加或者替换别名，目标本身是别名时指向其真实的流路径
+func AddStreamAlias(alias, streamPath string) error {
+	alias, streamPath = strings.Trim(alias, "/"), strings.Trim(streamPath, "/")
+	if alias == "" || streamPath == "" {
+		return ErrAliasInvalid
+	}
+	if target, ok := StreamAliases.Load(streamPath); ok {
+		streamPath = target.(string)
+	}
+	if alias == streamPath {
+		return ErrAliasLoop
+	}
+	// 指向该别名的其他别名也改为指向真实的流路径
+	StreamAliases.Range(func(other, target string) {
+		if target == alias {
+			StreamAliases.Set(other, streamPath)
+		}
+	})
+	StreamAliases.Set(alias, streamPath)
+	return nil
+}
+
+func RemoveStreamAlias(alias string) error {
+	if _, ok := StreamAliases.Delete(strings.Trim(alias, "/")); !ok {
+		return ErrAliasNotFound
+	}
+	return nil
+}
+
+// ResolveStreamPath 返回别名或者重写规则对应的真实流路径，都不匹配时原样返回
+func ResolveStreamPath(streamPath string) string {
+	if target, ok := StreamAliases.Load(streamPath); ok {
+		return target.(string)
+	}
+	streamRewritesLock.RLock()
+	defer streamRewritesLock.RUnlock()
+	for _, rule := range streamRewrites {
+		if match := rule.FindStringSubmatchIndex(streamPath); match != nil {
+			return string(rule.ExpandString(nil, rule.Replace, streamPath, match))
+		}
+	}
+	return streamPath
+}
+
+// AliasesOf 指向该流路径的所有别名，不包括重写规则
+func AliasesOf(streamPath string) (aliases []string) {
+	StreamAliases.Range(func(alias, target string) {
+		if target == streamPath {
+			aliases = append(aliases, alias)
+		}
+	})
+	sort.Strings(aliases)
+	return
+}
+
+// loadStreamAliases 加载配置中的别名和重写规则，重写规则按正则表达式的字典序依次匹配。
+// 重新加载时配置中删除的别名也会删除，通过接口添加的别名不受影响
+func loadStreamAliases(aliases map[string]string, rewrites map[string]string) {
+	streamRewritesLock.Lock()
+	defer streamRewritesLock.Unlock()
+	for _, alias := range configAliases {
+		StreamAliases.Delete(alias)
+	}
+	configAliases = configAliases[:0]
+	for alias, streamPath := range aliases {
+		if err := AddStreamAlias(alias, streamPath); err != nil {
+			Engine.Error("stream alias", zap.String("alias", alias), zap.Error(err))
+			continue
+		}
+		configAliases = append(configAliases, strings.Trim(alias, "/"))
+	}
+	var rules []streamRewrite
+	for pattern, replace := range rewrites {
+		reg, err := regexp.Compile(pattern)
+		if err != nil {
+			Engine.Error("stream rewrite", zap.String("pattern", pattern), zap.Error(err))
+			continue
+		}
+		rules = append(rules, streamRewrite{reg, replace})
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].String() < rules[j].String()
+	})
+	streamRewrites = rules
+}
+
+// API_alias_list 所有的别名以及重写规则
+func (conf *GlobalConfig) API_alias_list(w http.ResponseWriter, r *http.Request) {
+	util.ReturnFetchList(func() (list []StreamAlias) {
+		StreamAliases.Range(func(alias, streamPath string) {
+			list = append(list, StreamAlias{Alias: alias, StreamPath: streamPath})
+		})
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Alias < list[j].Alias
+		})
+		streamRewritesLock.RLock()
+		for _, rule := range streamRewrites {
+			list = append(list, StreamAlias{Alias: rule.String(), StreamPath: rule.Replace, Regexp: true})
+		}
+		streamRewritesLock.RUnlock()
+		return
+	}, w, r)
+}
+
+// API_alias_add 添加别名，之后订阅 alias 即订阅 streamPath，无需改动发布者
+func (conf *GlobalConfig) API_alias_add(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if err := AddStreamAlias(q.Get("alias"), q.Get("streamPath")); err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	util.ReturnOK(w, r)
+}
+
+func (conf *GlobalConfig) API_alias_remove(w http.ResponseWriter, r *http.Request) {
+	if err := RemoveStreamAlias(r.URL.Query().Get("alias")); err != nil {
+		util.ReturnError(util.APIErrorNotFound, err.Error(), w, r)
+		return
+	}
+	util.ReturnOK(w, r)
+}
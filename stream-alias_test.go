@@ -0,0 +1,70 @@
+package engine
+
+import "testing"
+
+// TestAddStreamAlias 别名的目标是别名时指向真实的流路径，成为别名的流路径的其他别名也随之指向真实的流路径，指向自身的别名被拒绝
+func TestAddStreamAlias(t *testing.T) {
+	type step struct {
+		alias, streamPath string
+		err               error
+	}
+	for _, c := range []struct {
+		name  string
+		steps []step
+		want  map[string]string // 别名 -> 解析后的流路径
+	}{
+		{"chain", []step{{"alias/a", "live/x", nil}, {"alias/b", "alias/a", nil}}, map[string]string{"alias/a": "live/x", "alias/b": "live/x"}},
+		{"retarget", []step{{"alias/a", "live/x", nil}, {"alias/b", "alias/a", nil}, {"alias/a", "live/y", nil}}, map[string]string{"alias/a": "live/y", "alias/b": "live/x"}},
+		{"target becomes alias", []step{{"alias/b", "alias/a", nil}, {"alias/c", "alias/a", nil}, {"alias/a", "live/x", nil}}, map[string]string{"alias/a": "live/x", "alias/b": "live/x", "alias/c": "live/x"}},
+		{"trim", []step{{"/alias/a/", "/live/x/", nil}}, map[string]string{"alias/a": "live/x"}},
+		{"self", []step{{"alias/a", "/alias/a", ErrAliasLoop}}, map[string]string{"alias/a": "alias/a"}},
+		{"loop", []step{{"alias/a", "alias/b", nil}, {"alias/b", "alias/a", ErrAliasLoop}}, map[string]string{"alias/a": "alias/b", "alias/b": "alias/b"}},
+		{"long loop", []step{{"alias/a", "alias/b", nil}, {"alias/b", "alias/c", nil}, {"alias/c", "alias/a", ErrAliasLoop}}, map[string]string{"alias/a": "alias/c", "alias/b": "alias/c", "alias/c": "alias/c"}},
+		{"empty", []step{{"", "live/x", ErrAliasInvalid}, {"alias/a", "/", ErrAliasInvalid}}, map[string]string{"alias/a": "alias/a"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			defer func() {
+				for _, alias := range []string{"alias/a", "alias/b", "alias/c"} {
+					RemoveStreamAlias(alias)
+				}
+			}()
+			for _, s := range c.steps {
+				if err := AddStreamAlias(s.alias, s.streamPath); err != s.err {
+					t.Fatalf("add %s -> %s: %v, want %v", s.alias, s.streamPath, err, s.err)
+				}
+			}
+			for alias, want := range c.want {
+				if got := ResolveStreamPath(alias); got != want {
+					t.Errorf("%s resolves to %s, want %s", alias, got, want)
+				}
+			}
+		})
+	}
+	if err := RemoveStreamAlias("alias/a"); err != ErrAliasNotFound {
+		t.Fatalf("remove missing alias: %v", err)
+	}
+}
+
+// TestResolveStreamPath 重写规则按正则表达式的字典序依次匹配，第一个匹配的规则展开分组，别名优先于重写规则
+func TestResolveStreamPath(t *testing.T) {
+	defer RemoveStreamAlias("public/lobby")
+	defer loadStreamAliases(nil, nil)
+	loadStreamAliases(map[string]string{"public/lobby": "live/cam0"}, map[string]string{
+		`^public/(.+)$`:                  "live/$1",
+		`^public/(?P<room>\w+)/hd$`:      "live/${room}_1080",
+		`^(?P<app>\w+)/(?P<cam>cam\d+)$`: "${app}/relay/${cam}",
+		`^broken/(`:                      "live/broken", // 无效的规则被忽略
+	})
+	for streamPath, want := range map[string]string{
+		"public/lobby":    "live/cam0",        // 别名
+		"public/room1":    "live/room1",       // ^public/(.+)$ 排在 ^public/(?P<room>... 之前
+		"public/room1/hd": "live/room1/hd",    // 字典序靠前的规则先匹配
+		"edge/cam12":      "edge/relay/cam12", // 命名分组
+		"edge/door":       "edge/door",        // 不匹配时原样返回
+		"broken/x":        "broken/x",
+	} {
+		if got := ResolveStreamPath(streamPath); got != want {
+			t.Errorf("%s resolves to %s, want %s", streamPath, got, want)
+		}
+	}
+}
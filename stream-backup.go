@@ -0,0 +1,216 @@
+package engine
+
+import (
+	"errors"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+)
+
+var ErrPublisherStandby = errors.New("publisher is standby")
+
+// backupPublisher 备用发布者在接替之前的状态，写入的数据被丢弃，只保留最新的序列帧用于接替时发送
+type backupPublisher struct {
+	standby    bool
+	videoHead  []byte // 最新的视频序列帧（AVCC 格式）
+	audioHead  []byte // 最新的音频序列帧，G711 没有序列帧，保留第一帧的头
+	videoCodec codec.VideoCodecID
+	audioCodec codec.AudioCodecID
+	held       []common.Track // 自行创建轨道的插件在备用期间添加的轨道，接替时再加入流
+}
+
+// isBackup 发布者是否要求作为备用发布者
+func (p *Publisher) isBackup() bool {
+	return p.Backup || p.Config != nil && p.Config.BackupArgName != "" && p.Args.Has(p.Config.BackupArgName)
+}
+
+// IsStandby 是否是正在等待接替的备用发布者，自行创建轨道写入数据的插件可以据此跳过写入，备用期间添加的轨道会在接替时加入流
+func (p *Publisher) IsStandby() bool {
+	p.backupLock.Lock()
+	defer p.backupLock.Unlock()
+	return p.backup.standby
+}
+
+// holdTrack 备用状态下暂存发布者添加的轨道，返回 false 表示需要正常添加
+func (p *Publisher) holdTrack(t common.Track) bool {
+	p.backupLock.Lock()
+	defer p.backupLock.Unlock()
+	if !p.backup.standby {
+		return false
+	}
+	p.backup.held = append(p.backup.held, t)
+	return true
+}
+
+func (p *Publisher) setStandby(standby bool) {
+	p.backupLock.Lock()
+	p.backup = backupPublisher{standby: standby}
+	p.backupLock.Unlock()
+}
+
+// standbyVideo 备用状态下丢弃视频帧并记录序列帧，返回 false 表示需要正常写入
+func (p *Publisher) standbyVideo(frame *util.BLL) bool {
+	p.backupLock.Lock()
+	defer p.backupLock.Unlock()
+	if !p.backup.standby {
+		return false
+	}
+	if frame.ByteLength >= 6 {
+		b0 := frame.GetByte(0)
+		if isExtHeader := b0 & 0b1000_0000; isExtHeader != 0 {
+			if b0&0x0F == 0 { // PacketTypeSequenceStart
+				switch frame.GetUintN(1, 4) {
+				case codec.FourCC_H265_32:
+					p.backup.videoHead, p.backup.videoCodec = frame.ToBytes(), codec.CodecID_H265
+				case codec.FourCC_AV1_32:
+					p.backup.videoHead, p.backup.videoCodec = frame.ToBytes(), codec.CodecID_AV1
+				}
+			}
+		} else if frame.GetByte(1) == 0 {
+			p.backup.videoHead, p.backup.videoCodec = frame.ToBytes(), codec.VideoCodecID(b0&0x0F)
+		}
+	}
+	frame.Recycle()
+	return true
+}
+
+// standbyAudio 备用状态下丢弃音频帧并记录序列帧，返回 false 表示需要正常写入
+func (p *Publisher) standbyAudio(frame *util.BLL) bool {
+	p.backupLock.Lock()
+	defer p.backupLock.Unlock()
+	if !p.backup.standby {
+		return false
+	}
+	if frame.ByteLength >= 4 {
+		audioCodec := codec.AudioCodecID(frame.GetByte(0) >> 4)
+		if audioCodec != codec.CodecID_AAC {
+			if p.backup.audioHead == nil {
+				p.backup.audioHead, p.backup.audioCodec = frame.ToBytes(), audioCodec
+			}
+		} else if frame.GetByte(1) == 0 {
+			p.backup.audioHead, p.backup.audioCodec = frame.ToBytes(), audioCodec
+		}
+	}
+	frame.Recycle()
+	return true
+}
+
+// takeOver 备用发布者接替 old 的音视频轨道，编码相同时沿用原有的轨道并以离线重连的方式重新计算时间戳，
+// 然后写入备用发布者的序列帧，订阅者据此重新发送解码配置。返回被接替的轨道，以及备用期间暂存的轨道
+func (p *Publisher) takeOver(old *Publisher) (taken []common.Track, held []common.Track) {
+	p.backupLock.Lock()
+	defer p.backupLock.Unlock()
+	backup := p.backup
+	p.backup = backupPublisher{}
+	held = backup.held
+	pool := make(util.BytesPool, 17)
+	p.VideoTrack, p.AudioTrack = nil, nil
+	if backup.videoHead != nil {
+		if vt := old.VideoTrack; vt != nil && vt.GetCodec() == backup.videoCodec {
+			vt.SetStuff(common.TrackStateOffline)
+			vt.SetLostFlag() // 从关键帧开始
+			p.VideoTrack = vt
+			taken = append(taken, vt)
+		}
+		var frame util.BLL
+		frame.Push(pool.GetShell(backup.videoHead))
+		p.writeAVCCVideo(&p.VideoTrack, 0, &frame, pool)
+	}
+	if backup.audioHead != nil {
+		if at := old.AudioTrack; at != nil && at.GetCodec() == backup.audioCodec {
+			at.SetStuff(common.TrackStateOffline)
+			p.AudioTrack = at
+			taken = append(taken, at)
+		}
+		// G711 保留的是第一帧，只需要用来创建轨道
+		if backup.audioCodec == codec.CodecID_AAC || p.AudioTrack == nil {
+			var frame util.BLL
+			frame.Push(pool.GetShell(backup.audioHead))
+			p.writeAVCCAudio(&p.AudioTrack, 0, &frame, pool)
+		}
+	}
+	return
+}
+
+// addBackup 注册备用发布者，重复注册的只保留一个
+func (s *Stream) addBackup(backup IPublisher) {
+	for _, b := range s.backups {
+		if b == backup {
+			return
+		}
+	}
+	backup.GetPublisher().setStandby(true)
+	s.backups = append(s.backups, backup)
+	s.Info("backup publisher", zap.String("type", backup.GetPublisher().Type), zap.Int("backups", len(s.backups)))
+}
+
+// failover 发布者超时后由最早注册且仍在线的备用发布者接替，没有接替的音视频轨道会被移除，订阅者无需重新订阅。
+// 备用发布者自行创建的轨道在备用期间被暂存，接替时替换被移除的轨道，在这些轨道上读取的订阅者需要重新订阅
+func (s *Stream) failover() bool {
+	for len(s.backups) > 0 {
+		backup := s.backups[0]
+		s.backups = s.backups[1:]
+		if backup.IsClosed() {
+			continue
+		}
+		old, oldPuber := s.Publisher, s.publisher
+		puber := backup.GetPublisher()
+		s.Warn("failover", zap.String("old type", oldPuber.Type), zap.String("new type", puber.Type), zap.Int("backups", len(s.backups)))
+		if !old.IsClosed() {
+			old.OnEvent(SEKick{CreateEvent(util.Null)})
+		}
+		s.Publisher, s.publisher = backup, puber
+		conf := puber.Config
+		s.PublishTimeout = conf.PublishTimeout
+		s.DelayCloseTimeout = conf.DelayCloseTimeout
+		s.IdleTimeout = conf.IdleTimeout
+		s.PauseTimeout = conf.PauseTimeout
+		taken := make(map[string]bool)
+		takenTracks, held := puber.takeOver(oldPuber)
+		for _, t := range takenTracks {
+			taken[t.GetName()] = true
+		}
+		var removed []string
+		s.Tracks.Range(func(name string, t common.Track) {
+			switch t.(type) {
+			case *track.Video, *track.Audio:
+				if !taken[name] {
+					removed = append(removed, name)
+				}
+			}
+		})
+		for _, name := range removed {
+			if t, ok := s.Tracks.Remove(name); ok {
+				s.Info("track -1", zap.String("name", name))
+				s.Subscribers.Broadcast(t)
+				t.Dispose()
+			}
+		}
+		for _, t := range held {
+			switch t.(type) {
+			case *track.Video:
+				if !conf.PubVideo {
+					continue
+				}
+			case *track.Audio:
+				if !conf.PubAudio {
+					continue
+				}
+			}
+			if name := t.GetName(); s.Tracks.Add(name, t) {
+				s.Info("track +1", zap.String("name", name))
+				s.Subscribers.OnTrack(t)
+			}
+		}
+		// 在流的协程中发送，不能因为事件总线阻塞而卡住流
+		event := FailoverEvent{CreateEvent(s), old, backup}
+		go func() {
+			EventBus <- event
+		}()
+		return true
+	}
+	return false
+}
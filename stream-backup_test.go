@@ -0,0 +1,96 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"m7s.live/engine/v4/track"
+)
+
+// backupTestConfig 发布超时 1 秒，便于触发接替
+func backupTestConfig(backup bool) func(*Publisher) {
+	return func(p *Publisher) {
+		conf := EngineConfig.GetPublishConfig()
+		conf.PublishTimeout = time.Second
+		p.Config = &conf
+		p.Backup = backup
+	}
+}
+
+// publishFailoverPrimary 发布原发布者并订阅，返回订阅者和当前的写入函数，接替后测试将其换成备用发布者的写入
+func publishFailoverPrimary(t *testing.T, streamPath string) (*testSubscriber, *func()) {
+	primary := publishTestVideo(t, streamPath, backupTestConfig(false))
+	primary.writeVideo("", 0, primary.sequenceHead(testSPS720))
+	i := 0
+	write := func() {
+		primary.writeVideo("", uint32(i*40), primary.frame(i%10 == 0))
+		i++
+	}
+	write()
+	sub := subscribeTestVideo(t, streamPath, func() { write() })
+	return sub, &write
+}
+
+// testFrameWriter 向轨道写入 25fps、每 10 帧一个关键帧的视频
+func testFrameWriter(write func(ts uint32, idr bool)) func() {
+	i := 0
+	return func() {
+		write(uint32(i*40), i%10 == 0)
+		i++
+	}
+}
+
+// waitFailover 原发布者停止写入后等待流的发布者变为 backup，等待期间不写入，接替时流的协程不会和写入同时访问轨道
+func waitFailover(t *testing.T, stream *Stream, backup IPublisher) {
+	for deadline := time.Now().Add(time.Second * 10); stream.snapshot().Publisher != backup; time.Sleep(time.Millisecond * 50) {
+		if time.Now().After(deadline) {
+			t.Fatal("backup publisher did not take over")
+		}
+	}
+}
+
+// TestFailover 以 AVCC 格式写入的备用发布者沿用原有的轨道接替，订阅者继续收到帧
+func TestFailover(t *testing.T) {
+	t.Parallel()
+	sub, write := publishFailoverPrimary(t, "backup/avcc")
+	backup := publishTestVideo(t, "backup/avcc", backupTestConfig(true))
+	backup.writeVideo("", 0, backup.sequenceHead(testSPS720))
+	stream := sub.sync(t)[0].stream
+	if !backup.IsStandby() {
+		t.Fatal("second publisher is not standby")
+	}
+	waitFailover(t, stream, backup)
+	*write = testFrameWriter(func(ts uint32, idr bool) {
+		backup.writeVideo("", ts, backup.frame(idr))
+	})
+	(*write)()
+	if frames := sub.sync(t); frames[len(frames)-1].stream != backup.Stream {
+		t.Fatalf("frame from %v after failover", frames[len(frames)-1].stream)
+	}
+}
+
+// TestFailoverHeldTracks 自行创建轨道的备用发布者，备用期间添加的轨道在接替时加入流
+func TestFailoverHeldTracks(t *testing.T) {
+	t.Parallel()
+	sub, _ := publishFailoverPrimary(t, "backup/held")
+	backup := publishTestVideo(t, "backup/held", backupTestConfig(true))
+	vt := track.NewH264(&backup.Publisher)
+	vt.WriteAVCC(0, backup.sequenceHead(testSPS720))
+	write := testFrameWriter(func(ts uint32, idr bool) {
+		vt.WriteAVCC(ts, backup.frame(idr))
+	})
+	write() // 关键帧写完后添加轨道
+	stream := sub.sync(t)[0].stream
+	if v, _ := stream.Tracks.Load(vt.GetName()); v == &vt.Video {
+		t.Fatal("standby track added to stream")
+	}
+	waitFailover(t, stream, backup)
+	if v, _ := stream.Tracks.Load(vt.GetName()); v != &vt.Video {
+		t.Fatal("held track not added after failover")
+	}
+	write()
+	viewer := subscribeTestVideo(t, "backup/held", write)
+	if f := viewer.sync(t)[0]; f.stream != stream {
+		t.Fatalf("frame from %v", f.stream)
+	}
+}
@@ -0,0 +1,334 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/util"
+)
+
+var (
+	ErrCompositeNotFound = errors.New("composite stream not found")
+	ErrCompositeInvalid  = errors.New("composite stream needs streamPath and sources with distinct streamPath and name")
+)
+
+// Layout 来源在画布中的位置和大小，均为相对画布的比例（0~1），由客户端按布局排版，服务端不转码
+type Layout struct {
+	X      float64
+	Y      float64
+	Width  float64
+	Height float64
+	ZIndex int `json:",omitempty" yaml:",omitempty"` // 叠放次序，大的在上层，例如画中画的小窗
+}
+
+// CompositeSource 合成流的一个来源
+type CompositeSource struct {
+	StreamPath string
+	Name       string // 轨道名前缀，为空时取流路径的最后一段，来源的轨道在合成流中命名为 Name_原轨道名
+	Layout
+}
+
+// CompositeStream 合成流，把多个来源流的轨道转发到同一个虚拟流中并附带布局信息，一个订阅者即可收到所有来源（例如会议、画中画）
+type CompositeStream struct {
+	StreamPath         string
+	Width              int `json:",omitempty" yaml:",omitempty"` // 画布大小，仅供客户端参考
+	Height             int `json:",omitempty" yaml:",omitempty"`
+	Sources            []CompositeSource
+	context.Context    `json:"-" yaml:"-"`
+	context.CancelFunc `json:"-" yaml:"-"`
+	lock               sync.Mutex
+	publisher          *compositePublisher
+	start              time.Time                     // 本次发布的开始时间，各来源的时间戳对齐到该时间轴
+	forwarders         map[string]context.CancelFunc // 来源流路径 -> 停止转发
+}
+
+// CompositeStreams 所有的合成流，key 为合成流的路径
+var CompositeStreams util.Map[string, *CompositeStream]
+
+// AddCompositeStream 添加合成流，路径相同的合成流已经存在时更新布局和来源，来源不变的轨道不受影响
+func AddCompositeStream(c *CompositeStream) error {
+	if c.StreamPath = strings.Trim(c.StreamPath, "/"); c.StreamPath == "" || len(c.Sources) == 0 {
+		return ErrCompositeInvalid
+	}
+	// 来源以流路径区分，名称是轨道名的前缀，都不能重复
+	paths, names := make(map[string]bool, len(c.Sources)), make(map[string]bool, len(c.Sources))
+	for i := range c.Sources {
+		source := &c.Sources[i]
+		if source.StreamPath = strings.Trim(source.StreamPath, "/"); source.StreamPath == "" || source.StreamPath == c.StreamPath {
+			return ErrCompositeInvalid
+		}
+		if source.Name == "" {
+			source.Name = source.StreamPath[strings.LastIndexByte(source.StreamPath, '/')+1:]
+		}
+		if paths[source.StreamPath] || names[source.Name] {
+			return ErrCompositeInvalid
+		}
+		paths[source.StreamPath], names[source.Name] = true, true
+	}
+	if old := CompositeStreams.Get(c.StreamPath); old != nil {
+		old.update(c)
+		return nil
+	}
+	c.Context, c.CancelFunc = context.WithCancel(Engine)
+	CompositeStreams.Set(c.StreamPath, c)
+	go c.run()
+	return nil
+}
+
+// RemoveCompositeStream 停止合成流并关闭对应的虚拟流
+func RemoveCompositeStream(streamPath string) error {
+	c, ok := CompositeStreams.Delete(streamPath)
+	if !ok {
+		return ErrCompositeNotFound
+	}
+	c.CancelFunc()
+	return nil
+}
+
+// compositePublisher 合成流的发布者，每个来源对应一组具名轨道
+type compositePublisher struct {
+	Publisher
+}
+
+// run 发布合成流，流因为所有来源长时间离线等原因关闭后重新发布
+func (c *CompositeStream) run() {
+	for c.Err() == nil {
+		pub := &compositePublisher{}
+		pub.SetParentCtx(c)
+		if err := Engine.Publish(c.StreamPath, pub); err != nil {
+			Engine.Error("composite publish", zap.String("stream", c.StreamPath), zap.Error(err))
+		} else {
+			c.lock.Lock()
+			pub.Info("composite start", zap.Int("sources", len(c.Sources)))
+			c.publisher, c.start = pub, time.Now()
+			c.forwarders = make(map[string]context.CancelFunc)
+			for _, source := range c.Sources {
+				c.forward(source)
+			}
+			c.lock.Unlock()
+			select {
+			case <-pub.Done():
+			case <-c.Done():
+				pub.Stream.Close()
+			}
+			c.lock.Lock()
+			c.publisher = nil
+			c.lock.Unlock()
+			pub.Info("composite stop")
+		}
+		select {
+		case <-c.Done():
+		case <-time.After(time.Second * 5):
+		}
+	}
+}
+
+func (c *CompositeStream) update(n *CompositeStream) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	old := make(map[string]CompositeSource, len(c.Sources))
+	for _, source := range c.Sources {
+		old[source.StreamPath] = source
+	}
+	c.Width, c.Height, c.Sources = n.Width, n.Height, n.Sources
+	if c.publisher == nil {
+		return
+	}
+	keep := make(map[string]bool, len(n.Sources))
+	for _, source := range n.Sources {
+		// 名称改变后轨道名也随之改变，需要重新转发
+		if o, ok := old[source.StreamPath]; ok && o.Name == source.Name {
+			keep[source.StreamPath] = true
+		}
+	}
+	for streamPath, stop := range c.forwarders {
+		if !keep[streamPath] {
+			stop()
+			delete(c.forwarders, streamPath)
+		}
+	}
+	for _, source := range n.Sources {
+		if _, ok := c.forwarders[source.StreamPath]; !ok {
+			c.forward(source)
+		}
+	}
+}
+
+// forward 持续转发一个来源，来源离线后移除其轨道，重新上线后再次转发，调用时需持有锁
+func (c *CompositeStream) forward(source CompositeSource) {
+	ctx, cancel := context.WithCancel(c.publisher)
+	c.forwarders[source.StreamPath] = cancel
+	pub, start := c.publisher, c.start
+	go func() {
+		for ctx.Err() == nil {
+			f := &compositeForwarder{source: source, publisher: pub, start: start, pool: make(util.BytesPool, 17)}
+			f.SetParentCtx(ctx)
+			subConf := EngineConfig.Subscribe
+			subConf.Internal = true
+			subConf.SubCue = false
+			subConf.IFrameOnly = false
+			f.Config = &subConf
+			if err := Engine.Subscribe(source.StreamPath, f); err == nil {
+				f.PlayRaw()
+			}
+			f.removeTracks()
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+}
+
+// compositeForwarder 以内部订阅者的身份读取来源流，把音视频帧复制到合成流中该来源的具名轨道
+type compositeForwarder struct {
+	Subscriber
+	source    CompositeSource
+	publisher *compositePublisher
+	start     time.Time
+	offset    int64 // 来源时间戳到合成流时间戳的偏移（毫秒）
+	synced    bool
+	pool      util.BytesPool
+	video     string // 在合成流中的轨道名
+	audio     string
+}
+
+func (f *compositeForwarder) OnEvent(event any) {
+	switch v := event.(type) {
+	case VideoDeConf:
+		f.video = f.source.Name + "_" + f.Video.GetName()
+		f.publisher.WriteNamedAVCCVideo(f.video, 0, f.copy(v), f.pool)
+	case AudioDeConf:
+		f.audio = f.source.Name + "_" + f.Audio.GetName()
+		f.publisher.WriteNamedAVCCAudio(f.audio, 0, f.copy(v), f.pool)
+	case VideoFrame:
+		if f.video != "" && v.AVCC.ByteLength > 0 {
+			f.publisher.WriteNamedAVCCVideo(f.video, f.timestamp(v.AVFrame, v.AbsTime), f.copy(v.AVCC.ToBytes()), f.pool)
+		}
+	case AudioFrame:
+		if f.audio != "" && v.AVCC.ByteLength > 0 {
+			f.publisher.WriteNamedAVCCAudio(f.audio, f.timestamp(v.AVFrame, v.AbsTime), f.copy(v.AVCC.ToBytes()), f.pool)
+		}
+	default:
+		f.Subscriber.OnEvent(event)
+	}
+}
+
+// copy 来源的内存会被回收复用，需要复制一份
+func (f *compositeForwarder) copy(data []byte) *util.BLL {
+	var frame util.BLL
+	frame.Push(f.pool.GetShell(append([]byte(nil), data...)))
+	return &frame
+}
+
+// timestamp 来源的第一帧按写入时间对齐到合成流的时间轴，之后保持来源自身的时间间隔，音视频共用同一个偏移
+func (f *compositeForwarder) timestamp(frame *AVFrame, absTime uint32) uint32 {
+	if !f.synced {
+		var elapsed time.Duration
+		if frame.WriteTime.After(f.start) {
+			elapsed = frame.WriteTime.Sub(f.start)
+		}
+		f.offset = elapsed.Milliseconds() - int64(absTime)
+		f.synced = true
+	}
+	return uint32(int64(absTime) + f.offset)
+}
+
+func (f *compositeForwarder) removeTracks() {
+	if f.video != "" {
+		f.publisher.RemoveNamedTrack(f.video)
+	}
+	if f.audio != "" {
+		f.publisher.RemoveNamedTrack(f.audio)
+	}
+}
+
+// CompositeSourceInfo 来源的实时信息，Tracks 为其在合成流中的轨道名
+type CompositeSourceInfo struct {
+	CompositeSource
+	Online bool
+	Tracks []string `json:",omitempty" yaml:",omitempty"`
+}
+
+type CompositeInfo struct {
+	StreamPath string
+	Width      int `json:",omitempty" yaml:",omitempty"`
+	Height     int `json:",omitempty" yaml:",omitempty"`
+	Sources    []CompositeSourceInfo
+}
+
+func (c *CompositeStream) Info() (info CompositeInfo) {
+	c.lock.Lock()
+	info.StreamPath, info.Width, info.Height = c.StreamPath, c.Width, c.Height
+	sources := append([]CompositeSource(nil), c.Sources...)
+	c.lock.Unlock()
+	s := Streams.Get(c.StreamPath)
+	for _, source := range sources {
+		si := CompositeSourceInfo{CompositeSource: source}
+		if s != nil {
+			prefix := source.Name + "_"
+			s.Tracks.Range(func(name string, _ Track) {
+				if strings.HasPrefix(name, prefix) {
+					si.Tracks = append(si.Tracks, name)
+				}
+			})
+			sort.Strings(si.Tracks)
+		}
+		si.Online = len(si.Tracks) > 0
+		info.Sources = append(info.Sources, si)
+	}
+	return
+}
+
+// API_composite_list 所有合成流的布局和来源信息
+func (conf *GlobalConfig) API_composite_list(w http.ResponseWriter, r *http.Request) {
+	util.ReturnFetchList(func() (list []CompositeInfo) {
+		CompositeStreams.Range(func(_ string, c *CompositeStream) {
+			list = append(list, c.Info())
+		})
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].StreamPath < list[j].StreamPath
+		})
+		return
+	}, w, r)
+}
+
+// API_composite 合成流的布局和来源信息，客户端据此排版各来源的轨道
+func (conf *GlobalConfig) API_composite(w http.ResponseWriter, r *http.Request) {
+	c := CompositeStreams.Get(r.URL.Query().Get("streamPath"))
+	if c == nil {
+		util.ReturnError(util.APIErrorNotFound, ErrCompositeNotFound.Error(), w, r)
+		return
+	}
+	util.ReturnFetchValue(c.Info, w, r)
+}
+
+// API_composite_add 以 JSON 提交合成流，路径相同则更新布局和来源
+func (conf *GlobalConfig) API_composite_add(w http.ResponseWriter, r *http.Request) {
+	var c CompositeStream
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		util.ReturnError(util.APIErrorDecode, err.Error(), w, r)
+		return
+	}
+	if err := AddCompositeStream(&c); err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	util.ReturnOK(w, r)
+}
+
+func (conf *GlobalConfig) API_composite_remove(w http.ResponseWriter, r *http.Request) {
+	if err := RemoveCompositeStream(r.URL.Query().Get("streamPath")); err != nil {
+		util.ReturnError(util.APIErrorNotFound, err.Error(), w, r)
+		return
+	}
+	util.ReturnOK(w, r)
+}
@@ -0,0 +1,145 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	. "m7s.live/engine/v4/common"
+)
+
+// TestAddCompositeStreamInvalid 路径为空、没有来源、来源是自身以及来源的路径或名称重复时拒绝添加
+func TestAddCompositeStreamInvalid(t *testing.T) {
+	for name, c := range map[string]*CompositeStream{
+		"no path":        {Sources: []CompositeSource{{StreamPath: "live/a"}}},
+		"no sources":     {StreamPath: "composite/invalid"},
+		"empty source":   {StreamPath: "composite/invalid", Sources: []CompositeSource{{StreamPath: "/"}}},
+		"self":           {StreamPath: "composite/invalid", Sources: []CompositeSource{{StreamPath: "/composite/invalid/"}}},
+		"duplicate path": {StreamPath: "composite/invalid", Sources: []CompositeSource{{StreamPath: "live/a", Name: "a"}, {StreamPath: "/live/a", Name: "b"}}},
+		"duplicate name": {StreamPath: "composite/invalid", Sources: []CompositeSource{{StreamPath: "live/a", Name: "cam"}, {StreamPath: "live/b", Name: "cam"}}},
+		"default name":   {StreamPath: "composite/invalid", Sources: []CompositeSource{{StreamPath: "east/cam"}, {StreamPath: "west/cam"}}},
+	} {
+		if err := AddCompositeStream(c); err != ErrCompositeInvalid {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if CompositeStreams.Get("composite/invalid") != nil {
+		t.Fatal("invalid composite stream added")
+	}
+}
+
+// TestCompositeTimestamp 来源的第一帧按写入时间对齐到合成流的时间轴，之后保持来源自身的时间间隔
+func TestCompositeTimestamp(t *testing.T) {
+	start := time.Now()
+	f := &compositeForwarder{start: start}
+	for _, c := range []struct {
+		writeTime time.Time
+		absTime   uint32
+		want      uint32
+	}{
+		{start.Add(time.Second * 2), 100000, 2000},
+		{start.Add(time.Second * 5), 100040, 2040}, // 写入时间只用于第一帧
+		{start.Add(time.Second * 5), 99980, 1980},
+	} {
+		frame := &AVFrame{}
+		frame.WriteTime = c.writeTime
+		if ts := f.timestamp(frame, c.absTime); ts != c.want {
+			t.Fatalf("absTime %d: timestamp %d, want %d", c.absTime, ts, c.want)
+		}
+	}
+	// 早于合成流开始写入的帧从 0 开始
+	f = &compositeForwarder{start: start}
+	frame := &AVFrame{}
+	frame.WriteTime = start.Add(-time.Second)
+	if ts := f.timestamp(frame, 500); ts != 0 {
+		t.Fatalf("frame before start: timestamp %d", ts)
+	}
+}
+
+// TestCompositeForward 来源的轨道以 名称_原轨道名 转发到合成流，更新时来源不变的轨道不受影响，移除的来源的轨道被删除
+func TestCompositeForward(t *testing.T) {
+	sources := map[string]*testVideoPublisher{}
+	for _, path := range []string{"composite/src/cam1", "composite/src/cam2", "composite/src/cam3"} {
+		pub := publishTestVideo(t, path)
+		pub.writeVideo("", 0, pub.sequenceHead(testSPS720))
+		sources[path] = pub
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			for _, pub := range sources {
+				pub.writeVideo("", uint32(i*40), pub.frame(i%10 == 0))
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond * 10):
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+	defer RemoveCompositeStream("composite/room")
+	if err := AddCompositeStream(&CompositeStream{StreamPath: "composite/room", Sources: []CompositeSource{
+		{StreamPath: "composite/src/cam1"},
+		{StreamPath: "composite/src/cam2", Name: "guest", Layout: Layout{X: 0.75, Y: 0.75, Width: 0.25, Height: 0.25, ZIndex: 1}},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	c := CompositeStreams.Get("composite/room")
+	tracks := func() map[string][]string {
+		m := map[string][]string{}
+		for _, si := range c.Info().Sources {
+			m[si.StreamPath] = si.Tracks
+		}
+		return m
+	}
+	waitTracks := func(want map[string]string) {
+		for deadline := time.Now().Add(time.Second * 5); ; time.Sleep(time.Millisecond * 50) {
+			got, ok := tracks(), true
+			for path, name := range want {
+				ok = ok && len(got[path]) == 1 && got[path][0] == name
+			}
+			if ok && len(got) == len(want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("composite tracks %v, want %v", got, want)
+			}
+		}
+	}
+	waitTracks(map[string]string{"composite/src/cam1": "cam1_h264", "composite/src/cam2": "guest_h264"})
+	viewer := subscribeTestVideo(t, "composite/room", func() {})
+	for i := 0; i < 3; i++ { // 来源的帧转发到合成流中
+		if f := viewer.next(t); f.stream.Path != "composite/room" || f.name != "cam1_h264" && f.name != "guest_h264" {
+			t.Fatalf("frame of %s from %s", f.name, f.stream.Path)
+		}
+	}
+	viewer.stop() // 来源还在写入，可以唤醒等待中的读取
+	s := Streams.Get("composite/room")
+	cam1, _ := s.Tracks.Load("cam1_h264")
+	if err := AddCompositeStream(&CompositeStream{StreamPath: "composite/room", Width: 1920, Height: 1080, Sources: []CompositeSource{
+		{StreamPath: "composite/src/cam1", Layout: Layout{Width: 1, Height: 1}},
+		{StreamPath: "composite/src/cam3"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	waitTracks(map[string]string{"composite/src/cam1": "cam1_h264", "composite/src/cam3": "cam3_h264"})
+	for deadline := time.Now().Add(time.Second * 5); ; time.Sleep(time.Millisecond * 50) {
+		if _, ok := s.Tracks.Load("guest_h264"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("track of removed source still in composite stream")
+		}
+	}
+	if v, _ := s.Tracks.Load("cam1_h264"); v != cam1 {
+		t.Fatal("track of unchanged source replaced on update")
+	}
+	if info := c.Info(); info.Width != 1920 || info.Sources[0].Width != 1 {
+		t.Fatalf("layout not updated: %+v", info)
+	}
+}
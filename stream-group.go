@@ -0,0 +1,274 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/util"
+)
+
+// GROUP_ALIGN_TOLERANCE 各清晰度最近关键帧的时间戳相差不超过该值时认为关键帧是对齐的
+const GROUP_ALIGN_TOLERANCE = 100 * time.Millisecond
+
+var (
+	ErrGroupNotFound    = errors.New("stream group not found")
+	ErrGroupInvalid     = errors.New("stream group needs master and renditions")
+	ErrNotInGroup       = errors.New("stream not in the same group")
+	ErrRenditionOffline = errors.New("rendition not publishing")
+)
+
+// Rendition 码率组中的一路流
+type Rendition struct {
+	StreamPath string
+	Name       string // 例如 720p，为空时取流路径最后一个下划线之后的部分
+	Bandwidth  int    `json:",omitempty" yaml:",omitempty"` // 声明的码率（比特每秒），为 0 时使用实时码率
+}
+
+// StreamGroup 码率组，主路径下关联多个清晰度的流，用于多码率（ABR）输出
+type StreamGroup struct {
+	Master     string
+	Renditions []Rendition
+}
+
+// StreamGroups 所有的码率组，key 为主路径
+var StreamGroups util.Map[string, *StreamGroup]
+
+// AddStreamGroup 添加或者替换码率组
+func AddStreamGroup(group *StreamGroup) error {
+	if group.Master == "" || len(group.Renditions) == 0 {
+		return ErrGroupInvalid
+	}
+	for i := range group.Renditions {
+		r := &group.Renditions[i]
+		if r.StreamPath == "" {
+			return ErrGroupInvalid
+		}
+		if r.Name == "" {
+			if i := strings.LastIndexByte(r.StreamPath, '_'); i >= 0 {
+				r.Name = r.StreamPath[i+1:]
+			} else {
+				r.Name = r.StreamPath
+			}
+		}
+	}
+	StreamGroups.Set(group.Master, group)
+	return nil
+}
+
+// FindStreamGroup 查找流所在的码率组，streamPath 可以是主路径或者其中一路流
+func FindStreamGroup(streamPath string) (group *StreamGroup) {
+	if group = StreamGroups.Get(streamPath); group != nil {
+		return
+	}
+	StreamGroups.Range(func(_ string, g *StreamGroup) {
+		if group == nil && g.Has(streamPath) {
+			group = g
+		}
+	})
+	return
+}
+
+func (g *StreamGroup) Has(streamPath string) bool {
+	for _, r := range g.Renditions {
+		if r.StreamPath == streamPath {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	configGroups     []string // 上次从配置加载的码率组主路径，重新加载配置时先删除
+	configGroupsLock sync.Mutex
+)
+
+// loadStreamGroups 加载配置中的码率组，配置为主路径对应各清晰度的流路径。
+// 重新加载时配置中删除的码率组也会删除，通过接口添加的码率组不受影响
+func loadStreamGroups(groups map[string][]string) {
+	configGroupsLock.Lock()
+	defer configGroupsLock.Unlock()
+	for _, master := range configGroups {
+		StreamGroups.Delete(master)
+	}
+	configGroups = configGroups[:0]
+	for master, paths := range groups {
+		group := &StreamGroup{Master: master}
+		for _, streamPath := range paths {
+			group.Renditions = append(group.Renditions, Rendition{StreamPath: streamPath})
+		}
+		if err := AddStreamGroup(group); err != nil {
+			Engine.Error("stream group", zap.String("master", master), zap.Error(err))
+			continue
+		}
+		configGroups = append(configGroups, master)
+	}
+}
+
+// RenditionInfo 码率组中一路流的实时信息，供 HLS、DASH 等插件生成多码率播放列表
+type RenditionInfo struct {
+	Rendition
+	Online     bool
+	Codec      string `json:",omitempty" yaml:",omitempty"`
+	Width      uint   `json:",omitempty" yaml:",omitempty"`
+	Height     uint   `json:",omitempty" yaml:",omitempty"`
+	FPS        int    `json:",omitempty" yaml:",omitempty"`
+	GOP        int    `json:",omitempty" yaml:",omitempty"` // 关键帧间隔（帧数）
+	KeyFrameTs int64  `json:",omitempty" yaml:",omitempty"` // 最近关键帧的时间戳（毫秒）
+	AudioCodec string `json:",omitempty" yaml:",omitempty"`
+}
+
+// StreamGroupInfo 码率组的实时信息，Aligned 表示各清晰度的关键帧是否对齐，对齐时可以无缝切换
+type StreamGroupInfo struct {
+	Master        string
+	Renditions    []RenditionInfo
+	Aligned       bool
+	KeyFrameDrift int64 // 各清晰度最近关键帧时间戳之间的最大偏差（毫秒），已按关键帧间隔折算
+}
+
+func (g *StreamGroup) Info() (info StreamGroupInfo) {
+	info.Master = g.Master
+	var gopDuration time.Duration
+	var keyFrames []time.Duration
+	for _, r := range g.Renditions {
+		ri := RenditionInfo{Rendition: r}
+		if s := Streams.Get(r.StreamPath); s != nil && s.Publisher != nil {
+			if v := s.Tracks.MainVideo; v != nil {
+				ri.Online = true
+				ri.Codec, ri.Width, ri.Height, ri.FPS, ri.GOP = v.CodecID.String(), v.Width, v.Height, v.FPS, v.GOP
+				if ri.Bandwidth == 0 {
+					ri.Bandwidth = v.BPS * 8
+				}
+				if idr := v.IDRing; idr != nil {
+					keyFrames = append(keyFrames, idr.Value.Timestamp)
+					ri.KeyFrameTs = idr.Value.Timestamp.Milliseconds()
+				}
+				if v.FPS > 0 && gopDuration == 0 {
+					gopDuration = time.Duration(v.GOP) * time.Second / time.Duration(v.FPS)
+				}
+			}
+			if a := s.Tracks.MainAudio; a != nil {
+				ri.AudioCodec = a.CodecID.String()
+				if ri.Online && r.Bandwidth == 0 {
+					ri.Bandwidth += a.BPS * 8
+				}
+			}
+		}
+		info.Renditions = append(info.Renditions, ri)
+	}
+	drift := keyFrameDrift(keyFrames, gopDuration)
+	info.KeyFrameDrift = drift.Milliseconds()
+	info.Aligned = len(keyFrames) > 0 && drift <= GROUP_ALIGN_TOLERANCE
+	sort.SliceStable(info.Renditions, func(i, j int) bool {
+		return info.Renditions[i].Bandwidth > info.Renditions[j].Bandwidth
+	})
+	return
+}
+
+// keyFrameDrift 各清晰度最近关键帧之间的最大偏差，最近关键帧可能相差整数个关键帧间隔，按间隔折算后比较
+func keyFrameDrift(keyFrames []time.Duration, gopDuration time.Duration) (drift time.Duration) {
+	for i := 1; i < len(keyFrames); i++ {
+		d := keyFrames[i] - keyFrames[0]
+		if d < 0 {
+			d = -d
+		}
+		if gopDuration > 0 {
+			if d %= gopDuration; d > gopDuration/2 {
+				d = gopDuration - d
+			}
+		}
+		if d > drift {
+			drift = d
+		}
+	}
+	return
+}
+
+// SwitchRendition 切换到同一码率组中的另一路流，在其下一个视频关键帧处切换，音频随之切换，无需重新订阅
+func (s *Subscriber) SwitchRendition(streamPath string) error {
+	group := FindStreamGroup(s.Stream.Path)
+	if group == nil || !group.Has(streamPath) {
+		return ErrNotInGroup
+	}
+	target := Streams.Get(streamPath)
+	if target == nil || target.Publisher == nil || target.Tracks.MainVideo == nil {
+		return ErrRenditionOffline
+	}
+	if err := s.switchTo(target.Tracks.MainVideo, target.Tracks.MainAudio); err != nil {
+		return err
+	}
+	s.Info("switch rendition", zap.String("to", streamPath))
+	return nil
+}
+
+// API_group_list 所有码率组的实时信息
+func (conf *GlobalConfig) API_group_list(w http.ResponseWriter, r *http.Request) {
+	util.ReturnFetchList(func() (list []StreamGroupInfo) {
+		StreamGroups.Range(func(_ string, g *StreamGroup) {
+			list = append(list, g.Info())
+		})
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Master < list[j].Master
+		})
+		return
+	}, w, r)
+}
+
+// API_group 码率组的实时信息，master 可以是主路径或者其中一路流
+func (conf *GlobalConfig) API_group(w http.ResponseWriter, r *http.Request) {
+	group := FindStreamGroup(r.URL.Query().Get("master"))
+	if group == nil {
+		util.ReturnError(util.APIErrorNotFound, ErrGroupNotFound.Error(), w, r)
+		return
+	}
+	util.ReturnFetchValue(group.Info, w, r)
+}
+
+// API_group_add 以 JSON 提交码率组，主路径相同则替换
+func (conf *GlobalConfig) API_group_add(w http.ResponseWriter, r *http.Request) {
+	var group StreamGroup
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		util.ReturnError(util.APIErrorDecode, err.Error(), w, r)
+		return
+	}
+	if err := AddStreamGroup(&group); err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	util.ReturnOK(w, r)
+}
+
+func (conf *GlobalConfig) API_group_remove(w http.ResponseWriter, r *http.Request) {
+	master := r.URL.Query().Get("master")
+	if StreamGroups.Get(master) == nil {
+		util.ReturnError(util.APIErrorNotFound, ErrGroupNotFound.Error(), w, r)
+		return
+	}
+	StreamGroups.Delete(master)
+	util.ReturnOK(w, r)
+}
+
+// API_group_switch 将订阅者切换到同一码率组中的另一路流
+func (conf *GlobalConfig) API_group_switch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	s := Streams.Get(q.Get("streamPath"))
+	if s == nil {
+		util.ReturnError(util.APIErrorNoStream, NO_SUCH_STREAM, w, r)
+		return
+	}
+	suber := s.Subscribers.Find(q.Get("id"))
+	if suber == nil {
+		util.ReturnError(util.APIErrorNoSubscriber, "no such subscriber", w, r)
+		return
+	}
+	if err := suber.GetSubscriber().SwitchRendition(q.Get("rendition")); err != nil {
+		util.ReturnError(util.APIErrorQueryParse, err.Error(), w, r)
+		return
+	}
+	util.ReturnOK(w, r)
+}
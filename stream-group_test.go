@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyFrameDrift(t *testing.T) {
+	ms := time.Millisecond
+	for _, c := range []struct {
+		keyFrames  []time.Duration
+		gop, drift time.Duration
+	}{
+		{[]time.Duration{800 * ms, 800 * ms}, time.Second, 0},
+		{[]time.Duration{800 * ms, 1840 * ms}, time.Second, 40 * ms}, // 相差一个关键帧间隔多 40ms
+		{[]time.Duration{800 * ms, 1700 * ms}, time.Second, 100 * ms},
+		{[]time.Duration{800 * ms, 920 * ms, 700 * ms}, 0, 120 * ms}, // 帧率未知时不折算
+	} {
+		if drift := keyFrameDrift(c.keyFrames, c.gop); drift != c.drift {
+			t.Errorf("%v gop %v: drift %v, want %v", c.keyFrames, c.gop, drift, c.drift)
+		}
+	}
+}
+
+// TestStreamGroupInfo 各清晰度最近关键帧的时间戳相同时对齐，相差超过 GROUP_ALIGN_TOLERANCE 时不对齐
+func TestStreamGroupInfo(t *testing.T) {
+	pubs := map[string]*testVideoPublisher{
+		"info/test_1080":  publishTestVideo(t, "info/test_1080"),
+		"info/test_480":   publishTestVideo(t, "info/test_480"),
+		"info/test_drift": publishTestVideo(t, "info/test_drift"),
+	}
+	for path, pub := range pubs {
+		sps, offset := testSPS720, 0
+		if path == "info/test_480" {
+			sps = testSPS480
+		} else if path == "info/test_drift" {
+			offset = 3 // 关键帧晚 3 帧
+		}
+		pub.writeVideo("", 0, pub.sequenceHead(sps))
+		// 1 秒内写完，帧率为 0，关键帧偏差不按关键帧间隔折算
+		for i := 0; i < 25; i++ {
+			pub.writeVideo("", uint32(i*40), pub.frame(i%10 == offset))
+		}
+	}
+	aligned := &StreamGroup{Master: "info/test", Renditions: []Rendition{{StreamPath: "info/test_480", Bandwidth: 1000000}, {StreamPath: "info/test_1080", Bandwidth: 2000000}}}
+	drifted := &StreamGroup{Master: "info/drift", Renditions: []Rendition{{StreamPath: "info/test_1080"}, {StreamPath: "info/test_drift"}}}
+	for _, g := range []*StreamGroup{aligned, drifted} {
+		if err := AddStreamGroup(g); err != nil {
+			t.Fatal(err)
+		}
+		defer StreamGroups.Delete(g.Master)
+	}
+	// 轨道在流的协程中加入，等待各路流上线
+	var info, driftInfo StreamGroupInfo
+	for deadline := time.Now().Add(time.Second * 5); ; time.Sleep(time.Millisecond * 10) {
+		info, driftInfo = aligned.Info(), drifted.Info()
+		if info.Renditions[0].KeyFrameTs == 800 && info.Renditions[1].KeyFrameTs == 800 && driftInfo.Renditions[0].KeyFrameTs+driftInfo.Renditions[1].KeyFrameTs == 1720 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("renditions not online: %+v %+v", info, driftInfo)
+		}
+	}
+	if !info.Aligned || info.KeyFrameDrift != 0 {
+		t.Errorf("aligned group: %+v", info)
+	}
+	if r := info.Renditions[0]; r.Name != "1080" || r.Width != 1280 || r.Height != 720 || r.Codec != "h264" {
+		t.Errorf("renditions should be sorted by bandwidth: %+v", info.Renditions)
+	}
+	if driftInfo.Aligned || driftInfo.KeyFrameDrift != 120 {
+		t.Errorf("drifted group: %+v", driftInfo)
+	}
+}
+
+// testVideoWriter 交替向各路流写入 25fps、每 10 帧一个关键帧的视频，写完一帧后由测试等待订阅者读到再写下一帧
+func testVideoWriter(pubs ...*testVideoPublisher) (write func()) {
+	for _, pub := range pubs {
+		pub.writeVideo("", 0, pub.sequenceHead(testSPS720))
+	}
+	i := 0
+	return func() {
+		for _, pub := range pubs {
+			pub.writeVideo("", uint32(i*40), pub.frame(i%10 == 0))
+		}
+		i++
+	}
+}
+
+// TestSwitchRendition 切换后从目标流的关键帧开始读取，订阅者计入目标流的观看者，目标流不会因为自己的订阅者离开而等待关闭
+func TestSwitchRendition(t *testing.T) {
+	hi, lo := publishTestVideo(t, "switch/test_1080"), publishTestVideo(t, "switch/test_720")
+	write := testVideoWriter(lo, hi) // 先写目标流，切换时目标流已经写完
+	write()
+	group := &StreamGroup{Master: "switch/test", Renditions: []Rendition{{StreamPath: "switch/test_1080"}, {StreamPath: "switch/test_720"}}}
+	if err := AddStreamGroup(group); err != nil {
+		t.Fatal(err)
+	}
+	defer StreamGroups.Delete(group.Master)
+	viewer := subscribeTestVideo(t, "switch/test_720", write)
+	viewer.sync(t)
+	sub := subscribeTestVideo(t, "switch/test_1080", write)
+	target := lo.Stream
+	if f := sub.sync(t)[0]; f.stream != hi.Stream {
+		t.Fatalf("first frame from %v", f.stream)
+	}
+	if err := sub.SwitchRendition("other/test"); err != ErrNotInGroup {
+		t.Fatalf("switch to stream not in group: %v", err)
+	}
+	if err := sub.SwitchRendition("switch/test_720"); err != nil {
+		t.Fatal(err)
+	}
+	var after []testFrame
+	for switched := false; len(after) == 0; {
+		write()
+		viewer.sync(t)
+		for _, f := range sub.sync(t) {
+			switch {
+			case f.switched:
+				switched = true
+			case switched:
+				after = append(after, f)
+			case f.stream != hi.Stream:
+				t.Fatal("frame from target before switch event")
+			}
+		}
+	}
+	if f := after[0]; f.stream != target || !f.idr {
+		t.Fatalf("first frame after switch: %+v", f)
+	}
+	if !hasForeignReaders(target) {
+		t.Fatal("switched subscriber not counted by target stream")
+	}
+	viewer.stop()
+	time.Sleep(time.Millisecond * 200)
+	if state := target.snapshot().State; state != STATE_PUBLISHING {
+		t.Fatalf("target stream state %s after its own subscriber left", StateNames[state])
+	}
+	write()
+	if frames := sub.sync(t); frames[len(frames)-1].stream != target {
+		t.Fatalf("frame from %v after viewer left", frames[len(frames)-1].stream)
+	}
+	sub.stop()
+	for deadline := time.Now().Add(time.Second * 2); ; time.Sleep(time.Millisecond * 10) {
+		state := target.snapshot().State
+		if state == STATE_WAITCLOSE {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("target stream state %s after switched subscriber left", StateNames[state])
+		}
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"unsafe"
 
 	. "github.com/logrusorgru/aurora/v4"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"m7s.live/engine/v4/common"
 	"m7s.live/engine/v4/config"
@@ -120,6 +122,14 @@ type StreamTimeoutConfig struct {
 	PauseTimeout      time.Duration //暂停后超时
 	NeverTimeout      bool          // 永不超时
 }
+
+// 轨道在流中的角色
+const (
+	TRACK_ROLE_MAIN      = "main"      // 主轨道，订阅者未指定轨道时订阅主轨道
+	TRACK_ROLE_ALTERNATE = "alternate" // 同类的其他轨道，例如其他机位、其他语言
+	TRACK_ROLE_DATA      = "data"
+)
+
 type Tracks struct {
 	sync.Map
 	Video       []*track.Video
@@ -127,6 +137,7 @@ type Tracks struct {
 	Data        []common.Track
 	MainVideo   *track.Video
 	MainAudio   *track.Audio
+	Cue         *track.Cue // 广告标记轨道
 	marshalLock sync.Mutex
 }
 
@@ -151,6 +162,10 @@ func (tracks *Tracks) Add(name string, t common.Track) bool {
 		if tracks.MainVideo != nil {
 			v.Narrow()
 		}
+	case *track.Cue:
+		if tracks.Cue == nil {
+			tracks.Cue = v
+		}
 	}
 	_, loaded := tracks.LoadOrStore(name, t)
 	if !loaded {
@@ -166,6 +181,84 @@ func (tracks *Tracks) Add(name string, t common.Track) bool {
 	return !loaded
 }
 
+// Remove 移除轨道，移除的是主轨道时由同类的第一个轨道接替
+func (tracks *Tracks) Remove(name string) (t common.Track, ok bool) {
+	var v any
+	if v, ok = tracks.LoadAndDelete(name); !ok {
+		return
+	}
+	t = v.(common.Track)
+	switch v := t.(type) {
+	case *track.Video:
+		tracks.Video = removeTrack(tracks.Video, v)
+		if tracks.MainVideo == v {
+			tracks.MainVideo = nil
+			if len(tracks.Video) > 0 {
+				tracks.MainVideo = tracks.Video[0]
+				tracks.SetIDR(tracks.MainVideo)
+			}
+		}
+	case *track.Audio:
+		tracks.Audio = removeTrack(tracks.Audio, v)
+		if tracks.MainAudio == v {
+			tracks.MainAudio = nil
+			if len(tracks.Audio) > 0 {
+				tracks.MainAudio = tracks.Audio[0]
+			}
+		}
+	default:
+		tracks.Data = removeTrack(tracks.Data, t)
+		if t == tracks.Cue {
+			tracks.Cue = nil
+		}
+	}
+	return
+}
+
+func removeTrack[T comparable](list []T, t T) []T {
+	for i, v := range list {
+		if v == t {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+// SetMain 将指定名称的音视频轨道设为同类轨道中的主轨道
+func (tracks *Tracks) SetMain(name string) error {
+	t, ok := tracks.Load(name)
+	if !ok {
+		return ErrTrackNotFound
+	}
+	switch v := t.(type) {
+	case *track.Video:
+		tracks.MainVideo = v
+		tracks.SetIDR(v)
+	case *track.Audio:
+		tracks.MainAudio = v
+	default:
+		return ErrTrackNotMedia
+	}
+	return nil
+}
+
+// Role 轨道在流中的角色
+func (tracks *Tracks) Role(t common.Track) string {
+	switch v := t.(type) {
+	case *track.Video:
+		if v == tracks.MainVideo {
+			return TRACK_ROLE_MAIN
+		}
+		return TRACK_ROLE_ALTERNATE
+	case *track.Audio:
+		if v == tracks.MainAudio {
+			return TRACK_ROLE_MAIN
+		}
+		return TRACK_ROLE_ALTERNATE
+	}
+	return TRACK_ROLE_DATA
+}
+
 func (tracks *Tracks) SetIDR(video common.Track) {
 	if video == tracks.MainVideo {
 		tracks.Range(func(_ string, t common.Track) {
@@ -182,6 +275,9 @@ func (tracks *Tracks) MarshalJSON() ([]byte, error) {
 	defer tracks.marshalLock.Unlock()
 	tracks.Range(func(_ string, t common.Track) {
 		t.SnapForJson()
+		if r, ok := t.(interface{ SetRole(string) }); ok {
+			r.SetRole(tracks.Role(t))
+		}
 		trackList = append(trackList, t)
 	})
 	return json.Marshal(trackList)
@@ -201,6 +297,7 @@ type Stream struct {
 	Publisher   IPublisher
 	publisher   *Publisher
 	State       StreamState
+	closed      atomic.Bool  // 是否已关闭，State 只在流的协程中读写，其他协程通过 IsClosed 判断
 	SEHistory   []StateEvent // 事件历史
 	Subscribers Subscribers  // 订阅者
 	Tracks      Tracks
@@ -208,12 +305,15 @@ type Stream struct {
 	StreamName  string
 	IsPause     bool // 是否处于暂停状态
 	pubLocker   sync.Mutex
+	backups     []IPublisher // 备用发布者，按注册顺序接替超时的发布者
+	stateSpan   trace.Span   // 当前状态的追踪，迁移到下一个状态时结束
 }
 type StreamSummay struct {
 	Path        string
 	State       StreamState
 	Subscribers int
 	Tracks      []string
+	Aliases     []string `json:",omitempty" yaml:",omitempty"`
 	StartTime   time.Time
 	Type        string
 	BPS         int
@@ -252,6 +352,7 @@ func (s *Stream) Summary() (r StreamSummay) {
 		r.Tracks = append(r.Tracks, name)
 	})
 	r.Path = s.Path
+	r.Aliases = AliasesOf(s.Path)
 	r.State = s.State
 	r.Subscribers = s.Subscribers.Len()
 	r.StartTime = s.StartTime
@@ -303,7 +404,25 @@ func (r *Stream) action(action StreamAction) (ok bool) {
 	event.Time = time.Now()
 	var next StreamState
 	if next, ok = event.Next(); ok {
+		var plugin string
+		var cause error
+		var parent context.Context
+		if r.publisher != nil {
+			plugin, parent = r.publisher.plugin, r.publisher.spanCtx
+			if action == ACTION_PUBLISHCLOSE && r.publisher.Context != nil {
+				cause = context.Cause(r.publisher.Context)
+			}
+		}
+		// 每个状态一个追踪，从进入该状态的迁移开始，到离开该状态的迁移结束
+		if r.stateSpan != nil {
+			endSpan(r.stateSpan, cause)
+			r.stateSpan = nil
+		}
+		if next != STATE_CLOSED {
+			_, r.stateSpan = startSpan(parent, "Stream.action", r.Path, plugin, attribute.String("action", action.String()), attribute.String("from", event.From.String()), attribute.String("to", next.String()))
+		}
 		r.State = next
+		r.closed.Store(next == STATE_CLOSED)
 		r.SEHistory = append(r.SEHistory, event)
 		// 给Publisher状态变更的回调，方便进行远程拉流等操作
 		var stateEvent any
@@ -334,6 +453,10 @@ func (r *Stream) action(action StreamAction) (ok bool) {
 				stateEvent = SErepublish{event}
 			} else {
 				stateEvent = SEpublish{event}
+				// 发布者只能在流的协程中读取，接替后会改变
+				if conf := r.GetPublisherConfig(); conf != nil && conf.TimeShift > 0 {
+					go StartTimeShift(r.Path, conf)
+				}
 			}
 			r.timeout.Reset(time.Second * 5) // 5秒心跳，检测track的存活度
 		case STATE_PUBLISHING:
@@ -356,6 +479,11 @@ func (r *Stream) action(action StreamAction) (ok bool) {
 			r.timeout.Stop()
 			stateEvent = SEclose{event}
 			r.Subscribers.Broadcast(stateEvent)
+			stopForeignReaders(r)
+			for _, backup := range r.backups {
+				backup.OnEvent(stateEvent)
+			}
+			r.backups = nil
 			r.Tracks.Range(func(_ string, t common.Track) {
 				if t.GetPublisher().GetStream() == r {
 					t.Dispose()
@@ -404,7 +532,7 @@ func (r *Stream) IsClosed() bool {
 	if r == nil {
 		return true
 	}
-	return r.State == STATE_CLOSED
+	return r.closed.Load()
 }
 
 func (r *Stream) Close() {
@@ -423,11 +551,16 @@ func (s *Stream) onSuberClose(sub ISubscriber) {
 	if s.Publisher != nil {
 		s.Publisher.OnEvent(sub) // 通知Publisher有订阅者离开，在回调中可以去获取订阅者数量
 	}
-	if (s.DelayCloseTimeout > 0 || s.IdleTimeout > 0) && s.Subscribers.Len() == 0 {
+	if (s.DelayCloseTimeout > 0 || s.IdleTimeout > 0) && s.noViewers() {
 		s.action(ACTION_LASTLEAVE)
 	}
 }
 
+// noViewers 没有订阅者，也没有从其他流切换过来读取的订阅者
+func (s *Stream) noViewers() bool {
+	return s.Subscribers.Len() == 0 && !hasForeignReaders(s)
+}
+
 func (s *Stream) checkRunCost(timeStart time.Time, timeOutInfo zap.Field) {
 	if cost := time.Since(timeStart); cost > 100*time.Millisecond {
 		s.Warn("run timeout", timeOutInfo, zap.Duration("cost", cost))
@@ -488,22 +621,24 @@ func (s *Stream) run() {
 							if time.Since(s.StartTime) > timeout {
 								lost = true
 								s.action(ACTION_CLOSE)
+							} else {
+								s.timeout.Reset(time.Second * 5) // 继续等待轨道，否则超时前的检查之后不会再检查
 							}
 							continue
 						} else if s.Publisher != nil && s.Publisher.IsClosed() {
 							s.Warn("publish is closed", zap.Error(context.Cause(s.publisher)), zap.String("ptr", fmt.Sprintf("%p", s.publisher.Context)))
 							lost = true
-							if len(s.Tracks.Audio)+len(s.Tracks.Video) == 0 {
+							if len(s.Tracks.Audio)+len(s.Tracks.Video) == 0 && len(s.backups) == 0 {
 								s.action(ACTION_CLOSE)
 								continue
 							}
 						}
 					}
-					if lost {
+					if lost && !s.failover() {
 						s.action(ACTION_TIMEOUT)
 						continue
 					}
-					if s.IdleTimeout > 0 && s.Subscribers.Len() == 0 && time.Since(s.StartTime) > s.IdleTimeout {
+					if s.IdleTimeout > 0 && s.noViewers() && time.Since(s.StartTime) > s.IdleTimeout {
 						s.action(ACTION_LASTLEAVE)
 						continue
 					}
@@ -533,6 +668,11 @@ func (s *Stream) run() {
 					break
 				}
 				puber := v.Value.GetPublisher()
+				if puber.isBackup() && s.Publisher != nil && s.Publisher != v.Value && !s.Publisher.IsClosed() {
+					s.addBackup(v.Value)
+					v.Resolve()
+					break
+				}
 				oldPuber := s.publisher
 				s.publisher = puber
 				conf := puber.Config
@@ -598,6 +738,13 @@ func (s *Stream) run() {
 				if s.Publisher != nil {
 					s.Publisher.OnEvent(v) // 通知Publisher有新的订阅者加入，在回调中可以去获取订阅者数量
 					pubConfig := s.Publisher.GetConfig()
+					// 未指定轨道名称时优先订阅主轨道
+					if s.Tracks.MainVideo != nil {
+						waits.Accept(s.Tracks.MainVideo)
+					}
+					if s.Tracks.MainAudio != nil {
+						waits.Accept(s.Tracks.MainAudio)
+					}
 					s.Tracks.Range(func(name string, t common.Track) {
 						waits.Accept(t)
 					})
@@ -630,10 +777,10 @@ func (s *Stream) run() {
 					break
 				}
 				name := v.GetName()
-				if t, ok := s.Tracks.LoadAndDelete(name); ok {
+				if t, ok := s.Tracks.Remove(name); ok {
 					s.Info("track -1", zap.String("name", name))
 					s.Subscribers.Broadcast(t)
-					t.(common.Track).Dispose()
+					t.Dispose()
 				}
 			case *util.Promise[common.Track]:
 				timeOutInfo = zap.String("action", "Track")
@@ -641,6 +788,10 @@ func (s *Stream) run() {
 					v.Reject(ErrStreamIsClosed)
 					break
 				}
+				if puber, ok := v.Value.GetPublisher().(IPublisher); ok && puber.GetPublisher().holdTrack(v.Value) {
+					v.Reject(ErrPublisherStandby)
+					continue
+				}
 				if s.State == STATE_WAITPUBLISH {
 					s.action(ACTION_PUBLISH)
 				}
@@ -669,8 +820,28 @@ func (s *Stream) run() {
 				} else {
 					v.Reject(ErrBadTrackName)
 				}
+			case *util.Promise[*streamSnapshot]:
+				v.Value.State, v.Value.Publisher = s.State, s.Publisher
+				v.Resolve()
+			case *util.Promise[mainTrackChange]:
+				timeOutInfo = zap.String("action", "MainTrack")
+				if err := s.Tracks.SetMain(string(v.Value)); err != nil {
+					v.Reject(err)
+				} else {
+					s.Info("main track", zap.String("name", string(v.Value)))
+					v.Resolve()
+				}
 			case NoMoreTrack:
 				s.Subscribers.AbortWait()
+			case foreignReaderChange:
+				timeOutInfo = zap.String("action", "ForeignReader")
+				if v.enter {
+					if s.State == STATE_WAITCLOSE {
+						s.action(ACTION_FIRSTENTER)
+					}
+				} else if (s.DelayCloseTimeout > 0 || s.IdleTimeout > 0) && s.noViewers() {
+					s.action(ACTION_LASTLEAVE)
+				}
 			case StreamAction:
 				timeOutInfo = zap.String("action", "StreamAction"+v.String())
 				s.action(v)
@@ -697,6 +868,33 @@ func (s *Stream) RemoveTrack(t common.Track) {
 	s.Receive(TrackRemoved{t})
 }
 
+// mainTrackChange 设置主轨道的请求，在流的协程中执行
+type mainTrackChange string
+
+// SetMainTrack 运行时将指定名称的音视频轨道设为主轨道，已经在播放的订阅者不受影响
+func (s *Stream) SetMainTrack(name string) error {
+	promise := util.NewPromise(mainTrackChange(name))
+	if !s.Receive(promise) {
+		return ErrStreamIsClosed
+	}
+	return promise.Await()
+}
+
+// streamSnapshot 在流的协程中读取的状态，State 和 Publisher 只能在流的协程中访问
+type streamSnapshot struct {
+	State     StreamState
+	Publisher IPublisher
+}
+
+// snapshot 其他协程通过流的协程读取当前状态和发布者，流已关闭时返回 STATE_CLOSED
+func (s *Stream) snapshot() (snap streamSnapshot) {
+	promise := util.NewPromise(&snap)
+	if !s.Receive(promise) || promise.Await() != nil {
+		return streamSnapshot{State: STATE_CLOSED}
+	}
+	return
+}
+
 func (s *Stream) Pause() {
 	s.IsPause = true
 }
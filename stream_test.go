@@ -0,0 +1,21 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+// TestNoTrackTimeout 发布者一直没有添加轨道时，超过发布超时流会关闭，超时前的检查要继续等待
+func TestNoTrackTimeout(t *testing.T) {
+	t.Parallel()
+	pub := publishTestVideo(t, "timeout/notrack", func(p *Publisher) {
+		conf := EngineConfig.GetPublishConfig()
+		conf.PublishTimeout = time.Second * 6 // 第一次检查（5 秒）时还未超时
+		p.Config = &conf
+	})
+	for deadline := time.Now().Add(time.Second * 15); Streams.Get("timeout/notrack") != nil; time.Sleep(time.Millisecond * 100) {
+		if time.Now().After(deadline) {
+			t.Fatalf("stream without tracks still %s", StateNames[pub.Stream.snapshot().State])
+		}
+	}
+}
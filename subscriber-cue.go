@@ -0,0 +1,84 @@
+package engine
+
+import (
+	"sort"
+	"time"
+
+	. "m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/track"
+)
+
+type pendingCue struct {
+	*track.CueMarker
+	writeTime time.Time
+}
+
+// cueQueue 缓存读取到的广告标记，在音视频帧到达标记的时间点时按顺序送出
+type cueQueue struct {
+	*Subscriber
+	syncMode int
+	send     func(CueFrame)
+	reader   track.DataReader[*track.CueMarker]
+	pending  []pendingCue
+}
+
+func (q *cueQueue) read() {
+	cue := q.cue.Load()
+	if cue == nil {
+		return
+	}
+	if q.reader.Ring == nil {
+		// 只接收订阅之后写入的标记
+		q.reader.Ring = cue.Ring
+	}
+	for {
+		frame, err := q.reader.TryRead()
+		if err != nil {
+			q.reader = track.DataReader[*track.CueMarker]{}
+			q.reader.Ring = cue.Ring
+			return
+		}
+		if frame == nil {
+			return
+		}
+		q.pending = append(q.pending, pendingCue{frame.Data, frame.WriteTime})
+	}
+}
+
+// flush 送出在 frame 之前（含）的标记，reader 为 frame 所在轨道的读取器
+func (q *cueQueue) flush(frame *AVFrame, reader *track.AVRingReader) {
+	q.read()
+	if len(q.pending) == 0 {
+		return
+	}
+	framePTS := uint32(frame.PTS)
+	sort.SliceStable(q.pending, func(i, j int) bool {
+		return int32(q.pending[i].PTS-q.pending[j].PTS) < 0
+	})
+	skip := uint32(reader.SkipTs * 90 / time.Millisecond)
+	n := 0
+	for _, cue := range q.pending {
+		var due bool
+		if cue.PTS == 0 || q.syncMode == 1 {
+			// 立即生效的标记以及按写入时间同步时，以写入时间作为顺序
+			due = !cue.writeTime.After(frame.WriteTime)
+		} else {
+			due = int32(cue.PTS-framePTS) <= 0
+		}
+		if !due {
+			q.pending[n] = cue
+			n++
+			continue
+		}
+		pts := cue.PTS
+		if pts == 0 {
+			pts = framePTS
+		}
+		absTime := int64(reader.AbsTime) + int64(int32(pts-framePTS))/90
+		if absTime < 0 {
+			absTime = 0
+		}
+		q.send(CueFrame{cue.CueMarker, pts - skip, uint32(absTime)})
+	}
+	q.pending = q.pending[:n]
+}
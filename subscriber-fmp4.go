@@ -0,0 +1,250 @@
+package engine
+
+import (
+	"io"
+	"net"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+	. "m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/util"
+)
+
+// FMP4Init fMP4 的初始化分片（ftyp+moov），解码配置变化时会重新发送
+type FMP4Init []byte
+
+// FMP4Fragment fMP4 的媒体分片（moof+mdat）
+type FMP4Fragment net.Buffers
+
+func (f FMP4Init) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(f)
+	return int64(n), err
+}
+
+func (f FMP4Fragment) WriteTo(w io.Writer) (int64, error) {
+	t := (net.Buffers)(f)
+	return t.WriteTo(w)
+}
+
+type fmp4Track struct {
+	codec.FMP4Track
+	ready   bool
+	lastDTS uint32 // 上一帧的 DTS（90kHz）
+	dts90k  uint64 // 累加后的 DTS（90kHz），避免 32 位时间戳回绕
+	pending *codec.FMP4Sample
+	samples []codec.FMP4Sample
+	lastDur uint32 // 上一帧的时长，最后一帧沿用
+}
+
+// push 缓存一帧，上一帧的时长在收到本帧时才能确定
+func (t *fmp4Track) push(dts, pts uint32, keyFrame bool, data []byte) {
+	if t.pending == nil && len(t.samples) == 0 && t.dts90k == 0 {
+		t.lastDTS = dts
+	}
+	if delta := int32(dts - t.lastDTS); delta > 0 {
+		t.dts90k += uint64(delta)
+	}
+	t.lastDTS = dts
+	sample := &codec.FMP4Sample{
+		DTS:      t.dts90k * uint64(t.TimeScale) / 90000,
+		CTS:      int32(int64(int32(pts-dts)) * int64(t.TimeScale) / 90000),
+		KeyFrame: keyFrame,
+		Data:     data,
+	}
+	if t.pending != nil {
+		if sample.DTS > t.pending.DTS {
+			t.pending.Duration = uint32(sample.DTS - t.pending.DTS)
+			t.lastDur = t.pending.Duration
+		}
+		t.samples = append(t.samples, *t.pending)
+	}
+	t.pending = sample
+}
+
+// finish 没有下一帧时，最后一帧的时长沿用上一帧的时长
+func (t *fmp4Track) finish() {
+	if t.pending == nil {
+		return
+	}
+	t.pending.Duration = t.lastDur
+	t.samples = append(t.samples, *t.pending)
+	t.pending = nil
+}
+
+func (t *fmp4Track) fragment() (traf codec.FMP4TrackFragment) {
+	traf.TrackID = t.TrackID
+	traf.Samples = t.samples
+	t.samples = nil
+	return
+}
+
+// fmp4Muxer 将订阅到的音视频帧封装为 fMP4
+type fmp4Muxer struct {
+	*Subscriber
+	video, audio *fmp4Track
+	sequence     uint32
+	gopMode      bool
+	initSent     bool
+	confSeq      [2]int
+}
+
+func (m *fmp4Muxer) init(hasVideo, hasAudio bool) {
+	m.gopMode = m.Config.FMP4Mode == 1
+	var trackID uint32
+	if hasVideo {
+		switch m.Video.CodecID {
+		case codec.CodecID_H264, codec.CodecID_H265, codec.CodecID_AV1:
+			trackID++
+			m.video = &fmp4Track{FMP4Track: codec.FMP4Track{TrackID: trackID, TimeScale: 90000, IsVideo: true}}
+		default:
+			m.Warn("fmp4 unsupported video codec", zap.String("codec", m.Video.CodecID.String()))
+		}
+	}
+	if hasAudio {
+		switch m.Audio.CodecID {
+		case codec.CodecID_AAC, codec.CodecID_OPUS:
+			trackID++
+			m.audio = &fmp4Track{FMP4Track: codec.FMP4Track{TrackID: trackID, TimeScale: m.Audio.SampleRate}}
+		default:
+			m.Warn("fmp4 unsupported audio codec", zap.String("codec", m.Audio.CodecID.String()))
+		}
+	}
+}
+
+func (m *fmp4Muxer) onVideoDecConf() {
+	if m.video == nil {
+		return
+	}
+	v := m.Video
+	head := v.SequenceHead
+	if len(head) < 5 {
+		return
+	}
+	width, height := uint16(v.Width), uint16(v.Height)
+	switch v.CodecID {
+	case codec.CodecID_H264:
+		m.video.SampleEntry = codec.AVCSampleEntry(width, height, head[5:])
+	case codec.CodecID_H265:
+		m.video.SampleEntry = codec.HEVCSampleEntry(width, height, head[5:])
+	case codec.CodecID_AV1:
+		av1C := head[5:]
+		// 从 RTP 来的 AV1 序列头只有 sequence header OBU，需要补上 av1C 的头部
+		if len(av1C) == 0 || av1C[0] != 0x81 {
+			info := v.ParamaterSets[1]
+			av1C = codec.BuildAV1CodecConfigurationRecord(info[1], info[0], info[2], av1C)
+		}
+		m.video.SampleEntry = codec.AV1SampleEntry(width, height, av1C)
+	}
+	m.video.Width, m.video.Height = uint32(width), uint32(height)
+	m.video.ready = true
+	m.sendInit()
+}
+
+func (m *fmp4Muxer) onAudioDecConf() {
+	if m.audio == nil {
+		return
+	}
+	a := m.Audio
+	switch a.CodecID {
+	case codec.CodecID_AAC:
+		if len(a.SequenceHead) < 2 {
+			return
+		}
+		m.audio.SampleEntry = codec.AACSampleEntry(uint16(a.Channels), a.SampleRate, a.SequenceHead[2:])
+	case codec.CodecID_OPUS:
+		m.audio.SampleEntry = codec.OpusSampleEntry(uint16(a.Channels), 0, a.SampleRate)
+	}
+	m.audio.ready = true
+	m.sendInit()
+}
+
+// sendInit 所有轨道的解码配置都就绪后发送初始化分片
+func (m *fmp4Muxer) sendInit() {
+	var tracks []*codec.FMP4Track
+	var confSeq [2]int
+	if m.video != nil {
+		if !m.video.ready {
+			return
+		}
+		tracks = append(tracks, &m.video.FMP4Track)
+		confSeq[0] = m.Video.SequenceHeadSeq
+	}
+	if m.audio != nil {
+		if !m.audio.ready {
+			return
+		}
+		tracks = append(tracks, &m.audio.FMP4Track)
+		confSeq[1] = m.Audio.SequenceHeadSeq
+	}
+	if len(tracks) == 0 || (m.initSent && confSeq == m.confSeq) {
+		return
+	}
+	// 旧配置下缓存的帧需要在新的初始化分片之前发出
+	m.flush()
+	m.confSeq = confSeq
+	m.initSent = true
+	m.Spesific.OnEvent(FMP4Init(codec.MarshalFMP4Init(tracks...)))
+}
+
+func (m *fmp4Muxer) flush() {
+	if !m.initSent {
+		return
+	}
+	var trafs []codec.FMP4TrackFragment
+	for _, t := range []*fmp4Track{m.video, m.audio} {
+		if t != nil && len(t.samples) > 0 {
+			trafs = append(trafs, t.fragment())
+		}
+	}
+	if len(trafs) > 0 {
+		m.sequence++
+		m.Spesific.OnEvent(FMP4Fragment(codec.MarshalFMP4Fragment(m.sequence, trafs...)))
+	}
+}
+
+// close 停止读取时发出缓存的最后一帧
+func (m *fmp4Muxer) close() {
+	for _, t := range []*fmp4Track{m.video, m.audio} {
+		if t != nil {
+			t.finish()
+		}
+	}
+	m.flush()
+}
+
+func (m *fmp4Muxer) sendVideoFrame(frame *AVFrame) {
+	if m.video == nil || frame.AUList.ByteLength == 0 {
+		return
+	}
+	var data []byte
+	if m.Video.CodecID == codec.CodecID_AV1 {
+		data = frame.AUList.ToBytes()
+	} else {
+		// 帧会被环形缓冲复用，这里需要复制
+		buf := make(util.Buffer, 0, frame.AUList.ByteLength+frame.AUList.Length*4)
+		frame.AUList.Range(func(au *util.BLL) bool {
+			buf.WriteUint32(uint32(au.ByteLength))
+			au.Range(func(slice util.Buffer) bool {
+				buf.Write(slice)
+				return true
+			})
+			return true
+		})
+		data = buf
+	}
+	// 先 push，使上一个 GOP 的最后一帧完成后再按关键帧切分
+	m.video.push(m.VideoReader.GetDTS32(), m.VideoReader.GetPTS32(), frame.IFrame, data)
+	if !m.gopMode || frame.IFrame {
+		m.flush()
+	}
+}
+
+func (m *fmp4Muxer) sendAudioFrame(frame *AVFrame) {
+	if m.audio == nil || frame.AUList.ByteLength == 0 {
+		return
+	}
+	m.audio.push(m.AudioReader.GetDTS32(), m.AudioReader.GetDTS32(), true, frame.AUList.ToBytes())
+	if !m.gopMode || m.video == nil {
+		m.flush()
+	}
+}
@@ -0,0 +1,32 @@
+package engine
+
+import (
+	"testing"
+
+	"m7s.live/engine/v4/codec"
+)
+
+// TestFMP4TrackFinish 停止时缓存的最后一帧也要写出，时长沿用上一帧
+func TestFMP4TrackFinish(t *testing.T) {
+	track := &fmp4Track{FMP4Track: codec.FMP4Track{TimeScale: 90000}}
+	for i, dts := range []uint32{1000, 4000, 7600} {
+		track.push(dts, dts, i == 0, []byte{byte(i)})
+	}
+	if len(track.samples) != 2 {
+		t.Fatalf("%d samples before finish", len(track.samples))
+	}
+	track.finish()
+	samples := track.fragment().Samples
+	if len(samples) != 3 {
+		t.Fatalf("%d samples after finish", len(samples))
+	}
+	for i, duration := range []uint32{3000, 3600, 3600} {
+		if samples[i].Duration != duration || samples[i].Data[0] != byte(i) {
+			t.Errorf("sample %d: duration %d data %v", i, samples[i].Duration, samples[i].Data)
+		}
+	}
+	track.finish()
+	if len(track.samples) != 0 {
+		t.Error("finish without pending sample added samples")
+	}
+}
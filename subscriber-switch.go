@@ -0,0 +1,253 @@
+package engine
+
+import (
+	"errors"
+	"sync"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+)
+
+var (
+	ErrSwitchNotPlaying = errors.New("subscriber not playing")
+	ErrSwitchTimeShift  = errors.New("switch during time shift")
+	// 订阅者的输出（FLV、TS、fMP4 等）按开始播放时的编码初始化，中途不能更换编码，只能切换到相同编码的轨道
+	ErrSwitchCodec   = errors.New("switch to track with different codec")
+	ErrSwitchNoTrack = errors.New("no such track")
+)
+
+// trackSwitch 等待切换的轨道，视频在新轨道的下一个关键帧处切换，同时请求的音频随视频一起切换。
+// 请求来自其他协程，PlayBlock 中正在读取的轨道和时移状态也记录在这里，都由锁保护
+type trackSwitch struct {
+	sync.Mutex
+	video  *track.Video
+	audio  *track.Audio
+	idrSeq uint32 // 请求切换时新视频轨道最近关键帧的序号
+
+	playingVideo                   *track.Video // 为空表示没有在播放视频
+	playingAudio                   *track.Audio
+	videoTimeShift, audioTimeShift bool
+}
+
+// startSwitching PlayBlock 开始读取时记录正在读取的轨道，之后才接受切换请求
+func (s *Subscriber) startSwitching(hasVideo, hasAudio bool) {
+	sw := &s.switching
+	sw.Lock()
+	defer sw.Unlock()
+	if hasVideo {
+		sw.playingVideo, sw.videoTimeShift = s.Video, s.VideoReader.TimeShift != nil
+	}
+	if hasAudio {
+		sw.playingAudio, sw.audioTimeShift = s.Audio, s.AudioReader.TimeShift != nil
+	}
+}
+
+// stopSwitching 停止读取后不再接受切换请求，丢弃未完成的切换
+func (s *Subscriber) stopSwitching() {
+	sw := &s.switching
+	sw.Lock()
+	defer sw.Unlock()
+	sw.playingVideo, sw.playingAudio, sw.video, sw.audio = nil, nil, nil, nil
+}
+
+// foreignReaders 切换到其他流的轨道上读取的订阅者，该流关闭时需要停止这些订阅者，否则会一直等待不再写入的轨道
+var foreignReaders util.Map[*Subscriber, *Stream]
+
+// foreignReaderChange 订阅者开始或者停止在该流的轨道上读取，由流的协程判断是否还有人观看
+type foreignReaderChange struct {
+	enter bool
+}
+
+// hasForeignReaders 是否有其他流的订阅者在该流的轨道上读取，这些订阅者和本流的订阅者一样使流保持打开
+func hasForeignReaders(target *Stream) (has bool) {
+	foreignReaders.Range(func(_ *Subscriber, s *Stream) {
+		has = has || s == target
+	})
+	return
+}
+
+// updateForeignReader 视频切换后记录订阅者正在读取的其他流
+func (s *Subscriber) updateForeignReader() {
+	target, _ := s.Video.Publisher.GetStream().(*Stream)
+	if target == s.Stream {
+		target = nil
+	}
+	s.setForeignReader(target)
+}
+
+// setForeignReader 记录订阅者正在读取的其他流，为空表示回到本流，并通知进入和离开的流
+func (s *Subscriber) setForeignReader(target *Stream) {
+	old := foreignReaders.Get(s)
+	if old == target {
+		return
+	}
+	if target == nil {
+		foreignReaders.Delete(s)
+	} else {
+		foreignReaders.Set(s, target)
+		target.Receive(foreignReaderChange{enter: true})
+	}
+	if old != nil {
+		old.Receive(foreignReaderChange{})
+	}
+}
+
+// stopForeignReaders 流关闭时停止在该流的轨道上读取的其他流的订阅者
+func stopForeignReaders(closed *Stream) {
+	foreignReaders.Range(func(s *Subscriber, target *Stream) {
+		if target == closed {
+			foreignReaders.Delete(s)
+			s.Stop(zap.String("reason", "switched stream closed"))
+		}
+	})
+}
+
+// switchTo 请求切换轨道，为空或者正在读取的不切换，由 PlayBlock 在读取时完成切换。
+// 只能切换到与正在读取的轨道编码相同的轨道，否则返回 ErrSwitchCodec
+func (s *Subscriber) switchTo(video *track.Video, audio *track.Audio) error {
+	sw := &s.switching
+	sw.Lock()
+	defer sw.Unlock()
+	if sw.playingVideo == nil && sw.playingAudio == nil {
+		return ErrSwitchNotPlaying
+	}
+	if video == sw.playingVideo {
+		video = nil
+	}
+	if video != nil {
+		if sw.playingVideo == nil {
+			return ErrSwitchNotPlaying
+		}
+		if sw.videoTimeShift {
+			return ErrSwitchTimeShift
+		}
+		if video.CodecID != sw.playingVideo.CodecID {
+			return ErrSwitchCodec
+		}
+	}
+	if audio != nil && sw.playingAudio == nil {
+		if video == nil {
+			return ErrSwitchNotPlaying
+		}
+		audio = nil // 没有播放音频，只切换视频
+	}
+	if audio == sw.playingAudio {
+		audio = nil
+	}
+	if audio != nil {
+		if sw.audioTimeShift {
+			return ErrSwitchTimeShift
+		}
+		if audio.CodecID != sw.playingAudio.CodecID {
+			return ErrSwitchCodec
+		}
+	}
+	if video != nil {
+		sw.video = video
+		if video.IDRing != nil {
+			sw.idrSeq = video.IDRing.Value.Sequence
+		}
+	}
+	if audio != nil {
+		sw.audio = audio
+	}
+	return nil
+}
+
+// SwitchVideoTrack 切换到本流中的另一个视频轨道（例如另一个机位），在其下一个关键帧处切换，AbsTime 保持连续
+func (s *Subscriber) SwitchVideoTrack(name string) error {
+	v, ok := s.Stream.Tracks.Load(name)
+	if !ok {
+		return ErrSwitchNoTrack
+	}
+	video, ok := v.(*track.Video)
+	if !ok {
+		return ErrSwitchNoTrack
+	}
+	return s.switchTo(video, nil)
+}
+
+// SwitchAudioTrack 切换到本流中的另一个音频轨道（例如另一种语言），从新轨道的下一帧开始
+func (s *Subscriber) SwitchAudioTrack(name string) error {
+	v, ok := s.Stream.Tracks.Load(name)
+	if !ok {
+		return ErrSwitchNoTrack
+	}
+	audio, ok := v.(*track.Audio)
+	if !ok {
+		return ErrSwitchNoTrack
+	}
+	return s.switchTo(nil, audio)
+}
+
+// switchVideo 新视频轨道出现请求之后的关键帧时切换，返回视频、音频是否切换
+func (s *Subscriber) switchVideo() (video bool, audio bool) {
+	sw := &s.switching
+	sw.Lock()
+	defer sw.Unlock()
+	sw.videoTimeShift = s.VideoReader.TimeShift != nil
+	if sw.video == nil {
+		return
+	}
+	idr := sw.video.IDRing
+	if idr == nil || idr.Value.Sequence == sw.idrSeq {
+		return
+	}
+	if s.replaceReader(&s.VideoReader, &sw.video.Media, idr) {
+		s.Video, video = sw.video, true
+		sw.playingVideo = sw.video
+		s.updateForeignReader()
+	}
+	sw.video = nil
+	if sw.audio != nil {
+		audio = s.switchAudioLocked()
+	}
+	return
+}
+
+// switchAudio 只切换音频时立即切换，随视频切换的音频等待视频
+func (s *Subscriber) switchAudio() bool {
+	sw := &s.switching
+	sw.Lock()
+	defer sw.Unlock()
+	sw.audioTimeShift = s.AudioReader.TimeShift != nil
+	if sw.audio == nil || sw.video != nil {
+		return false
+	}
+	return s.switchAudioLocked()
+}
+
+func (s *Subscriber) switchAudioLocked() (ok bool) {
+	sw := &s.switching
+	if ok = s.replaceReader(&s.AudioReader, &sw.audio.Media, sw.audio.Ring); ok {
+		s.Audio, sw.playingAudio = sw.audio, sw.audio
+	}
+	sw.audio = nil
+	return
+}
+
+// replaceReader 在新轨道上创建读取者替换原来的读取者，原读取者当前的帧不再发送
+func (s *Subscriber) replaceReader(old **track.AVRingReader, media *track.Media, start *util.Ring[*AVFrame]) bool {
+	reader := s.CreateTrackReader(media)
+	if err := reader.SwitchFrom(*old, start); err != nil {
+		s.Warn("switch track failed", zap.String("track", media.Name), zap.Error(err))
+		s.removeReader(reader)
+		return false
+	}
+	(*old).Value.ReaderLeave()
+	s.removeReader(*old)
+	*old = reader
+	return true
+}
+
+func (s *Subscriber) removeReader(reader *track.AVRingReader) {
+	for i, r := range s.readers {
+		if r == reader {
+			s.readers = append(s.readers[:i], s.readers[i+1:]...)
+			break
+		}
+	}
+	reader.Track.Debug("reader -1", zap.Int32("count", reader.Track.ReaderCount.Add(-1)))
+}
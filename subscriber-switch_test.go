@@ -0,0 +1,65 @@
+package engine
+
+import (
+	"testing"
+)
+
+// TestSwitchVideoTrack 切换到时间戳相差很大的另一个机位，AbsTime 保持连续递增
+func TestSwitchVideoTrack(t *testing.T) {
+	pub := publishTestVideo(t, "switch/cameras")
+	pub.writeVideo("", 0, pub.sequenceHead(testSPS720))
+	pub.writeVideo("cam2", 0, pub.sequenceHead(testSPS720))
+	i := 0
+	write := func() {
+		// 先写 cam2，订阅者读到主轨道的帧时 cam2 已经写完
+		pub.writeVideo("cam2", uint32(100000+i*40), pub.frame(i%10 == 5))
+		pub.writeVideo("", uint32(i*40), pub.frame(i%10 == 0))
+		i++
+	}
+	for i < 6 { // 两个轨道都收到关键帧后加入流
+		write()
+	}
+	sub := subscribeTestVideo(t, "switch/cameras", write)
+	frames := sub.sync(t)
+	main := frames[0].name
+	if err := sub.SwitchVideoTrack("nosuch"); err != ErrSwitchNoTrack {
+		t.Fatalf("switch to missing track: %v", err)
+	}
+	if err := sub.SwitchVideoTrack(main); err != nil {
+		t.Fatalf("switch to playing track: %v", err)
+	}
+	if err := sub.SwitchVideoTrack("cam2"); err != nil {
+		t.Fatal(err)
+	}
+	last := frames[len(frames)-1].absTime
+	switched, after := false, 0
+	for after < 20 {
+		write()
+		for _, f := range sub.sync(t) {
+			switch {
+			case f.switched:
+				if f.name != "cam2" {
+					t.Fatalf("switch to %s", f.name)
+				}
+				switched = true
+			case !switched:
+				if f.name != main {
+					t.Fatalf("frame from %s before switch event", f.name)
+				}
+				last = f.absTime
+			default:
+				if f.name != "cam2" {
+					t.Fatalf("frame from %s after switch", f.name)
+				}
+				if after == 0 && !f.idr {
+					t.Fatal("first frame after switch is not a key frame")
+				}
+				if delta := int64(f.absTime) - int64(last); delta <= 0 || delta > 1000 {
+					t.Fatalf("absTime jumps from %d to %d", last, f.absTime)
+				}
+				last = f.absTime
+				after++
+			}
+		}
+	}
+}
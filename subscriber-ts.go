@@ -0,0 +1,335 @@
+package engine
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/codec/mpegts"
+	. "m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+)
+
+// TSPackets 若干个 188 字节的 TS 包，缓冲区在下一次事件时会被复用
+type TSPackets []byte
+
+func (t TSPackets) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(t)
+	return int64(n), err
+}
+
+// tsTimestamp 将 32 位的 90kHz 时间戳展开为 64 位，避免回绕，音视频仍使用相同的起点
+type tsTimestamp struct {
+	last  uint32
+	value uint64
+	init  bool
+}
+
+func (t *tsTimestamp) extend(ts uint32) uint64 {
+	if !t.init {
+		t.init, t.last, t.value = true, ts, uint64(ts)
+	}
+	t.value += uint64(int64(int32(ts - t.last)))
+	t.last = ts
+	return t.value
+}
+
+// tsMuxer 将订阅到的音视频帧封装为 TS 包，多节目模式下流中的每个轨道各自一个节目
+type tsMuxer struct {
+	*Subscriber
+	mpegts.TsMuxer
+	video, audio       *mpegts.TsStream
+	videoDTS, audioDTS tsTimestamp
+	tracks             []*tsTrack // 多节目模式下主音视频之外的轨道
+	othersRead         int        // 已经处理的 otherTracks 的数量
+	lastDTS            uint64     // 最近写入的音视频帧的 DTS，作为数据轨道的时间戳
+	buffer             util.Buffer
+}
+
+// tsTrack 主音视频之外的轨道，read 送出轨道中已经写入的帧，轨道销毁后返回错误
+type tsTrack struct {
+	Track
+	stream *mpegts.TsStream
+	read   func() error
+	leave  func() // 停止时释放正在读取的帧
+}
+
+func tsVideoStreamType(codecID codec.VideoCodecID) byte {
+	switch codecID {
+	case codec.CodecID_H264:
+		return mpegts.STREAM_TYPE_H264
+	case codec.CodecID_H265:
+		return mpegts.STREAM_TYPE_H265
+	}
+	return 0
+}
+
+func tsAudioStreamType(audio *track.Audio) (streamType byte, descriptor []mpegts.MpegTsDescriptor) {
+	switch audio.CodecID {
+	case codec.CodecID_AAC:
+		streamType = mpegts.STREAM_TYPE_AAC
+	case codec.CodecID_PCMA:
+		streamType = mpegts.STREAM_TYPE_G711A
+	case codec.CodecID_PCMU:
+		streamType = mpegts.STREAM_TYPE_G711U
+	case codec.CodecID_OPUS:
+		streamType = mpegts.STREAM_TYPE_OPUS
+		descriptor = mpegts.OpusDescriptors(audio.Channels)
+	}
+	return
+}
+
+func (m *tsMuxer) init(hasVideo, hasAudio bool) {
+	conf := m.Config
+	m.PCRInterval = uint64(conf.TSPCRInterval * 90 / time.Millisecond)
+	m.PSIInterval = uint64(conf.TSPSIInterval * 90 / time.Millisecond)
+	m.BitRate = uint64(conf.TSBitRate)
+	m.TransportStreamID = 1
+	// 多节目模式下每个轨道单独一个节目，否则只输出订阅到的音视频，两者在同一个节目中
+	var program *mpegts.TsProgram
+	nextProgram := func() *mpegts.TsProgram {
+		if program == nil || conf.TSMultiProgram {
+			program = m.AddProgram()
+		}
+		return program
+	}
+	if hasVideo {
+		if streamType := tsVideoStreamType(m.Video.CodecID); streamType != 0 {
+			m.video, _ = nextProgram().AddStream(streamType, mpegts.STREAM_ID_VIDEO)
+		} else {
+			m.Warn("ts unsupported video codec", zap.String("codec", m.Video.CodecID.String()))
+		}
+	}
+	if hasAudio {
+		if streamType, descriptor := tsAudioStreamType(m.Audio); streamType != 0 {
+			m.audio, _ = nextProgram().AddStream(streamType, mpegts.STREAM_ID_AUDIO, descriptor...)
+		} else {
+			m.Warn("ts unsupported audio codec", zap.String("codec", m.Audio.CodecID.String()))
+		}
+	}
+	if conf.TSMultiProgram {
+		// 订阅时已有的其他轨道，之后加入的轨道由 AddTrack 记录在 otherTracks 中
+		m.Stream.Tracks.Range(func(_ string, t Track) {
+			m.addTrack(t)
+		})
+	}
+}
+
+// addTrack 为主音视频之外的轨道添加节目，数据轨道的流类型在第一帧中，收到第一帧时才添加节目
+func (m *tsMuxer) addTrack(t Track) {
+	if t == Track(m.Video) || t == Track(m.Audio) || !m.Permission.AllowTrack(t.GetName()) {
+		return
+	}
+	for _, tt := range m.tracks {
+		if tt.Track == t {
+			return
+		}
+	}
+	tt := &tsTrack{Track: t}
+	m.tracks = append(m.tracks, tt)
+	switch v := t.(type) {
+	case *track.Video:
+		streamType := tsVideoStreamType(v.CodecID)
+		if streamType == 0 {
+			m.Warn("ts unsupported video codec", zap.String("track", v.Name), zap.String("codec", v.CodecID.String()))
+			return
+		}
+		tt.stream, _ = m.AddProgram().AddStream(streamType, mpegts.STREAM_ID_VIDEO)
+		m.readMedia(tt, &v.Media, true, func(frame *AVFrame, pts, dts uint64) {
+			m.sendVideo(tt.stream, v, frame, pts, dts)
+		})
+	case *track.Audio:
+		streamType, descriptor := tsAudioStreamType(v)
+		if streamType == 0 {
+			m.Warn("ts unsupported audio codec", zap.String("track", v.Name), zap.String("codec", v.CodecID.String()))
+			return
+		}
+		tt.stream, _ = m.AddProgram().AddStream(streamType, mpegts.STREAM_ID_AUDIO, descriptor...)
+		m.readMedia(tt, &v.Media, false, func(frame *AVFrame, _, dts uint64) {
+			m.sendAudio(tt.stream, v, frame, dts)
+		})
+	case *track.Data[TSData]:
+		var section bool
+		readData(tt, v, func(data TSData) {
+			if tt.stream == nil {
+				streamID := byte(mpegts.STREAM_ID_PRIVATE_1)
+				if data.StreamType == mpegts.STREAM_TYPE_METADATA {
+					streamID = mpegts.STREAM_ID_METADATA
+				}
+				pmtStream := mpegts.MpegTsPmtStream{StreamType: data.StreamType}
+				section = pmtStream.IsSection()
+				tt.stream, _ = m.AddProgram().AddDataStream(data.StreamType, streamID)
+			}
+			m.sendData(tt.stream, section, data.Payload)
+		})
+	case *track.Cue:
+		// 只有来自 SCTE-35 的标记带有原始的 splice_info_section
+		tt.stream, _ = m.AddProgram().AddDataStream(mpegts.STREAM_TYPE_SCTE35, 0)
+		readData(tt, v, func(cue *track.CueMarker) {
+			if len(cue.Data) > 0 {
+				m.sendData(tt.stream, true, cue.Data)
+			}
+		})
+	default:
+		m.Warn("ts unsupported track", zap.String("track", t.GetName()))
+	}
+}
+
+// readMedia 从正在写入的帧开始读取，视频从关键帧开始，时间戳与主音视频使用相同的偏移
+func (m *tsMuxer) readMedia(tt *tsTrack, media *track.Media, video bool, send func(frame *AVFrame, pts, dts uint64)) {
+	var reader track.RingReader[any, *AVFrame]
+	var dts tsTimestamp
+	reader.Ring = media.Writing()
+	waitIDR := video
+	tt.read = func() error {
+		for {
+			frame, err := reader.TryRead()
+			if err != nil || frame == nil {
+				return err
+			}
+			if waitIDR && !frame.IFrame || frame.AUList.ByteLength == 0 {
+				continue
+			}
+			waitIDR = false
+			d := dts.extend(uint32(frame.DTS - m.skipTs()*90/time.Millisecond))
+			send(frame, d+uint64(frame.PTS-frame.DTS), d)
+		}
+	}
+	tt.leave = func() {
+		if reader.Count > 0 {
+			reader.Value.ReaderLeave()
+		}
+	}
+}
+
+// readData 从正在写入的帧开始读取数据轨道
+func readData[T any](tt *tsTrack, data *track.Data[T], send func(T)) {
+	var reader track.DataReader[T]
+	reader.Ring = data.Writing()
+	tt.read = func() error {
+		for {
+			frame, err := reader.TryRead()
+			if err != nil || frame == nil {
+				return err
+			}
+			send(frame.Data)
+		}
+	}
+	tt.leave = func() {
+		if reader.Count > 0 {
+			reader.Value.ReaderLeave()
+		}
+	}
+}
+
+// skipTs 主音视频读取器的时间戳偏移
+func (m *tsMuxer) skipTs() time.Duration {
+	if m.VideoReader != nil {
+		return m.VideoReader.SkipTs
+	}
+	if m.AudioReader != nil {
+		return m.AudioReader.SkipTs
+	}
+	return 0
+}
+
+// sendTracks 送出其他轨道中已经写入的帧，在主音视频的每一帧之后调用
+func (m *tsMuxer) sendTracks() {
+	if !m.Config.TSMultiProgram {
+		return
+	}
+	if p := m.otherTracks.Load(); p != nil && len(*p) > m.othersRead {
+		for _, t := range (*p)[m.othersRead:] {
+			m.addTrack(t)
+		}
+		m.othersRead = len(*p)
+	}
+	for _, tt := range m.tracks {
+		if tt.read == nil {
+			continue
+		}
+		if err := tt.read(); err != nil {
+			// 轨道已经销毁，节目保留但不再有数据
+			tt.read, tt.leave = nil, nil
+			m.Info("ts track end", zap.String("track", tt.GetName()), zap.Error(err))
+		}
+	}
+}
+
+// close 停止读取时释放其他轨道正在读取的帧
+func (m *tsMuxer) close() {
+	for _, tt := range m.tracks {
+		if tt.leave != nil {
+			tt.leave()
+		}
+	}
+}
+
+func (m *tsMuxer) send(s *mpegts.TsStream, pts, dts uint64, keyFrame bool, payload net.Buffers) {
+	m.buffer.Reset()
+	if err := m.WritePES(&m.buffer, s, pts, dts, keyFrame, payload); err != nil {
+		m.Error("ts write pes", zap.Error(err))
+		return
+	}
+	m.lastDTS = dts
+	m.Spesific.OnEvent(TSPackets(m.buffer))
+}
+
+// sendData 数据轨道的帧以 PSI 段或者 PES 的形式送出，PES 的时间戳为最近写入的音视频帧的 DTS
+func (m *tsMuxer) sendData(s *mpegts.TsStream, section bool, payload []byte) {
+	m.buffer.Reset()
+	var err error
+	if section {
+		err = m.WriteSection(&m.buffer, s, payload)
+	} else {
+		err = m.WritePES(&m.buffer, s, m.lastDTS, m.lastDTS, false, net.Buffers{payload})
+	}
+	if err != nil {
+		m.Error("ts write data", zap.Error(err))
+		return
+	}
+	m.Spesific.OnEvent(TSPackets(m.buffer))
+}
+
+func (m *tsMuxer) sendVideo(s *mpegts.TsStream, video *track.Video, frame *AVFrame, pts, dts uint64) {
+	var payload net.Buffers
+	if video.CodecID == codec.CodecID_H264 {
+		payload = append(payload, codec.NALU_AUD_BYTE)
+	} else {
+		payload = append(payload, codec.AudNalu)
+	}
+	payload = append(payload, VideoFrame{AVFrame: frame, Video: video}.GetAnnexB()...)
+	m.send(s, pts, dts, frame.IFrame, payload)
+}
+
+func (m *tsMuxer) sendAudio(s *mpegts.TsStream, audio *track.Audio, frame *AVFrame, dts uint64) {
+	var payload net.Buffers
+	switch audio.CodecID {
+	case codec.CodecID_AAC:
+		payload = AudioFrame{AVFrame: frame, Audio: audio}.GetADTS()
+	case codec.CodecID_OPUS:
+		payload = append(net.Buffers{mpegts.OpusControlHeader(frame.AUList.ByteLength)}, frame.AUList.ToBuffers()...)
+	default:
+		payload = frame.AUList.ToBuffers()
+	}
+	m.send(s, dts, dts, false, payload)
+}
+
+func (m *tsMuxer) sendVideoFrame(frame *AVFrame) {
+	if m.video != nil && frame.AUList.ByteLength > 0 {
+		dts := m.videoDTS.extend(m.VideoReader.GetDTS32())
+		pts := dts + uint64(int64(int32(m.VideoReader.GetPTS32()-m.VideoReader.GetDTS32())))
+		m.sendVideo(m.video, m.Video, frame, pts, dts)
+	}
+	m.sendTracks()
+}
+
+func (m *tsMuxer) sendAudioFrame(frame *AVFrame) {
+	if m.audio != nil && frame.AUList.ByteLength > 0 {
+		m.sendAudio(m.audio, m.Audio, frame, m.audioDTS.extend(m.AudioReader.GetDTS32()))
+	}
+	m.sendTracks()
+}
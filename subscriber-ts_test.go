@@ -0,0 +1,167 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"m7s.live/engine/v4/codec/mpegts"
+	. "m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+)
+
+// testTSSubscriber 以 PlayTS 读取，按包复制后送出，读取跟不上时丢弃
+type testTSSubscriber struct {
+	Subscriber
+	packets chan []byte
+}
+
+func (s *testTSSubscriber) OnEvent(event any) {
+	switch v := event.(type) {
+	case TSPackets:
+		for b := []byte(v); len(b) >= mpegts.TS_PACKET_SIZE; b = b[mpegts.TS_PACKET_SIZE:] {
+			select {
+			case s.packets <- append([]byte(nil), b[:mpegts.TS_PACKET_SIZE]...):
+			default:
+			}
+		}
+	default:
+		s.Subscriber.OnEvent(event)
+	}
+}
+
+// tsPrograms 从收到的 TS 包中解析出的 PAT、PMT 以及有数据的 PID
+type tsPrograms struct {
+	patVersion byte
+	pmt        map[uint16]uint16   // PMT 的 PID -> 节目号
+	streams    map[uint16][]uint16 // PMT 的 PID -> 基本流的 PID
+	pcr        map[uint16]uint16   // PMT 的 PID -> PCR_PID
+	data       map[uint16]bool
+}
+
+func (p *tsPrograms) parse(pkt []byte) {
+	pid := util.ReadBE[uint16](pkt[1:3]) & 0x1fff
+	if pid != 0 && p.pmt[pid] == 0 {
+		p.data[pid] = true
+		return
+	}
+	// PSI 包没有调整字段
+	section := pkt[5+int(pkt[4]):]
+	end := 3 + int(util.ReadBE[uint16](section[1:3])&0xfff) - 4 // 不含 CRC
+	if pid == 0 {
+		p.patVersion = section[5] >> 1 & 0x1f
+		p.pmt = map[uint16]uint16{}
+		for b := section[8:end]; len(b) >= 4; b = b[4:] {
+			p.pmt[util.ReadBE[uint16](b[2:4])&0x1fff] = util.ReadBE[uint16](b[0:2])
+		}
+		return
+	}
+	p.pcr[pid] = util.ReadBE[uint16](section[8:10]) & 0x1fff
+	p.streams[pid] = nil
+	for b := section[12+int(util.ReadBE[uint16](section[10:12])&0xfff) : end]; len(b) >= 5; b = b[5+int(util.ReadBE[uint16](b[3:5])&0xfff):] {
+		p.streams[pid] = append(p.streams[pid], util.ReadBE[uint16](b[1:3])&0x1fff)
+	}
+}
+
+// complete 节目数为 n 并且每个节目都只有一个已经收到数据的基本流
+func (p *tsPrograms) complete(n int) bool {
+	if len(p.pmt) != n {
+		return false
+	}
+	for pmtPid := range p.pmt {
+		if s := p.streams[pmtPid]; len(s) != 1 || !p.data[s[0]] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestTSMultiProgram 多节目模式下流中的每个音视频和数据轨道各自一个节目，播放过程中加入的轨道也会添加节目并更新 PAT 的版本
+func TestTSMultiProgram(t *testing.T) {
+	pub := publishTestVideo(t, "ts/programs", func(p *Publisher) {
+		conf := EngineConfig.GetPublishConfig()
+		conf.BufferTime = time.Minute // 环形缓冲不会在订阅者读取时缩小
+		p.Config = &conf
+	})
+	klv := track.NewDataTrack[TSData]("klv_300")
+	klv.SetStuff(&pub.Publisher)
+	klv.Attach(pub.Stream)
+	names := []string{"", "cam2"}
+	pub.writeVideo("", 0, pub.sequenceHead(testSPS720))
+	pub.writeVideo("cam2", 0, pub.sequenceHead(testSPS480))
+	i := 0
+	write := func() {
+		for _, name := range names {
+			pub.writeVideo(name, uint32(i*40), pub.frame(i%10 == 0))
+		}
+		klv.Push(TSData{StreamType: mpegts.STREAM_TYPE_METADATA, Payload: []byte{0x06, 0x0e, 0x2b, 0x34, byte(i)}})
+		i++
+	}
+	write()
+	sub := &testTSSubscriber{packets: make(chan []byte, 4096)}
+	conf := EngineConfig.Subscribe
+	conf.TSMultiProgram = true
+	conf.SubMode = track.SUBMODE_NOJUMP // 开始读取之后不再查找关键帧，不会和写入同时进行
+	sub.Config = &conf
+	if err := Engine.Subscribe("ts/programs", sub); err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		sub.PlayTS()
+	}()
+	defer func() {
+		sub.Stop()
+		write() // 唤醒等待下一帧的读取
+		<-stopped
+	}()
+	// 开始读取时查找关键帧，读到第一帧之后再继续写入
+	programs := &tsPrograms{pmt: map[uint16]uint16{}, streams: map[uint16][]uint16{}, pcr: map[uint16]uint16{}, data: map[uint16]bool{}}
+	select {
+	case pkt := <-sub.packets:
+		programs.parse(pkt)
+	case <-time.After(time.Second * 5):
+		t.Fatal("no ts packet received")
+	}
+	waitPrograms := func(n int) {
+		for deadline := time.Now().Add(time.Second * 5); !programs.complete(n); {
+			if time.Now().After(deadline) {
+				t.Fatalf("programs %v streams %v data %v, want %d", programs.pmt, programs.streams, programs.data, n)
+			}
+			write()
+			time.Sleep(time.Millisecond * 10)
+			for len(sub.packets) > 0 {
+				programs.parse(<-sub.packets)
+			}
+		}
+	}
+	waitPrograms(3)
+	version := programs.patVersion
+	// 播放过程中加入的轨道
+	pub.writeVideo("cam3", uint32(i*40), pub.sequenceHead(testSPS480))
+	names = append(names, "cam3")
+	waitPrograms(4)
+	if programs.patVersion == version {
+		t.Fatalf("pat version %d not changed", version)
+	}
+	tracks := 0
+	pub.Stream.Tracks.Range(func(string, Track) { tracks++ })
+	if tracks != len(programs.pmt) {
+		t.Fatalf("%d tracks, %d programs", tracks, len(programs.pmt))
+	}
+	// 视频节目的 PCR 在视频流中，数据节目没有 PCR
+	nullPCR := 0
+	for pmtPid, streams := range programs.streams {
+		switch programs.pcr[pmtPid] {
+		case streams[0]:
+		case mpegts.PID_NULL:
+			nullPCR++
+		default:
+			t.Errorf("program %d pcr pid %x", programs.pmt[pmtPid], programs.pcr[pmtPid])
+		}
+	}
+	if nullPCR != 1 {
+		t.Fatalf("%d programs without pcr", nullPCR)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -21,6 +22,8 @@ const (
 	SUBTYPE_RAW = iota
 	SUBTYPE_RTP
 	SUBTYPE_FLV
+	SUBTYPE_FMP4
+	SUBTYPE_TS
 )
 const (
 	SUBSTATE_INIT = iota
@@ -48,6 +51,13 @@ type VideoFrame struct {
 	DTS     uint32
 }
 type FLVFrame net.Buffers
+
+// CueFrame 按时间戳顺序送达的广告标记，PTS 和 AbsTime 已转换到订阅者的时间轴
+type CueFrame struct {
+	*track.CueMarker
+	PTS     uint32
+	AbsTime uint32
+}
 type AudioRTP RTPFrame
 type VideoRTP RTPFrame
 type HasAnnexB interface {
@@ -73,6 +83,9 @@ func (f FLVFrame) WriteTo(w io.Writer) (int64, error) {
 }
 
 func (a AudioFrame) GetADTS() (r net.Buffers) {
+	if len(a.ADTS.Value) > codec.ADTS_HEADER_SIZE { // 以 ADTS 格式发布时保存的是完整的 ADTS 数据
+		return append(r, a.ADTS.Value)
+	}
 	r = append(append(r, a.ADTS.Value), a.AUList.ToBuffers()...)
 	return
 }
@@ -123,6 +136,10 @@ type Subscriber struct {
 	Config      *config.Subscribe
 	readers     []*track.AVRingReader
 	TrackPlayer `json:"-" yaml:"-"`
+	cue         atomic.Pointer[track.Cue]       // 广告标记轨道可能在播放过程中才加入
+	otherTracks atomic.Pointer[[]Track]         // TS 多节目模式下读取器之外的轨道，只在流的协程中追加
+	timeShift   struct{ start, open time.Time } // 时移播放的开始时间以及开始读取的时间，音视频共用
+	switching   trackSwitch                     // 等待切换的轨道
 }
 
 func (s *Subscriber) Subscribe(streamPath string, sub ISubscriber) error {
@@ -156,26 +173,75 @@ func (s *Subscriber) CreateTrackReader(t *track.Media) (result *track.AVRingRead
 }
 
 func (s *Subscriber) AddTrack(t Track) bool {
+	if !s.Permission.AllowTrack(t.GetName()) {
+		return false
+	}
 	switch v := t.(type) {
 	case *track.Video:
-		if s.VideoReader != nil || !s.Config.SubVideo {
+		if !s.Config.SubVideo {
+			return false
+		}
+		if s.VideoReader != nil {
+			s.addOtherTrack(v)
 			return false
 		}
 		s.VideoReader = s.CreateTrackReader(&v.Media)
 		s.Video = v
+		s.openTimeShift(s.VideoReader)
 	case *track.Audio:
-		if s.AudioReader != nil || !s.Config.SubAudio {
+		if !s.Config.SubAudio {
+			return false
+		}
+		if s.AudioReader != nil {
+			s.addOtherTrack(v)
 			return false
 		}
 		s.AudioReader = s.CreateTrackReader(&v.Media)
 		s.Audio = v
+		s.openTimeShift(s.AudioReader)
+	case *track.Cue:
+		s.addOtherTrack(v)
+		if !s.Config.SubCue || !s.cue.CompareAndSwap(nil, v) {
+			return false
+		}
 	default:
+		s.addOtherTrack(t)
 		return false
 	}
 	s.Info("track+1", zap.String("name", t.GetName()))
 	return true
 }
 
+// addOtherTrack 记录读取器之外的轨道，由 TS 多节目模式的 tsMuxer 各自输出一个节目。
+// 轨道移除时也会再次收到，tsMuxer 会忽略已经添加过的轨道
+func (s *Subscriber) addOtherTrack(t Track) {
+	if !s.Config.TSMultiProgram {
+		return
+	}
+	var tracks []Track
+	if p := s.otherTracks.Load(); p != nil {
+		tracks = *p
+	}
+	tracks = append(tracks[:len(tracks):len(tracks)], t)
+	s.otherTracks.Store(&tracks)
+}
+
+// overBitrate 订阅的音视频轨道的发布码率超过权限中的上限，此时只发送视频关键帧。
+// 比较的是轨道的码率而不是实际发给该订阅者的码率，否则只发关键帧后码率下降又会恢复发送全部帧
+func (s *Subscriber) overBitrate() bool {
+	if s.Permission == nil || s.Permission.MaxBPS <= 0 {
+		return false
+	}
+	var bps int
+	if s.Video != nil {
+		bps += s.Video.BPS
+	}
+	if s.Audio != nil {
+		bps += s.Audio.BPS
+	}
+	return bps > s.Permission.MaxBPS
+}
+
 func (s *Subscriber) IsPlaying() bool {
 	return s.TrackPlayer.Context != nil && s.TrackPlayer.Err() == nil
 }
@@ -196,6 +262,14 @@ func (s *Subscriber) PlayRTP() {
 	s.PlayBlock(SUBTYPE_RTP)
 }
 
+func (s *Subscriber) PlayFMP4() {
+	s.PlayBlock(SUBTYPE_FMP4)
+}
+
+func (s *Subscriber) PlayTS() {
+	s.PlayBlock(SUBTYPE_TS)
+}
+
 // PlayBlock 阻塞式读取数据
 func (s *Subscriber) PlayBlock(subType byte) {
 	spesic := s.Spesific
@@ -219,6 +293,7 @@ func (s *Subscriber) PlayBlock(subType byte) {
 		stopReason = zap.String("reason", "play neither video nor audio")
 		return
 	}
+	s.startSwitching(hasVideo, hasAudio)
 	sendVideoDecConf := func() {
 		// s.Debug("sendVideoDecConf")
 		spesic.OnEvent(s.Video.ParamaterSets)
@@ -314,6 +389,47 @@ func (s *Subscriber) PlayBlock(subType byte) {
 			// fmt.Println(frame.Sequence, s.AudioReader.AbsTime, s.AudioReader.Delay)
 			sendFlvFrame(codec.FLV_TAG_TYPE_AUDIO, s.AudioReader.AbsTime, frame.AVCC.ToBuffers()...)
 		}
+	case SUBTYPE_FMP4:
+		muxer := &fmp4Muxer{Subscriber: s}
+		muxer.init(hasVideo, hasAudio)
+		defer muxer.close()
+		sendVideoDecConf = muxer.onVideoDecConf
+		sendAudioDecConf = muxer.onAudioDecConf
+		sendVideoFrame = muxer.sendVideoFrame
+		sendAudioFrame = muxer.sendAudioFrame
+	case SUBTYPE_TS:
+		muxer := &tsMuxer{Subscriber: s}
+		muxer.init(hasVideo, hasAudio)
+		defer muxer.close()
+		sendVideoDecConf = func() {}
+		sendAudioDecConf = func() {}
+		sendVideoFrame = muxer.sendVideoFrame
+		sendAudioFrame = muxer.sendAudioFrame
+	}
+
+	if conf.SubCue {
+		sendCueFrame := func(cue CueFrame) {
+			spesic.OnEvent(cue)
+		}
+		if subType == SUBTYPE_FLV {
+			sendCueFrame = func(cue CueFrame) {
+				spesic.OnEvent(cue)
+				// FLV 中以 onCuePoint 脚本数据送出
+				params := map[string]any{"id": cue.ID, "type": cue.Type, "duration": cue.Duration.Seconds()}
+				data := util.MarshalAMFs("onCuePoint", map[string]any{"name": util.Conditoinal(cue.Name == "", cue.Type, cue.Name), "time": float64(cue.AbsTime) / 1000, "type": "event", "parameters": params})
+				spesic.OnEvent(FLVFrame(codec.AVCC2FLV(codec.FLV_TAG_TYPE_SCRIPT, cue.AbsTime, data)))
+			}
+		}
+		cues := &cueQueue{Subscriber: s, syncMode: conf.SyncMode, send: sendCueFrame}
+		rawVideo, rawAudio := sendVideoFrame, sendAudioFrame
+		sendVideoFrame = func(frame *AVFrame) {
+			cues.flush(frame, s.VideoReader)
+			rawVideo(frame)
+		}
+		sendAudioFrame = func(frame *AVFrame) {
+			cues.flush(frame, s.AudioReader)
+			rawAudio(frame)
+		}
 	}
 
 	var subMode = conf.SubMode //订阅模式
@@ -341,6 +457,16 @@ func (s *Subscriber) PlayBlock(subType byte) {
 					stopReason = zap.Error(err)
 					return
 				}
+				preVideo, preAudio := s.Video, s.Audio
+				if video, audio := s.switchVideo(); video {
+					// 原轨道当前的帧已经释放，从新轨道的关键帧开始发送
+					lastSentVF = nil
+					spesic.OnEvent(TrackSwitchEvent{CreateEvent[Track](s.Video), preVideo})
+					if audio {
+						audioFrame, lastSentAF = nil, nil
+						spesic.OnEvent(TrackSwitchEvent{CreateEvent[Track](s.Audio), preAudio})
+					}
+				}
 				videoFrame = s.VideoReader.Value
 				// fmt.Println("video", s.VideoReader.Track.PreFrame().Sequence-frame.Sequence)
 				if videoFrame.IFrame && s.VideoReader.DecConfChanged() {
@@ -361,7 +487,7 @@ func (s *Subscriber) PlayBlock(subType byte) {
 					}
 				}
 
-				if !conf.IFrameOnly || videoFrame.IFrame {
+				if !(conf.IFrameOnly || s.overBitrate()) || videoFrame.IFrame {
 					lastSentVF = videoFrame
 					sendVideoFrame(videoFrame)
 				} else {
@@ -391,6 +517,10 @@ func (s *Subscriber) PlayBlock(subType byte) {
 					stopReason = zap.Error(err)
 					return
 				}
+				if preAudio := s.Audio; s.switchAudio() {
+					lastSentAF = nil
+					spesic.OnEvent(TrackSwitchEvent{CreateEvent[Track](s.Audio), preAudio})
+				}
 				audioFrame = s.AudioReader.Value
 				// fmt.Println("audio", s.AudioReader.Track.PreFrame().Sequence-frame.Sequence)
 				if s.AudioReader.DecConfChanged() {
@@ -419,6 +549,8 @@ func (s *Subscriber) PlayBlock(subType byte) {
 }
 
 func (s *Subscriber) onStop(reason *zapcore.Field) {
+	s.stopSwitching()
+	s.setForeignReader(nil)
 	if !s.Stream.IsClosed() {
 		s.Info("play stop", *reason)
 		if !s.Config.Internal {
@@ -0,0 +1,30 @@
+package engine
+
+import (
+	"bytes"
+	"testing"
+
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/util"
+)
+
+// TestGetADTS 以 ADTS 格式发布时 ADTS 中是完整的数据，其他方式发布时只有头，需要加上裸数据
+func TestGetADTS(t *testing.T) {
+	pool := make(util.BytesPool, 17)
+	payload := []byte{1, 2, 3, 4}
+	header := make([]byte, codec.ADTS_HEADER_SIZE)
+	header[0], header[1] = 0xff, 0xf1
+	adts := append(append([]byte{}, header...), payload...)
+	for name, value := range map[string][]byte{"header": header, "full": adts} {
+		var frame common.AVFrame
+		frame.ADTS = &util.ListItem[util.Buffer]{Value: value}
+		frame.AUList.Push(pool.GetShell(payload))
+		r := AudioFrame{AVFrame: &frame}.GetADTS()
+		var out bytes.Buffer
+		r.WriteTo(&out)
+		if !bytes.Equal(out.Bytes(), adts) {
+			t.Errorf("%s: % x", name, out.Bytes())
+		}
+	}
+}
@@ -2,17 +2,20 @@ package engine
 
 import (
 	"encoding/json"
+	"sync/atomic"
 
 	"go.uber.org/zap"
 	"m7s.live/engine/v4/common"
 	"m7s.live/engine/v4/config"
+	"m7s.live/engine/v4/util"
 )
 
 type Subscribers struct {
 	public      map[ISubscriber]*waitTracks
 	internal    map[ISubscriber]*waitTracks
 	waits       map[*waitTracks]ISubscriber
-	waitAborted bool // 不再等待了
+	waitAborted bool                            // 不再等待了
+	types       util.Map[string, *atomic.Int32] // 按类型统计的订阅者数量，可以在其他协程中读取
 }
 
 func (s *Subscribers) Init() {
@@ -49,6 +52,15 @@ func (s *Subscribers) Len() int {
 	return len(s.public)
 }
 
+// CountByType 按订阅者类型返回数量
+func (s *Subscribers) CountByType() map[string]int32 {
+	counts := make(map[string]int32)
+	s.types.Range(func(t string, count *atomic.Int32) {
+		counts[t] = count.Load()
+	})
+	return counts
+}
+
 func (s *Subscribers) RangeAll(f func(sub ISubscriber)) {
 	s.rangeAll(func(sub ISubscriber, wait *waitTracks) {
 		f(sub)
@@ -135,6 +147,7 @@ func (s *Subscribers) Delete(suber ISubscriber) {
 	io.readers = nil
 	if _, ok := s.public[suber]; ok {
 		delete(s.public, suber)
+		s.types.Get(io.Type).Add(-1)
 		io.Info("suber -1", zap.Int("remains", s.Len()))
 	}
 	if _, ok := s.internal[suber]; ok {
@@ -153,6 +166,12 @@ func (s *Subscribers) Add(suber ISubscriber, wait *waitTracks) {
 		io.Info("innersuber +1", zap.Int("remains", len(s.internal)))
 	} else {
 		s.public[suber] = wait
+		count := s.types.Get(io.Type)
+		if count == nil {
+			count = new(atomic.Int32)
+			s.types.Set(io.Type, count)
+		}
+		count.Add(1)
 		io.Info("suber +1", zap.Int("remains", s.Len()))
 		if config.Global.EnableSubEvent {
 			EventBus <- suber
@@ -0,0 +1,470 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	. "m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/config"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+)
+
+var (
+	ErrTimeShiftFrame = errors.New("time shift frame error")
+	ErrTimeShiftPath  = errors.New("time shift dir must be under TimeShiftPath")
+)
+
+// TimeShifts 开启了时移的流，key 为 streamPath
+var TimeShifts sync.Map
+
+// timeShiftIndex 分片中可以开始读取的位置（视频为关键帧）
+type timeShiftIndex struct {
+	offset    int64
+	writeTime time.Time
+}
+
+type timeShiftSegment struct {
+	path       string
+	start, end time.Time // 第一帧和最后一帧的写入时间
+	size       int64     // 已经完整写入的字节数，读取不会超过该位置
+	index      []timeShiftIndex
+}
+
+// timeShiftTrack 一个轨道的时移分片，分片按时间顺序排列
+type timeShiftTrack struct {
+	sync.RWMutex
+	dir      string
+	segments []*timeShiftSegment
+	file     *os.File
+}
+
+// next 下一个分片，当前分片已经过期删除时返回第一个更新的分片
+func (t *timeShiftTrack) next(seg *timeShiftSegment) *timeShiftSegment {
+	t.RLock()
+	defer t.RUnlock()
+	for _, s := range t.segments {
+		if s.start.After(seg.start) {
+			return s
+		}
+	}
+	return nil
+}
+
+// seek 查找开始时间之前最近的可读取位置及其写入时间，开始时间早于时移窗口时从最早的数据开始
+func (t *timeShiftTrack) seek(start time.Time) (seg *timeShiftSegment, offset int64, at time.Time) {
+	t.RLock()
+	defer t.RUnlock()
+	for _, s := range t.segments {
+		if seg != nil && s.start.After(start) {
+			break
+		}
+		seg = s
+	}
+	if seg == nil {
+		return
+	}
+	at = seg.start
+	for _, index := range seg.index {
+		if index.writeTime.After(start) {
+			break
+		}
+		offset, at = index.offset, index.writeTime
+	}
+	return
+}
+
+// TimeShift 时移写入者，以内部订阅者的身份把主音视频轨道的帧按分片写入磁盘，流关闭后删除
+type TimeShift struct {
+	Subscriber
+	Dir      string
+	Window   time.Duration
+	Fragment time.Duration
+	tracks   sync.Map // 轨道名 -> *timeShiftTrack
+	buffer   util.Buffer
+}
+
+// StartTimeShift 为流开启时移，上一次发布遗留的数据会被清除
+func StartTimeShift(streamPath string, conf *config.Publish) {
+	dir, err := timeShiftDir(conf.TimeShiftPath, streamPath)
+	if err != nil {
+		Engine.Error("time shift", zap.String("stream", streamPath), zap.Error(err))
+		return
+	}
+	ts := &TimeShift{Dir: dir, Window: conf.TimeShift, Fragment: conf.TimeShiftFragment}
+	if ts.Fragment <= 0 {
+		ts.Fragment = time.Minute
+	}
+	if _, loaded := TimeShifts.LoadOrStore(streamPath, ts); loaded {
+		return
+	}
+	defer TimeShifts.Delete(streamPath)
+	os.RemoveAll(ts.Dir)
+	subConf := EngineConfig.Subscribe
+	subConf.Internal = true
+	subConf.SubMode = track.SUBMODE_BUFFER // 从缓冲中最早的关键帧开始并且不丢帧
+	subConf.SubCue = false
+	subConf.IFrameOnly = false
+	ts.Config = &subConf
+	if err := Engine.Subscribe(streamPath, ts); err != nil {
+		Engine.Error("time shift subscribe", zap.String("stream", streamPath), zap.Error(err))
+		return
+	}
+	ts.Info("time shift start", zap.String("dir", ts.Dir), zap.Duration("window", ts.Window))
+	ts.PlayRaw()
+	ts.tracks.Range(func(_, value any) bool {
+		t := value.(*timeShiftTrack)
+		t.Lock()
+		if t.file != nil {
+			t.file.Close()
+		}
+		t.segments = nil
+		t.Unlock()
+		return true
+	})
+	os.RemoveAll(ts.Dir)
+	ts.Info("time shift stop")
+}
+
+// timeShiftDir 清理后的子目录，必须在 root 之下并且不能是 root 本身，避免删除其他目录
+func timeShiftDir(root, name string) (string, error) {
+	if root == "" {
+		return "", ErrTimeShiftPath
+	}
+	dir := filepath.Join(root, name)
+	rel, err := filepath.Rel(filepath.Clean(root), dir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrTimeShiftPath
+	}
+	return dir, nil
+}
+
+func (ts *TimeShift) OnEvent(event any) {
+	switch v := event.(type) {
+	case VideoFrame:
+		ts.write(v.Video.Name, v.AVFrame, v.IFrame)
+	case AudioFrame:
+		ts.write(v.Audio.Name, v.AVFrame, true)
+	default:
+		ts.Subscriber.OnEvent(event)
+	}
+}
+
+func (ts *TimeShift) getTrack(name string) *timeShiftTrack {
+	if t, ok := ts.tracks.Load(name); ok {
+		return t.(*timeShiftTrack)
+	}
+	return nil
+}
+
+// write 写入一帧，random 表示可以从该帧开始读取
+func (ts *TimeShift) write(name string, frame *AVFrame, random bool) {
+	t := ts.getTrack(name)
+	if t == nil {
+		dir, err := timeShiftDir(ts.Dir, name)
+		if err != nil {
+			ts.Error("time shift track", zap.String("name", name), zap.Error(err))
+			dir = ""
+		}
+		t = &timeShiftTrack{dir: dir}
+		ts.tracks.Store(name, t)
+	}
+	if t.dir == "" {
+		return
+	}
+	now := frame.WriteTime
+	var seg *timeShiftSegment
+	if l := len(t.segments); l > 0 {
+		seg = t.segments[l-1]
+	}
+	if random && (t.file == nil || now.Sub(seg.start) >= ts.Fragment) {
+		if seg = ts.rotate(t, now); seg == nil {
+			return
+		}
+	}
+	if t.file == nil {
+		// 视频需要从关键帧开始写入
+		return
+	}
+	ts.buffer = marshalTimeShiftFrame(ts.buffer[:0], frame)
+	offset := seg.size
+	n, err := t.file.Write(ts.buffer)
+	if err != nil {
+		ts.Error("time shift write", zap.Error(err))
+		t.file.Close()
+		t.file = nil
+		return
+	}
+	t.Lock()
+	seg.size += int64(n)
+	seg.end = now
+	if l := len(seg.index); random && (l == 0 || now.Sub(seg.index[l-1].writeTime) >= time.Second) {
+		seg.index = append(seg.index, timeShiftIndex{offset, now})
+	}
+	t.Unlock()
+}
+
+// rotate 开始新的分片并删除超出时移窗口的分片
+func (ts *TimeShift) rotate(t *timeShiftTrack, now time.Time) *timeShiftSegment {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+	if err := os.MkdirAll(t.dir, 0766); err != nil {
+		ts.Error("time shift create dir", zap.Error(err))
+		return nil
+	}
+	seg := &timeShiftSegment{path: filepath.Join(t.dir, strconv.FormatInt(now.UnixMilli(), 10)+".frames"), start: now, end: now}
+	file, err := os.Create(seg.path)
+	if err != nil {
+		ts.Error("time shift create file", zap.Error(err))
+		return nil
+	}
+	t.file = file
+	t.Lock()
+	defer t.Unlock()
+	t.segments = append(t.segments, seg)
+	expired := 0
+	for _, s := range t.segments[:len(t.segments)-1] {
+		if now.Sub(s.end) <= ts.Window {
+			break
+		}
+		os.Remove(s.path)
+		expired++
+	}
+	t.segments = t.segments[expired:]
+	return seg
+}
+
+// marshalTimeShiftFrame 帧的磁盘格式：长度、标志、序号、时间戳、PTS、DTS、写入时间、ADTS、AVCC、AUList
+func marshalTimeShiftFrame(buf util.Buffer, frame *AVFrame) util.Buffer {
+	buf.WriteUint32(0)
+	buf.WriteByte(util.Conditoinal[byte](frame.IFrame, 1, 0))
+	buf.WriteUint32(frame.Sequence)
+	util.PutBE(buf.Malloc(8), uint64(frame.Timestamp))
+	util.PutBE(buf.Malloc(8), uint64(frame.PTS))
+	util.PutBE(buf.Malloc(8), uint64(frame.DTS))
+	util.PutBE(buf.Malloc(8), uint64(frame.WriteTime.UnixNano()))
+	if frame.ADTS != nil {
+		buf.WriteByte(byte(len(frame.ADTS.Value)))
+		buf.Write(frame.ADTS.Value)
+	} else {
+		buf.WriteByte(0)
+	}
+	buf.WriteUint32(uint32(frame.AVCC.ByteLength))
+	frame.AVCC.Range(func(b util.Buffer) bool {
+		buf.Write(b)
+		return true
+	})
+	buf.WriteUint16(uint16(frame.AUList.Length))
+	frame.AUList.Range(func(au *util.BLL) bool {
+		buf.WriteUint32(uint32(au.ByteLength))
+		au.Range(func(b util.Buffer) bool {
+			buf.Write(b)
+			return true
+		})
+		return true
+	})
+	util.PutBE(buf[:4], uint32(buf.Len()-4))
+	return buf
+}
+
+func unmarshalTimeShiftFrame(data util.Buffer) (frame *AVFrame, err error) {
+	if !data.CanReadN(38) {
+		return nil, ErrTimeShiftFrame
+	}
+	frame = NewAVFrame()
+	frame.Init()
+	frame.IFrame = data.ReadByte() == 1
+	frame.Sequence = data.ReadUint32()
+	frame.Timestamp = time.Duration(data.ReadUint64())
+	frame.PTS = time.Duration(data.ReadUint64())
+	frame.DTS = time.Duration(data.ReadUint64())
+	frame.WriteTime = time.Unix(0, int64(data.ReadUint64()))
+	if l := int(data.ReadByte()); l > 0 {
+		if !data.CanReadN(l) {
+			return nil, ErrTimeShiftFrame
+		}
+		frame.ADTS = &util.ListItem[util.Buffer]{Value: data.ReadN(l)}
+	}
+	if !data.CanReadN(4) {
+		return nil, ErrTimeShiftFrame
+	}
+	if l := int(data.ReadUint32()); l > 0 {
+		if !data.CanReadN(l) {
+			return nil, ErrTimeShiftFrame
+		}
+		frame.AVCC.PushValue(data.ReadN(l))
+		frame.AVCC.ByteLength = l
+	}
+	if !data.CanReadN(2) {
+		return nil, ErrTimeShiftFrame
+	}
+	for count := data.ReadUint16(); count > 0; count-- {
+		if !data.CanReadN(4) {
+			return nil, ErrTimeShiftFrame
+		}
+		l := int(data.ReadUint32())
+		if !data.CanReadN(l) {
+			return nil, ErrTimeShiftFrame
+		}
+		var au util.BLL
+		au.PushValue(data.ReadN(l))
+		au.ByteLength = l
+		frame.AUList.PushValue(&au)
+	}
+	frame.BytesIn = frame.AUList.ByteLength
+	frame.MarkReadable()
+	return
+}
+
+// timeShiftReader 从磁盘分片读取历史帧，按照写入时的节奏（乘以速度）送出
+type timeShiftReader struct {
+	context.Context
+	track   *timeShiftTrack
+	segment *timeShiftSegment
+	file    *os.File
+	offset  int64
+	start   time.Time // 请求的开始时间
+	open    time.Time // 开始读取的时间
+	speed   float64
+	mu      sync.Mutex
+}
+
+func (r *timeShiftReader) ReadFrame() (frame *AVFrame, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var head [4]byte
+	for {
+		if err = r.Err(); err != nil {
+			return
+		}
+		r.track.RLock()
+		size := r.segment.size
+		r.track.RUnlock()
+		if r.offset+4 > size {
+			next := r.track.next(r.segment)
+			if next == nil {
+				return nil, io.EOF
+			}
+			r.closeFile()
+			r.segment, r.offset = next, 0
+			continue
+		}
+		if r.file == nil {
+			if r.file, err = os.Open(r.segment.path); err != nil {
+				return
+			}
+		}
+		if _, err = r.file.ReadAt(head[:], r.offset); err != nil {
+			return
+		}
+		l := int64(util.ReadBE[uint32](head[:]))
+		if r.offset+4+l > size {
+			return nil, io.EOF
+		}
+		data := make(util.Buffer, l)
+		if _, err = r.file.ReadAt(data, r.offset+4); err != nil {
+			return
+		}
+		r.offset += 4 + l
+		if frame, err = unmarshalTimeShiftFrame(data); err != nil {
+			return
+		}
+		break
+	}
+	deadline := r.open.Add(time.Duration(float64(frame.WriteTime.Sub(r.start)) / r.speed))
+	if wait := time.Until(deadline); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-r.Done():
+			return nil, r.Err()
+		case <-timer.C:
+		}
+	}
+	return
+}
+
+func (r *timeShiftReader) closeFile() {
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+}
+
+func (r *timeShiftReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeFile()
+	return nil
+}
+
+// timeShiftStart 从订阅参数中解析时移的开始时间，starttime 为 unix 时间戳（秒）或 RFC3339 时间，offset 为相对现在的偏移
+func (s *Subscriber) timeShiftStart() (start time.Time, ok bool) {
+	if !s.timeShift.start.IsZero() {
+		return s.timeShift.start, true
+	}
+	conf := s.Config
+	if v := s.Args.Get(conf.StartArgName); v != "" {
+		var err error
+		if start, err = parseTime(v); err != nil {
+			s.Warn("invalid time shift start", zap.String("value", v))
+			return
+		}
+	} else if v := s.Args.Get(conf.OffsetArgName); v != "" {
+		offset, err := parseDuration(v)
+		if err != nil {
+			s.Warn("invalid time shift offset", zap.String("value", v))
+			return
+		}
+		if offset > 0 {
+			offset = -offset
+		}
+		start = time.Now().Add(offset)
+	}
+	if start.IsZero() || !start.Before(time.Now()) {
+		return
+	}
+	s.timeShift.start, s.timeShift.open = start, time.Now()
+	return start, true
+}
+
+// openTimeShift 订阅参数中带有时移时，读取器先从磁盘读取，追上直播后切换到环形缓冲
+func (s *Subscriber) openTimeShift(reader *track.AVRingReader) {
+	start, ok := s.timeShiftStart()
+	if !ok {
+		return
+	}
+	v, ok := TimeShifts.Load(s.Stream.Path)
+	if !ok {
+		s.Warn("time shift not enabled")
+		return
+	}
+	t := v.(*TimeShift).getTrack(reader.Track.Name)
+	if t == nil {
+		return
+	}
+	seg, offset, at := t.seek(start)
+	if seg == nil {
+		return
+	}
+	// 开始时间早于最早的数据时立即送出最早的数据，不等待没有数据的这段时间
+	if at.After(start) {
+		start = at
+	}
+	speed := s.Config.TimeShiftSpeed
+	if speed <= 0 {
+		speed = 1
+	}
+	reader.TimeShift = &timeShiftReader{Context: s.IO.Context, track: t, segment: seg, offset: offset, start: start, open: s.timeShift.open, speed: speed}
+	s.Info("time shift", zap.String("track", reader.Track.Name), zap.Time("start", start), zap.Time("segment", seg.start))
+}
@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"m7s.live/engine/v4/track"
+)
+
+// TestTimeShiftSeek 从开始时间之前最近的索引开始读取，早于时移窗口时从最早的数据开始，晚于所有数据时从最后的索引开始
+func TestTimeShiftSeek(t *testing.T) {
+	base := time.Now()
+	at := func(s float64) time.Time { return base.Add(time.Duration(s * float64(time.Second))) }
+	seg1 := &timeShiftSegment{start: at(0), end: at(9), index: []timeShiftIndex{{0, at(0)}, {100, at(3)}, {200, at(6)}}}
+	seg2 := &timeShiftSegment{start: at(10), end: at(19), index: []timeShiftIndex{{0, at(10)}, {150, at(15)}}}
+	ts := &timeShiftTrack{segments: []*timeShiftSegment{seg1, seg2}}
+	for _, c := range []struct {
+		start  float64
+		seg    *timeShiftSegment
+		offset int64
+		at     float64
+	}{
+		{-5, seg1, 0, 0},
+		{0, seg1, 0, 0},
+		{4, seg1, 100, 3},
+		{6, seg1, 200, 6},
+		{9.5, seg1, 200, 6}, // 两个分片之间
+		{12, seg2, 0, 10},
+		{30, seg2, 150, 15},
+	} {
+		seg, offset, pos := ts.seek(at(c.start))
+		if seg != c.seg || offset != c.offset || !pos.Equal(at(c.at)) {
+			t.Errorf("seek %vs: segment %v offset %d at %v, want %v %d %v", c.start, seg == seg1, offset, pos.Sub(base), c.seg == seg1, c.offset, at(c.at).Sub(base))
+		}
+	}
+	if seg, _, _ := (&timeShiftTrack{}).seek(base); seg != nil {
+		t.Fatal("seek in empty track")
+	}
+}
+
+// TestTimeShiftStart starttime 为 unix 时间戳（秒）或 RFC3339 时间并且优先于 offset，offset 不论正负都表示过去，将来的时间和无效的值不时移
+func TestTimeShiftStart(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		args string
+		want time.Duration // 开始时间相对现在的偏移
+		ok   bool
+	}{
+		{"starttime=" + strconv.FormatInt(now.Add(-time.Minute).Unix(), 10), -time.Minute, true},
+		{"starttime=" + url.QueryEscape(now.Add(-time.Hour).Format(time.RFC3339)), -time.Hour, true},
+		{"starttime=" + strconv.FormatInt(now.Add(-time.Minute).Unix(), 10) + "&offset=10s", -time.Minute, true},
+		{"offset=30s", -time.Second * 30, true},
+		{"offset=-1m30s", -time.Second * 90, true},
+		{"offset=45", -time.Second * 45, true},
+		{"starttime=" + strconv.FormatInt(now.Add(time.Minute).Unix(), 10), 0, false},
+		{"starttime=yesterday", 0, false},
+		{"offset=abc", 0, false},
+		{"", 0, false},
+	} {
+		conf := EngineConfig.Subscribe
+		s := &Subscriber{}
+		s.Config = &conf
+		s.Logger = Engine.Logger
+		s.Args, _ = url.ParseQuery(c.args)
+		start, ok := s.timeShiftStart()
+		if ok != c.ok {
+			t.Errorf("%s: ok %v", c.args, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		// unix 时间戳和 RFC3339 只精确到秒
+		if d := start.Sub(now.Add(c.want)); d < -time.Second*2 || d > time.Second*2 {
+			t.Errorf("%s: start %v, want %v", c.args, start.Sub(now), c.want)
+		}
+		// 音视频共用同一个开始时间
+		if again, _ := s.timeShiftStart(); !again.Equal(start) {
+			t.Errorf("%s: start changed to %v", c.args, again.Sub(now))
+		}
+	}
+}
+
+// TestTimeShiftCatchUp 时移订阅从磁盘上最早的关键帧开始读取，追上直播后切换到环形缓冲，序号和时间戳保持连续
+func TestTimeShiftCatchUp(t *testing.T) {
+	const total = 200 // 小于环形缓冲的初始大小
+	pub := publishTestVideo(t, "timeshift/catchup", func(p *Publisher) {
+		conf := EngineConfig.GetPublishConfig()
+		conf.TimeShift = time.Minute
+		conf.TimeShiftFragment = time.Millisecond * 500 // 读取时跨越多个分片
+		conf.SpeedLimit = 0                             // 由测试控制写入的节奏
+		conf.BufferTime = time.Minute                   // 缓冲所有的帧，环形缓冲不会在时移写入者读取时缩小或扩大
+		p.Config = &conf
+	})
+	pub.writeVideo("", 0, pub.sequenceHead(testSPS720))
+	pub.writeVideo("", 0, pub.frame(true))
+	// 等待时移写入者读到第一帧后再继续写入，它开始读取时查找关键帧不会和写入同时进行
+	for deadline := time.Now().Add(time.Second * 5); ; time.Sleep(time.Millisecond * 10) {
+		if v, ok := TimeShifts.Load("timeshift/catchup"); ok && v.(*TimeShift).getTrack("h264") != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("time shift not started")
+		}
+	}
+	for i := 1; i < total; i++ {
+		pub.writeVideo("", uint32(i*40), pub.frame(i%25 == 0))
+		time.Sleep(time.Millisecond * 5)
+	}
+	video := &pub.VideoTrack.(*track.H264).Video
+	last, liveIDR := video.LastValue.Sequence, video.IDRing.Value.Sequence
+	// 比环形缓冲一半还早的帧只能从磁盘读取
+	sub := subscribeTestVideo(t, "timeshift/catchup?offset=1m", func() {
+		pub.writeVideo("", total*40, pub.frame(false))
+	}, func(s *Subscriber) {
+		conf := EngineConfig.Subscribe
+		conf.TimeShiftSpeed = 10
+		s.Config = &conf
+	})
+	first := sub.next(t)
+	if !first.idr || first.seq >= liveIDR || last-first.seq < uint32(video.Size/2) {
+		t.Fatalf("first frame seq %d idr %v, live idr %d last %d", first.seq, first.idr, liveIDR, last)
+	}
+	for prev := first; prev.seq != last; {
+		f := sub.next(t)
+		if f.seq != prev.seq+1 || f.absTime < prev.absTime {
+			t.Fatalf("frame seq %d absTime %d after seq %d absTime %d", f.seq, f.absTime, prev.seq, prev.absTime)
+		}
+		prev = f
+	}
+	// 收到最后一帧之后读取者不再修改 TimeShift
+	if sub.VideoReader.TimeShift != nil {
+		t.Fatal("reader not switched to live")
+	}
+}
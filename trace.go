@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"m7s.live/engine/v4/config"
+)
+
+// 追踪属性
+const (
+	TRACE_ATTR_STREAM = attribute.Key("m7s.stream")
+	TRACE_ATTR_PLUGIN = attribute.Key("m7s.plugin")
+	TRACE_ATTR_TYPE   = attribute.Key("m7s.type")
+	TRACE_ATTR_CAUSE  = attribute.Key("error.cause")
+)
+
+// tracer 未配置 Endpoint 时为空实现，不产生开销
+var tracer = otel.Tracer("m7s.live/engine/v4")
+
+// initTrace 按配置创建 OTLP HTTP 导出器，ctx 结束时将剩余的追踪数据发送出去
+func initTrace(ctx context.Context, conf *config.Trace) error {
+	if conf.Endpoint == "" {
+		return nil
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(conf.Endpoint)}
+	if conf.URLPath != "" {
+		opts = append(opts, otlptracehttp.WithURLPath(conf.URLPath))
+	}
+	if conf.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(conf.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(conf.Headers))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", conf.ServiceName),
+			attribute.String("service.version", Engine.Version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		provider.Shutdown(shutdownCtx)
+	}()
+	return nil
+}
+
+// startSpan 开始一个带有流路径和插件名的追踪
+func startSpan(ctx context.Context, name string, streamPath string, plugin string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	attrs = append(attrs, TRACE_ATTR_STREAM.String(streamPath))
+	if plugin != "" {
+		attrs = append(attrs, TRACE_ATTR_PLUGIN.String(plugin))
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan 结束追踪，有错误时记录错误原因，io.EOF 表示正常结束
+func endSpan(span trace.Span, err error) {
+	if err != nil && err != io.EOF {
+		cause := err.Error()
+		if stop, ok := err.(StopError); ok {
+			for _, field := range stop {
+				if field.Key == "reason" {
+					cause = field.String
+				}
+			}
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, cause)
+		span.SetAttributes(TRACE_ATTR_CAUSE.String(cause))
+	}
+	span.End()
+}
@@ -0,0 +1,68 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanAttr(span sdktrace.ReadOnlySpan, key attribute.Key) string {
+	for _, attr := range span.Attributes() {
+		if attr.Key == key {
+			return attr.Value.Emit()
+		}
+	}
+	return ""
+}
+
+// TestStreamStateSpan 流状态的追踪挂在发布者的 IO.receive 追踪下，离开该状态时才结束
+func TestStreamStateSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	pub := publishTestVideo(t, "trace/test")
+	pub.writeVideo("", 0, pub.sequenceHead(testSPS720))
+	for i := 0; ; i++ {
+		state := pub.Stream.snapshot().State
+		if state == STATE_PUBLISHING {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("stream state %s", StateNames[state])
+		}
+		pub.writeVideo("", uint32(i*40), pub.frame(i%10 == 0))
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 100)
+	var receive, waitTrack sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if spanAttr(span, TRACE_ATTR_STREAM) != "trace/test" {
+			continue
+		}
+		switch span.Name() {
+		case "IO.receive":
+			receive = span
+		case "Stream.action":
+			if spanAttr(span, "to") == STATE_WAITTRACK.String() {
+				waitTrack = span
+			}
+		}
+	}
+	if receive == nil || waitTrack == nil {
+		t.Fatalf("spans not ended: receive %v, waittrack %v", receive, waitTrack)
+	}
+	if waitTrack.Parent().SpanID() != receive.SpanContext().SpanID() {
+		t.Fatal("state span is not a child of the publisher span")
+	}
+	if waitTrack.EndTime().Sub(waitTrack.StartTime()) <= 0 {
+		t.Fatal("state span ended immediately")
+	}
+	for _, span := range recorder.Ended() {
+		if span.Name() == "Stream.action" && spanAttr(span, "to") == STATE_PUBLISHING.String() && spanAttr(span, TRACE_ATTR_STREAM) == "trace/test" {
+			t.Fatal("span of the current state ended")
+		}
+	}
+}
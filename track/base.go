@@ -1,6 +1,7 @@
 package track
 
 import (
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -22,9 +23,24 @@ type Base[T any, F util.IDataFrame[T]] struct {
 	DropCount int `json:"-" yaml:"-"` //丢帧数
 	BPS       int
 	FPS       int
-	Drops     int   // 丢帧率
-	RawSize   int   // 裸数据长度
-	RawPart   []int // 裸数据片段用于UI上显示
+	Drops     int          // 丢帧率
+	RawSize   int          // 裸数据长度
+	RawPart   []int        // 裸数据片段用于UI上显示
+	Role      string       `json:",omitempty" yaml:",omitempty"` // 在流中的角色，序列化时由 Stream 填写
+	lastWrite atomic.Int64 // 最后一帧的写入时间，流的协程据此检测轨道是否存活
+}
+
+// Step 写完一帧，同时记录写入时间
+func (bt *Base[T, F]) Step() {
+	bt.RingWriter.Step()
+	bt.lastWrite.Store(time.Now().UnixNano())
+}
+
+func (bt *Base[T, F]) LastWriteTime() time.Time {
+	if t := bt.lastWrite.Load(); t > 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
 }
 
 func (bt *Base[T, F]) ComputeBPS(bytes int) {
@@ -65,6 +81,10 @@ func (bt *Base[T, F]) GetRBSize() int {
 func (bt *Base[T, F]) SnapForJson() {
 }
 
+func (bt *Base[T, F]) SetRole(role string) {
+	bt.Role = role
+}
+
 func (bt *Base[T, F]) SetStuff(stuff ...any) {
 	for _, s := range stuff {
 		switch v := s.(type) {
@@ -84,5 +104,8 @@ func (bt *Base[T, F]) GetPublisher() common.IPuber {
 }
 
 func (bt *Base[T, F]) Dispose() {
-	bt.Value.Broadcast()
+	// 在流的协程中调用，发布者可能还在写入，通过 Writing 读取正在写入的帧
+	frame := bt.Writing().Value
+	frame.Discard() // 正在写入的帧不会再完成，等待它的读取者被唤醒后退出
+	frame.Broadcast()
 }
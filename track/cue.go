@@ -0,0 +1,35 @@
+package track
+
+import (
+	"sync"
+	"time"
+
+	. "m7s.live/engine/v4/common"
+)
+
+// 广告标记类型
+const (
+	CUE_TYPE_OUT   = "out"   // 进入广告（cue-out）
+	CUE_TYPE_IN    = "in"    // 广告结束回到节目（cue-in）
+	CUE_TYPE_POINT = "point" // 其他时间点标记，例如 SCTE-35 time_signal
+)
+
+// CueMarker 广告插入或者自定义的时间点标记
+type CueMarker struct {
+	ID       uint32        // 事件ID，例如 SCTE-35 的 splice_event_id
+	Type     string        // CUE_TYPE_*
+	PTS      uint32        // 发布者时间轴上的时间戳（90kHz），0 表示立即生效
+	Duration time.Duration // 广告时长，0 表示未知
+	Name     string
+	Data     []byte `json:"-" yaml:"-"` // 原始数据，例如 SCTE-35 splice_info_section
+}
+
+// Cue 广告标记轨道，与音视频轨道一起发布，订阅者按时间戳顺序收到标记
+type Cue = Data[*CueMarker]
+
+func NewCue(puber IPuber) (cue *Cue) {
+	cue = NewDataTrack[*CueMarker]("cue")
+	cue.SetStuff(puber)
+	cue.Locker = &sync.Mutex{} // 可能同时从 API 和发布者的读取协程写入
+	return
+}
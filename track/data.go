@@ -3,7 +3,6 @@ package track
 import (
 	"context"
 	"sync"
-	"time"
 
 	"go.uber.org/zap"
 	. "m7s.live/engine/v4/common"
@@ -60,10 +59,6 @@ func (d *Data[T]) Attach(s IStream) {
 	}
 }
 
-func (d *Data[T]) LastWriteTime() time.Time {
-	return d.LastValue.WriteTime
-}
-
 func NewDataTrack[T any](name string) (dt *Data[T]) {
 	dt = &Data[T]{}
 	dt.Init(10)
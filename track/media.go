@@ -1,6 +1,7 @@
 package track
 
 import (
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -19,6 +20,7 @@ type 流速控制 struct {
 	起始dts time.Duration
 	等待上限  time.Duration
 	起始时间  time.Time
+	需要重置  bool // 暂停恢复后从下一帧重新开始计算
 }
 
 func (p *流速控制) 重置(绝对时间戳 time.Duration, dts time.Duration) {
@@ -35,6 +37,11 @@ func (p *流速控制) 根据起始DTS计算绝对时间戳(dts time.Duration) t
 }
 
 func (p *流速控制) 控制流速(绝对时间戳 time.Duration, dts time.Duration) (等待了 time.Duration) {
+	if p.需要重置 {
+		p.需要重置 = false
+		p.重置(绝对时间戳, dts)
+		return
+	}
 	数据时间差, 实际时间差 := 绝对时间戳-p.起始时间戳, time.Since(p.起始时间)
 	// println("数据时间差", 数据时间差, "实际时间差", 实际时间差, "绝对时间戳", 绝对时间戳, "起始时间戳", p.起始时间戳, "起始时间", p.起始时间.Format("2006-01-02 15:04:05"))
 	// if 实际时间差 > 数据时间差 {
@@ -103,6 +110,7 @@ type Media struct {
 	SpesificTrack  `json:"-" yaml:"-"`
 	deltaTs        time.Duration //用于接续发布后时间戳连续
 	iframeReceived bool
+	SlowJumps      atomic.Uint64 `json:"-" yaml:"-"` //读取过慢导致跳到最新关键帧的次数
 	流速控制
 }
 
@@ -150,6 +158,11 @@ func (av *Media) SetSpeedLimit(value time.Duration) {
 	av.等待上限 = value
 }
 
+// ResetSpeedLimit 发布暂停后恢复时调用，避免流速控制把暂停的时间当作需要追赶的时间
+func (av *Media) ResetSpeedLimit() {
+	av.需要重置 = true
+}
+
 func (av *Media) SetStuff(stuff ...any) {
 	// 代表发布者已经离线，该Track成为遗留Track，等待下一任发布者接续发布
 	for _, s := range stuff {
@@ -177,10 +190,6 @@ func (av *Media) SetStuff(stuff ...any) {
 	}
 }
 
-func (av *Media) LastWriteTime() time.Time {
-	return av.LastValue.WriteTime
-}
-
 func (av *Media) CurrentFrame() *AVFrame {
 	return av.Value
 }
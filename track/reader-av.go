@@ -2,11 +2,13 @@ package track
 
 import (
 	"errors"
+	"io"
 	"time"
 
 	"go.uber.org/zap"
 	"m7s.live/engine/v4/common"
 	"m7s.live/engine/v4/log"
+	"m7s.live/engine/v4/util"
 )
 
 const (
@@ -22,6 +24,12 @@ const (
 
 var ErrDiscard = errors.New("discard")
 
+// TimeShiftSource 时移数据源，按写入时的节奏依次提供磁盘上的历史帧，暂时没有更多数据时返回 io.EOF
+type TimeShiftSource interface {
+	ReadFrame() (*common.AVFrame, error)
+	Close() error
+}
+
 type AVRingReader struct {
 	RingReader[any, *common.AVFrame]
 	mode       int
@@ -36,6 +44,7 @@ type AVRingReader struct {
 	startTime  time.Time
 	AbsTime    uint32
 	Delay      uint32
+	TimeShift  TimeShiftSource // 不为空时先从磁盘读取，追上直播后切换到环形缓冲
 	*log.Logger
 }
 
@@ -56,8 +65,9 @@ func (r *AVRingReader) readFrame() (err error) {
 		return err
 	}
 	// 超过一半的缓冲区大小，说明Reader太慢，需要丢帧
-	if r.mode != SUBMODE_BUFFER && r.State == READSTATE_NORMAL && r.Track.LastValue.Sequence-r.Value.Sequence > uint32(r.Track.Size/2) && r.Track.IDRing != nil && r.Track.IDRing.Value.Sequence > r.Value.Sequence {
-		r.Warn("reader too slow", zap.Uint32("lastSeq", r.Track.LastValue.Sequence), zap.Uint32("seq", r.Value.Sequence))
+	if r.mode != SUBMODE_BUFFER && r.State == READSTATE_NORMAL && r.Track.LastSeq()-r.Value.Sequence > uint32(r.Track.Size/2) && r.Track.IDRing != nil && r.Track.IDRing.Value.Sequence > r.Value.Sequence {
+		r.Warn("reader too slow", zap.Uint32("lastSeq", r.Track.LastSeq()), zap.Uint32("seq", r.Value.Sequence))
+		r.Track.SlowJumps.Add(1)
 		return r.Read(r.Track.IDRing)
 	}
 	return
@@ -68,29 +78,35 @@ func (r *AVRingReader) ReadFrame(mode int) (err error) {
 	switch r.State {
 	case READSTATE_INIT:
 		r.Info("start read", zap.Int("mode", mode))
-		startRing := r.Track.Ring
-		if r.Track.IDRing != nil {
-			startRing = r.Track.IDRing
+		if r.TimeShift != nil {
+			if err = r.startTimeShift(); err != nil {
+				return
+			}
 		} else {
-			r.Warn("no IDRring")
-		}
-		switch mode {
-		case SUBMODE_REAL:
+			startRing := r.Track.Writing()
 			if r.Track.IDRing != nil {
-				r.State = READSTATE_FIRST
+				startRing = r.Track.IDRing
 			} else {
+				r.Warn("no IDRring")
+			}
+			switch mode {
+			case SUBMODE_REAL:
+				if r.Track.IDRing != nil {
+					r.State = READSTATE_FIRST
+				} else {
+					r.State = READSTATE_NORMAL
+				}
+			case SUBMODE_NOJUMP:
+				r.State = READSTATE_NORMAL
+			case SUBMODE_BUFFER:
+				if r.Track.HistoryRing != nil {
+					startRing = r.Track.HistoryRing
+				}
 				r.State = READSTATE_NORMAL
 			}
-		case SUBMODE_NOJUMP:
-			r.State = READSTATE_NORMAL
-		case SUBMODE_BUFFER:
-			if r.Track.HistoryRing != nil {
-				startRing = r.Track.HistoryRing
+			if err = r.StartRead(startRing); err != nil {
+				return
 			}
-			r.State = READSTATE_NORMAL
-		}
-		if err = r.StartRead(startRing); err != nil {
-			return
 		}
 		r.startTime = time.Now()
 		if r.FirstTs == 0 {
@@ -100,17 +116,20 @@ func (r *AVRingReader) ReadFrame(mode int) (err error) {
 		r.FirstSeq = r.Value.Sequence
 		r.Info("first frame read", zap.Duration("firstTs", r.FirstTs), zap.Uint32("firstSeq", r.FirstSeq))
 	case READSTATE_FIRST:
-		if r.Track.IDRing.Value.Sequence != r.FirstSeq {
-			if err = r.Read(r.Track.IDRing); err != nil {
-				return
+		// 等下一帧写完后再查看最新的关键帧，写入者在此之前对关键帧位置的修改都已完成
+		if err = r.readFrame(); err != nil {
+			return
+		}
+		if idr := r.Track.IDRing; idr.Value.Sequence != r.FirstSeq {
+			if idr != r.Ring {
+				if err = r.Read(idr); err != nil {
+					return
+				}
 			}
 			r.SkipTs = r.Value.Timestamp - r.beforeJump - r.StartTs - 10*time.Millisecond
-			r.Info("jump", zap.Uint32("skipSeq", r.Track.IDRing.Value.Sequence-r.FirstSeq), zap.Duration("skipTs", r.SkipTs))
+			r.Info("jump", zap.Uint32("skipSeq", r.Value.Sequence-r.FirstSeq), zap.Duration("skipTs", r.SkipTs))
 			r.State = READSTATE_NORMAL
 		} else {
-			if err = r.readFrame(); err != nil {
-				return
-			}
 			r.beforeJump = r.Value.Timestamp - r.FirstTs
 			// 防止过快消费
 			if fast := r.beforeJump - time.Since(r.startTime); fast > 0 && fast < time.Second {
@@ -118,7 +137,12 @@ func (r *AVRingReader) ReadFrame(mode int) (err error) {
 			}
 		}
 	case READSTATE_NORMAL:
-		if err = r.readFrame(); err != nil {
+		if r.TimeShift != nil {
+			err = r.readTimeShift()
+		} else {
+			err = r.readFrame()
+		}
+		if err != nil {
 			return
 		}
 	}
@@ -127,11 +151,32 @@ func (r *AVRingReader) ReadFrame(mode int) (err error) {
 		r.AbsTime = 1
 	}
 	// r.Delay = uint32((r.Track.LastValue.Timestamp - r.Value.Timestamp).Milliseconds())
-	r.Delay = uint32(r.Track.LastValue.Sequence - r.Value.Sequence)
+	r.Delay = uint32(r.Track.LastSeq() - r.Value.Sequence)
 	// fmt.Println(r.Track.Name, r.Delay)
 	// fmt.Println(r.Track.Name, r.Value.Sequence, r.Delay, r.AbsTime)
 	return
 }
+
+// SwitchFrom 从 old 切换到本轨道，从 ring 处（一般为关键帧）开始读取，AbsTime 按两帧的写入时间差接续 old
+func (r *AVRingReader) SwitchFrom(old *AVRingReader, ring *util.Ring[*common.AVFrame]) (err error) {
+	if err = r.StartRead(ring); err != nil {
+		return
+	}
+	r.State = READSTATE_NORMAL
+	r.startTime = time.Now()
+	r.FirstTs = r.Value.Timestamp
+	r.FirstSeq = r.Value.Sequence
+	gap := r.Value.WriteTime.Sub(old.Value.WriteTime)
+	if gap <= 0 {
+		gap = time.Millisecond
+	}
+	r.SkipTs = r.Value.Timestamp - (old.Value.Timestamp - old.SkipTs) - gap
+	r.AbsTime = uint32((r.Value.Timestamp - r.SkipTs).Milliseconds())
+	r.Delay = uint32(r.Track.LastSeq() - r.Value.Sequence)
+	r.Info("switch", zap.String("from", old.Track.Name), zap.Uint32("seq", r.Value.Sequence), zap.Duration("skipTs", r.SkipTs))
+	return
+}
+
 func (r *AVRingReader) GetPTS32() uint32 {
 	return uint32((r.Value.PTS - r.SkipTs*90/time.Millisecond))
 }
@@ -142,3 +187,85 @@ func (r *AVRingReader) ResetAbsTime() {
 	r.SkipTs = r.Value.Timestamp
 	r.AbsTime = 1
 }
+
+func (r *AVRingReader) startTimeShift() (err error) {
+	r.State = READSTATE_NORMAL
+	frame, err := r.TimeShift.ReadFrame()
+	if err == nil {
+		r.Ring = &util.Ring[*common.AVFrame]{Value: frame}
+		r.Count++
+		r.Info("time shift start", zap.Time("writeTime", frame.WriteTime), zap.Uint32("seq", frame.Sequence))
+		return
+	}
+	r.closeTimeShift()
+	if err != io.EOF {
+		return
+	}
+	// 磁盘上还没有数据，从直播开始
+	r.Warn("time shift no data")
+	startRing := r.Track.Writing()
+	if r.Track.IDRing != nil {
+		startRing = r.Track.IDRing
+	}
+	return r.StartRead(startRing)
+}
+
+// readTimeShift 从磁盘读取下一帧，直播的环形缓冲中已经有下一帧时切换到直播
+func (r *AVRingReader) readTimeShift() error {
+	for retry := 0; ; retry++ {
+		if live := r.findLive(r.Value.Sequence + 1); live != nil {
+			r.Info("time shift catch up", zap.Uint32("seq", r.Value.Sequence+1))
+			r.closeTimeShift()
+			return r.Read(live)
+		}
+		frame, err := r.TimeShift.ReadFrame()
+		if err == nil {
+			r.Ring = &util.Ring[*common.AVFrame]{Value: frame}
+			return nil
+		}
+		if err != io.EOF {
+			r.closeTimeShift()
+			return err
+		}
+		// 磁盘数据已经读完但直播中找不到接续的帧（缓冲已被覆盖），跳到直播的最近关键帧
+		if retry >= 100 && r.Track.IDRing != nil {
+			preTs := r.Value.Timestamp
+			r.closeTimeShift()
+			if err = r.Read(r.Track.IDRing); err != nil {
+				return err
+			}
+			r.SkipTs += r.Value.Timestamp - preTs - 10*time.Millisecond
+			r.Warn("time shift jump to live", zap.Duration("skipTs", r.SkipTs))
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// findLive 在环形缓冲中查找指定序号的帧，只查找不会很快被覆盖的部分
+func (r *AVRingReader) findLive(seq uint32) *util.Ring[*common.AVFrame] {
+	writing := r.Track.Writing()
+	if writing == nil {
+		return nil
+	}
+	// 正在写入的下一帧也可以直接读取，StartRead 会等待其写入完成
+	if delta := int32(r.Track.LastSeq() - seq); delta < -1 || delta >= int32(r.Track.Size/2) {
+		return nil
+	}
+	for p, n := writing, 0; n < r.Track.Size; p, n = p.Prev(), n+1 {
+		if p.Value.Sequence == seq {
+			if p.Value.IsDiscarded() {
+				return nil
+			}
+			return p
+		}
+	}
+	return nil
+}
+
+func (r *AVRingReader) closeTimeShift() {
+	if r.TimeShift != nil {
+		r.TimeShift.Close()
+		r.TimeShift = nil
+	}
+}
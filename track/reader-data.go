@@ -15,10 +15,14 @@ func (r *RingReader[T, F]) StartRead(ring *util.Ring[F]) (err error) {
 	if r.Value.IsDiscarded() {
 		return ErrDiscard
 	}
-	if r.Value.IsWriting() {
+	// 被唤醒后重新检查，确保读到的是写入完成的帧
+	for r.Value.IsWriting() {
 		// t := time.Now()
 		r.Value.Wait()
 		// log.Info("wait", time.Since(t))
+		if r.Value.IsDiscarded() { // 轨道销毁时废弃了正在写入的帧
+			return ErrDiscard
+		}
 	}
 	r.Count++
 	r.Value.ReaderEnter()
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"context"
 	"math/rand"
 	"time"
 )
@@ -10,6 +11,14 @@ func init() {
 }
 
 func Retry(attempts int, sleep time.Duration, f func() error) error {
+	return RetryContext(context.Background(), attempts, sleep, f)
+}
+
+// RetryContext 同 Retry，ctx 结束后不再重试，返回 ctx 的错误
+func RetryContext(ctx context.Context, attempts int, sleep time.Duration, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if err := f(); err != nil {
 		if s, ok := err.(retryStop); ok {
 			// Return the original error for later checking
@@ -17,12 +26,20 @@ func Retry(attempts int, sleep time.Duration, f func() error) error {
 		}
 
 		if attempts--; attempts > 0 {
-			// Add some randomness to prevent creating a Thundering Herd
-			jitter := time.Duration(rand.Int63n(int64(sleep)))
-			sleep = sleep + jitter/2
-
-			time.Sleep(sleep)
-			return Retry(attempts, 2*sleep, f)
+			if sleep > 0 { // 间隔为 0 时立即重试，rand.Int63n 不接受 0
+				// Add some randomness to prevent creating a Thundering Herd
+				jitter := time.Duration(rand.Int63n(int64(sleep)))
+				sleep = sleep + jitter/2
+			}
+
+			timer := time.NewTimer(sleep)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+			return RetryContext(ctx, attempts, 2*sleep, f)
 		}
 		return err
 	}
@@ -0,0 +1,59 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	done := make(chan error)
+	go func() {
+		done <- RetryContext(ctx, 3, time.Hour, func() error {
+			calls++
+			return errors.New("fail")
+		})
+	}()
+	time.Sleep(time.Millisecond * 50)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("retry not stopped by cancelled context")
+	}
+	if calls != 1 {
+		t.Fatalf("%d calls", calls)
+	}
+	if err := RetryContext(ctx, 3, time.Millisecond, func() error {
+		t.Fatal("called with cancelled context")
+		return nil
+	}); err != context.Canceled {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	calls = 0
+	if err := Retry(3, time.Millisecond, func() error {
+		if calls++; calls < 3 {
+			return errors.New("fail")
+		}
+		return nil
+	}); err != nil || calls != 3 {
+		t.Fatalf("retry: %v after %d calls", err, calls)
+	}
+}
+
+// TestRetryZeroInterval 间隔为 0 时立即重试
+func TestRetryZeroInterval(t *testing.T) {
+	calls := 0
+	if err := Retry(3, 0, func() error {
+		calls++
+		return errors.New("fail")
+	}); err == nil || calls != 3 {
+		t.Fatalf("retry: %v after %d calls", err, calls)
+	}
+}
@@ -37,6 +37,8 @@ type RingWriter[T any, F IDataFrame[T]] struct {
 	Size          int
 	LastValue     F
 	constructor   func() F
+	writing       atomic.Pointer[Ring[F]] // 正在写入的节点，其他协程通过 Writing 读取
+	lastSeq       atomic.Uint32           // 最后写完的帧序号，其他协程通过 LastSeq 读取
 }
 
 func (rb *RingWriter[T, F]) create(n int) (ring *Ring[F]) {
@@ -53,9 +55,20 @@ func (rb *RingWriter[T, F]) Init(n int, constructor func() F) *RingWriter[T, F]
 	rb.Ring = rb.create(n)
 	rb.Size = n
 	rb.LastValue = rb.Value
+	rb.writing.Store(rb.Ring)
 	return rb
 }
 
+// Writing 正在写入的节点，读取者从其他协程开始读取时用它代替 Ring
+func (rb *RingWriter[T, F]) Writing() *Ring[F] {
+	return rb.writing.Load()
+}
+
+// LastSeq 最后写完的帧序号
+func (rb *RingWriter[T, F]) LastSeq() uint32 {
+	return rb.lastSeq.Load()
+}
+
 // func (rb *RingBuffer[T, F]) MoveNext() F {
 // 	rb.LastValue = rb.Value
 // 	rb.Ring = rb.Next()
@@ -125,6 +138,8 @@ func (rb *RingWriter[T, F]) Step() (normal bool) {
 		rb.Value.StartWrite()
 	}
 	rb.Value.SetSequence(nextSeq)
+	rb.writing.Store(rb.Ring)
+	rb.lastSeq.Store(nextSeq - 1)
 	rb.LastValue.Ready()
 	return
 }
@@ -25,6 +25,7 @@ const (
 	APIErrorDecode = iota + 4000
 	APIErrorQueryParse
 	APIErrorNoBody
+	APIErrorInvalidConfig
 )
 
 const (
@@ -34,6 +35,7 @@ const (
 	APIErrorNoPusher
 	APIErrorNoSubscriber
 	APIErrorNoSEI
+	APIErrorNoPublisher
 )
 
 const (
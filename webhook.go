@@ -0,0 +1,163 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+	"m7s.live/engine/v4/config"
+	"m7s.live/engine/v4/util"
+)
+
+const (
+	EVENT_RECONNECT = "reconnect"
+	EVENT_AUTHFAIL  = "authfail"
+)
+
+// WebhookPayload 回调内容，在流事件记录的基础上增加了重连和鉴权失败的信息
+type WebhookPayload struct {
+	EventRecord
+	URL        string `json:",omitempty"` // 拉流地址
+	Count      int    `json:",omitempty"` // 重连次数
+	RemoteAddr string `json:",omitempty"`
+	Error      string `json:",omitempty"`
+}
+
+// webhookDispatcher 在独立的协程中发送回调，队列满时丢弃，不阻塞事件总线
+type webhookDispatcher struct {
+	*config.Webhook
+	events  map[string]bool
+	workers []*webhookWorker
+	client  http.Client
+}
+
+// webhookWorker 每个回调地址各自一个队列和协程，某个地址变慢或者不可用时不影响其他地址
+type webhookWorker struct {
+	*webhookDispatcher
+	url   string
+	queue chan *WebhookPayload
+}
+
+var webhooks *webhookDispatcher
+
+// startWebhooks 配置了回调地址时启动回调协程
+func startWebhooks(ctx context.Context, conf *config.Webhook) {
+	if len(conf.URLs) == 0 {
+		return
+	}
+	webhooks = newWebhookDispatcher(ctx, conf)
+}
+
+// newWebhookDispatcher 为每个回调地址启动一个发送协程，ctx 结束时停止发送和重试
+func newWebhookDispatcher(ctx context.Context, conf *config.Webhook) *webhookDispatcher {
+	d := &webhookDispatcher{
+		Webhook: conf,
+		client:  http.Client{Timeout: conf.Timeout},
+	}
+	if len(conf.Events) > 0 {
+		d.events = make(map[string]bool)
+		for _, e := range conf.Events {
+			d.events[e] = true
+		}
+	}
+	for _, url := range conf.URLs {
+		w := &webhookWorker{webhookDispatcher: d, url: url, queue: make(chan *WebhookPayload, conf.QueueSize)}
+		d.workers = append(d.workers, w)
+		go w.run(ctx)
+	}
+	return d
+}
+
+func newWebhookPayload(event any) (payload *WebhookPayload) {
+	switch v := event.(type) {
+	case PullerReconnectEvent:
+		payload = &WebhookPayload{URL: v.URL, Count: v.Count}
+		payload.Time, payload.Type, payload.StreamPath = v.Time, EVENT_RECONNECT, v.StreamPath
+		if v.Error != nil {
+			payload.Error = v.Error.Error()
+		}
+	case AuthFailEvent:
+		payload = &WebhookPayload{RemoteAddr: v.Target.RemoteAddr, Error: v.Error.Error()}
+		payload.Time, payload.Type = v.Time, EVENT_AUTHFAIL
+		payload.StreamPath, payload.Action = v.Target.StreamPath, v.Target.Action
+		payload.Subscriber, payload.SubscriberType = v.Target.ID, v.Target.Type
+	default:
+		if record, ok := newEventRecord(event); ok {
+			payload = &WebhookPayload{EventRecord: record}
+		}
+	}
+	return
+}
+
+func (d *webhookDispatcher) OnEvent(event any) {
+	payload := newWebhookPayload(event)
+	if payload == nil || d.events != nil && !d.events[payload.Type] {
+		return
+	}
+	for _, w := range d.workers {
+		select {
+		case w.queue <- payload:
+		default:
+			Engine.Warn("webhook queue full", zap.String("url", w.url), zap.String("event", payload.Type), zap.String("stream", payload.StreamPath))
+		}
+	}
+}
+
+func (w *webhookWorker) run(ctx context.Context) {
+	for {
+		select {
+		case payload := <-w.queue:
+			w.send(ctx, payload)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *webhookWorker) send(ctx context.Context, payload *WebhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	var signature string
+	if w.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.Secret))
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	err = util.RetryContext(ctx, w.Retry+1, w.RetryInterval, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+		if err != nil {
+			return util.RetryStopErr(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-M7S-Event", payload.Type)
+		if signature != "" {
+			req.Header.Set("X-M7S-Signature", signature)
+		}
+		for k, v := range w.Headers {
+			req.Header.Set(k, v)
+		}
+		res, err := w.client.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode >= 500 {
+			return fmt.Errorf("webhook status %s", res.Status)
+		} else if res.StatusCode >= 300 {
+			// 客户端错误重试也不会成功
+			return util.RetryStopErr(fmt.Errorf("webhook status %s", res.Status))
+		}
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		Engine.Error("webhook", zap.String("url", w.url), zap.String("event", payload.Type), zap.Error(err))
+	}
+}
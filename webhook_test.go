@@ -0,0 +1,85 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"m7s.live/engine/v4/config"
+)
+
+// TestWebhookWorkers 每个回调地址单独发送，一个地址卡住时其他地址照常收到回调，ctx 结束后不再等待
+func TestWebhookWorkers(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	received := make(chan WebhookPayload, 10)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload WebhookPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		received <- payload
+	}))
+	defer fast.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := newWebhookDispatcher(ctx, &config.Webhook{
+		URLs:          []string{slow.URL, fast.URL},
+		Timeout:       time.Minute,
+		Retry:         3,
+		RetryInterval: time.Hour,
+		QueueSize:     10,
+	})
+	for i := 1; i <= 2; i++ {
+		d.OnEvent(PullerReconnectEvent{Event: CreateEvent[IPuller](nil), StreamPath: "live/test", Count: i})
+	}
+	for i := 1; i <= 2; i++ {
+		select {
+		case payload := <-received:
+			if payload.Type != EVENT_RECONNECT || payload.Count != i {
+				t.Fatalf("payload %+v", payload)
+			}
+		case <-time.After(time.Second * 2):
+			t.Fatalf("event %d blocked by the slow webhook", i)
+		}
+	}
+}
+
+// TestWebhookZeroRetryInterval 重试间隔为 0 时立即重试，重试次数用完后不再发送
+func TestWebhookZeroRetryInterval(t *testing.T) {
+	calls := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- struct{}{}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := newWebhookDispatcher(ctx, &config.Webhook{
+		URLs:      []string{server.URL},
+		Timeout:   time.Second,
+		Retry:     2,
+		QueueSize: 10,
+	})
+	d.OnEvent(PullerReconnectEvent{Event: CreateEvent[IPuller](nil), StreamPath: "live/test", Count: 1})
+	for i := 1; i <= 3; i++ {
+		select {
+		case <-calls:
+		case <-time.After(time.Second * 2):
+			t.Fatalf("%d calls, want 3", i-1)
+		}
+	}
+	select {
+	case <-calls:
+		t.Fatal("retried more than configured")
+	case <-time.After(time.Millisecond * 200):
+	}
+}